@@ -2,13 +2,22 @@ package main
 
 import (
 	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/danp/snowhfx/internal/timelines"
+	"github.com/danp/snowhfx/internal/timeparse"
 	_ "github.com/ncruces/go-sqlite3/driver"
 	_ "github.com/ncruces/go-sqlite3/embed"
 )
@@ -16,54 +25,605 @@ import (
 func main() {
 	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	var dbPath string
+	var jsonlOut string
+	var timezone string
+	var csvPath string
+	var reorder bool
+	var coalesce time.Duration
+	var revert time.Duration
+	var season int
+	var since string
 	fs.StringVar(&dbPath, "db", "data.db", "database file path")
+	fs.StringVar(&jsonlOut, "jsonl-out", "", "path to also write events as JSON lines, or - for stdout")
+	fs.StringVar(&timezone, "timezone", "America/Halifax", "IANA time zone the observations' times are written in")
+	fs.StringVar(&csvPath, "csv", "", "path to a csv of observations to read instead of the database; events are written as JSON lines")
+	fs.BoolVar(&reorder, "reorder", false, "sort -csv observations by time instead of failing when they are out of order, holding them all in memory")
+	fs.DurationVar(&coalesce, "coalesce-window", 0, "continue an event that goes active again within this long of ending instead of starting a new one; 0 disables")
+	fs.DurationVar(&revert, "revert-window", 0, "drop a content change and its revert when the previous content comes back within this long; 0 disables")
+	fs.IntVar(&season, "season", 0, "only process observations from Nov 1 of this year through Apr 30 of the next")
+	fs.StringVar(&since, "since", "", "only process observations after this RFC 3339 time, or after the last one with an event if \"last\", continuing from the event state persisted by then")
 	fs.Parse(os.Args[1:])
 
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.Fatalf("loading timezone %q: %v", timezone, err)
+	}
+	opts := runOptions{Location: loc, Coalesce: coalesce, Revert: revert, Reorder: reorder}
+	if season != 0 {
+		opts.Window = seasonWindow(season, loc)
+	}
+
+	switch jsonlOut {
+	case "":
+	case "-":
+		opts.JSONL = os.Stdout
+	default:
+		f, err := os.Create(jsonlOut)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		opts.JSONL = f
+	}
+
+	if csvPath != "" {
+		if since != "" {
+			log.Fatal("-since needs events persisted in the database, not -csv")
+		}
+		f, err := os.Open(csvPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if opts.JSONL == nil {
+			opts.JSONL = os.Stdout
+		}
+		if err := runCSV(f, opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	db, err := sql.Open("sqlite3", "file:"+dbPath+"?_pragma=journal_mode=WAL&_pragma=foreign_keys=ON&_pragma=busy_timeout=5000")
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS events (observation_id INTEGER PRIMARY KEY REFERENCES observations (id), event_id TEXT, state TEXT, update_time DATETIME, end_time DATETIME, service_update TEXT)`)
-	if err != nil {
+	switch since {
+	case "":
+	case "last":
+		if opts.Since, err = lastEventTime(db); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		if opts.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			log.Fatalf("parsing -since: %v", err)
+		}
+	}
+
+	if err := run(db, opts); err != nil {
 		log.Fatal(err)
 	}
+}
+
+// errOutOfOrder is returned when an observation is earlier than the one
+// before it, which would corrupt the event state transitions.
+var errOutOfOrder = errors.New("observations out of time order")
+
+// window limits observations to those at or after start and before end.
+// The zero window allows all of them.
+type window struct {
+	start, end time.Time
+}
+
+// seasonWindow is the winter season starting Nov 1 of year and running
+// through Apr 30 of the next year in loc.
+func seasonWindow(year int, loc *time.Location) window {
+	return window{
+		start: time.Date(year, time.November, 1, 0, 0, 0, 0, loc),
+		end:   time.Date(year+1, time.May, 1, 0, 0, 0, 0, loc),
+	}
+}
+
+func (w window) contains(t time.Time) bool {
+	if !w.start.IsZero() && t.Before(w.start) {
+		return false
+	}
+	return w.end.IsZero() || t.Before(w.end)
+}
 
-	halifax, err := time.LoadLocation("America/Halifax")
+// runOptions configures how run and runCSV turn observations into events.
+type runOptions struct {
+	// Location is the time zone observations' times are written in.
+	Location *time.Location
+	// JSONL, if set, also gets each event as a JSON line.
+	JSONL io.Writer
+	// Coalesce continues an event that goes active again within this long
+	// of ending instead of starting a new one. Zero disables it.
+	Coalesce time.Duration
+	// Revert drops a content change and its revert when the previous
+	// content comes back within this long. Zero disables it.
+	Revert time.Duration
+	// Window limits the observations used. The zero window allows all of
+	// them.
+	Window window
+	// Since, if set, makes run only process observations after it,
+	// continuing from the event state persisted as of then.
+	Since time.Time
+	// Reorder makes runCSV sort observations by time rather than reject
+	// them when out of order, which means holding them all.
+	Reorder bool
+}
+
+// eventRecord is the JSON lines form of an events row.
+type eventRecord struct {
+	ObservationID int    `json:"observation_id"`
+	EventID       string `json:"event_id"`
+	State         string `json:"state"`
+	UpdateTime    string `json:"update_time,omitempty"`
+	EndTime       string `json:"end_time,omitempty"`
+	ServiceUpdate string `json:"service_update,omitempty"`
+	UpdateTimeRaw string `json:"update_time_raw,omitempty"`
+	EndTimeRaw    string `json:"end_time_raw,omitempty"`
+	Severity      int    `json:"severity"`
+}
+
+// run processes observations into the events table. If opts.Since is set,
+// only observations after it are processed, continuing from the event state
+// persisted as of then.
+func run(db *sql.DB, opts runOptions) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS events (observation_id INTEGER PRIMARY KEY REFERENCES observations (id), event_id TEXT, state TEXT, update_time DATETIME, end_time DATETIME, service_update TEXT, update_time_raw TEXT, end_time_raw TEXT, severity INTEGER)`)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	// Databases created before these columns existed need them added.
+	for _, col := range []struct{ name, typ string }{
+		{"update_time_raw", "TEXT"},
+		{"end_time_raw", "TEXT"},
+		{"severity", "INTEGER"},
+	} {
+		if err := addColumnIfMissing(db, "events", col.name, col.typ); err != nil {
+			return err
+		}
 	}
 
-	q := `WITH changes AS (SELECT id, t, content_id, LAG(content_id) OVER (ORDER BY t) AS prev_content_id FROM observations) SELECT changes.id, t, content->'updateTime'->>'txt', content->'serviceUpdate'->>'txt', content->'endTime'->>'txt' FROM changes JOIN contents ON contents.id=content_id WHERE content_id != prev_content_id OR prev_content_id IS NULL ORDER BY t`
+	start := state{s: stateDormant}
+	if !opts.Since.IsZero() {
+		if start, err = persistedState(db, opts.Since); err != nil {
+			return fmt.Errorf("loading event state as of %s: %w", opts.Since.Format(time.RFC3339), err)
+		}
+	}
 
-	rows, err := db.Query(q)
+	// Filter before comparing content so the first observation in the
+	// window always starts from dormant, even if it matches the one before.
+	var where string
+	var args []any
+	if !opts.Window.start.IsZero() {
+		where = ` WHERE ` + julianT("t") + ` >= julianday(?)`
+		args = append(args, opts.Window.start.UTC().Format(time.RFC3339))
+	}
+	if !opts.Window.end.IsZero() {
+		if where == "" {
+			where = ` WHERE`
+		} else {
+			where += ` AND`
+		}
+		where += ` ` + julianT("t") + ` < julianday(?)`
+		args = append(args, opts.Window.end.UTC().Format(time.RFC3339))
+	}
+	// An observation with a NULL content_id is kept as one with no content,
+	// which reads as dormant. IS NOT treats NULLs as equal to each other, and
+	// the LAG default of -1 makes the first observation always a change.
+	// Observations up to since are still compared so the first one after it
+	// is only a change if its content differs.
+	// Both orderings use julianT, like the window, so text and epoch times
+	// stored side by side still sort by the time they represent.
+	q := `WITH changes AS (SELECT id, t, content_id, LAG(content_id, 1, -1) OVER (ORDER BY ` + julianT("t") + `) AS prev_content_id FROM observations` + where + `) SELECT changes.id, t, content FROM changes LEFT JOIN contents ON contents.id=content_id WHERE content_id IS NOT prev_content_id`
+	if !opts.Since.IsZero() {
+		q += ` AND ` + julianT("t") + ` > julianday(?)`
+		args = append(args, opts.Since.UTC().Format(time.RFC3339Nano))
+	}
+	q += ` ORDER BY ` + julianT("t")
+
+	rows, err := db.Query(q, args...)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer rows.Close()
+	var row int
+	next := func() (observation, bool, error) {
+		for rows.Next() {
+			row++
+			var o observation
+			var content []byte
+			dest := []any{&o.ID, observationTime{&o.Time}, &content}
+			if err := rows.Scan(dest...); err != nil {
+				// One malformed row shouldn't stop the rest being processed.
+				log.Printf("skipping %v", scanError(rows, row, dest, err))
+				continue
+			}
+			if content == nil {
+				return o, true, nil
+			}
+			if err := o.parseContent(content); err != nil {
+				return observation{}, false, fmt.Errorf("observation %d: %w", o.ID, err)
+			}
+			return o, true, nil
+		}
+		return observation{}, false, rows.Err()
+	}
+
+	var enc *json.Encoder
+	if opts.JSONL != nil {
+		enc = json.NewEncoder(opts.JSONL)
+	}
+	return trackEvents(suppressReverts(next, opts.Revert), opts.Location, opts.Coalesce, start, func(e event) error {
+		_, err := db.Exec(
+			`INSERT INTO events (observation_id, event_id, state, update_time, end_time, service_update, update_time_raw, end_time_raw, severity) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+			e.o.ID,
+			e.eventID,
+			e.s.String(),
+			nullTime(e.updateTime),
+			nullTime(e.endTime),
+			e.serviceUpdate(),
+			e.updateTimeRaw,
+			e.endTimeRaw,
+			e.severity,
+		)
+		if err != nil {
+			return err
+		}
+		if enc != nil {
+			return enc.Encode(e.record())
+		}
+		return nil
+	})
+}
+
+// scanError wraps err, from scanning rows' current row into dest, with the
+// 1-based row number and the first column that fails to scan on its own.
+func scanError(rows *sql.Rows, row int, dest []any, err error) error {
+	names, _ := rows.Columns()
+	for i := range dest {
+		probe := make([]any, len(dest))
+		for j := range probe {
+			probe[j] = new(any)
+		}
+		probe[i] = dest[i]
+		if rows.Scan(probe...) != nil && i < len(names) {
+			return fmt.Errorf("row %d: reading column %s: %w", row, names[i], err)
+		}
+	}
+	return fmt.Errorf("row %d: %w", row, err)
+}
 
+// observationTime scans an observations t value into t. The driver decodes
+// DATETIME columns itself; exports that store Unix epoch seconds in an
+// INTEGER or REAL column, or times as TEXT, are converted here.
+type observationTime struct {
+	t *time.Time
+}
+
+func (o observationTime) Scan(src any) error {
+	switch v := src.(type) {
+	case time.Time:
+		*o.t = v
+	case int64:
+		*o.t = time.Unix(v, 0).UTC()
+	case float64:
+		sec, frac := math.Modf(v)
+		*o.t = time.Unix(int64(sec), int64(frac*1e9)).UTC()
+	case string:
+		return o.parse(v)
+	case []byte:
+		return o.parse(string(v))
+	default:
+		return fmt.Errorf("unsupported time value %v (%T)", src, src)
+	}
+	return nil
+}
+
+func (o observationTime) parse(s string) error {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			*o.t = t
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported time value %q", s)
+}
+
+// julianT is a SQL expression for the julian day of the time column col,
+// reading numbers as Unix epoch seconds rather than julian days.
+func julianT(col string) string {
+	return `(CASE WHEN typeof(` + col + `) IN ('integer', 'real') THEN julianday(` + col + `, 'unixepoch') ELSE julianday(` + col + `) END)`
+}
+
+// lastEventTime is the time of the latest observation with an events row, or
+// zero if there are none.
+func lastEventTime(db *sql.DB) (time.Time, error) {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'events'`).Scan(&n); err != nil || n == 0 {
+		return time.Time{}, err
+	}
+	var t time.Time
+	err := db.QueryRow(`SELECT observations.t FROM events JOIN observations ON observations.id = events.observation_id ORDER BY ` + julianT("observations.t") + ` DESC LIMIT 1`).Scan(observationTime{&t})
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return t, err
+}
+
+// persistedState restores the state trackEvents was in after the last
+// observation at or before since from the events table. Only state changes
+// and end time changes are persisted, so the state was entered at the
+// earliest of the trailing rows sharing its state.
+func persistedState(db *sql.DB, since time.Time) (state, error) {
+	observedAt := julianT("observations.t")
+	eventsAsOf := `FROM events JOIN observations ON observations.id = events.observation_id WHERE ` + observedAt + ` <= julianday(?)`
+	at := since.UTC().Format(time.RFC3339Nano)
 	s := state{s: stateDormant}
+	var name string
+	var eventID sql.NullString
+	var updateTime, endTime sql.NullTime
+	err := db.QueryRow(`SELECT observations.id, observations.t, event_id, state, update_time, end_time `+eventsAsOf+` ORDER BY `+observedAt+` DESC LIMIT 1`, at).
+		Scan(&s.o.ID, observationTime{&s.o.Time}, &eventID, &name, &updateTime, &endTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, nil
+	}
+	if err != nil {
+		return state{}, err
+	}
+	switch name {
+	case stateDormant.String():
+		s.s = stateDormant
+	case stateActive.String():
+		s.s = stateActive
+	case stateEnded.String():
+		s.s = stateEnded
+	default:
+		return state{}, fmt.Errorf("observation %d: unknown state %q", s.o.ID, name)
+	}
+	s.eventID = eventID.String
+	s.updateTime = updateTime.Time
+	s.endTime = endTime.Time
+
+	err = db.QueryRow(`SELECT observations.t `+eventsAsOf+` AND `+observedAt+` > COALESCE((SELECT MAX(`+observedAt+`) `+eventsAsOf+` AND state != ?), 0) ORDER BY `+observedAt+` LIMIT 1`, at, at, name).Scan(observationTime{&s.since})
+	if err != nil {
+		return state{}, err
+	}
+	return s, nil
+}
+
+// runCSV is like run but reads observations from a CSV, see
+// csvObservations, and only writes events as JSON lines to opts.JSONL.
+// Observations are processed as they're read, so long histories run in
+// constant memory unless opts.Reorder is set. opts.Since is ignored.
+func runCSV(r io.Reader, opts runOptions) error {
+	next, err := csvObservations(r)
+	if err != nil {
+		return err
+	}
+	next = inWindow(next, opts.Window)
+	if opts.Reorder {
+		var observations []observation
+		for {
+			o, ok, err := next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			observations = append(observations, o)
+		}
+		sort.SliceStable(observations, func(i, j int) bool {
+			return observations[i].Time.Before(observations[j].Time)
+		})
+		next = func() (observation, bool, error) {
+			if len(observations) == 0 {
+				return observation{}, false, nil
+			}
+			o := observations[0]
+			observations = observations[1:]
+			return o, true, nil
+		}
+	}
+	enc := json.NewEncoder(opts.JSONL)
+	return trackEvents(suppressReverts(dropUnchanged(next), opts.Revert), opts.Location, opts.Coalesce, state{s: stateDormant}, func(e event) error {
+		return enc.Encode(e.record())
+	})
+}
+
+// csvObservations reads the header of a CSV naming the id, time, updateTime,
+// serviceUpdate and endTime columns, and returns a func yielding its
+// observations one row at a time. Times are RFC 3339.
+func csvObservations(r io.Reader) (func() (observation, bool, error), error) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %w", err)
+	}
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"id", "time", "updateTime", "serviceUpdate", "endTime"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("csv header is missing column %q", name)
+		}
+	}
+	idCol, timeCol := cols["id"], cols["time"]
+	updateTimeCol, serviceUpdateCol, endTimeCol := cols["updateTime"], cols["serviceUpdate"], cols["endTime"]
 
-	for rows.Next() {
+	return func() (observation, bool, error) {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return observation{}, false, nil
+		}
+		if err != nil {
+			return observation{}, false, err
+		}
+		line, _ := cr.FieldPos(0)
 		var o observation
-		if err := rows.Scan(&o.ID, &o.Time, &o.UpdateTime, &o.ServiceUpdate, &o.EndTime); err != nil {
-			log.Fatal(err)
+		if o.ID, err = strconv.Atoi(rec[idCol]); err != nil {
+			return observation{}, false, fmt.Errorf("line %d: parsing id: %w", line, err)
+		}
+		if o.Time, err = time.Parse(time.RFC3339, rec[timeCol]); err != nil {
+			return observation{}, false, fmt.Errorf("line %d: parsing time: %w", line, err)
 		}
-		o.Time = o.Time.In(halifax)
+		o.UpdateTime = rec[updateTimeCol]
+		o.ServiceUpdate = rec[serviceUpdateCol]
+		o.EndTime = rec[endTimeCol]
+		return o, true, nil
+	}, nil
+}
 
-		updateTime, ok := parseUpdateTime(o.UpdateTime, o.Time)
-		if !ok {
-			log.Fatalf("failed to parse update time: %q", o.UpdateTime)
+// inWindow wraps next to skip observations outside w.
+func inWindow(next func() (observation, bool, error), w window) func() (observation, bool, error) {
+	return func() (observation, bool, error) {
+		for {
+			o, ok, err := next()
+			if err != nil || !ok || w.contains(o.Time) {
+				return o, ok, err
+			}
+		}
+	}
+}
+
+// dropUnchanged wraps next to skip observations whose content matches the
+// previous one's, like the observations query does.
+func dropUnchanged(next func() (observation, bool, error)) func() (observation, bool, error) {
+	var prev observation
+	havePrev := false
+	return func() (observation, bool, error) {
+		for {
+			o, ok, err := next()
+			if err != nil || !ok {
+				return o, ok, err
+			}
+			if havePrev && prev.sameContent(o) {
+				continue
+			}
+			prev, havePrev = o, true
+			return o, true, nil
 		}
+	}
+}
 
-		// Feb. 6 | 11 p.m.7
-		if before, ok := strings.CutSuffix(o.EndTime, "p.m.7"); ok {
-			o.EndTime = before + "p.m."
+// suppressReverts wraps next, which must yield only content changes, to
+// drop scraper flaps: given A, B, A where the second A comes within revert
+// of B, both B and the revert are dropped. A zero revert disables it.
+func suppressReverts(next func() (observation, bool, error), revert time.Duration) func() (observation, bool, error) {
+	if revert <= 0 {
+		return next
+	}
+	var prev, pending observation
+	var havePrev, havePending bool
+	take := func() (observation, bool, error) {
+		if havePending {
+			havePending = false
+			return pending, true, nil
+		}
+		return next()
+	}
+	return func() (observation, bool, error) {
+		for {
+			o, ok, err := take()
+			if err != nil || !ok {
+				return o, ok, err
+			}
+			after, ok, err := take()
+			if err != nil {
+				return observation{}, false, err
+			}
+			if ok {
+				// Out of order observations are left for trackEvents to reject.
+				if havePrev && after.sameContent(prev) && !after.Time.Before(o.Time) && after.Time.Sub(o.Time) < revert {
+					continue
+				}
+				pending, havePending = after, true
+			}
+			prev, havePrev = o, true
+			return o, true, nil
+		}
+	}
+}
+
+// event is a state change to record as an events row.
+type event struct {
+	state
+	// Keep the source strings as-is for auditing the parsed times.
+	updateTimeRaw string
+	endTimeRaw    string
+	severity      int
+}
+
+func (e event) serviceUpdate() sql.NullString {
+	su := sql.NullString{String: e.o.ServiceUpdate}
+	if su.String != "" && !timeparse.IsNA(su.String) {
+		su.Valid = true
+	}
+	return su
+}
+
+func (e event) record() eventRecord {
+	rec := eventRecord{
+		ObservationID: e.o.ID,
+		EventID:       e.eventID,
+		State:         e.s.String(),
+		UpdateTimeRaw: e.updateTimeRaw,
+		EndTimeRaw:    e.endTimeRaw,
+		Severity:      e.severity,
+	}
+	if !e.updateTime.IsZero() {
+		rec.UpdateTime = e.updateTime.UTC().Format(time.RFC3339)
+	}
+	if !e.endTime.IsZero() {
+		rec.EndTime = e.endTime.UTC().Format(time.RFC3339)
+	}
+	if su := e.serviceUpdate(); su.Valid {
+		rec.ServiceUpdate = su.String
+	}
+	return rec
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// trackEvents runs observations from next through the weather event state
+// machine and calls emit for each resulting events row. Observations must be
+// in time order; one earlier than the last is an error. An event that goes
+// active again within coalesce of ending continues rather than starting a
+// new event. Tracking continues from s, which is dormant for a fresh start.
+func trackEvents(next func() (observation, bool, error), loc *time.Location, coalesce time.Duration, s state, emit func(event) error) error {
+	prev := s.o
+
+	for {
+		o, ok, err := next()
+		if err != nil {
+			return err
 		}
-		endTime, ok := parseUpdateTime(o.EndTime, o.Time)
 		if !ok {
-			log.Fatalf("failed to parse end time: %q", o.EndTime)
+			return nil
+		}
+		if !prev.Time.IsZero() && o.Time.Before(prev.Time) {
+			return fmt.Errorf("observation %d at %s is before observation %d at %s: %w", o.ID, o.Time.Format(time.RFC3339), prev.ID, prev.Time.Format(time.RFC3339), errOutOfOrder)
+		}
+		prev = o
+		o.Time = o.Time.In(loc)
+
+		updateTime, err := timeparse.Parse(o.UpdateTime, o.Time, loc)
+		if err != nil {
+			return fmt.Errorf("failed to parse update time: %w", err)
+		}
+
+		endTime, err := timeparse.Parse(o.EndTime, o.Time, loc)
+		if err != nil {
+			return fmt.Errorf("failed to parse end time: %w", err)
 		}
 
 		newState := state{
@@ -71,6 +631,7 @@ func main() {
 			eventID:    s.eventID,
 			updateTime: updateTime,
 			endTime:    endTime,
+			since:      s.since,
 		}
 
 		if !endTime.IsZero() {
@@ -80,6 +641,9 @@ func main() {
 		} else {
 			newState.s = stateDormant
 		}
+		if newState.s != s.s {
+			newState.since = o.Time
+		}
 
 		if s.s == stateDormant && newState.s == stateDormant {
 			s = newState
@@ -87,7 +651,9 @@ func main() {
 		}
 
 		dormantNew := s.s == stateDormant && (newState.s == stateActive || newState.s == stateEnded)
-		endedNew := s.s == stateEnded && newState.s == stateActive
+		// A brief ended state between active ones is usually noise.
+		flap := coalesce > 0 && o.Time.Sub(s.since) < coalesce
+		endedNew := s.s == stateEnded && newState.s == stateActive && !flap
 		endChange := s.s == stateEnded && newState.s == stateEnded && !endTime.Equal(s.endTime)
 
 		if dormantNew || endedNew || endChange {
@@ -98,32 +664,67 @@ func main() {
 			newState.eventID = eventTime.Format("2006-01-02")
 		}
 
-		updateTimeSQL := sql.NullTime{Time: newState.updateTime.UTC(), Valid: !newState.updateTime.IsZero()}
-		endTimeSQL := sql.NullTime{Time: newState.endTime.UTC(), Valid: !newState.endTime.IsZero()}
-		serviceUpdateSQL := sql.NullString{String: newState.o.ServiceUpdate}
-		if serviceUpdateSQL.String != "" && serviceUpdateSQL.String != "N/A" && serviceUpdateSQL.String != "N\\A" {
-			serviceUpdateSQL.Valid = true
-		}
-
-		_, err = db.Exec(
-			`INSERT INTO events (observation_id, event_id, state, update_time, end_time, service_update) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
-			newState.o.ID,
-			newState.eventID,
-			newState.s.String(),
-			updateTimeSQL,
-			endTimeSQL,
-			serviceUpdateSQL,
-		)
+		err = emit(event{
+			state:         newState,
+			updateTimeRaw: o.UpdateTime,
+			endTimeRaw:    o.EndTime,
+			severity:      severity(newState.endTime, newState.o.Time),
+		})
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 		s = newState
 	}
+}
 
-	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+// severity scores how much deadline pressure there is at t for an event
+// that ended at endTime, from 0 (no deadlines running) to 3. It combines how
+// far t is into the nearest pending priority's timeline with whether more
+// than one priority is still pending.
+func severity(endTime, t time.Time) int {
+	if endTime.IsZero() || t.Before(endTime) {
+		return 0
 	}
+	elapsed := t.Sub(endTime)
+	var pending int
+	var nearest time.Duration
+	for _, timeline := range timelines.Default() {
+		if elapsed >= timeline {
+			continue
+		}
+		if pending == 0 || timeline < nearest {
+			nearest = timeline
+		}
+		pending++
+	}
+	if pending == 0 {
+		return 0
+	}
+
+	var sev int
+	switch frac := float64(elapsed) / float64(nearest); {
+	case frac >= 0.75:
+		sev = 2
+	case frac >= 0.5:
+		sev = 1
+	}
+	if pending > 1 {
+		sev++
+	}
+	return sev
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, typ string) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, typ))
+	return err
 }
 
 type weatherEventState int
@@ -153,6 +754,8 @@ type state struct {
 	eventID    string
 	updateTime time.Time
 	endTime    time.Time
+	// since is when the state was entered.
+	since time.Time
 }
 
 type observation struct {
@@ -163,97 +766,33 @@ type observation struct {
 	EndTime       string
 }
 
-var (
-	squeezeRe = regexp.MustCompile(`\s+`)
-	noonRe    = regexp.MustCompile(`(?i)\bnoon\b`)
-)
+// sameContent reports whether o and p were scraped from the same content.
+func (o observation) sameContent(p observation) bool {
+	return o.UpdateTime == p.UpdateTime && o.ServiceUpdate == p.ServiceUpdate && o.EndTime == p.EndTime
+}
 
-func parseUpdateTime(txt string, t time.Time) (_ time.Time, ok bool) {
-	txt = strings.TrimSpace(txt)
-	if txt == "" || strings.EqualFold(txt, "N/A") || strings.EqualFold(txt, "N\\A") {
-		return time.Time{}, true
-	}
-
-	txt = strings.ReplaceAll(txt, "a.m.", "AM")
-	txt = strings.ReplaceAll(txt, "p.m.", "PM")
-	txt = strings.ReplaceAll(txt, "|", " ")
-	txt = strings.ReplaceAll(txt, "-", " ")
-	txt = strings.ReplaceAll(txt, ".", " ")
-	txt = strings.ReplaceAll(txt, ",", " ")
-	txt = strings.ReplaceAll(txt, " at ", " ")
-	txt = squeezeRe.ReplaceAllString(txt, " ")
-	txt = noonRe.ReplaceAllString(txt, "12 PM")
-	txt = strings.TrimSpace(txt)
-
-	type format struct {
-		s       string
-		hasYear bool
-		hasDate bool
-		hasTime bool
-	}
-	formats := []format{
-		{"1/2/2006 3:04 PM", true, true, true},
-		{"3 PM Jan 2", false, true, true},
-		{"3 PM January 2", false, true, true},
-		{"3 PM Mon Jan 2", false, true, true},
-		{"3 PM Mon January 2", false, true, true},
-		{"3 PM Monday Jan 2", false, true, true},
-		{"3 PM Monday January 2", false, true, true},
-		{"3 PM", false, false, true},
-		{"3:04 PM Jan 2", false, true, true},
-		{"3:04 PM January 2", false, true, true},
-		{"3:04 PM Mon Jan 2", false, true, true},
-		{"3:04 PM Mon January 2", false, true, true},
-		{"3:04 PM Monday Jan 2", false, true, true},
-		{"3:04 PM Monday January 2", false, true, true},
-		{"3:04 PM", false, false, true},
-		{"Jan 2 3 PM", false, true, true},
-		{"Jan 2 3:04 PM", false, true, true},
-		{"January 2 3 PM", false, true, true},
-		{"January 2 3:04 PM", false, true, true},
-		{"Mon Jan 2 3 PM", false, true, true},
-		{"Mon Jan 2 3:04 PM", false, true, true},
-		{"Mon January 2 3 PM", false, true, true},
-		{"Mon January 2 3:04 PM", false, true, true},
-		{"Monday Jan 2", false, true, false},
-		{"Monday Jan 2 3 PM", false, true, true},
-		{"Monday Jan 2 3:04 PM", false, true, true},
-		{"Monday January 2 3 PM", false, true, true},
-		{"Monday January 2 3:04 PM", false, true, true},
+// parseContent sets the observation's fields from the txt values in its
+// scraped content JSON, naming any path that is missing.
+func (o *observation) parseContent(content []byte) error {
+	var fields map[string]struct {
+		Txt *string `json:"txt"`
 	}
-
-	for {
-		for _, format := range formats {
-			if parsed, err := time.ParseInLocation(format.s, txt, t.Location()); err == nil {
-				if !format.hasYear {
-					parsed = parsed.AddDate(t.Year(), 0, 0)
-					if parsed.After(t) {
-						parsed = parsed.AddDate(-1, 0, 0)
-					}
-				}
-				if !format.hasDate {
-					parsed = parsed.AddDate(0, int(t.Month())-1, t.Day())
-					if parsed.After(t) {
-						parsed = parsed.AddDate(0, 0, -1)
-					}
-				}
-				if !format.hasTime {
-					hms := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
-					parsed = parsed.Add(hms)
-					if parsed.After(t) {
-						parsed = parsed.AddDate(0, 0, -1)
-					}
-				}
-				return parsed, true
-			}
-		}
-		lastSpace := strings.LastIndex(txt, " ")
-		if lastSpace == -1 {
-			break
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return fmt.Errorf("parsing content: %w", err)
+	}
+	for _, f := range []struct {
+		key string
+		dst *string
+	}{
+		{"updateTime", &o.UpdateTime},
+		{"serviceUpdate", &o.ServiceUpdate},
+		{"endTime", &o.EndTime},
+	} {
+		field, ok := fields[f.key]
+		if !ok || field.Txt == nil {
+			return fmt.Errorf("content is missing %s.txt", f.key)
 		}
-		txt = txt[:lastSpace]
+		*f.dst = *field.Txt
 	}
-
-	// If no format matches, return zero time
-	return time.Time{}, false
+	return nil
 }
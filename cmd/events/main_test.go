@@ -0,0 +1,769 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+)
+
+type testObservation struct {
+	id            int
+	t             time.Time
+	updateTime    string
+	serviceUpdate string
+	endTime       string
+}
+
+func setupTestDB(t *testing.T, observations []testObservation) *sql.DB {
+	t.Helper()
+	// run reads observations while inserting events, so it needs more than
+	// one connection to the same database.
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?_pragma=journal_mode=WAL&_pragma=busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE contents (id INTEGER PRIMARY KEY, content TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE observations (id INTEGER PRIMARY KEY, t DATETIME, content_id INTEGER REFERENCES contents (id))`); err != nil {
+		t.Fatal(err)
+	}
+	insertObservations(t, db, observations)
+	return db
+}
+
+func insertObservations(t *testing.T, db *sql.DB, observations []testObservation) {
+	t.Helper()
+	for _, o := range observations {
+		content, err := json.Marshal(map[string]map[string]string{
+			"updateTime":    {"txt": o.updateTime},
+			"serviceUpdate": {"txt": o.serviceUpdate},
+			"endTime":       {"txt": o.endTime},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`INSERT INTO contents (id, content) VALUES (?, ?)`, o.id, string(content)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`INSERT INTO observations (id, t, content_id) VALUES (?, ?, ?)`, o.id, o.t.UTC(), o.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func halifaxLocation(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func readEvents(t *testing.T, db *sql.DB) []eventRecord {
+	t.Helper()
+	rows, err := db.Query(`SELECT observation_id, event_id, state, update_time, end_time, service_update, update_time_raw, end_time_raw, severity FROM events ORDER BY observation_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var out []eventRecord
+	for rows.Next() {
+		var rec eventRecord
+		var updateTime, endTime sql.NullTime
+		var serviceUpdate sql.NullString
+		if err := rows.Scan(&rec.ObservationID, &rec.EventID, &rec.State, &updateTime, &endTime, &serviceUpdate, &rec.UpdateTimeRaw, &rec.EndTimeRaw, &rec.Severity); err != nil {
+			t.Fatal(err)
+		}
+		if updateTime.Valid {
+			rec.UpdateTime = updateTime.Time.UTC().Format(time.RFC3339)
+		}
+		if endTime.Valid {
+			rec.EndTime = endTime.Time.UTC().Format(time.RFC3339)
+		}
+		if serviceUpdate.Valid {
+			rec.ServiceUpdate = serviceUpdate.String
+		}
+		out = append(out, rec)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestRunJSONLMatchesEvents(t *testing.T) {
+	loc := halifaxLocation(t)
+	db := setupTestDB(t, []testObservation{
+		{id: 1, t: time.Date(2025, 2, 5, 10, 0, 0, 0, loc), updateTime: "N/A", serviceUpdate: "N/A", endTime: "N/A"},
+		{id: 2, t: time.Date(2025, 2, 6, 12, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 3, t: time.Date(2025, 2, 7, 12, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "N\\A", endTime: "Feb. 7 | 6 a.m."},
+	})
+
+	var jsonl bytes.Buffer
+	if err := run(db, runOptions{Location: loc, JSONL: &jsonl}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	var got []eventRecord
+	dec := json.NewDecoder(&jsonl)
+	for dec.More() {
+		var rec eventRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("decode jsonl: %v", err)
+		}
+		got = append(got, rec)
+	}
+	want := readEvents(t, db)
+	if len(want) != 2 {
+		t.Fatalf("expected 2 event rows, got %d: %+v", len(want), want)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("jsonl lines: got %d want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("jsonl line %d: got %+v want %+v", i, got[i], want[i])
+		}
+	}
+	if got[0].State != "active" || got[1].State != "ended" {
+		t.Fatalf("unexpected states: %q, %q", got[0].State, got[1].State)
+	}
+}
+
+func TestRunPersistsRawTimes(t *testing.T) {
+	loc := halifaxLocation(t)
+	db := setupTestDB(t, []testObservation{
+		{id: 1, t: time.Date(2025, 2, 6, 23, 30, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 2, t: time.Date(2025, 2, 7, 0, 30, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "Feb. 6 | 11 p.m.7"},
+	})
+	// Simulate a database created before the raw columns were added.
+	if _, err := db.Exec(`CREATE TABLE events (observation_id INTEGER PRIMARY KEY REFERENCES observations (id), event_id TEXT, state TEXT, update_time DATETIME, end_time DATETIME, service_update TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(db, runOptions{Location: loc}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	got := readEvents(t, db)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 event rows, got %d: %+v", len(got), got)
+	}
+	if got[0].UpdateTimeRaw != "Feb. 6 | 8 a.m." || got[0].EndTimeRaw != "N/A" {
+		t.Fatalf("row 0 raw times: got %q, %q", got[0].UpdateTimeRaw, got[0].EndTimeRaw)
+	}
+	if got[1].EndTimeRaw != "Feb. 6 | 11 p.m.7" {
+		t.Fatalf("row 1 raw end time: got %q", got[1].EndTimeRaw)
+	}
+	if got[1].EndTime == "" {
+		t.Fatalf("row 1 end time was not parsed")
+	}
+}
+
+func TestRunContentMissingField(t *testing.T) {
+	db := setupTestDB(t, nil)
+	if _, err := db.Exec(`INSERT INTO contents (id, content) VALUES (1, ?)`, `{"updateTime":{},"serviceUpdate":{"txt":"Crews are out"},"endTime":{"txt":"N/A"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO observations (id, t, content_id) VALUES (7, ?, 1)`, time.Date(2025, 2, 6, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := run(db, runOptions{Location: halifaxLocation(t)})
+	if err == nil || !strings.Contains(err.Error(), "observation 7: content is missing updateTime.txt") {
+		t.Fatalf("expected missing updateTime.txt error, got %v", err)
+	}
+}
+
+func TestRunNullContent(t *testing.T) {
+	loc := halifaxLocation(t)
+	db := setupTestDB(t, []testObservation{
+		{id: 1, t: time.Date(2025, 2, 6, 9, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 4, t: time.Date(2025, 2, 8, 9, 0, 0, 0, loc), updateTime: "Feb. 8 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+	})
+	for _, o := range []struct {
+		id int
+		t  time.Time
+	}{
+		{2, time.Date(2025, 2, 7, 9, 0, 0, 0, loc)},
+		{3, time.Date(2025, 2, 7, 10, 0, 0, 0, loc)},
+	} {
+		if _, err := db.Exec(`INSERT INTO observations (id, t, content_id) VALUES (?, ?, NULL)`, o.id, o.t.UTC()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := run(db, runOptions{Location: loc}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var got []string
+	for _, rec := range readEvents(t, db) {
+		got = append(got, fmt.Sprintf("%d:%s", rec.ObservationID, rec.State))
+	}
+	// Observation 3 repeats 2's missing content, so only 2 is a change.
+	want := "1:active,2:dormant,4:active"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("events: got %v want %s", got, want)
+	}
+}
+
+func TestRunTimezone(t *testing.T) {
+	toronto, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	observations := []testObservation{
+		{id: 1, t: time.Date(2025, 2, 6, 23, 30, 0, 0, toronto), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+	}
+
+	db := setupTestDB(t, observations)
+	if err := run(db, runOptions{Location: toronto}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	got := readEvents(t, db)
+	if len(got) != 1 {
+		t.Fatalf("expected 1 event row, got %d: %+v", len(got), got)
+	}
+	// 8 a.m. Eastern is 13:00 UTC, where Halifax would give 12:00.
+	if got[0].UpdateTime != "2025-02-06T13:00:00Z" {
+		t.Fatalf("update time: got %s want 2025-02-06T13:00:00Z", got[0].UpdateTime)
+	}
+
+	halifaxDB := setupTestDB(t, observations)
+	if err := run(halifaxDB, runOptions{Location: halifaxLocation(t)}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := readEvents(t, halifaxDB); got[0].UpdateTime != "2025-02-06T12:00:00Z" {
+		t.Fatalf("halifax update time: got %s want 2025-02-06T12:00:00Z", got[0].UpdateTime)
+	}
+}
+
+func TestRunCSVMatchesSQL(t *testing.T) {
+	loc := halifaxLocation(t)
+	observations := []testObservation{
+		{id: 1, t: time.Date(2025, 2, 5, 10, 0, 0, 0, loc), updateTime: "N/A", serviceUpdate: "N/A", endTime: "N/A"},
+		{id: 2, t: time.Date(2025, 2, 6, 12, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out, salting", endTime: "N/A"},
+		{id: 3, t: time.Date(2025, 2, 7, 12, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "N\\A", endTime: "Feb. 7 | 6 a.m."},
+		{id: 4, t: time.Date(2025, 2, 9, 8, 0, 0, 0, loc), updateTime: "Feb. 9 | 7 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+	}
+
+	var sqlOut bytes.Buffer
+	if err := run(setupTestDB(t, observations), runOptions{Location: loc, JSONL: &sqlOut}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	var in bytes.Buffer
+	w := csv.NewWriter(&in)
+	w.Write([]string{"id", "time", "updateTime", "serviceUpdate", "endTime"})
+	for _, o := range observations {
+		w.Write([]string{strconv.Itoa(o.id), o.t.UTC().Format(time.RFC3339), o.updateTime, o.serviceUpdate, o.endTime})
+	}
+	w.Flush()
+	var csvOut bytes.Buffer
+	if err := runCSV(&in, runOptions{Location: loc, JSONL: &csvOut}); err != nil {
+		t.Fatalf("runCSV: %v", err)
+	}
+
+	if sqlOut.Len() == 0 {
+		t.Fatal("expected events from the SQL path")
+	}
+	if csvOut.String() != sqlOut.String() {
+		t.Fatalf("csv events:\n%s\nwant sql events:\n%s", csvOut.String(), sqlOut.String())
+	}
+
+	err := runCSV(strings.NewReader("id,time,updateTime,endTime\n"), runOptions{Location: loc, JSONL: io.Discard})
+	if err == nil || !strings.Contains(err.Error(), `missing column "serviceUpdate"`) {
+		t.Fatalf("expected missing column error, got %v", err)
+	}
+}
+
+func TestRunCSVOutOfOrder(t *testing.T) {
+	loc := halifaxLocation(t)
+	in := `id,time,updateTime,serviceUpdate,endTime
+1,2025-02-06T16:00:00Z,Feb. 6 | 8 a.m.,Crews are out,N/A
+3,2025-02-07T16:00:00Z,Feb. 6 | 8 a.m.,N/A,Feb. 7 | 6 a.m.
+2,2025-02-06T20:00:00Z,Feb. 6 | 8 a.m.,Crews are salting,N/A
+`
+	err := runCSV(strings.NewReader(in), runOptions{Location: loc, JSONL: io.Discard})
+	if !errors.Is(err, errOutOfOrder) {
+		t.Fatalf("expected out of order error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "observation 2 at") {
+		t.Fatalf("expected error to name observation 2, got %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := runCSV(strings.NewReader(in), runOptions{Location: loc, JSONL: &out, Reorder: true}); err != nil {
+		t.Fatalf("runCSV with reorder: %v", err)
+	}
+	var ids []int
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var rec eventRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, rec.ObservationID)
+	}
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+		t.Fatalf("reordered observation ids: got %v want [1 2 3]", ids)
+	}
+}
+
+func TestRunCoalesceWindow(t *testing.T) {
+	loc := halifaxLocation(t)
+	// An event that flaps to ended for a minute before going active again
+	// with an update time on the next day.
+	observations := []testObservation{
+		{id: 1, t: time.Date(2025, 2, 6, 23, 58, 0, 0, loc), updateTime: "Feb. 6 | 11:58 p.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 2, t: time.Date(2025, 2, 6, 23, 59, 0, 0, loc), updateTime: "Feb. 6 | 11:58 p.m.", serviceUpdate: "Crews are out", endTime: "Feb. 6 | 11:59 p.m."},
+		{id: 3, t: time.Date(2025, 2, 7, 0, 0, 0, 0, loc), updateTime: "Feb. 7 | 12 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+	}
+
+	eventIDs := func(coalesce time.Duration) []string {
+		t.Helper()
+		db := setupTestDB(t, observations)
+		if err := run(db, runOptions{Location: loc, Coalesce: coalesce}); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		var ids []string
+		for _, rec := range readEvents(t, db) {
+			ids = append(ids, rec.EventID)
+		}
+		return ids
+	}
+
+	if got := eventIDs(0); strings.Join(got, ",") != "2025-02-06,2025-02-06,2025-02-07" {
+		t.Fatalf("event ids without coalescing: got %v", got)
+	}
+	if got := eventIDs(10 * time.Minute); strings.Join(got, ",") != "2025-02-06,2025-02-06,2025-02-06" {
+		t.Fatalf("event ids with a 10m window: got %v", got)
+	}
+}
+
+func TestRunRevertWindow(t *testing.T) {
+	loc := halifaxLocation(t)
+	// The page flaps to an ended state for two minutes before showing the
+	// active event again, then the event really ends that afternoon.
+	observations := []testObservation{
+		{id: 1, t: time.Date(2025, 2, 6, 10, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 2, t: time.Date(2025, 2, 6, 10, 1, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "N/A", endTime: "Feb. 6 | 10 a.m."},
+		{id: 3, t: time.Date(2025, 2, 6, 10, 3, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 4, t: time.Date(2025, 2, 6, 14, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "N/A", endTime: "Feb. 6 | 2 p.m."},
+	}
+
+	observationIDs := func(revert time.Duration) string {
+		t.Helper()
+		db := setupTestDB(t, observations)
+		if err := run(db, runOptions{Location: loc, Revert: revert}); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		var ids []string
+		for _, rec := range readEvents(t, db) {
+			ids = append(ids, strconv.Itoa(rec.ObservationID))
+		}
+		return strings.Join(ids, ",")
+	}
+	if got := observationIDs(0); got != "1,2,3,4" {
+		t.Fatalf("events without a revert window: got %s", got)
+	}
+	if got := observationIDs(10 * time.Minute); got != "1,4" {
+		t.Fatalf("events with a 10m revert window: got %s want 1,4", got)
+	}
+	// A revert after the window is a real change.
+	if got := observationIDs(time.Minute); got != "1,2,3,4" {
+		t.Fatalf("events with a 1m revert window: got %s", got)
+	}
+
+	var in bytes.Buffer
+	w := csv.NewWriter(&in)
+	w.Write([]string{"id", "time", "updateTime", "serviceUpdate", "endTime"})
+	for _, o := range observations {
+		w.Write([]string{strconv.Itoa(o.id), o.t.UTC().Format(time.RFC3339), o.updateTime, o.serviceUpdate, o.endTime})
+	}
+	w.Flush()
+	var out bytes.Buffer
+	if err := runCSV(&in, runOptions{Location: loc, JSONL: &out, Revert: 10 * time.Minute}); err != nil {
+		t.Fatalf("runCSV: %v", err)
+	}
+	var ids []int
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var rec eventRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, rec.ObservationID)
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 4 {
+		t.Fatalf("csv events with a 10m revert window: got %v want [1 4]", ids)
+	}
+}
+
+func TestRunSeason(t *testing.T) {
+	loc := halifaxLocation(t)
+	observations := []testObservation{
+		{id: 1, t: time.Date(2024, 1, 10, 9, 0, 0, 0, loc), updateTime: "Jan. 10 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 2, t: time.Date(2024, 1, 11, 9, 0, 0, 0, loc), updateTime: "Jan. 10 | 8 a.m.", serviceUpdate: "N/A", endTime: "Jan. 11 | 6 a.m."},
+		// Still showing the last event when the 2024 season starts.
+		{id: 3, t: time.Date(2024, 11, 1, 0, 30, 0, 0, loc), updateTime: "Jan. 10 | 8 a.m.", serviceUpdate: "N/A", endTime: "Jan. 11 | 6 a.m."},
+		{id: 4, t: time.Date(2024, 11, 20, 9, 0, 0, 0, loc), updateTime: "Nov. 20 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 5, t: time.Date(2025, 5, 2, 9, 0, 0, 0, loc), updateTime: "May 2 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+	}
+	db := setupTestDB(t, observations)
+	if err := run(db, runOptions{Location: loc, Window: seasonWindow(2024, loc)}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var got []string
+	for _, rec := range readEvents(t, db) {
+		got = append(got, fmt.Sprintf("%d:%s:%s", rec.ObservationID, rec.State, rec.EventID))
+	}
+	// Observations 1 and 2 are outside the season, so 3 is seen from
+	// dormant and 5 is after it.
+	want := "3:ended:2024-01-10,4:active:2024-11-20"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("season 2024 events: got %v want %s", got, want)
+	}
+
+	var out bytes.Buffer
+	in := `id,time,updateTime,serviceUpdate,endTime
+1,2024-01-10T13:00:00Z,Jan. 10 | 8 a.m.,Crews are out,N/A
+4,2024-11-20T13:00:00Z,Nov. 20 | 8 a.m.,Crews are out,N/A
+5,2025-05-02T12:00:00Z,May 2 | 8 a.m.,Crews are out,N/A
+`
+	if err := runCSV(strings.NewReader(in), runOptions{Location: loc, JSONL: &out, Window: seasonWindow(2024, loc)}); err != nil {
+		t.Fatalf("runCSV: %v", err)
+	}
+	var rec eventRecord
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+		t.Fatalf("expected a single event, got %q: %v", out.String(), err)
+	}
+	if rec.ObservationID != 4 {
+		t.Fatalf("csv season 2024: got observation %d want 4", rec.ObservationID)
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	end := time.Date(2025, 2, 7, 6, 0, 0, 0, time.UTC)
+
+	justStarted := severity(end, end.Add(10*time.Minute))
+	nearDeadline := severity(end, end.Add(11*time.Hour+30*time.Minute))
+	if justStarted >= nearDeadline {
+		t.Fatalf("just started severity %d should be lower than near priority 1 deadline %d", justStarted, nearDeadline)
+	}
+	if nearDeadline != 3 {
+		t.Fatalf("near priority 1 deadline severity: got %d want 3", nearDeadline)
+	}
+
+	tests := []struct {
+		name    string
+		endTime time.Time
+		t       time.Time
+		want    int
+	}{
+		{"no end time", time.Time{}, end, 0},
+		{"before end", end, end.Add(-time.Hour), 0},
+		{"just started", end, end.Add(10 * time.Minute), 1},
+		{"priority 2 next", end, end.Add(13 * time.Hour), 2},
+		{"only priority 3 left", end, end.Add(20 * time.Hour), 1},
+		{"priority 3 nearly due", end, end.Add(30 * time.Hour), 2},
+		{"all deadlines passed", end, end.Add(40 * time.Hour), 0},
+	}
+	for _, tt := range tests {
+		if got := severity(tt.endTime, tt.t); got != tt.want {
+			t.Errorf("%s: severity = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunSince(t *testing.T) {
+	loc := halifaxLocation(t)
+	// An event ends and briefly goes active again, which the coalesce window
+	// folds into the same event only if the ended state's start is restored.
+	// The first later observation repeats the last earlier one's content.
+	earlier := []testObservation{
+		{id: 1, t: time.Date(2025, 2, 6, 10, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 2, t: time.Date(2025, 2, 6, 11, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "Feb. 6 | 11 a.m."},
+	}
+	later := []testObservation{
+		{id: 4, t: time.Date(2025, 2, 6, 11, 5, 0, 0, loc), updateTime: "Feb. 7 | 11 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 5, t: time.Date(2025, 2, 7, 18, 0, 0, 0, loc), updateTime: "Feb. 7 | 11 a.m.", serviceUpdate: "Done", endTime: "Feb. 7 | 6 p.m."},
+	}
+	addLater := func(db *sql.DB) {
+		t.Helper()
+		insertObservations(t, db, later)
+		if _, err := db.Exec(`INSERT INTO observations (id, t, content_id) VALUES (3, ?, 2)`, time.Date(2025, 2, 6, 11, 2, 0, 0, loc).UTC()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const coalesce = 10 * time.Minute
+
+	full := setupTestDB(t, earlier)
+	addLater(full)
+	if err := run(full, runOptions{Location: loc, Coalesce: coalesce}); err != nil {
+		t.Fatalf("full run: %v", err)
+	}
+	want := readEvents(t, full)
+
+	db := setupTestDB(t, earlier)
+	if err := run(db, runOptions{Location: loc, Coalesce: coalesce}); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	addLater(db)
+	since, err := lastEventTime(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !since.Equal(earlier[1].t) {
+		t.Fatalf("last event time: got %s want %s", since, earlier[1].t)
+	}
+	var jsonl bytes.Buffer
+	if err := run(db, runOptions{Location: loc, JSONL: &jsonl, Coalesce: coalesce, Since: since}); err != nil {
+		t.Fatalf("run since: %v", err)
+	}
+	var ids []int
+	dec := json.NewDecoder(&jsonl)
+	for dec.More() {
+		var rec eventRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, rec.ObservationID)
+	}
+	if fmt.Sprint(ids) != "[4 5]" {
+		t.Fatalf("second run events: got observations %v want [4 5]", ids)
+	}
+	got := readEvents(t, db)
+	if len(got) != len(want) {
+		t.Fatalf("events: got %+v want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("event %d: got %+v want %+v", i, got[i], want[i])
+		}
+	}
+	if want[2].EventID != want[0].EventID {
+		t.Fatalf("expected the brief end to be coalesced: %+v", want)
+	}
+
+	// An empty events table processes everything.
+	if since, err := lastEventTime(setupTestDB(t, nil)); err != nil || !since.IsZero() {
+		t.Fatalf("last event time without events: got %s, %v", since, err)
+	}
+}
+
+func TestRunSkipsMalformedRow(t *testing.T) {
+	loc := halifaxLocation(t)
+	db := setupTestDB(t, []testObservation{
+		{id: 1, t: time.Date(2025, 2, 6, 10, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 2, t: time.Date(2025, 2, 6, 11, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Still out", endTime: "N/A"},
+		{id: 3, t: time.Date(2025, 2, 7, 12, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "N/A", endTime: "Feb. 7 | 6 a.m."},
+	})
+	if _, err := db.Exec(`UPDATE observations SET t = 'yesterday' WHERE id = 2`); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	if err := run(db, runOptions{Location: loc}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if !strings.Contains(logs.String(), "reading column t") {
+		t.Fatalf("log does not name the malformed column:\n%s", logs.String())
+	}
+	var ids []int
+	for _, rec := range readEvents(t, db) {
+		ids = append(ids, rec.ObservationID)
+	}
+	if fmt.Sprint(ids) != "[1 3]" {
+		t.Fatalf("events: got observations %v want [1 3]", ids)
+	}
+}
+
+func TestRunEpochTimes(t *testing.T) {
+	loc := halifaxLocation(t)
+	observations := []testObservation{
+		{id: 1, t: time.Date(2025, 1, 20, 10, 0, 0, 0, loc), updateTime: "Jan. 20 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 2, t: time.Date(2025, 2, 6, 12, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 3, t: time.Date(2025, 2, 7, 12, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "N/A", endTime: "Feb. 7 | 6 a.m."},
+	}
+	// An export with t as INTEGER epoch seconds, which the driver doesn't
+	// decode as a time.
+	epochDB := setupTestDB(t, nil)
+	for _, stmt := range []string{
+		`DROP TABLE observations`,
+		`CREATE TABLE observations (id INTEGER PRIMARY KEY, t INTEGER, content_id INTEGER REFERENCES contents (id))`,
+	} {
+		if _, err := epochDB.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insertObservations(t, epochDB, observations)
+	if _, err := epochDB.Exec(`UPDATE observations SET t = CAST(strftime('%s', t) AS INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	var typ string
+	if err := epochDB.QueryRow(`SELECT typeof(t) FROM observations LIMIT 1`).Scan(&typ); err != nil || typ != "integer" {
+		t.Fatalf("t stored as %q (%v), want integer", typ, err)
+	}
+
+	for _, w := range []window{{}, {start: time.Date(2025, 2, 1, 0, 0, 0, 0, loc)}} {
+		datetimeDB := setupTestDB(t, observations)
+		if err := run(datetimeDB, runOptions{Location: loc, Window: w}); err != nil {
+			t.Fatalf("datetime run: %v", err)
+		}
+		want := readEvents(t, datetimeDB)
+
+		if _, err := epochDB.Exec(`DELETE FROM events`); err != nil && !strings.Contains(err.Error(), "no such table") {
+			t.Fatal(err)
+		}
+		var jsonl bytes.Buffer
+		if err := run(epochDB, runOptions{Location: loc, JSONL: &jsonl, Window: w}); err != nil {
+			t.Fatalf("epoch run: %v", err)
+		}
+		got := readEvents(t, epochDB)
+		if len(got) != len(want) || len(want) == 0 {
+			t.Fatalf("window %v: got %d events want %d: %+v", w, len(got), len(want), got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("window %v event %d: got %+v want %+v", w, i, got[i], want[i])
+			}
+		}
+		if w.start.IsZero() && got[0].UpdateTime != "2025-01-20T12:00:00Z" {
+			t.Fatalf("first event update time: got %s want 2025-01-20T12:00:00Z", got[0].UpdateTime)
+		}
+	}
+}
+
+func TestRunMixedTimeStorage(t *testing.T) {
+	loc := halifaxLocation(t)
+	observations := []testObservation{
+		{id: 1, t: time.Date(2025, 2, 6, 10, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are out", endTime: "N/A"},
+		{id: 2, t: time.Date(2025, 2, 6, 12, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "Crews are salting", endTime: "N/A"},
+		{id: 3, t: time.Date(2025, 2, 7, 12, 0, 0, 0, loc), updateTime: "Feb. 6 | 8 a.m.", serviceUpdate: "N/A", endTime: "Feb. 7 | 6 a.m."},
+	}
+	want := setupTestDB(t, observations)
+	if err := run(want, runOptions{Location: loc}); err != nil {
+		t.Fatal(err)
+	}
+
+	// SQLite sorts every integer before any text, so ordering by the raw
+	// column would put the latest observation first.
+	db := setupTestDB(t, observations)
+	if _, err := db.Exec(`UPDATE observations SET t = CAST(strftime('%s', t) AS INTEGER) WHERE id = 3`); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(db, runOptions{Location: loc}); err != nil {
+		t.Fatal(err)
+	}
+	got, wantEvents := readEvents(t, db), readEvents(t, want)
+	if len(got) != len(wantEvents) {
+		t.Fatalf("got %d events want %d: %+v", len(got), len(wantEvents), got)
+	}
+	for i := range wantEvents {
+		if got[i] != wantEvents[i] {
+			t.Fatalf("event %d: got %+v want %+v", i, got[i], wantEvents[i])
+		}
+	}
+}
+
+// syntheticCSV generates rows observations as it's read, alternating between
+// two service updates a minute apart, without holding them in memory.
+type syntheticCSV struct {
+	rows, row int
+	started   bool
+	buf       []byte
+	// onRow, if set, is called before each row is generated.
+	onRow func(row int)
+}
+
+func (s *syntheticCSV) Read(p []byte) (int, error) {
+	if !s.started {
+		s.buf = append(s.buf, "id,time,updateTime,serviceUpdate,endTime\n"...)
+		s.started = true
+	}
+	if len(s.buf) == 0 {
+		if s.row >= s.rows {
+			return 0, io.EOF
+		}
+		if s.onRow != nil {
+			s.onRow(s.row)
+		}
+		t := time.Date(2025, 2, 6, 12, 0, 0, 0, time.UTC).Add(time.Duration(s.row) * time.Minute)
+		update := "Crews are out"
+		if s.row%2 == 1 {
+			update = "Crews are salting"
+		}
+		s.buf = fmt.Appendf(s.buf, "%d,%s,Feb. 6 | 8 a.m.,%s,N/A\n", s.row+1, t.Format(time.RFC3339), update)
+		s.row++
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func TestRunCSVStreamsInBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("reads a large synthetic history")
+	}
+	loc := halifaxLocation(t)
+	const rows = 200_000
+
+	var m runtime.MemStats
+	heap := func() uint64 {
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	base := heap()
+	var peak uint64
+	src := &syntheticCSV{rows: rows, onRow: func(row int) {
+		if row%20_000 == 0 {
+			peak = max(peak, heap())
+		}
+	}}
+	if err := runCSV(src, runOptions{Location: loc, JSONL: io.Discard}); err != nil {
+		t.Fatalf("runCSV: %v", err)
+	}
+	if src.row != rows {
+		t.Fatalf("read %d rows, want %d", src.row, rows)
+	}
+	// Holding every observation would take tens of megabytes.
+	if grown := int64(peak) - int64(base); grown > 4<<20 {
+		t.Fatalf("heap grew by %d bytes reading %d observations; want under 4MiB", grown, rows)
+	}
+}
+
+func BenchmarkRunCSV(b *testing.B) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := runCSV(&syntheticCSV{rows: 10_000}, runOptions{Location: loc, JSONL: io.Discard}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
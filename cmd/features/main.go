@@ -1,26 +1,37 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"log"
 	"math"
+	"math/rand/v2"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
+	"github.com/danp/snowhfx/internal/featuresbin"
+	"github.com/danp/snowhfx/internal/timelines"
 	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
 	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/planar"
+	"github.com/paulmach/orb/project"
 )
 
 const (
@@ -31,8 +42,17 @@ const (
 	defaultTravelwaysOut = "features.bin"
 	defaultBikeOut       = "features_cycling.bin"
 
+	defaultHTTPTimeout = 5 * time.Minute
+
+	onlyAll        = "all"
+	onlyTravelways = "travelways"
+	onlyBike       = "bike"
+
+	formatBin  = "bin"
+	formatJSON = "json"
+
 	featuresBinMagic   = "SHFX"
-	featuresBinVersion = uint8(4)
+	featuresBinVersion = uint8(17)
 )
 
 const (
@@ -41,56 +61,485 @@ const (
 	datasetIce
 )
 
+// Bike protection types, from PROT_TYPE and BIKETYPE.
+const (
+	bikeTypeUnknown uint8 = iota
+	bikeTypeProtected
+	bikeTypeUnprotected
+)
+
+// Cycling lane directions relative to traffic, from -direction-property.
+const (
+	directionTwoWay uint8 = iota
+	directionWithTraffic
+	directionAgainstTraffic
+)
+
 func main() {
-	ctx := context.Background()
+	cfg, err := parseArgs(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := run(context.Background(), cfg); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+// parseArgs builds a runConfig from command line flags and, with -config,
+// a file of flag values, which flags given on the command line override.
+func parseArgs(name string, args []string) (runConfig, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
 	cfg := runConfig{}
+	var configPath string
+	fs.StringVar(&configPath, "config", "", "path to a json file of flag names to values, such as {\"max-match-meters\": 25}; flags given on the command line override it")
 	fs.StringVar(&cfg.TravelwaysFile, "travelways", "", "path to travelways geojson file, otherwise download")
 	fs.StringVar(&cfg.BikeFile, "bike", "", "path to bike infrastructure geojson file, otherwise download")
 	fs.StringVar(&cfg.IceFile, "ice", "", "path to ice routes geojson file, otherwise download")
+	fs.BoolVar(&cfg.Offline, "offline", false, "fail instead of downloading any dataset not given as a file")
+	fs.BoolVar(&cfg.Quiet, "quiet", false, "suppress download progress logs and the run summary")
+	fs.BoolVar(&cfg.PrettyLog, "pretty-log", true, "log a summary of features, files written, bike matches, warnings and elapsed time at the end of the run")
 	fs.StringVar(&cfg.SaveDownloadsDir, "save-downloads-dir", "", "directory to save downloaded geojson files")
 	fs.StringVar(&cfg.TravelwaysOut, "out-travelways", defaultTravelwaysOut, "path to write travelways features bin")
 	fs.StringVar(&cfg.BikeOut, "out-bike", defaultBikeOut, "path to write bike infrastructure features bin")
 	fs.Float64Var(&cfg.MaxMatchMeters, "max-match-meters", 30, "max distance in meters to match bike routes to travelways or ice routes")
-	fs.Float64Var(&cfg.MaxAngleDeg, "max-angle-deg", 30, "max angle delta in degrees for matching bike routes to other datasets")
+	fs.Float64Var(&cfg.TravelwayBufferMeters, "travelway-buffer-meters", 0, "half-width in meters of travelways when matching bike routes, so lanes along either edge of a divided street match; 0 matches the centerline")
+	fs.Float64Var(&cfg.NameMatchBiasMeters, "name-match-bias-meters", 0, "rank travelways whose LOCATION matches a bike route's STREETNAME as if they were this many meters closer when matching; 0 disables")
+	fs.Float64Var(&cfg.MaxAngleDeg, "max-angle-deg", 30, "max angle delta in degrees for matching bike routes to other datasets; 0 matches on distance alone, for data whose line directions are unreliable")
 	fs.Float64Var(&cfg.MinRunMeters, "min-run-meters", 20, "min run length in meters when collapsing bike priority segments")
+	fs.Float64Var(&cfg.CoincidentMeters, "coincident-meters", 2, "drop cycling features lying entirely within this many meters of one matched from a better source (travelways, then ice, then bike); 0 disables")
+	fs.BoolVar(&cfg.SnapEndpoints, "snap-endpoints", false, fmt.Sprintf("move the ends of cycling features matched to a travelway onto it when within %dm, removing small offsets", snapEndpointsMeters))
 	fs.Float64Var(&cfg.SimplifyMeters, "simplify-meters", 2, "simplify line geometry (Douglas-Peucker) in meters; 0 disables")
+	fs.StringVar(&cfg.DirectionProperty, "direction-property", "", "bike route property giving a lane's direction (two-way, with or against traffic) to record; empty records none")
+	fs.StringVar(&cfg.TraceTitle, "trace-title", "", "log each matching step for cycling features with this title")
 	fs.StringVar(&cfg.DebugOut, "debug-out", "", "path to write debug json with decision details")
-	fs.Parse(os.Args[1:])
+	fs.StringVar(&cfg.UnmatchedOut, "unmatched-out", "", "path to write bike routes that fell back to WINT_LOS or were dropped as geojson with a reason property, for coverage review")
+	fs.StringVar(&cfg.GeoJSONOut, "geojson-out", "", "path to also write the output features as geojson")
+	fs.StringVar(&cfg.PMTiles, "pmtiles", "", "path to also write the output features as a PMTiles archive of vector tiles, one layer per output")
+	fs.IntVar(&cfg.PMTilesZoom, "pmtiles-zoom", 14, "zoom level to write -pmtiles tiles at; viewers overzoom beyond it")
+	fs.IntVar(&cfg.GridAuto, "grid-auto", 0, "segment each output into about this many grid cells shaped to be roughly square over its bounds, instead of 8x4; 0 keeps 8x4")
+	fs.StringVar(&cfg.GridDebug, "grid-debug", "", "path to write each output's segment bounding boxes and feature counts as geojson")
+	fs.StringVar(&cfg.StatsOut, "stats-json", "", "path to write run statistics as json")
+	fs.IntVar(&cfg.MaxFeatures, "max-features", 100000, "fail if an output would contain more than this many features; 0 disables")
+	fs.IntVar(&cfg.TravelwaysMinFeatures, "min-features-travelways", 0, "fail if the travelways output would contain fewer than this many features")
+	fs.IntVar(&cfg.BikeMinFeatures, "min-features-bike", 0, "fail if the cycling output would contain fewer than this many features")
+	fs.StringVar(&cfg.Tiers, "tiers", "", "comma-separated coordinate decimal places (1-6), such as 4,5; each output is also written at each as name.pN.bin for clients to pick by zoom")
+	fs.StringVar(&cfg.Format, "format", formatBin, "output format: bin, or json for a plain array of {title, priority, source, coords} written to .json paths by default")
+	fs.IntVar(&cfg.TravelwaysPrecision, "precision-travelways", 0, "decimal places to store travelways coordinates at, recorded in the header; 0 keeps 6 (2 with -mercator)")
+	fs.IntVar(&cfg.BikePrecision, "precision-bike", 0, "decimal places to store bike infrastructure coordinates at, recorded in the header; 0 keeps 6 (2 with -mercator)")
+	fs.BoolVar(&cfg.CompactCoords, "compact-coords", false, "store coordinates at ~10m precision where deltas fit in int16")
+	fs.StringVar(&cfg.Labels, "labels", "", "path to json object mapping priorities to {en, fr} labels to record for viewers")
+	fs.StringVar(&cfg.EndTime, "end-time", "", "RFC 3339 weather event end time to record so readers can compute each priority's clearing deadline")
+	fs.BoolVar(&cfg.PastDueOnly, "past-due-only", false, "keep only features whose -end-time clearing deadline is before now, for a past due layer")
+	fs.BoolVar(&cfg.DeadlineFields, "deadline-fields", false, "with -end-time, store each feature's whole hours until its clearing deadline as of now, negative once it has passed")
+	fs.StringVar(&cfg.Now, "now", "", "RFC 3339 time to use as now for -past-due-only and -deadline-fields instead of the current time")
+	fs.StringVar(&cfg.Timelines, "timelines", "", "comma-separated priority=duration clearing timelines recorded with -end-time, each overriding the default 1=12h,2=18h,3=36h")
+	fs.StringVar(&cfg.Styles, "styles", "", "path to json object mapping priorities to {color, weight} styles to record for viewers")
+	fs.BoolVar(&cfg.Timestamp, "timestamp", false, "record the generation time in the header for staleness checks")
+	fs.BoolVar(&cfg.VerifyOutput, "verify-output", true, "decode each output before writing it and fail if its feature count differs from what was encoded")
+	fs.BoolVar(&cfg.Verify, "verify", false, "as -verify-output, and also fail if any feature falls outside its segment bounding box")
+	fs.BoolVar(&cfg.Mercator, "mercator", false, "store coordinates as Web Mercator (EPSG:3857) metres instead of lon/lat")
+	fs.BoolVar(&cfg.NoFlatten, "no-flatten", false, "fail on MultiLineString travelways instead of joining their parts")
+	fs.StringVar(&cfg.Only, "only", onlyAll, "which outputs to build: travelways, bike or all")
+	fs.BoolVar(&cfg.Strict, "strict", false, "fail the run on any warning, such as skipped features or priority overrides that match no title")
+	fs.BoolVar(&cfg.SuffixDuplicateIDs, "suffix-duplicate-ids", false, "allow input features whose stable IDs collide, suffixing the repeated IDs instead of failing")
+	fs.BoolVar(&cfg.SplitPartial, "split-partial", false, "split matched bike lines where they leave max-match-meters, using WINT_LOS for the unmatched parts")
+	fs.Float64Var(&cfg.Sample, "sample", 0, "keep each feature with this probability (0-1) for lightweight fixtures; 0 keeps all")
+	fs.Uint64Var(&cfg.Seed, "seed", 1, "random seed for -sample")
+	fs.StringVar(&cfg.PriorityOverrides, "priority-overrides", "", "path to json object mapping titles to priorities (1-3) that replace the dataset's")
+	fs.StringVar(&cfg.ClipPolygon, "clip-polygon", "", "path to geojson polygon; features whose centroid falls outside it are dropped")
+	fs.Parse(args)
+
+	if configPath != "" {
+		if err := applyConfigFile(fs, configPath); err != nil {
+			return runConfig{}, fmt.Errorf("config %s: %w", configPath, err)
+		}
+	}
+	// -verify-output defaults on but only applies to the binary format, so
+	// JSON output turns it off unless it was asked for, which run rejects.
+	if cfg.Format == formatJSON {
+		verifyOutputSet := false
+		fs.Visit(func(f *flag.Flag) { verifyOutputSet = verifyOutputSet || f.Name == "verify-output" })
+		if !verifyOutputSet {
+			cfg.VerifyOutput = false
+		}
+	}
+	return cfg, nil
+}
 
-	if err := run(ctx, cfg); err != nil {
-		log.Fatal(err)
+// applyConfigFile sets fs flags from the file at path, a JSON object of
+// flag names to values, skipping flags already set on the command line.
+// Unknown names are rejected.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".json" {
+		return fmt.Errorf("unsupported config extension %q: want .json", ext)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values, err := parseJSONConfig(data)
+	if err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("option %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// parseJSONConfig reads a JSON object of option values. Arrays are joined
+// with commas for list options like tiers.
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw map[string]any
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		s, err := configValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("option %q: %w", name, err)
+		}
+		values[name] = s
+	}
+	return values, nil
+}
+
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			s, err := configValue(e)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ","), nil
 	}
+	return "", fmt.Errorf("unsupported value %v", v)
 }
 
 type runConfig struct {
-	TravelwaysFile   string
-	BikeFile         string
-	IceFile          string
-	SaveDownloadsDir string
-	TravelwaysOut    string
-	BikeOut          string
-	MaxMatchMeters   float64
-	MaxAngleDeg      float64
-	MinRunMeters     float64
-	SimplifyMeters   float64
-	DebugOut         string
+	TravelwaysFile        string
+	BikeFile              string
+	IceFile               string
+	SaveDownloadsDir      string
+	Quiet                 bool
+	PrettyLog             bool
+	Offline               bool
+	TravelwaysOut         string
+	BikeOut               string
+	MaxMatchMeters        float64
+	TravelwayBufferMeters float64
+	NameMatchBiasMeters   float64
+	MaxAngleDeg           float64
+	MinRunMeters          float64
+	SimplifyMeters        float64
+	MaxFeatures           int
+	TravelwaysMinFeatures int
+	BikeMinFeatures       int
+	DebugOut              string
+	UnmatchedOut          string
+	TraceTitle            string
+	DirectionProperty     string
+	CoincidentMeters      float64
+	SnapEndpoints         bool
+	GeoJSONOut            string
+	PMTiles               string
+	PMTilesZoom           int
+	GridDebug             string
+	GridAuto              int
+	Styles                string
+	Labels                string
+	EndTime               string
+	PastDueOnly           bool
+	DeadlineFields        bool
+	Now                   string
+	Timelines             string
+	Tiers                 string
+	StatsOut              string
+	ClipPolygon           string
+	PriorityOverrides     string
+	Sample                float64
+	Seed                  uint64
+	Format                string
+	TravelwaysPrecision   int
+	BikePrecision         int
+	CompactCoords         bool
+	Mercator              bool
+	Timestamp             bool
+	Verify                bool
+	VerifyOutput          bool
+	NoFlatten             bool
+	SplitPartial          bool
+	SuffixDuplicateIDs    bool
+	Strict                bool
+	Only                  string
+	HTTPClient            *http.Client
+	// Output receives the files run writes. It defaults to the local
+	// filesystem.
+	Output OutputSink
 }
 
-func run(ctx context.Context, cfg runConfig) error {
-	travelwaysFC, err := loadFeatureCollection(ctx, cfg.TravelwaysFile, cfg.SaveDownloadsDir, "travelways.geojson", activeTravelwaysItemID)
+// OutputSink creates the files run writes, such as the features bins, so
+// they can go straight to object storage instead of local disk.
+type OutputSink interface {
+	Create(name string) (io.WriteCloser, error)
+}
+
+// fileSink is the default OutputSink, writing to the local filesystem.
+type fileSink struct{}
+
+func (fileSink) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+// writeOutput writes data to name in sink.
+func writeOutput(sink OutputSink, name string, data []byte) error {
+	w, err := sink.Create(name)
 	if err != nil {
 		return err
 	}
-	bikeFC, err := loadFeatureCollection(ctx, cfg.BikeFile, cfg.SaveDownloadsDir, "bike.geojson", bikeInfraItemID)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("closing %s: %w", name, err)
+	}
+	return nil
+}
+
+// recordingSink passes files through to sink, noting each one's name and
+// size for the run summary.
+type recordingSink struct {
+	sink  OutputSink
+	files []writtenFile
+}
+
+type writtenFile struct {
+	name  string
+	bytes int
+}
+
+func (s *recordingSink) Create(name string) (io.WriteCloser, error) {
+	w, err := s.sink.Create(name)
 	if err != nil {
+		return nil, err
+	}
+	return &recordingFile{w: w, sink: s, name: name}, nil
+}
+
+type recordingFile struct {
+	w    io.WriteCloser
+	sink *recordingSink
+	name string
+	n    int
+}
+
+func (f *recordingFile) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.n += n
+	return n, err
+}
+
+func (f *recordingFile) Close() error {
+	if err := f.w.Close(); err != nil {
 		return err
 	}
-	iceFC, err := loadFeatureCollection(ctx, cfg.IceFile, cfg.SaveDownloadsDir, "ice.geojson", iceRoutesItemID)
+	f.sink.files = append(f.sink.files, writtenFile{name: f.name, bytes: f.n})
+	return nil
+}
+
+// runSummary is what -pretty-log reports once a run finishes.
+type runSummary struct {
+	datasets []datasetSummary
+	files    []writtenFile
+	matches  *bikeMatchStats
+	warnings int
+	elapsed  time.Duration
+}
+
+// datasetSummary counts a dataset's source features and, if it has an
+// output, the features written; out is -1 otherwise.
+type datasetSummary struct {
+	name    string
+	in, out int
+}
+
+func writeRunSummary(w io.Writer, s runSummary) {
+	fmt.Fprintln(w, "summary:")
+	for _, d := range s.datasets {
+		if d.out < 0 {
+			fmt.Fprintf(w, "  %-12s %6d in\n", d.name, d.in)
+			continue
+		}
+		fmt.Fprintf(w, "  %-12s %6d in %6d out\n", d.name, d.in, d.out)
+	}
+	for _, f := range s.files {
+		fmt.Fprintf(w, "  wrote %s (%d bytes)\n", f.name, f.bytes)
+	}
+	if m := s.matches; m != nil {
+		fmt.Fprintf(w, "  bike matches travelways=%d ice=%d bike=%d fallback=%d skipped=%d\n", m.Travelways, m.Ice, m.Bike, m.Fallback, m.Skipped)
+	}
+	fmt.Fprintf(w, "  warnings %d\n", s.warnings)
+	fmt.Fprintf(w, "  elapsed %s\n", s.elapsed.Round(time.Millisecond))
+}
+
+func run(ctx context.Context, cfg runConfig) error {
+	var writeTravelways, buildBike bool
+	switch cfg.Only {
+	case "", onlyAll:
+		writeTravelways, buildBike = true, true
+	case onlyTravelways:
+		writeTravelways = true
+	case onlyBike:
+		buildBike = true
+	default:
+		return fmt.Errorf("invalid -only %q: want %s, %s or %s", cfg.Only, onlyTravelways, onlyBike, onlyAll)
+	}
+	switch cfg.Format {
+	case "", formatBin:
+	case formatJSON:
+		if cfg.Mercator {
+			return fmt.Errorf("-format %s writes lon/lat and can't be used with -mercator", formatJSON)
+		}
+		if cfg.GridDebug != "" {
+			return fmt.Errorf("-grid-debug needs -format %s", formatBin)
+		}
+		if cfg.CompactCoords {
+			return fmt.Errorf("-compact-coords needs -format %s", formatBin)
+		}
+		if cfg.Verify || cfg.VerifyOutput {
+			return fmt.Errorf("-verify and -verify-output decode the binary format and need -format %s", formatBin)
+		}
+		if cfg.TravelwaysOut == defaultTravelwaysOut {
+			cfg.TravelwaysOut = strings.TrimSuffix(defaultTravelwaysOut, ".bin") + ".json"
+		}
+		if cfg.BikeOut == defaultBikeOut {
+			cfg.BikeOut = strings.TrimSuffix(defaultBikeOut, ".bin") + ".json"
+		}
+	default:
+		return fmt.Errorf("invalid -format %q: want %s or %s", cfg.Format, formatBin, formatJSON)
+	}
+	if cfg.Sample < 0 || cfg.Sample > 1 {
+		return fmt.Errorf("invalid -sample %v: want a rate between 0 and 1", cfg.Sample)
+	}
+	if cfg.MaxAngleDeg < 0 {
+		return fmt.Errorf("invalid -max-angle-deg %v: want 0 or more degrees, 0 for no angle limit", cfg.MaxAngleDeg)
+	}
+	if cfg.GridAuto < 0 || cfg.GridAuto > maxGridCells {
+		return fmt.Errorf("invalid -grid-auto %d: want 0 to %d cells", cfg.GridAuto, maxGridCells)
+	}
+	maxPrecision := maxPrecisionDegrees
+	if cfg.Mercator {
+		maxPrecision = maxPrecisionMercator
+	}
+	for _, p := range []struct {
+		flag  string
+		value int
+	}{{"-precision-travelways", cfg.TravelwaysPrecision}, {"-precision-bike", cfg.BikePrecision}} {
+		if p.value < 0 || p.value > maxPrecision {
+			return fmt.Errorf("invalid %s %d: want 0 to %d decimal places", p.flag, p.value, maxPrecision)
+		}
+	}
+
+	var overrides map[string]uint8
+	if cfg.PriorityOverrides != "" {
+		var err error
+		overrides, err = loadPriorityOverrides(cfg.PriorityOverrides)
+		if err != nil {
+			return fmt.Errorf("load priority overrides: %w", err)
+		}
+	}
+
+	start := time.Now()
+	stats := runStats{Outputs: make(map[string]encodeStats)}
+	var warnings []string
+	warnf := func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		log.Printf("warning: %s", msg)
+		warnings = append(warnings, msg)
+	}
+
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	// Travelways take title casing from the bike dataset, so it's loaded
+	// even when only they're written; only the cycling output needs ice.
+	sources := []featureSource{
+		{path: cfg.TravelwaysFile, saveName: "travelways.geojson", itemID: activeTravelwaysItemID},
+		{path: cfg.BikeFile, saveName: "bike.geojson", itemID: bikeInfraItemID},
+	}
+	if buildBike {
+		sources = append(sources, featureSource{path: cfg.IceFile, saveName: "ice.geojson", itemID: iceRoutesItemID})
+	}
+	if cfg.Offline {
+		for _, src := range sources {
+			if src.path == "" {
+				return fmt.Errorf("-offline: no file given for %s", strings.TrimSuffix(src.saveName, ".geojson"))
+			}
+		}
+	}
+	fcs, err := loadFeatureCollections(ctx, client, downloadLogger(cfg.Quiet), cfg.SaveDownloadsDir, sources)
 	if err != nil {
 		return err
 	}
+	travelwaysFC, bikeFC := fcs[0], fcs[1]
+	var iceFC *geojson.FeatureCollection
+	if buildBike {
+		iceFC = fcs[2]
+	}
+	// Ice routes aren't written with stable IDs, so only travelways and bike
+	// lines can collide.
+	for _, src := range []struct {
+		name     string
+		fc       *geojson.FeatureCollection
+		stableID func(geojson.Properties, int) string
+	}{
+		{"travelways.geojson", travelwaysFC, travelwayStableID},
+		{"bike.geojson", bikeFC, bikeStableID},
+	} {
+		if src.fc == nil {
+			continue
+		}
+		n := countDuplicateStableIDs(src.fc, src.stableID)
+		if n == 0 {
+			continue
+		}
+		warnf("%s: %d features share a stable ID with an earlier feature", src.name, n)
+		if !cfg.SuffixDuplicateIDs {
+			return fmt.Errorf("%s: %d features have duplicate stable IDs; pass -suffix-duplicate-ids to disambiguate them", src.name, n)
+		}
+	}
+	stats.Timing.LoadSeconds = time.Since(start).Seconds()
 
 	var debugEntries []debugEntry
 	titleNormalizer := newTitleNormalizer()
@@ -101,57 +550,381 @@ func run(ctx context.Context, cfg runConfig) error {
 		return err
 	}
 
+	var bikeFeatures []lineFeature
+	if buildBike {
+		matchStart := time.Now()
+		var matches bikeMatchStats
+		bikeFeatures, matches, err = matchBikeLines(cfg, travelwaysFC, bikeFC, iceFC, titleNormalizer, &debugEntries)
+		if err != nil {
+			return err
+		}
+		stats.Timing.MatchSeconds = time.Since(matchStart).Seconds()
+		stats.BikeMatches = &matches
+	}
+
+	if cfg.SuffixDuplicateIDs {
+		if n := suffixDuplicateStableIDs(travelwaysFeatures); n > 0 {
+			log.Printf("suffixed %d duplicate travelway stable IDs", n)
+		}
+		if n := suffixDuplicateStableIDs(bikeFeatures); n > 0 {
+			log.Printf("suffixed %d duplicate bike stable IDs", n)
+		}
+	}
+
+	for _, w := range skipWarnings(debugEntries) {
+		warnf("%s", w)
+	}
+
+	if len(overrides) > 0 {
+		matched := make(map[string]bool)
+		if writeTravelways {
+			applyPriorityOverrides(travelwaysFeatures, overrides, matched)
+		}
+		if buildBike {
+			applyPriorityOverrides(bikeFeatures, overrides, matched)
+		}
+		var unmatched []string
+		for title := range overrides {
+			if !matched[title] {
+				unmatched = append(unmatched, title)
+			}
+		}
+		sort.Strings(unmatched)
+		for _, title := range unmatched {
+			warnf("priority override %q: no features have this title", title)
+		}
+	}
+	if cfg.Strict && len(warnings) > 0 {
+		return fmt.Errorf("-strict: %d warnings, first: %s", len(warnings), warnings[0])
+	}
+
+	if cfg.ClipPolygon != "" {
+		clip, err := loadClipPolygon(cfg.ClipPolygon)
+		if err != nil {
+			return fmt.Errorf("load clip polygon: %w", err)
+		}
+		var clipped int
+		if writeTravelways {
+			travelwaysFeatures, clipped = clipFeatures(travelwaysFeatures, clip)
+			log.Printf("clip travelways: dropped %d features outside %s", clipped, cfg.ClipPolygon)
+		}
+		if buildBike {
+			bikeFeatures, clipped = clipFeatures(bikeFeatures, clip)
+			log.Printf("clip bike lines: dropped %d features outside %s", clipped, cfg.ClipPolygon)
+		}
+	}
+
+	if cfg.Sample > 0 && cfg.Sample < 1 {
+		if writeTravelways {
+			travelwaysFeatures = sampleFeatures(travelwaysFeatures, cfg.Sample, cfg.Seed)
+			log.Printf("sample travelways: kept %d features at rate %v", len(travelwaysFeatures), cfg.Sample)
+		}
+		if buildBike {
+			bikeFeatures = sampleFeatures(bikeFeatures, cfg.Sample, cfg.Seed)
+			log.Printf("sample bike lines: kept %d features at rate %v", len(bikeFeatures), cfg.Sample)
+		}
+	}
+
+	encodeOpts := encodeOptions{CompactCoords: cfg.CompactCoords, NoFlatten: cfg.NoFlatten, Mercator: cfg.Mercator, MaxFeatures: cfg.MaxFeatures, Verify: cfg.Verify, VerifyOutput: cfg.VerifyOutput, GridCells: cfg.GridAuto, JSON: cfg.Format == formatJSON}
+	if cfg.Styles != "" {
+		styles, err := loadStyles(cfg.Styles)
+		if err != nil {
+			return fmt.Errorf("load styles: %w", err)
+		}
+		encodeOpts.Styles = styles
+	}
+	if cfg.Labels != "" {
+		labels, err := loadLabels(cfg.Labels)
+		if err != nil {
+			return fmt.Errorf("load labels: %w", err)
+		}
+		encodeOpts.Labels = labels
+	}
+	if cfg.EndTime != "" {
+		endTime, err := time.Parse(time.RFC3339, cfg.EndTime)
+		if err != nil {
+			return fmt.Errorf("parse end time: %w", err)
+		}
+		priorityTimelines := timelines.Default()
+		if cfg.Timelines != "" {
+			if priorityTimelines, err = timelines.Parse(cfg.Timelines); err != nil {
+				return fmt.Errorf("parse timelines: %w", err)
+			}
+		}
+		encodeOpts.EndTime = endTime
+		encodeOpts.Timelines = priorityTimelines
+	} else if cfg.Timelines != "" {
+		return fmt.Errorf("-timelines requires -end-time")
+	}
+	now := time.Now()
+	if cfg.Now != "" {
+		if !cfg.PastDueOnly && !cfg.DeadlineFields {
+			return fmt.Errorf("-now requires -past-due-only or -deadline-fields")
+		}
+		var err error
+		if now, err = time.Parse(time.RFC3339, cfg.Now); err != nil {
+			return fmt.Errorf("parse now: %w", err)
+		}
+	}
+	if cfg.PastDueOnly {
+		if cfg.EndTime == "" {
+			return fmt.Errorf("-past-due-only requires -end-time")
+		}
+		if writeTravelways {
+			before := len(travelwaysFeatures)
+			travelwaysFeatures = pastDueFeatures(travelwaysFeatures, encodeOpts.EndTime, encodeOpts.Timelines, now)
+			log.Printf("past due travelways: kept %d of %d features", len(travelwaysFeatures), before)
+		}
+		if buildBike {
+			before := len(bikeFeatures)
+			bikeFeatures = pastDueFeatures(bikeFeatures, encodeOpts.EndTime, encodeOpts.Timelines, now)
+			log.Printf("past due bike lines: kept %d of %d features", len(bikeFeatures), before)
+		}
+		// Everything being cleared on time is a legitimate result.
+		encodeOpts.AllowEmpty = true
+	}
+	if cfg.DeadlineFields {
+		if cfg.EndTime == "" {
+			return fmt.Errorf("-deadline-fields requires -end-time")
+		}
+		setHoursRemaining(travelwaysFeatures, encodeOpts.EndTime, encodeOpts.Timelines, now)
+		setHoursRemaining(bikeFeatures, encodeOpts.EndTime, encodeOpts.Timelines, now)
+		encodeOpts.HoursRemaining = true
+	}
+	if cfg.Timestamp {
+		encodeOpts.GeneratedAt = time.Now()
+	}
+	var tiers []int
+	if cfg.Tiers != "" {
+		var err error
+		if tiers, err = parseTiers(cfg.Tiers); err != nil {
+			return fmt.Errorf("parse tiers: %w", err)
+		}
+	}
+	travelwaysTierMax := tierMaxDecimals(cfg.TravelwaysPrecision, cfg.Mercator)
+	bikeTierMax := tierMaxDecimals(cfg.BikePrecision, cfg.Mercator)
+	for _, decimals := range tiers {
+		if writeTravelways && decimals > travelwaysTierMax {
+			return fmt.Errorf("invalid tier %d: the travelways output only stores %d decimal places", decimals, travelwaysTierMax)
+		}
+		if buildBike && decimals > bikeTierMax {
+			return fmt.Errorf("invalid tier %d: the cycling output only stores %d decimal places", decimals, bikeTierMax)
+		}
+	}
+	out := cfg.Output
+	if out == nil {
+		out = fileSink{}
+	}
+	sink := &recordingSink{sink: out}
+	encodeStart := time.Now()
+	var travelwaysBin, bikeBin []byte
+	var travelwaysSegments, bikeSegments []string
+	if writeTravelways {
+		travelwaysOpts := encodeOpts
+		travelwaysOpts.Precision = cfg.TravelwaysPrecision
+		travelwaysOpts.MinFeatures = cfg.TravelwaysMinFeatures
+		if cfg.GeoJSONOut != "" {
+			travelwaysSegments = make([]string, len(travelwaysFeatures))
+			travelwaysOpts.Assigned = segmentLabeler(travelwaysSegments)
+		}
+		data, encStats, err := writeFeaturesBin(sink, encodeFeatures, cfg.TravelwaysOut, travelwaysFeatures, cfg.SimplifyMeters, travelwaysOpts)
+		if err != nil {
+			return err
+		}
+		travelwaysBin = data
+		// Segments are labeled from the full output, not its tiers.
+		travelwaysOpts.Assigned = nil
+		stats.Outputs["travelways"] = encStats
+		for _, decimals := range tiers {
+			path := tierPath(cfg.TravelwaysOut, decimals)
+			_, encStats, err := writeFeaturesBin(sink, encodeFeatures, path, roundFeatures(travelwaysFeatures, decimals), max(cfg.SimplifyMeters, tierToleranceMeters(decimals, travelwaysTierMax)), travelwaysOpts)
+			if err != nil {
+				return err
+			}
+			stats.Outputs[fmt.Sprintf("travelways.p%d", decimals)] = encStats
+		}
+	}
+	if buildBike {
+		bikeOpts := encodeOpts
+		bikeOpts.BikeTypes = true
+		bikeOpts.Precision = cfg.BikePrecision
+		bikeOpts.MinFeatures = cfg.BikeMinFeatures
+		if cfg.GeoJSONOut != "" {
+			bikeSegments = make([]string, len(bikeFeatures))
+			bikeOpts.Assigned = segmentLabeler(bikeSegments)
+		}
+		// A season can legitimately have no cleared bike routes.
+		bikeOpts.AllowEmpty = true
+		if len(bikeFeatures) == 0 {
+			log.Printf("cycling: no features matched, writing an empty %s", cfg.BikeOut)
+		}
+		data, encStats, err := writeFeaturesBin(sink, encodeFeatures, cfg.BikeOut, bikeFeatures, cfg.SimplifyMeters, bikeOpts)
+		if err != nil {
+			return err
+		}
+		bikeBin = data
+		bikeOpts.Assigned = nil
+		stats.Outputs["cycling"] = encStats
+		for _, decimals := range tiers {
+			path := tierPath(cfg.BikeOut, decimals)
+			_, encStats, err := writeFeaturesBin(sink, encodeFeatures, path, roundFeatures(bikeFeatures, decimals), max(cfg.SimplifyMeters, tierToleranceMeters(decimals, bikeTierMax)), bikeOpts)
+			if err != nil {
+				return err
+			}
+			stats.Outputs[fmt.Sprintf("cycling.p%d", decimals)] = encStats
+		}
+	}
+	stats.Timing.EncodeSeconds = time.Since(encodeStart).Seconds()
+	if writeTravelways {
+		logLengthByPriority("travelways", travelwaysFeatures)
+	}
+	if buildBike {
+		logLengthByPriority("cycling", bikeFeatures)
+	}
+	if cfg.GeoJSONOut != "" {
+		var outputs []geojsonOutput
+		if writeTravelways {
+			outputs = append(outputs, geojsonOutput{name: "travelways", features: travelwaysFeatures, segments: travelwaysSegments, hoursRemaining: cfg.DeadlineFields})
+		}
+		if buildBike {
+			outputs = append(outputs, geojsonOutput{name: "cycling", features: bikeFeatures, segments: bikeSegments, hoursRemaining: cfg.DeadlineFields})
+		}
+		if err := writeGeoJSONOut(sink, cfg.GeoJSONOut, outputs); err != nil {
+			return err
+		}
+	}
+	if cfg.PMTiles != "" {
+		var outputs []geojsonOutput
+		if writeTravelways {
+			outputs = append(outputs, geojsonOutput{name: "travelways", features: travelwaysFeatures})
+		}
+		if buildBike {
+			outputs = append(outputs, geojsonOutput{name: "cycling", features: bikeFeatures})
+		}
+		if err := writePMTiles(sink, cfg.PMTiles, cfg.PMTilesZoom, outputs); err != nil {
+			return fmt.Errorf("writing pmtiles: %w", err)
+		}
+	}
+	if cfg.GridDebug != "" {
+		var outputs []gridDebugOutput
+		if writeTravelways {
+			outputs = append(outputs, gridDebugOutput{name: "travelways", data: travelwaysBin})
+		}
+		if buildBike {
+			outputs = append(outputs, gridDebugOutput{name: "cycling", data: bikeBin})
+		}
+		if err := writeGridDebug(sink, cfg.GridDebug, outputs); err != nil {
+			return fmt.Errorf("writing grid debug: %w", err)
+		}
+	}
+	if cfg.DebugOut != "" {
+		debugCfg := debugConfig{
+			MaxMatchMeters:        cfg.MaxMatchMeters,
+			MaxAngleDeg:           cfg.MaxAngleDeg,
+			MinRunMeters:          cfg.MinRunMeters,
+			SimplifyMeters:        cfg.SimplifyMeters,
+			SplitPartial:          cfg.SplitPartial,
+			TravelwayBufferMeters: cfg.TravelwayBufferMeters,
+			NameMatchBiasMeters:   cfg.NameMatchBiasMeters,
+		}
+		if err := writeDebug(sink, cfg.DebugOut, debugEntries, debugCfg); err != nil {
+			return err
+		}
+	}
+	if cfg.UnmatchedOut != "" && buildBike {
+		if err := writeUnmatched(sink, cfg.UnmatchedOut, debugEntries); err != nil {
+			return fmt.Errorf("writing unmatched: %w", err)
+		}
+	}
+	if cfg.StatsOut != "" {
+		stats.Timing.TotalSeconds = time.Since(start).Seconds()
+		b, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeOutput(sink, cfg.StatsOut, b); err != nil {
+			return err
+		}
+	}
+	if cfg.PrettyLog && !cfg.Quiet {
+		summary := runSummary{
+			datasets: []datasetSummary{{name: "travelways", in: len(travelwaysFC.Features), out: -1}},
+			files:    sink.files,
+			matches:  stats.BikeMatches,
+			warnings: len(warnings),
+			elapsed:  time.Since(start),
+		}
+		if writeTravelways {
+			summary.datasets[0].out = stats.Outputs["travelways"].Features
+		}
+		if buildBike {
+			summary.datasets = append(summary.datasets,
+				datasetSummary{name: "bike", in: len(bikeFC.Features), out: stats.Outputs["cycling"].Features},
+				datasetSummary{name: "ice", in: len(iceFC.Features), out: -1},
+			)
+		}
+		writeRunSummary(log.Writer(), summary)
+	}
+	return nil
+}
+
+// matchBikeLines builds the cycling features, taking priorities from nearby
+// travelways and ice routes.
+func matchBikeLines(cfg runConfig, travelwaysFC, bikeFC, iceFC *geojson.FeatureCollection, titles *titleNormalizer, debugEntries *[]debugEntry) ([]lineFeature, bikeMatchStats, error) {
 	priorityTravelways, priorityTravelwayRoutes, err := travelwayPriorityLines(travelwaysFC)
 	if err != nil {
-		return err
+		return nil, bikeMatchStats{}, err
 	}
 	travelwaysIndex, err := newSpatialIndex(priorityTravelways, 48, 24)
 	if err != nil {
-		return err
+		return nil, bikeMatchStats{}, err
 	}
-	travelwayTitles := travelwayTitleMap(travelwaysFeatures)
+	travelwaysIndex.bufferMeters = cfg.TravelwayBufferMeters
+	travelwaysIndex.nameBiasMeters = cfg.NameMatchBiasMeters
 	iceLines, err := iceRouteLines(iceFC)
 	if err != nil {
-		return err
+		return nil, bikeMatchStats{}, err
 	}
 	iceRoutes := iceRouteMap(iceFC)
 	iceIndex, err := newSpatialIndex(iceLines, 48, 24)
 	if err != nil {
-		return err
+		return nil, bikeMatchStats{}, err
 	}
 
-	nameTravelways, nameTravelwayTitles, err := travelwayNameLines(travelwaysFC, titleNormalizer)
+	nameTravelways, nameTravelwayTitles, err := travelwayNameLines(travelwaysFC, titles)
 	if err != nil {
-		return err
+		return nil, bikeMatchStats{}, err
 	}
 	nameTravelwaysIndex, err := newSpatialIndex(nameTravelways, 48, 24)
 	if err != nil {
-		return err
+		return nil, bikeMatchStats{}, err
 	}
 
-	bikeFeatures, err := bikeLines(bikeFC, titleNormalizer, travelwaysIndex, nameTravelwaysIndex, travelwayTitles, nameTravelwayTitles, priorityTravelwayRoutes, iceRoutes, iceIndex, cfg.MaxMatchMeters, cfg.MaxAngleDeg, cfg.MinRunMeters, &debugEntries)
-	if err != nil {
-		return err
+	sources := bikeMatchSources{
+		travelways:          travelwaysIndex,
+		nameTravelways:      nameTravelwaysIndex,
+		ice:                 iceIndex,
+		nameTravelwayTitles: nameTravelwayTitles,
+		travelwayRoutes:     priorityTravelwayRoutes,
+		iceRoutes:           iceRoutes,
 	}
+	return bikeLines(bikeFC, titles, sources, cfg, debugEntries)
+}
 
-	if err := writeFeaturesBin(cfg.TravelwaysOut, travelwaysFeatures, cfg.SimplifyMeters); err != nil {
-		return err
-	}
-	if err := writeFeaturesBin(cfg.BikeOut, bikeFeatures, cfg.SimplifyMeters); err != nil {
-		return err
-	}
-	if cfg.DebugOut != "" {
-		debugCfg := debugConfig{
-			MaxMatchMeters: cfg.MaxMatchMeters,
-			MaxAngleDeg:    cfg.MaxAngleDeg,
-			MinRunMeters:   cfg.MinRunMeters,
-			SimplifyMeters: cfg.SimplifyMeters,
-		}
-		if err := writeDebug(cfg.DebugOut, debugEntries, debugCfg); err != nil {
-			return err
-		}
-	}
-	return nil
+// bikeMatchSources are the indexes and lookups bikeLines matches bike lines
+// against.
+type bikeMatchSources struct {
+	// travelways indexes the plowed travelways by priority.
+	travelways *spatialIndex
+	// nameTravelways indexes named travelways for titling bike lines named
+	// only by their type, with their titles by OBJECTID.
+	nameTravelways      *spatialIndex
+	nameTravelwayTitles map[int]string
+	ice                 *spatialIndex
+	// travelwayRoutes and iceRoutes give each matched feature's winter
+	// maintenance route by OBJECTID.
+	travelwayRoutes map[int]routeInfo
+	iceRoutes       map[int]routeInfo
 }
 
 type lineFeature struct {
@@ -163,7 +936,18 @@ type lineFeature struct {
 	objectID      int
 	wintMaint     string
 	wintRoute     string
-	routeID       uint16
+	bikeType      uint8
+	// serviced is when the feature was last plowed as a Unix time, or 0 if
+	// unknown.
+	serviced int64
+	// direction is which way a cycling feature runs relative to traffic.
+	direction uint8
+	// hoursRemaining is the whole hours until the feature's clearing
+	// deadline with -deadline-fields, rounded down so it's negative once
+	// the deadline has passed.
+	hoursRemaining int16
+	// flattened is set when coords were joined from a MultiLineString.
+	flattened bool
 }
 
 type debugEntry struct {
@@ -190,13 +974,160 @@ type debugEntry struct {
 }
 
 type debugConfig struct {
-	MaxMatchMeters float64 `json:"max_match_meters"`
-	MaxAngleDeg    float64 `json:"max_angle_deg"`
-	MinRunMeters   float64 `json:"min_run_meters"`
-	SimplifyMeters float64 `json:"simplify_meters"`
+	MaxMatchMeters        float64 `json:"max_match_meters"`
+	MaxAngleDeg           float64 `json:"max_angle_deg"`
+	MinRunMeters          float64 `json:"min_run_meters"`
+	SimplifyMeters        float64 `json:"simplify_meters"`
+	SplitPartial          bool    `json:"split_partial,omitempty"`
+	TravelwayBufferMeters float64 `json:"travelway_buffer_meters,omitempty"`
+	NameMatchBiasMeters   float64 `json:"name_match_bias_meters,omitempty"`
 }
 
-func writeFeaturesBin(path string, features []lineFeature, simplifyMeters float64) error {
+// loadPriorityOverrides reads a JSON object mapping titles to priorities.
+// Titles are matched case-insensitively, like titleNormalizer.
+func loadPriorityOverrides(path string) (map[string]uint8, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]int
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	overrides := make(map[string]uint8, len(raw))
+	for title, priority := range raw {
+		if priority < 1 || priority > 3 {
+			return nil, fmt.Errorf("invalid priority %d for %q: want 1, 2 or 3", priority, title)
+		}
+		key := strings.ToLower(strings.TrimSpace(title))
+		if key == "" {
+			return nil, fmt.Errorf("empty title with priority %d", priority)
+		}
+		overrides[key] = uint8(priority)
+	}
+	return overrides, nil
+}
+
+// applyPriorityOverrides sets the priority of features whose title has an
+// override, logging each title that changed features. Override keys that
+// match a feature are added to matched.
+func applyPriorityOverrides(features []lineFeature, overrides map[string]uint8, matched map[string]bool) {
+	changed := make(map[string]int)
+	for i := range features {
+		key := strings.ToLower(features[i].title)
+		priority, ok := overrides[key]
+		if ok {
+			matched[key] = true
+		}
+		if !ok || features[i].priority == priority {
+			continue
+		}
+		features[i].priority = priority
+		changed[features[i].title]++
+	}
+	titles := make([]string, 0, len(changed))
+	for title := range changed {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	for _, title := range titles {
+		log.Printf("priority override %q: set %d features to priority %d", title, changed[title], overrides[strings.ToLower(title)])
+	}
+}
+
+// loadClipPolygon reads the polygons from a GeoJSON geometry, feature or
+// feature collection.
+func loadClipPolygon(path string) (orb.MultiPolygon, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var probe struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+	var geoms []orb.Geometry
+	switch probe.Type {
+	case "FeatureCollection":
+		fc, err := geojson.UnmarshalFeatureCollection(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fc.Features {
+			geoms = append(geoms, f.Geometry)
+		}
+	case "Feature":
+		f, err := geojson.UnmarshalFeature(data)
+		if err != nil {
+			return nil, err
+		}
+		geoms = append(geoms, f.Geometry)
+	default:
+		g, err := geojson.UnmarshalGeometry(data)
+		if err != nil {
+			return nil, err
+		}
+		geoms = append(geoms, g.Geometry())
+	}
+
+	var mp orb.MultiPolygon
+	for _, g := range geoms {
+		switch g := g.(type) {
+		case orb.Polygon:
+			mp = append(mp, g)
+		case orb.MultiPolygon:
+			mp = append(mp, g...)
+		default:
+			return nil, fmt.Errorf("unsupported clip geometry type %T", g)
+		}
+	}
+	if len(mp) == 0 {
+		return nil, fmt.Errorf("no polygons in %s", path)
+	}
+	return mp, nil
+}
+
+// clipFeatures drops features whose centroid falls outside clip and returns
+// the remaining features along with how many were dropped. Geometry-less
+// features have no centroid to test and are kept.
+func clipFeatures(features []lineFeature, clip orb.MultiPolygon) ([]lineFeature, int) {
+	kept := features[:0]
+	for _, f := range features {
+		if len(f.coords) == 0 {
+			kept = append(kept, f)
+			continue
+		}
+		centroid, _ := planar.CentroidArea(f.coords)
+		if planar.MultiPolygonContains(clip, centroid) {
+			kept = append(kept, f)
+		}
+	}
+	return kept, len(features) - len(kept)
+}
+
+// sampleFeatures keeps each feature with probability rate. Each call starts
+// from seed so an output's sample doesn't depend on what else was built.
+func sampleFeatures(features []lineFeature, rate float64, seed uint64) []lineFeature {
+	rng := rand.New(rand.NewPCG(seed, 0))
+	kept := make([]lineFeature, 0, int(float64(len(features))*rate))
+	for _, f := range features {
+		if rng.Float64() < rate {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// featureEncoder writes features to w in the binary format, as
+// encodeFeatures does.
+type featureEncoder func(features []lineFeature, w io.Writer, opts encodeOptions) (encodeStats, error)
+
+// writeFeaturesBin encodes features to path in sink with encode, or as JSON
+// if opts.JSON is set, and returns the encoded bytes along with the encoding
+// stats.
+func writeFeaturesBin(sink OutputSink, encode featureEncoder, path string, features []lineFeature, simplifyMeters float64, opts encodeOptions) ([]byte, encodeStats, error) {
 	if simplifyMeters > 0 {
 		var before, after int
 		for i := range features {
@@ -207,16 +1138,229 @@ func writeFeaturesBin(path string, features []lineFeature, simplifyMeters float6
 		log.Printf("simplify %s: points %d -> %d (tolerance %.1fm)", path, before, after, simplifyMeters)
 	}
 	var out bytes.Buffer
-	if err := encodeFeatures(features, &out); err != nil {
-		return err
+	if opts.JSON {
+		stats, err := encodeFeaturesJSON(features, &out, opts)
+		if err != nil {
+			return nil, encodeStats{}, fmt.Errorf("encoding %s: %w", path, err)
+		}
+		if err := writeOutput(sink, path, out.Bytes()); err != nil {
+			return nil, encodeStats{}, err
+		}
+		return out.Bytes(), stats, nil
+	}
+	stats, err := encode(features, &out, opts)
+	if err != nil {
+		return nil, encodeStats{}, fmt.Errorf("encoding %s: %w", path, err)
+	}
+	if opts.VerifyOutput || opts.Verify {
+		if err := verifyEncoded(out.Bytes(), stats.Features, opts.Verify); err != nil {
+			return nil, encodeStats{}, fmt.Errorf("verifying %s: %w", path, err)
+		}
 	}
-	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+	if err := writeOutput(sink, path, out.Bytes()); err != nil {
+		return nil, encodeStats{}, err
+	}
+	return out.Bytes(), stats, nil
+}
+
+// verifyEncoded decodes an encoded features bin and checks it holds the
+// number of features the encoder reported writing. If checkBounds is set, it
+// also checks that each feature's coordinates fall within the bounding box
+// written for its segment, which clients rely on to skip segments outside
+// the view.
+func verifyEncoded(data []byte, want int, checkBounds bool) error {
+	reader, err := featuresbin.Open(data)
+	if err != nil {
 		return err
 	}
+	tolerance := segmentBoundTolerance(reader.Header())
+	var decoded int
+	for {
+		feat, ok, err := reader.NextFeature()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		decoded++
+		if !checkBounds {
+			continue
+		}
+		bound := reader.SegmentBound().Pad(tolerance)
+		for _, c := range feat.Coords {
+			if !bound.Contains(orb.Point{c[0], c[1]}) {
+				return fmt.Errorf("feature %q coordinate (%.7f,%.7f) outside segment bounds %v", feat.Title, c[0], c[1], bound)
+			}
+		}
+	}
+	if decoded != want {
+		return fmt.Errorf("decoded %d features, encoded %d", decoded, want)
+	}
 	return nil
 }
 
-func writeDebug(path string, entries []debugEntry, cfg debugConfig) error {
+// segmentBoundTolerance is half a stored coordinate unit in degrees, the most
+// rounding can move a coordinate past the bounds it was encoded within.
+func segmentBoundTolerance(h featuresbin.Header) float64 {
+	unit := math.Pow(10, -float64(h.Precision))
+	if h.Mercator {
+		// Mercator metres per degree is largest at the equator.
+		unit *= 180 / (math.Pi * 6378137)
+	}
+	if h.CompactCoords {
+		unit *= compactCoordDivisor
+	}
+	return unit / 2
+}
+
+// runStats is written by -stats-json for tracking runs over time.
+type runStats struct {
+	Outputs     map[string]encodeStats `json:"outputs"`
+	BikeMatches *bikeMatchStats        `json:"bike_matches,omitempty"`
+	Timing      runTiming              `json:"timing"`
+}
+
+type runTiming struct {
+	LoadSeconds   float64 `json:"load_seconds"`
+	MatchSeconds  float64 `json:"match_seconds"`
+	EncodeSeconds float64 `json:"encode_seconds"`
+	TotalSeconds  float64 `json:"total_seconds"`
+}
+
+type geojsonOutput struct {
+	name     string
+	features []lineFeature
+	// segments, if set, holds the "row,col" grid cell each feature was
+	// encoded in, or "" for ones that weren't written.
+	segments []string
+	// hoursRemaining adds each feature's hoursRemaining and deadlinePassed
+	// properties, for -deadline-fields.
+	hoursRemaining bool
+}
+
+// segmentLabeler returns an encodeOptions.Assigned func recording each
+// feature's grid cell in segments as "row,col".
+func segmentLabeler(segments []string) func(feature, row, col int) {
+	return func(feature, row, col int) {
+		segments[feature] = fmt.Sprintf("%d,%d", row, col)
+	}
+}
+
+// writeGeoJSONOut writes the encoded features as a GeoJSON feature
+// collection for inspecting on a map. Each feature's source is the dataset
+// its priority came from, and its segment the grid cell it was encoded in.
+func writeGeoJSONOut(sink OutputSink, path string, outputs []geojsonOutput) error {
+	fc := geojson.NewFeatureCollection()
+	for _, out := range outputs {
+		for i, f := range out.features {
+			feat := outputFeature(out.name, f)
+			if out.segments != nil && out.segments[i] != "" {
+				feat.Properties["segment"] = out.segments[i]
+			}
+			if out.hoursRemaining {
+				feat.Properties["hoursRemaining"] = int(f.hoursRemaining)
+				feat.Properties["deadlinePassed"] = f.hoursRemaining < 0
+			}
+			fc.Append(feat)
+		}
+	}
+	b, err := json.Marshal(fc)
+	if err != nil {
+		return err
+	}
+	return writeOutput(sink, path, b)
+}
+
+// outputFeature is f as a GeoJSON feature of the named output.
+func outputFeature(output string, f lineFeature) *geojson.Feature {
+	feat := geojson.NewFeature(f.coords)
+	feat.Properties["output"] = output
+	feat.Properties["stable_id"] = f.stableID
+	feat.Properties["title"] = f.title
+	feat.Properties["priority"] = int(f.priority)
+	feat.Properties["source"] = datasetName(f.sourceDataset)
+	return feat
+}
+
+// lengthByPriority sums the haversine length in meters of features by their
+// priority.
+func lengthByPriority(features []lineFeature) map[uint8]float64 {
+	lengths := make(map[uint8]float64)
+	for _, f := range features {
+		lengths[f.priority] += geo.LengthHaversine(f.coords)
+	}
+	return lengths
+}
+
+// logLengthByPriority logs the named output's network length per priority.
+func logLengthByPriority(output string, features []lineFeature) {
+	lengths := lengthByPriority(features)
+	priorities := make([]uint8, 0, len(lengths))
+	for p := range lengths {
+		priorities = append(priorities, p)
+	}
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+	parts := make([]string, len(priorities))
+	for i, p := range priorities {
+		parts[i] = fmt.Sprintf("%d=%.1fkm", p, lengths[p]/1000)
+	}
+	log.Printf("%s length by priority: %s", output, strings.Join(parts, " "))
+}
+
+// gridDebugOutput is an encoded features bin for writeGridDebug.
+type gridDebugOutput struct {
+	name string
+	data []byte
+}
+
+// writeGridDebug decodes each encoded features bin and writes its segments'
+// bounding boxes as GeoJSON polygons with their grid cell and feature count,
+// for tuning the grid dimensions.
+func writeGridDebug(sink OutputSink, path string, outputs []gridDebugOutput) error {
+	fc := geojson.NewFeatureCollection()
+	for _, out := range outputs {
+		reader, err := featuresbin.Open(out.data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", out.name, err)
+		}
+		type cell struct {
+			row, col int
+			bound    orb.Bound
+			features int
+		}
+		var cells []cell
+		for {
+			_, ok, err := reader.NextFeature()
+			if err != nil {
+				return fmt.Errorf("%s: %w", out.name, err)
+			}
+			if !ok {
+				break
+			}
+			row, col := reader.SegmentCell()
+			if n := len(cells); n == 0 || cells[n-1].row != row || cells[n-1].col != col {
+				cells = append(cells, cell{row: row, col: col, bound: reader.SegmentBound()})
+			}
+			cells[len(cells)-1].features++
+		}
+		for _, c := range cells {
+			feat := geojson.NewFeature(c.bound.ToPolygon())
+			feat.Properties["output"] = out.name
+			feat.Properties["row"] = c.row
+			feat.Properties["col"] = c.col
+			feat.Properties["features"] = c.features
+			fc.Append(feat)
+		}
+	}
+	b, err := json.Marshal(fc)
+	if err != nil {
+		return err
+	}
+	return writeOutput(sink, path, b)
+}
+
+func writeDebug(sink OutputSink, path string, entries []debugEntry, cfg debugConfig) error {
 	payload := struct {
 		GeneratedAt time.Time    `json:"generated_at"`
 		Config      debugConfig  `json:"config"`
@@ -230,7 +1374,75 @@ func writeDebug(path string, entries []debugEntry, cfg debugConfig) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, b, 0644)
+	return writeOutput(sink, path, b)
+}
+
+// writeUnmatched writes the bike debug entries that weren't matched to a
+// travelway or ice route, either falling back to WINT_LOS or being dropped,
+// as GeoJSON features with a reason property. Intentional skips such as
+// routes marked not plowed are left out.
+func writeUnmatched(sink OutputSink, path string, entries []debugEntry) error {
+	fc := geojson.NewFeatureCollection()
+	for _, e := range entries {
+		if e.Dataset != "bike" || intentionalSkips[e.Reason] {
+			continue
+		}
+		if e.Included && e.Reason != "fallback WINT_LOS" {
+			continue
+		}
+		var g orb.Geometry
+		if len(e.Coords) > 0 {
+			g = e.Coords
+		}
+		feat := geojson.NewFeature(g)
+		feat.Properties["object_id"] = e.ObjectID
+		feat.Properties["stable_id"] = e.SourceStableID
+		feat.Properties["title"] = e.Title
+		feat.Properties["reason"] = e.Reason
+		feat.Properties["included"] = e.Included
+		feat.Properties["bike_type"] = e.BikeType
+		feat.Properties["prot_type"] = e.ProtType
+		feat.Properties["wint_los"] = e.WintLOS
+		if e.Priority != 0 {
+			feat.Properties["priority"] = int(e.Priority)
+		}
+		fc.Append(feat)
+	}
+	b, err := json.Marshal(fc)
+	if err != nil {
+		return err
+	}
+	return writeOutput(sink, path, b)
+}
+
+// intentionalSkips are the debug reasons for features the datasets mark as
+// not ours to show, as opposed to data problems.
+var intentionalSkips = map[string]bool{
+	"OWNER=PRIV":  true,
+	"WINT_PLOW=N": true,
+}
+
+// skipWarnings summarizes the excluded debug entries by dataset and reason,
+// leaving out intentional skips.
+func skipWarnings(entries []debugEntry) []string {
+	type key struct{ dataset, reason string }
+	counts := make(map[key]int)
+	var keys []key
+	for _, e := range entries {
+		if e.Included || intentionalSkips[e.Reason] {
+			continue
+		}
+		k := key{e.Dataset, e.Reason}
+		if counts[k] == 0 {
+			keys = append(keys, k)
+		}
+		counts[k]++
+	}
+	warnings := make([]string, 0, len(keys))
+	for _, k := range keys {
+		warnings = append(warnings, fmt.Sprintf("%s: skipped %d features: %s", k.dataset, counts[k], k.reason))
+	}
+	return warnings
 }
 
 func appendDebug(entries *[]debugEntry, entry debugEntry) {
@@ -428,6 +1640,7 @@ func travelwayLines(fc *geojson.FeatureCollection, titles *titleNormalizer, debu
 		if strings.EqualFold(title, "CORNWALLIS ST") {
 			title = titles.normalize("Nora Bernard St")
 		}
+		_, flattened := f.Geometry.(orb.MultiLineString)
 		features = append(features, lineFeature{
 			stableID:      stableID,
 			title:         title,
@@ -437,6 +1650,8 @@ func travelwayLines(fc *geojson.FeatureCollection, titles *titleNormalizer, debu
 			objectID:      objectID,
 			wintMaint:     wintMaint,
 			wintRoute:     wintRoute,
+			serviced:      servicedAt(props),
+			flattened:     flattened,
 		})
 		appendDebug(debug, debugEntry{
 			Dataset:        "travelways",
@@ -494,17 +1709,6 @@ func travelwayNameLines(fc *geojson.FeatureCollection, titles *titleNormalizer)
 	return lines, titleMap, nil
 }
 
-func travelwayTitleMap(features []lineFeature) map[int]string {
-	titles := make(map[int]string, len(features))
-	for _, feature := range features {
-		if feature.objectID == 0 || feature.title == "" {
-			continue
-		}
-		titles[feature.objectID] = feature.title
-	}
-	return titles
-}
-
 type routeInfo struct {
 	maint string
 	route string
@@ -536,6 +1740,7 @@ func travelwayPriorityLines(fc *geojson.FeatureCollection) ([]indexedLine, map[i
 			coords:   ls,
 			priority: priority,
 			objectID: objectID,
+			name:     streetNameKey(props.MustString("LOCATION", "")),
 		})
 		wintMaint := strings.TrimSpace(props.MustString("WINT_MAINT", ""))
 		wintRoute := strings.TrimSpace(props.MustString("WINT_ROUTE", ""))
@@ -601,6 +1806,14 @@ func (t *titleNormalizer) normalize(value string) string {
 	return raw
 }
 
+// streetNameKey normalizes a street name for comparison across datasets,
+// lowercasing it and reducing punctuation and spacing to single spaces.
+func streetNameKey(value string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
 func isAllUpper(value string) bool {
 	hasLetter := false
 	for _, r := range value {
@@ -627,17 +1840,32 @@ func bikeTitle(props geojson.Properties, titles *titleNormalizer) (string, bool)
 	return title, true
 }
 
-func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelwaysIndex, nameTravelwaysIndex *spatialIndex, travelwayTitles, nameTravelwayTitles map[int]string, travelwayRoutes map[int]routeInfo, iceRoutes map[int]routeInfo, iceIndex *spatialIndex, maxMatchMeters, maxAngleDeg, minRunMeters float64, debug *[]debugEntry) ([]lineFeature, error) {
-	var (
-		matchedTravelways int
-		matchedIce        int
-		matchedBike       int
-		matchedFallback   int
-		skipped           int
-		skippedNotPlowed  int
-		skippedNoName     int
-	)
-	maxAngleRad := deg2rad(maxAngleDeg)
+// bikeMatchStats counts where bike lines got their priorities.
+type bikeMatchStats struct {
+	Travelways        int `json:"travelways"`
+	Ice               int `json:"ice"`
+	Bike              int `json:"bike"`
+	Fallback          int `json:"fallback"`
+	Skipped           int `json:"skipped"`
+	SkippedNotPlowed  int `json:"skipped_not_plowed"`
+	SkippedNoName     int `json:"skipped_no_name"`
+	SkippedDegenerate int `json:"skipped_degenerate"`
+	Split             int `json:"split"`
+	Coincident        int `json:"coincident"`
+	Snapped           int `json:"snapped"`
+}
+
+func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, sources bikeMatchSources, cfg runConfig, debug *[]debugEntry) ([]lineFeature, bikeMatchStats, error) {
+	var stats bikeMatchStats
+	maxAngleRad := deg2rad(cfg.MaxAngleDeg)
+
+	var travelwayGeoms map[int][]orb.LineString
+	if cfg.SnapEndpoints && sources.travelways != nil {
+		travelwayGeoms = make(map[int][]orb.LineString)
+		for _, line := range sources.travelways.lines {
+			travelwayGeoms[line.objectID] = append(travelwayGeoms[line.objectID], line.coords)
+		}
+	}
 
 	features := make([]lineFeature, 0, len(fc.Features))
 	for _, f := range fc.Features {
@@ -648,7 +1876,7 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 		bikeType := strings.TrimSpace(props.MustString("BIKETYPE", ""))
 		baseStableID := bikeStableID(props, objectID)
 		if isNotPlowed(props) {
-			skippedNotPlowed++
+			stats.SkippedNotPlowed++
 			appendDebug(debug, debugEntry{
 				Dataset:        "bike",
 				ObjectID:       objectID,
@@ -668,8 +1896,36 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 
 		lines, err := lineStringsFromGeometry(f.Geometry)
 		if err != nil {
-			return nil, err
+			return nil, bikeMatchStats{}, &featureError{title: props.MustString("BIKE_NAME", ""), stableID: baseStableID, objectID: objectID, err: err}
 		}
+		// Matching works segment by segment, so a line needs two points.
+		kept := lines[:0]
+		for _, ls := range lines {
+			if len(ls) >= 2 {
+				kept = append(kept, ls)
+				continue
+			}
+			stats.SkippedDegenerate++
+			appendDebug(debug, debugEntry{
+				Dataset:        "bike",
+				ObjectID:       objectID,
+				SourceStableID: baseStableID,
+				Title:          props.MustString("BIKE_NAME", ""),
+				Included:       false,
+				Reason:         "fewer than two coordinates",
+				WintPlow:       wintPlow,
+				WintLOS:        wintLOS,
+				BikeType:       bikeType,
+				ProtType:       props.MustString("PROT_TYPE", ""),
+				BikeName:       props.MustString("BIKE_NAME", ""),
+				StreetName:     props.MustString("STREETNAME", ""),
+				Coords:         ls,
+			})
+		}
+		if len(kept) == 0 && len(lines) > 0 {
+			continue
+		}
+		lines = kept
 		if len(lines) == 0 {
 			appendDebug(debug, debugEntry{
 				Dataset:        "bike",
@@ -695,11 +1951,29 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 
 		isHelpConn := strings.EqualFold(bikeType, "HELPCONN")
 		isProtected := isProtectedBike(props)
+		protection := bikeProtection(props)
+		serviced := servicedAt(props)
+		streetName := streetNameKey(props.MustString("STREETNAME", ""))
+		var direction uint8
+		if cfg.DirectionProperty != "" {
+			direction = directionFrom(props.MustString(cfg.DirectionProperty, ""))
+		}
+		var tr *matchTrace
+		if cfg.TraceTitle != "" && strings.EqualFold(baseTitle, cfg.TraceTitle) {
+			tr = &matchTrace{title: baseTitle, objectID: objectID}
+			tr.printf("BIKETYPE=%q PROT_TYPE=%q WINT_LOS=%q protected=%t", bikeType, props.MustString("PROT_TYPE", ""), wintLOS, isProtected)
+		}
 		isOffstreetFallback := strings.EqualFold(bikeType, "MUPATH") ||
 			strings.EqualFold(bikeType, "INT_MUPATH") ||
 			strings.EqualFold(strings.TrimSpace(props.MustString("PROT_TYPE", "")), "OFFSTREET")
 
-		for _, ls := range lines {
+		for _, line := range lines {
+			ls := line
+			if cfg.SplitPartial {
+				// Short segments let a run end near where the line leaves
+				// matching distance rather than at the next source vertex.
+				ls = densifyLine(line, cfg.MaxMatchMeters/4)
+			}
 			title := baseTitle
 			titleFromType := baseTitleFromType
 			var (
@@ -717,44 +1991,44 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 				sourceDataset = datasetBike
 				reason = "prefer bike WINT_LOS+route"
 				found = true
-				matchedBike++
+				stats.Bike++
 			} else {
 				if isHelpConn {
-					attr = overlapAttributionPrefer(ls, iceIndex, datasetIce, travelwaysIndex, datasetTravelways, maxMatchMeters, maxAngleRad)
+					attr = overlapAttributionPrefer(ls, streetName, sources.ice, datasetIce, sources.travelways, datasetTravelways, cfg.MaxMatchMeters, maxAngleRad, tr)
 					if attr.totalLength > 0 {
 						sourceDataset = datasetIce
 						reason = "overlap-first ice with travelways fallback"
 						found = true
-						matchedIce++
+						stats.Ice++
 					}
 				} else if isProtected {
 					if isOffstreetFallback {
-						attr = overlapAttributionPrefer(ls, travelwaysIndex, datasetTravelways, iceIndex, datasetIce, maxMatchMeters, maxAngleRad)
+						attr = overlapAttributionPrefer(ls, streetName, sources.travelways, datasetTravelways, sources.ice, datasetIce, cfg.MaxMatchMeters, maxAngleRad, tr)
 						if attr.totalLength > 0 {
 							sourceDataset = datasetTravelways
 							reason = "overlap-first travelways with ice fallback"
 							found = true
-							matchedTravelways++
+							stats.Travelways++
 						}
 					} else {
-						attr = overlapAttribution(ls, travelwaysIndex, datasetTravelways, maxMatchMeters, maxAngleRad)
+						attr = overlapAttribution(ls, streetName, sources.travelways, datasetTravelways, cfg.MaxMatchMeters, maxAngleRad, tr)
 						if attr.totalLength > 0 {
 							sourceDataset = datasetTravelways
 							reason = "overlap-first travelways"
 							found = true
-							matchedTravelways++
+							stats.Travelways++
 						}
 					}
 				} else {
 					if isOffstreetFallback {
-						attr = overlapAttributionPrefer(ls, travelwaysIndex, datasetTravelways, iceIndex, datasetIce, maxMatchMeters, maxAngleRad)
+						attr = overlapAttributionPrefer(ls, streetName, sources.travelways, datasetTravelways, sources.ice, datasetIce, cfg.MaxMatchMeters, maxAngleRad, tr)
 						if attr.totalLength > 0 {
 							sourceDataset = datasetTravelways
 							reason = "overlap-first travelways with ice fallback"
 							found = true
 						}
 					} else {
-						attr = overlapAttribution(ls, iceIndex, datasetIce, maxMatchMeters, maxAngleRad)
+						attr = overlapAttribution(ls, streetName, sources.ice, datasetIce, cfg.MaxMatchMeters, maxAngleRad, tr)
 						if attr.totalLength > 0 {
 							sourceDataset = datasetIce
 							reason = "overlap-first ice"
@@ -763,16 +2037,16 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 					}
 					if attr.totalLength > 0 {
 						if sourceDataset == datasetTravelways {
-							matchedTravelways++
+							stats.Travelways++
 						} else if sourceDataset == datasetIce {
-							matchedIce++
+							stats.Ice++
 						}
 					}
 				}
 			}
 
 			if title == "" {
-				skippedNoName++
+				stats.SkippedNoName++
 				appendDebug(debug, debugEntry{
 					Dataset:        "bike",
 					ObjectID:       objectID,
@@ -786,7 +2060,7 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 					ProtType:       props.MustString("PROT_TYPE", ""),
 					BikeName:       props.MustString("BIKE_NAME", ""),
 					StreetName:     props.MustString("STREETNAME", ""),
-					Coords:         ls,
+					Coords:         line,
 				})
 				continue
 			}
@@ -800,12 +2074,13 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 					sourceDataset = datasetBike
 					reason = "fallback WINT_LOS"
 					found = true
-					matchedFallback++
+					stats.Fallback++
 				}
 			}
 
+			tr.printf("decision: found=%t source=%s reason=%q priorities=%v", found, datasetName(sourceDataset), reason, attr.byPriority)
 			if !found {
-				skipped++
+				stats.Skipped++
 				appendDebug(debug, debugEntry{
 					Dataset:        "bike",
 					ObjectID:       objectID,
@@ -820,7 +2095,7 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 					BikeName:       props.MustString("BIKE_NAME", ""),
 					StreetName:     props.MustString("STREETNAME", ""),
 					ProtectedBike:  isProtected,
-					Coords:         ls,
+					Coords:         line,
 				})
 				continue
 			}
@@ -831,15 +2106,30 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 					{
 						priority:      dominantPriority(attr.byPriority),
 						sourceDataset: sourceDataset,
-						coords:        ls,
-						length:        lineLengthMeters(ls, projectorForLine(ls)),
+						coords:        line,
+						length:        lineLengthMeters(line, projectorForLine(line)),
 					},
 				}
 			} else {
-				runs = runsFromAssignments(attr.assignments, minRunMeters)
+				runs = runsFromAssignments(attr.assignments, cfg.MinRunMeters)
+				if cfg.SplitPartial {
+					if fallback, ok := priorityFromWintLOS(wintLOS); ok {
+						n := len(runs)
+						runs = fillUnmatchedRuns(ls, runs, fallback, cfg.MinRunMeters)
+						if len(runs) > n && len(runs) > 1 {
+							stats.Split++
+						}
+					}
+					if len(runs) == 1 && runs[0].startSegment == 0 && runs[0].endSegment == len(ls)-2 {
+						// The line didn't split, so drop the points
+						// densifyLine added.
+						runs[0].coords = line
+						runs[0].endSegment = len(line) - 2
+					}
+				}
 			}
 			if len(runs) == 0 {
-				skipped++
+				stats.Skipped++
 				appendDebug(debug, debugEntry{
 					Dataset:        "bike",
 					ObjectID:       objectID,
@@ -854,7 +2144,7 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 					BikeName:       props.MustString("BIKE_NAME", ""),
 					StreetName:     props.MustString("STREETNAME", ""),
 					ProtectedBike:  isProtected,
-					Coords:         ls,
+					Coords:         line,
 				})
 				continue
 			}
@@ -862,10 +2152,10 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 			runStableIDs := make([]string, 0, len(runs))
 			for _, run := range runs {
 				runTitle := title
-				if (runTitle == "" || titleFromType) && nameTravelwaysIndex != nil {
-					nameAttr := overlapAttribution(run.coords, nameTravelwaysIndex, datasetTravelways, maxMatchMeters, maxAngleRad)
+				if (runTitle == "" || titleFromType) && sources.nameTravelways != nil {
+					nameAttr := overlapAttribution(run.coords, "", sources.nameTravelways, datasetTravelways, cfg.MaxMatchMeters, maxAngleRad, nil)
 					if id := dominantObjectID(nameAttr.byObjectID); id != 0 {
-						if name := nameTravelwayTitles[id]; name != "" {
+						if name := sources.nameTravelwayTitles[id]; name != "" {
 							runTitle = name
 						}
 					}
@@ -876,12 +2166,12 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 					dominantID := dominantObjectID(run.byObjectID)
 					if dominantID != 0 {
 						if run.sourceDataset == datasetTravelways {
-							if info, ok := travelwayRoutes[dominantID]; ok {
+							if info, ok := sources.travelwayRoutes[dominantID]; ok {
 								runWintMaint = info.maint
 								runWintRoute = info.route
 							}
 						} else if run.sourceDataset == datasetIce {
-							if info, ok := iceRoutes[dominantID]; ok {
+							if info, ok := sources.iceRoutes[dominantID]; ok {
 								runWintMaint = info.maint
 								runWintRoute = info.route
 							}
@@ -893,15 +2183,30 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 					runStableID = runStableID + ":" + runStableSuffix(run)
 				}
 				runStableIDs = append(runStableIDs, runStableID)
+				coords := run.coords
+				if travelwayGeoms != nil && run.sourceDataset == datasetTravelways {
+					var moved int
+					// Only the original line's ends move, so the vertex a
+					// split run shares with its neighbour stays put.
+					snapFirst := coords[0] == line[0]
+					snapLast := coords[len(coords)-1] == line[len(line)-1]
+					coords, moved = snapLineEndpoints(coords, travelwayGeoms[dominantObjectID(run.byObjectID)], snapEndpointsMeters, snapFirst, snapLast)
+					if moved > 0 {
+						stats.Snapped++
+					}
+				}
 				features = append(features, lineFeature{
 					stableID:      runStableID,
 					title:         runTitle,
 					priority:      run.priority,
-					coords:        run.coords,
+					coords:        coords,
 					sourceDataset: run.sourceDataset,
 					objectID:      objectID,
 					wintMaint:     runWintMaint,
 					wintRoute:     runWintRoute,
+					bikeType:      protection,
+					serviced:      serviced,
+					direction:     direction,
 				})
 			}
 
@@ -922,20 +2227,33 @@ func bikeLines(fc *geojson.FeatureCollection, titles *titleNormalizer, travelway
 				StreetName:     props.MustString("STREETNAME", ""),
 				ProtectedBike:  isProtected,
 				SourceDataset:  datasetName(sourceDataset),
-				Coords:         ls,
+				Coords:         line,
 			})
 		}
 	}
 
-	log.Printf("bike lines matched travelways=%d ice=%d bike=%d fallback=%d skipped=%d", matchedTravelways, matchedIce, matchedBike, matchedFallback, skipped)
-	if skippedNotPlowed > 0 {
-		log.Printf("bike lines skipped not plowed=%d", skippedNotPlowed)
+	if cfg.CoincidentMeters > 0 {
+		features, stats.Coincident = dropCoincident(features, cfg.CoincidentMeters)
+	}
+
+	log.Printf("bike lines matched travelways=%d ice=%d bike=%d fallback=%d skipped=%d", stats.Travelways, stats.Ice, stats.Bike, stats.Fallback, stats.Skipped)
+	if stats.Coincident > 0 {
+		log.Printf("bike lines dropped coincident with a better source=%d", stats.Coincident)
+	}
+	if stats.SkippedNotPlowed > 0 {
+		log.Printf("bike lines skipped not plowed=%d", stats.SkippedNotPlowed)
+	}
+	if stats.SkippedNoName > 0 {
+		log.Printf("bike lines skipped missing name=%d", stats.SkippedNoName)
+	}
+	if stats.SkippedDegenerate > 0 {
+		log.Printf("bike lines skipped fewer than two coordinates=%d", stats.SkippedDegenerate)
 	}
-	if skippedNoName > 0 {
-		log.Printf("bike lines skipped missing name=%d", skippedNoName)
+	if stats.Snapped > 0 {
+		log.Printf("bike lines snapped endpoints to travelways=%d", stats.Snapped)
 	}
 
-	return features, nil
+	return features, stats, nil
 }
 
 func isNotPlowed(props geojson.Properties) bool {
@@ -946,21 +2264,169 @@ func isPrivateOwner(owner string) bool {
 	return strings.EqualFold(strings.TrimSpace(owner), "PRIV")
 }
 
-func isProtectedBike(props geojson.Properties) bool {
-	protType := strings.TrimSpace(props.MustString("PROT_TYPE", ""))
-	if protType != "" && !strings.EqualFold(protType, "NONE") {
-		return true
-	}
-	switch strings.TrimSpace(props.MustString("BIKETYPE", "")) {
-	case "PROTBL", "INT_PROTBL":
-		return true
-	default:
-		return false
+func isProtectedBike(props geojson.Properties) bool {
+	protType := strings.TrimSpace(props.MustString("PROT_TYPE", ""))
+	if protType != "" && !strings.EqualFold(protType, "NONE") {
+		return true
+	}
+	switch strings.TrimSpace(props.MustString("BIKETYPE", "")) {
+	case "PROTBL", "INT_PROTBL":
+		return true
+	default:
+		return false
+	}
+}
+
+// bikeProtection classifies a bike feature as protected or unprotected, or
+// unknown if it has neither PROT_TYPE nor BIKETYPE.
+func bikeProtection(props geojson.Properties) uint8 {
+	if isProtectedBike(props) {
+		return bikeTypeProtected
+	}
+	if strings.TrimSpace(props.MustString("PROT_TYPE", "")) == "" && strings.TrimSpace(props.MustString("BIKETYPE", "")) == "" {
+		return bikeTypeUnknown
+	}
+	return bikeTypeUnprotected
+}
+
+// sourceRank orders cycling feature sources from most to least trusted:
+// a matched travelway, a matched ice route, then the bike dataset's own
+// WINT_LOS.
+func sourceRank(sourceDataset uint8) int {
+	switch sourceDataset {
+	case datasetTravelways:
+		return 0
+	case datasetIce:
+		return 1
+	}
+	return 2
+}
+
+// dropCoincident drops features lying entirely within toleranceMeters of a
+// kept feature from a better source, so one physical path isn't emitted
+// under two sources. Pieces of the same source feature are never compared.
+// It returns the kept features in their original order and how many were
+// dropped.
+func dropCoincident(features []lineFeature, toleranceMeters float64) ([]lineFeature, int) {
+	order := make([]int, len(features))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return sourceRank(features[order[i]].sourceDataset) < sourceRank(features[order[j]].sourceDataset)
+	})
+
+	dropped := make([]bool, len(features))
+	bounds := make([]orb.Bound, len(features))
+	for i, f := range features {
+		bounds[i] = f.coords.Bound()
+	}
+	var kept []int
+	var n int
+	for _, i := range order {
+		f := features[i]
+		if len(f.coords) == 0 {
+			continue
+		}
+		// A degree of longitude is never longer than one of latitude.
+		padded := bounds[i].Pad(metersToDegreesLon(toleranceMeters, deg2rad(bounds[i].Center()[1])))
+		for _, k := range kept {
+			other := features[k]
+			if sourceRank(other.sourceDataset) >= sourceRank(f.sourceDataset) || (f.objectID != 0 && other.objectID == f.objectID) {
+				continue
+			}
+			if !padded.Intersects(bounds[k]) {
+				continue
+			}
+			if coveredBy(f.coords, other.coords, toleranceMeters) {
+				dropped[i] = true
+				n++
+				break
+			}
+		}
+		if !dropped[i] {
+			kept = append(kept, i)
+		}
+	}
+	if n == 0 {
+		return features, 0
+	}
+	out := make([]lineFeature, 0, len(features)-n)
+	for i, f := range features {
+		if !dropped[i] {
+			out = append(out, f)
+		}
+	}
+	return out, n
+}
+
+// coveredBy reports whether every point along a, sampled at least every
+// toleranceMeters, is within toleranceMeters of b.
+func coveredBy(a, b orb.LineString, toleranceMeters float64) bool {
+	if len(b) == 0 {
+		return false
+	}
+	proj := projectorForLine(a)
+	bxy := proj.lineToXY(b)
+	near := func(p pointXY) bool {
+		if len(bxy) == 1 {
+			return distancePoint(p, bxy[0]) <= toleranceMeters
+		}
+		for j := 1; j < len(bxy); j++ {
+			if pointSegmentDistance(p, bxy[j-1], bxy[j]) <= toleranceMeters {
+				return true
+			}
+		}
+		return false
+	}
+	axy := proj.lineToXY(a)
+	if !near(axy[0]) {
+		return false
+	}
+	for i := 1; i < len(axy); i++ {
+		p, q := axy[i-1], axy[i]
+		steps := max(int(math.Ceil(distancePoint(p, q)/toleranceMeters)), 1)
+		for step := 1; step <= steps; step++ {
+			t := float64(step) / float64(steps)
+			if !near(pointXY{x: p.x + t*(q.x-p.x), y: p.y + t*(q.y-p.y)}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// servicedAt returns the serviced property as a Unix time, or 0 if it is
+// missing or invalid. ArcGIS exports dates as epoch milliseconds; RFC 3339
+// strings are also accepted.
+func servicedAt(props geojson.Properties) int64 {
+	switch v := props["serviced"].(type) {
+	case float64:
+		return int64(v) / 1000
+	case string:
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(v))
+		if err != nil {
+			return 0
+		}
+		return t.Unix()
+	}
+	return 0
+}
+
+// directionFrom maps a direction property value to a direction. Values
+// other than the one-way ones, including empty, are two-way.
+func directionFrom(value string) uint8 {
+	switch strings.ToUpper(strings.Join(strings.Fields(value), "")) {
+	case "ONEWAY", "ONE-WAY", "WITH", "WITHTRAFFIC", "FORWARD", "FT":
+		return directionWithTraffic
+	case "AGAINST", "AGAINSTTRAFFIC", "CONTRAFLOW", "REVERSE", "TF":
+		return directionAgainstTraffic
 	}
+	return directionTwoWay
 }
 
 func priorityFromWintLOS(value string) (uint8, bool) {
-	value = strings.TrimSpace(value)
+	value = strings.ToUpper(strings.Join(strings.Fields(value), ""))
 	if value == "" {
 		return 0, false
 	}
@@ -998,7 +2464,7 @@ func iceRouteLines(fc *geojson.FeatureCollection) ([]indexedLine, error) {
 
 		ls, ok, err := flattenLineString(f.Geometry)
 		if err != nil {
-			return nil, err
+			return nil, &featureError{objectID: objectID, err: err}
 		}
 		if !ok {
 			continue
@@ -1048,7 +2514,7 @@ func flattenLineString(geom orb.Geometry) (orb.LineString, bool, error) {
 			ls = append(ls, sub...)
 		}
 	default:
-		return nil, false, fmt.Errorf("unknown geometry type: %T", g)
+		return nil, false, fmt.Errorf("%w: %T", errUnknownGeometry, g)
 	}
 	if len(ls) == 0 {
 		return nil, false, nil
@@ -1075,7 +2541,7 @@ func lineStringsFromGeometry(geom orb.Geometry) ([]orb.LineString, error) {
 		}
 		return out, nil
 	default:
-		return nil, fmt.Errorf("unknown geometry type: %T", g)
+		return nil, fmt.Errorf("%w: %T", errUnknownGeometry, g)
 	}
 }
 
@@ -1094,19 +2560,670 @@ func writeVarintZigZag(w io.Writer, value int64) error {
 	return writeUvarint(w, encodeZigZag(value))
 }
 
-func encodeFeatures(features []lineFeature, writer io.Writer) error {
-	if len(features) == 0 {
-		return fmt.Errorf("no features")
+const maxPieceBytes = 255
+
+var (
+	errTitleTooLong    = errors.New("title piece too long")
+	errUnknownGeometry = errors.New("unknown geometry type")
+)
+
+// featureError ties an error to the feature that caused it, so callers can
+// use errors.As to report or skip the offender.
+type featureError struct {
+	title    string
+	stableID string
+	objectID int
+	err      error
+}
+
+func newFeatureError(f lineFeature, err error) *featureError {
+	return &featureError{title: f.title, stableID: f.stableID, objectID: f.objectID, err: err}
+}
+
+func (e *featureError) Error() string {
+	return fmt.Sprintf("feature %q (OBJECTID %d): %v", e.title, e.objectID, e.err)
+}
+
+func (e *featureError) Unwrap() error { return e.err }
+
+type encodeOptions struct {
+	// Progress, if set, is called after each feature is encoded with the
+	// number of features encoded so far and the total to encode.
+	Progress func(done, total int)
+	// Assigned, if set, is called with the index in features of each
+	// feature written and the grid cell of the segment it was put in.
+	Assigned func(feature, row, col int)
+	// CompactCoords stores coordinates as int16 deltas at 1e4 scale, about
+	// 10m precision, for features whose deltas fit; others keep int32 at 1e6.
+	CompactCoords bool
+	// Precision, if positive, stores coordinates at this many decimal
+	// places of degrees (or of metres with Mercator) instead of 6 (or 2),
+	// and records it in the header.
+	Precision int
+	// NoFlatten makes encoding fail on features that were flattened from a
+	// MultiLineString instead of writing the joined line.
+	NoFlatten bool
+	// ByteOrder is used for the fixed-width fields. It defaults to
+	// binary.LittleEndian; binary.BigEndian is recorded with a header flag.
+	ByteOrder binary.ByteOrder
+	// Mercator reprojects coordinates to Web Mercator (EPSG:3857) before
+	// delta-coding so renderers working in Mercator can skip reprojection.
+	Mercator bool
+	// MaxFeatures, if positive, fails encoding up front when there are more
+	// features than this, guarding against runaway upstream data.
+	MaxFeatures int
+	// MinFeatures fails encoding if fewer features than this would be
+	// written, catching filtering or matching bugs that silently drop data.
+	MinFeatures int
+	// AllowEmpty writes a valid file with no segments when there are no
+	// features instead of failing.
+	AllowEmpty bool
+	// GeneratedAt, if set, is written to the header so clients can tell how
+	// old the data is.
+	GeneratedAt time.Time
+	// AllowEmptyGeometry keeps features with no coordinates, such as legend
+	// entries, writing them with a coordinate count of 0 instead of skipping.
+	AllowEmptyGeometry bool
+	// Bounds, if set, is used as the global base and grid extent instead of
+	// the features' own bounds so separately encoded files share a base.
+	// Every coordinate must fall within it.
+	Bounds *orb.Bound
+	// GridCells, if positive, replaces the default 8x4 segment grid with
+	// about this many cells shaped to be roughly square over the bounds.
+	GridCells int
+	// Styles, if set, is written to the header so viewers can draw each
+	// priority without hardcoding colors.
+	Styles map[uint8]priorityStyle
+	// Labels, if set, is written to the header so viewers can name each
+	// priority in English or French.
+	Labels map[uint8]priorityLabel
+	// EndTime, if set, is written to the header with Timelines so readers
+	// can compute each priority's clearing deadline.
+	EndTime   time.Time
+	Timelines map[uint8]time.Duration
+	// HoursRemaining writes each feature's hoursRemaining.
+	HoursRemaining bool
+	// BikeTypes writes each feature's bike protection type, for the
+	// cycling output.
+	BikeTypes bool
+	// VerifyOutput makes writeFeaturesBin decode its output and check the
+	// feature count before writing it, catching an encoder that writes a
+	// file the decoder disagrees with.
+	VerifyOutput bool
+	// Verify does the VerifyOutput check and also checks that every
+	// feature lies within its segment's bounding box, the grid invariant
+	// clients rely on to skip segments.
+	Verify bool
+	// JSON makes writeFeaturesBin write a JSON array with encodeFeaturesJSON
+	// instead of the binary format.
+	JSON bool
+}
+
+const (
+	// flagCompactCoords marks files where each feature's coordinates are
+	// preceded by a coordWidth byte.
+	flagCompactCoords uint8 = 1 << 0
+	// flagBigEndian marks files whose fixed-width fields are big-endian.
+	flagBigEndian uint8 = 1 << 1
+	// flagMercator marks files whose coordinates are Web Mercator metres
+	// at coordPrecisionMercator decimal places rather than lon/lat degrees.
+	flagMercator uint8 = 1 << 2
+	// flagGeneratedAt marks files with an int64 Unix generation time after
+	// the base lon/lat.
+	flagGeneratedAt uint8 = 1 << 3
+	// flagStyles marks files with a table of per-priority styles after the
+	// generation time.
+	flagStyles uint8 = 1 << 4
+	// flagTimelines marks files with an int64 Unix weather event end time
+	// and a table of per-priority clearing timelines after the styles.
+	flagTimelines uint8 = 1 << 5
+	// flagBikeTypes marks files where each feature has a uint8 bike
+	// protection type after its route ID.
+	flagBikeTypes uint8 = 1 << 6
+	// flagLabels marks files with a table of per-priority English and
+	// French labels after the timelines.
+	flagLabels uint8 = 1 << 7
+
+	// Flags in the second flags byte, which follows the first.
+
+	// extFlagServiced marks files where each feature has an int64 Unix
+	// last-serviced time, or 0 if unknown, after its bike type.
+	extFlagServiced uint8 = 1 << 0
+	// extFlagFeatureFlags marks files where each feature has a uint8 of
+	// flags after its serviced time. Bits 0-1 are its direction.
+	extFlagFeatureFlags uint8 = 1 << 1
+	// extFlagPrecision marks files with a uint8 count of decimal places
+	// coordinates are stored at right after the flags, replacing the
+	// default of coordPrecisionDegrees or coordPrecisionMercator.
+	extFlagPrecision uint8 = 1 << 2
+	// extFlagHoursRemaining marks files where each feature has an int16 of
+	// whole hours until its clearing deadline, rounded down so it's
+	// negative once the deadline has passed, after its feature flags.
+	extFlagHoursRemaining uint8 = 1 << 3
+
+	featureFlagDirectionMask uint8 = 0x3
+
+	coordPrecisionDegrees  = 6 // ~0.1m
+	coordPrecisionMercator = 2 // 1cm
+	// Higher precisions could overflow int32 offsets within a city-sized
+	// area.
+	maxPrecisionDegrees  = 7
+	maxPrecisionMercator = 3
+
+	coordWidthWide    uint8 = 0
+	coordWidthCompact uint8 = 1
+
+	compactCoordDivisor = 100 // two fewer decimal places, 1e6 -> 1e4 by default
+
+	defaultGridCols = 8
+	defaultGridRows = 4
+	// maxGridCells keeps auto grid dimensions within the uint16 readers use.
+	maxGridCells = math.MaxUint16
+)
+
+// autoGridDims picks grid dimensions with about cells cells that are
+// roughly square on the ground over bound, so a tall and narrow area gets
+// more rows than columns. Lon/lat bounds are narrowed by the cosine of
+// their latitude; Mercator bounds are already square.
+func autoGridDims(bound orb.Bound, cells int, mercator bool) (cols, rows int) {
+	width := bound.Max[0] - bound.Min[0]
+	if !mercator {
+		width *= math.Cos(deg2rad(bound.Center()[1]))
+	}
+	height := bound.Max[1] - bound.Min[1]
+	switch {
+	case width <= 0 && height <= 0:
+		return 1, 1
+	case height <= 0:
+		return cells, 1
+	case width <= 0:
+		return 1, cells
+	}
+	cols = min(max(int(math.Round(math.Sqrt(float64(cells)*width/height))), 1), cells)
+	rows = max(int(math.Round(float64(cells)/float64(cols))), 1)
+	return cols, rows
+}
+
+// metersPerDegree is the length of a degree of latitude, roughly.
+const metersPerDegree = 111320
+
+// tierMaxDecimals is how many decimal places of a degree an output stored at
+// precision resolves, so a tier at it is the full-precision output. Mercator
+// outputs store metres, which resolve about five more places than degrees.
+func tierMaxDecimals(precision int, mercator bool) int {
+	if mercator {
+		if precision == 0 {
+			precision = coordPrecisionMercator
+		}
+		return int(math.Floor(float64(precision) + math.Log10(metersPerDegree)))
+	}
+	if precision == 0 {
+		return coordPrecisionDegrees
+	}
+	return precision
+}
+
+// parseTiers parses a comma-separated list of decimal places for -tiers.
+// Whether each output stores enough places for them is checked separately.
+func parseTiers(s string) ([]int, error) {
+	var tiers []int
+	for _, field := range strings.Split(s, ",") {
+		decimals, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || decimals < 1 {
+			return nil, fmt.Errorf("invalid tier %q: want a positive number of decimal places", field)
+		}
+		tiers = append(tiers, decimals)
+	}
+	return tiers, nil
+}
+
+// tierPath inserts ".pN" before path's extension for the tier with N
+// decimal places.
+func tierPath(path string, decimals int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.p%d%s", strings.TrimSuffix(path, ext), decimals, ext)
+}
+
+// tierToleranceMeters is half a grid step at decimals places, roughly, so
+// simplifying at it drops vertices that rounding makes redundant. A tier at
+// the output's maxDecimals isn't simplified.
+func tierToleranceMeters(decimals, maxDecimals int) float64 {
+	if decimals >= maxDecimals {
+		return 0
+	}
+	return 0.5 * math.Pow(10, -float64(decimals)) * metersPerDegree
+}
+
+// pastDueFeatures returns the features whose clearing deadline, endTime plus
+// their priority's timeline, is before now. Features with no timeline for
+// their priority have no deadline and are dropped.
+func pastDueFeatures(features []lineFeature, endTime time.Time, timelines map[uint8]time.Duration, now time.Time) []lineFeature {
+	kept := make([]lineFeature, 0, len(features))
+	for _, f := range features {
+		timeline, ok := timelines[f.priority]
+		if ok && endTime.Add(timeline).Before(now) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// setHoursRemaining sets each feature's hoursRemaining until its clearing
+// deadline, endTime plus its priority's timeline, as of now. Features with no
+// timeline for their priority have no deadline and get math.MaxInt16.
+func setHoursRemaining(features []lineFeature, endTime time.Time, timelines map[uint8]time.Duration, now time.Time) {
+	for i := range features {
+		timeline, ok := timelines[features[i].priority]
+		if !ok {
+			features[i].hoursRemaining = math.MaxInt16
+			continue
+		}
+		hours := math.Floor(endTime.Add(timeline).Sub(now).Hours())
+		features[i].hoursRemaining = int16(max(math.MinInt16, min(math.MaxInt16, hours)))
+	}
+}
+
+// roundFeatures returns copies of features with coordinates rounded to
+// decimals places, dropping consecutive points that become equal.
+func roundFeatures(features []lineFeature, decimals int) []lineFeature {
+	scale := math.Pow(10, float64(decimals))
+	out := make([]lineFeature, len(features))
+	for i, f := range features {
+		if len(f.coords) > 0 {
+			coords := make(orb.LineString, 0, len(f.coords))
+			for _, pt := range f.coords {
+				pt = orb.Point{math.Round(pt[0]*scale) / scale, math.Round(pt[1]*scale) / scale}
+				if n := len(coords); n > 0 && coords[n-1] == pt {
+					continue
+				}
+				coords = append(coords, pt)
+			}
+			// Keep lines that round to a single point as lines.
+			if len(coords) == 1 && len(f.coords) > 1 {
+				coords = append(coords, coords[0])
+			}
+			f.coords = coords
+		}
+		out[i] = f
+	}
+	return out
+}
+
+// writeTimelines writes a varint count and then, in priority order, each
+// varint priority and varint timeline in minutes.
+func writeTimelines(w io.Writer, timelines map[uint8]time.Duration) error {
+	priorities := make([]int, 0, len(timelines))
+	for p := range timelines {
+		priorities = append(priorities, int(p))
+	}
+	sort.Ints(priorities)
+	if err := writeUvarint(w, uint64(len(priorities))); err != nil {
+		return err
+	}
+	for _, p := range priorities {
+		if err := writeUvarint(w, uint64(p)); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, uint64(timelines[uint8(p)]/time.Minute)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// priorityStyle is how viewers should draw features of a priority. Weight is
+// a line width in pixels; 0 leaves it to the viewer.
+type priorityStyle struct {
+	Color  string `json:"color"`
+	Weight int    `json:"weight"`
+}
+
+// loadStyles reads a JSON object mapping priorities to styles, such as
+// {"1": {"color": "#017A74", "weight": 6}}.
+func loadStyles(path string) (map[uint8]priorityStyle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]priorityStyle
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	styles := make(map[uint8]priorityStyle, len(raw))
+	for key, style := range raw {
+		priority, err := strconv.Atoi(key)
+		if err != nil || priority < 1 || priority > 3 {
+			return nil, fmt.Errorf("invalid priority %q: want 1, 2 or 3", key)
+		}
+		if _, err := parseHexColor(style.Color); err != nil {
+			return nil, fmt.Errorf("priority %d: %w", priority, err)
+		}
+		if style.Weight < 0 || style.Weight > math.MaxUint8 {
+			return nil, fmt.Errorf("priority %d: weight %d out of range 0-%d", priority, style.Weight, math.MaxUint8)
+		}
+		styles[uint8(priority)] = style
+	}
+	return styles, nil
+}
+
+// priorityLabel names a priority for viewers in each language.
+type priorityLabel struct {
+	En string `json:"en"`
+	Fr string `json:"fr"`
+}
+
+// loadLabels reads a JSON object mapping priorities to labels, such as
+// {"1": {"en": "Main routes", "fr": "Routes principales"}}.
+func loadLabels(path string) (map[uint8]priorityLabel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]priorityLabel
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	labels := make(map[uint8]priorityLabel, len(raw))
+	for key, label := range raw {
+		priority, err := strconv.Atoi(key)
+		if err != nil || priority < 1 || priority > 3 {
+			return nil, fmt.Errorf("invalid priority %q: want 1, 2 or 3", key)
+		}
+		if label.En == "" && label.Fr == "" {
+			return nil, fmt.Errorf("priority %d: no en or fr label", priority)
+		}
+		labels[uint8(priority)] = label
+	}
+	return labels, nil
+}
+
+// writeLabels writes a varint count and then, in priority order, each
+// varint priority and its English and French labels as varint-length
+// prefixed strings.
+func writeLabels(w io.Writer, labels map[uint8]priorityLabel) error {
+	priorities := make([]int, 0, len(labels))
+	for p := range labels {
+		priorities = append(priorities, int(p))
+	}
+	sort.Ints(priorities)
+	if err := writeUvarint(w, uint64(len(priorities))); err != nil {
+		return err
+	}
+	for _, p := range priorities {
+		if err := writeUvarint(w, uint64(p)); err != nil {
+			return err
+		}
+		label := labels[uint8(p)]
+		for _, s := range []string{label.En, label.Fr} {
+			if err := writeUvarint(w, uint64(len(s))); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseHexColor parses a #rrggbb color.
+func parseHexColor(s string) ([3]byte, error) {
+	var rgb [3]byte
+	if len(s) != 7 || s[0] != '#' {
+		return rgb, fmt.Errorf("invalid color %q: want #rrggbb", s)
+	}
+	for i := range rgb {
+		v, err := strconv.ParseUint(s[1+2*i:3+2*i], 16, 8)
+		if err != nil {
+			return rgb, fmt.Errorf("invalid color %q: want #rrggbb", s)
+		}
+		rgb[i] = byte(v)
+	}
+	return rgb, nil
+}
+
+// writeStyles writes a varint count and then, in priority order, each
+// style's varint priority, 3 RGB bytes and varint weight.
+func writeStyles(w io.Writer, styles map[uint8]priorityStyle) error {
+	priorities := make([]int, 0, len(styles))
+	for p := range styles {
+		priorities = append(priorities, int(p))
+	}
+	sort.Ints(priorities)
+	if err := writeUvarint(w, uint64(len(priorities))); err != nil {
+		return err
+	}
+	for _, p := range priorities {
+		style := styles[uint8(p)]
+		rgb, err := parseHexColor(style.Color)
+		if err != nil {
+			return fmt.Errorf("priority %d: %w", p, err)
+		}
+		if err := writeUvarint(w, uint64(p)); err != nil {
+			return err
+		}
+		if _, err := w.Write(rgb[:]); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, uint64(style.Weight)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendCoords appends a feature's coordinates, given relative to its
+// segment base, to b. With compactCoords a width byte comes first and the
+// coordinates are int16 deltas if they fit; otherwise they are zigzag
+// varint deltas, the first from the segment base.
+func appendCoords(b []byte, order binary.ByteOrder, absCoords [][2]int32, compactCoords bool) []byte {
+	if compactCoords {
+		if compact, ok := compactDeltas(absCoords); ok {
+			b = append(b, coordWidthCompact)
+			for _, d := range compact {
+				b = append(b, 0, 0)
+				order.PutUint16(b[len(b)-2:], uint16(d))
+			}
+			return b
+		}
+		b = append(b, coordWidthWide)
+	}
+	var prevLon, prevLat int32
+	for _, abs := range absCoords {
+		b = binary.AppendUvarint(b, encodeZigZag(int64(abs[0]-prevLon)))
+		b = binary.AppendUvarint(b, encodeZigZag(int64(abs[1]-prevLat)))
+		prevLon, prevLat = abs[0], abs[1]
+	}
+	return b
+}
+
+// compactDeltas converts segment-relative scaled coordinates to int16 deltas
+// at 1/compactCoordDivisor of that scale, the first relative to the segment
+// base. It reports false if
+// any delta overflows int16.
+func compactDeltas(absCoords [][2]int32) ([]int16, bool) {
+	out := make([]int16, 0, len(absCoords)*2)
+	var prevLon, prevLat int64
+	for _, abs := range absCoords {
+		lon := int64(math.Round(float64(abs[0]) / compactCoordDivisor))
+		lat := int64(math.Round(float64(abs[1]) / compactCoordDivisor))
+		dLon, dLat := lon-prevLon, lat-prevLat
+		if dLon < math.MinInt16 || dLon > math.MaxInt16 || dLat < math.MinInt16 || dLat > math.MaxInt16 {
+			return nil, false
+		}
+		out = append(out, int16(dLon), int16(dLat))
+		prevLon, prevLat = lon, lat
+	}
+	return out, true
+}
+
+// splitLongFeatures splits features with more than maxCoords coordinates
+// into consecutive pieces of at most maxCoords that share their end points
+// and the original's title, priority and IDs, also returning the index in
+// features each piece came from. features is returned as is, with nil
+// origins, if none need splitting.
+func splitLongFeatures(features []lineFeature, maxCoords int) ([]lineFeature, []int) {
+	long := false
+	for _, f := range features {
+		if len(f.coords) > maxCoords {
+			long = true
+			break
+		}
+	}
+	if !long {
+		return features, nil
+	}
+	out := make([]lineFeature, 0, len(features)+1)
+	origins := make([]int, 0, len(features)+1)
+	for i, f := range features {
+		coords := f.coords
+		for len(coords) > maxCoords {
+			piece := f
+			piece.coords = coords[:maxCoords]
+			out = append(out, piece)
+			origins = append(origins, i)
+			coords = coords[maxCoords-1:]
+		}
+		f.coords = coords
+		out = append(out, f)
+		origins = append(origins, i)
+	}
+	return out, origins
+}
+
+// jsonFeature is a feature as written by -format json.
+type jsonFeature struct {
+	Title    string       `json:"title"`
+	Priority uint8        `json:"priority"`
+	Source   string       `json:"source"`
+	Coords   [][2]float64 `json:"coords"`
+	// HoursRemaining and DeadlinePassed are only written with
+	// -deadline-fields.
+	HoursRemaining *int16 `json:"hoursRemaining,omitempty"`
+	DeadlinePassed *bool  `json:"deadlinePassed,omitempty"`
+}
+
+// encodeFeaturesJSON writes features as a JSON array of jsonFeature, with
+// coordinates rounded to opts.Precision decimal places (default 6), for
+// consumers that don't want to decode the binary format. Limits and empty
+// geometry are handled as by encodeFeatures.
+func encodeFeaturesJSON(features []lineFeature, w io.Writer, opts encodeOptions) (encodeStats, error) {
+	if len(features) == 0 && !opts.AllowEmpty {
+		return encodeStats{}, fmt.Errorf("no features")
+	}
+	if opts.MaxFeatures > 0 && len(features) > opts.MaxFeatures {
+		return encodeStats{}, fmt.Errorf("%d features exceeds the limit of %d", len(features), opts.MaxFeatures)
+	}
+	precision := coordPrecisionDegrees
+	if opts.Precision > 0 {
+		precision = opts.Precision
+	}
+	scale := math.Pow(10, float64(precision))
+	var stats encodeStats
+	out := make([]jsonFeature, 0, len(features))
+	for _, f := range features {
+		if len(f.coords) == 0 && !opts.AllowEmptyGeometry {
+			continue
+		}
+		coords := make([][2]float64, len(f.coords))
+		for i, pt := range f.coords {
+			coords[i] = [2]float64{math.Round(pt[0]*scale) / scale, math.Round(pt[1]*scale) / scale}
+		}
+		jf := jsonFeature{Title: f.title, Priority: f.priority, Source: datasetName(f.sourceDataset), Coords: coords}
+		if opts.HoursRemaining {
+			hours, passed := f.hoursRemaining, f.hoursRemaining < 0
+			jf.HoursRemaining, jf.DeadlinePassed = &hours, &passed
+		}
+		out = append(out, jf)
+		stats.Coords += len(coords)
+	}
+	stats.Features = len(out)
+	if stats.Features < opts.MinFeatures {
+		return encodeStats{}, fmt.Errorf("%d features is below the minimum of %d", stats.Features, opts.MinFeatures)
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return encodeStats{}, err
+	}
+	n, err := w.Write(b)
+	stats.Bytes = n
+	return stats, err
+}
+
+// encodeStats summarizes what encodeFeatures wrote.
+type encodeStats struct {
+	Features   int `json:"features"`
+	Segments   int `json:"segments"`
+	Coords     int `json:"coords"`
+	Routes     int `json:"routes"`
+	NamePieces int `json:"name_pieces"`
+	Bytes      int `json:"bytes"`
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+func encodeFeatures(features []lineFeature, writer io.Writer, opts encodeOptions) (encodeStats, error) {
+	if len(features) == 0 && !opts.AllowEmpty {
+		return encodeStats{}, fmt.Errorf("no features")
+	}
+	if opts.MaxFeatures > 0 && len(features) > opts.MaxFeatures {
+		return encodeStats{}, fmt.Errorf("%d features exceeds the limit of %d", len(features), opts.MaxFeatures)
+	}
+	features, origins := splitLongFeatures(features, math.MaxUint16)
+	order := opts.ByteOrder
+	switch order {
+	case nil:
+		order = binary.LittleEndian
+	case binary.LittleEndian, binary.BigEndian:
+	default:
+		return encodeStats{}, fmt.Errorf("unsupported byte order: %v", order)
+	}
+
+	cw := &countingWriter{w: writer}
+	writer = cw
+
+	precision, maxPrecision := coordPrecisionDegrees, maxPrecisionDegrees
+	if opts.Mercator {
+		precision, maxPrecision = coordPrecisionMercator, maxPrecisionMercator
+	}
+	if opts.Precision > 0 {
+		if opts.Precision > maxPrecision {
+			return encodeStats{}, fmt.Errorf("precision %d exceeds the maximum of %d", opts.Precision, maxPrecision)
+		}
+		precision = opts.Precision
+	}
+	scale := math.Pow(10, float64(precision))
+	bounds := opts.Bounds
+	if opts.Mercator {
+		projected := make([]lineFeature, len(features))
+		for i, f := range features {
+			f.coords = project.LineString(f.coords.Clone(), project.WGS84.ToMercator)
+			projected[i] = f
+		}
+		features = projected
+		if bounds != nil {
+			b := project.Bound(*bounds, project.WGS84.ToMercator)
+			bounds = &b
+		}
 	}
 
 	globalMinLon, globalMinLat := math.MaxFloat64, math.MaxFloat64
 	globalMaxLon, globalMaxLat := -math.MaxFloat64, -math.MaxFloat64
 
-	type featureForSeg struct {
-		data           lineFeature
-		repLon, repLat float64
-	}
-	var featuresForSeg []featureForSeg
+	// Features are referred to by index from here on so segmenting them
+	// doesn't hold extra copies; routeIDs holds each one's assigned route.
+	routeIDs := make([]uint16, len(features))
+	var located, empty []int
+	var serviced, featureFlags bool
 	routeEntries := make([]routeInfo, 0)
 	routeIndex := make(map[routeInfo]uint16)
 	pieceEntries := make([]string, 0)
@@ -1116,13 +3233,19 @@ func encodeFeatures(features []lineFeature, writer io.Writer) error {
 	routeMaintPieceIDs := make(map[string][]uint16)
 	routeNamePieceIDs := make(map[string][]uint16)
 
-	for _, feature := range features {
+	for fi, feature := range features {
 		ls := feature.coords
-		if len(ls) == 0 {
+		if len(ls) == 0 && !opts.AllowEmptyGeometry {
 			continue
 		}
+		if opts.NoFlatten && feature.flattened {
+			return encodeStats{}, fmt.Errorf("feature %q (OBJECTID %d) is a MultiLineString", feature.title, feature.objectID)
+		}
 
 		for _, coord := range ls {
+			if bounds != nil && !bounds.Contains(coord) {
+				return encodeStats{}, fmt.Errorf("feature %q coordinate %v is outside bounds %v-%v", feature.title, coord, bounds.Min, bounds.Max)
+			}
 			if coord[0] < globalMinLon {
 				globalMinLon = coord[0]
 			}
@@ -1144,7 +3267,7 @@ func encodeFeatures(features []lineFeature, writer io.Writer) error {
 				routeID = id
 			} else {
 				if len(routeEntries) >= math.MaxUint16 {
-					return fmt.Errorf("too many winter routes: %d exceeds uint16 capacity", len(routeEntries)+1)
+					return encodeStats{}, fmt.Errorf("too many winter routes: %d exceeds uint16 capacity", len(routeEntries)+1)
 				}
 				routeEntries = append(routeEntries, key)
 				routeID = uint16(len(routeEntries))
@@ -1152,20 +3275,20 @@ func encodeFeatures(features []lineFeature, writer io.Writer) error {
 				if _, ok := routeMaintPieceIDs[key.maint]; !ok {
 					ids, err := ensureFieldPieces(key.maint, &pieceEntries, pieceIndex)
 					if err != nil {
-						return err
+						return encodeStats{}, err
 					}
 					routeMaintPieceIDs[key.maint] = ids
 				}
 				if _, ok := routeNamePieceIDs[key.route]; !ok {
 					ids, err := ensureFieldPieces(key.route, &pieceEntries, pieceIndex)
 					if err != nil {
-						return err
+						return encodeStats{}, err
 					}
 					routeNamePieceIDs[key.route] = ids
 				}
 			}
 		}
-		feature.routeID = routeID
+		routeIDs[fi] = routeID
 
 		if feature.stableID != "" {
 			if _, ok := stablePieceIDs[feature.stableID]; !ok {
@@ -1175,7 +3298,7 @@ func encodeFeatures(features []lineFeature, writer io.Writer) error {
 					id, ok := pieceIndex[chunk]
 					if !ok {
 						if len(pieceEntries) >= math.MaxUint16 {
-							return fmt.Errorf("too many string pieces: %d exceeds uint16 capacity", len(pieceEntries)+1)
+							return encodeStats{}, fmt.Errorf("too many string pieces: %d exceeds uint16 capacity", len(pieceEntries)+1)
 						}
 						pieceEntries = append(pieceEntries, chunk)
 						id = uint16(len(pieceEntries))
@@ -1188,32 +3311,53 @@ func encodeFeatures(features []lineFeature, writer io.Writer) error {
 		}
 		if feature.title != "" {
 			if _, ok := titlePieceIDs[feature.title]; !ok {
+				for _, field := range strings.Fields(feature.title) {
+					if len(field) > maxPieceBytes {
+						return encodeStats{}, newFeatureError(feature, fmt.Errorf("%w: %q exceeds %d bytes", errTitleTooLong, field, maxPieceBytes))
+					}
+				}
 				ids, err := ensureFieldPieces(feature.title, &pieceEntries, pieceIndex)
 				if err != nil {
-					return err
+					return encodeStats{}, err
 				}
 				titlePieceIDs[feature.title] = ids
 			}
 		}
-		repLon, repLat := ls[0][0], ls[0][1]
-		featuresForSeg = append(featuresForSeg, featureForSeg{
-			data:   feature,
-			repLon: repLon,
-			repLat: repLat,
-		})
+		if feature.serviced != 0 {
+			serviced = true
+		}
+		if feature.direction != directionTwoWay {
+			featureFlags = true
+		}
+		if len(ls) == 0 {
+			empty = append(empty, fi)
+			continue
+		}
+		located = append(located, fi)
 	}
 
-	const cols = 8
-	const rows = 4
+	if bounds != nil {
+		globalMinLon, globalMinLat = bounds.Min[0], bounds.Min[1]
+		globalMaxLon, globalMaxLat = bounds.Max[0], bounds.Max[1]
+	} else if len(located) == 0 {
+		// Only geometry-less features; there is nothing to take a base from.
+		globalMinLon, globalMinLat, globalMaxLon, globalMaxLat = 0, 0, 0, 0
+	}
+
+	cols, rows := defaultGridCols, defaultGridRows
+	if opts.GridCells > 0 {
+		cols, rows = autoGridDims(orb.Bound{Min: orb.Point{globalMinLon, globalMinLat}, Max: orb.Point{globalMaxLon, globalMaxLat}}, opts.GridCells, opts.Mercator)
+	}
 
 	type cellKey struct {
 		row, col int
 	}
-	segmentsMap := make(map[cellKey][]lineFeature)
-	for _, f := range featuresForSeg {
+	segmentsMap := make(map[cellKey][]int)
+	for _, fi := range located {
+		repLon, repLat := features[fi].coords[0][0], features[fi].coords[0][1]
 		var col int
 		if globalMaxLon > globalMinLon {
-			col = int((f.repLon - globalMinLon) / (globalMaxLon - globalMinLon) * cols)
+			col = int((repLon - globalMinLon) / (globalMaxLon - globalMinLon) * float64(cols))
 		} else {
 			col = 0
 		}
@@ -1226,7 +3370,7 @@ func encodeFeatures(features []lineFeature, writer io.Writer) error {
 
 		var row int
 		if globalMaxLat > globalMinLat {
-			row = int((f.repLat - globalMinLat) / (globalMaxLat - globalMinLat) * rows)
+			row = int((repLat - globalMinLat) / (globalMaxLat - globalMinLat) * float64(rows))
 		} else {
 			row = 0
 		}
@@ -1238,86 +3382,50 @@ func encodeFeatures(features []lineFeature, writer io.Writer) error {
 		}
 
 		key := cellKey{row: row, col: col}
-		segmentsMap[key] = append(segmentsMap[key], f.data)
+		segmentsMap[key] = append(segmentsMap[key], fi)
+	}
+	if len(empty) > 0 {
+		// Geometry-less features have no location, so they go in the first cell.
+		key := cellKey{row: 0, col: 0}
+		segmentsMap[key] = append(segmentsMap[key], empty...)
 	}
 
 	type segment struct {
 		row, col int
-		features []lineFeature
-	}
-	var segments []segment
-	for row := range rows {
-		for col := range cols {
-			key := cellKey{row: row, col: col}
-			if feats, ok := segmentsMap[key]; ok {
-				segments = append(segments, segment{
-					row:      row,
-					col:      col,
-					features: feats,
-				})
-			}
-		}
-	}
-
-	if _, err := writer.Write([]byte(featuresBinMagic)); err != nil {
-		return err
-	}
-	if err := binary.Write(writer, binary.LittleEndian, featuresBinVersion); err != nil {
-		return err
-	}
-	if err := writeUvarint(writer, uint64(len(segments))); err != nil {
-		return err
-	}
-	if err := binary.Write(writer, binary.LittleEndian, globalMinLon); err != nil {
-		return err
-	}
-	if err := binary.Write(writer, binary.LittleEndian, globalMinLat); err != nil {
-		return err
-	}
-	if err := writeUvarint(writer, uint64(len(routeEntries))); err != nil {
-		return err
-	}
-	if err := writeUvarint(writer, uint64(len(pieceEntries))); err != nil {
-		return err
-	}
-	for _, piece := range pieceEntries {
-		pieceBytes := []byte(piece)
-		if len(pieceBytes) > 255 {
-			return fmt.Errorf("title piece too long: %q exceeds 255 bytes", piece)
-		}
-		if err := writeUvarint(writer, uint64(len(pieceBytes))); err != nil {
-			return err
-		}
-		if _, err := writer.Write(pieceBytes); err != nil {
-			return err
-		}
-	}
-	for _, entry := range routeEntries {
-		maintIDs := routeMaintPieceIDs[entry.maint]
-		routeIDs := routeNamePieceIDs[entry.route]
-		if err := writeUvarint(writer, uint64(len(maintIDs))); err != nil {
-			return err
-		}
-		for _, id := range maintIDs {
-			if err := writeUvarint(writer, uint64(id)); err != nil {
-				return err
-			}
-		}
-		if err := writeUvarint(writer, uint64(len(routeIDs))); err != nil {
-			return err
-		}
-		for _, id := range routeIDs {
-			if err := writeUvarint(writer, uint64(id)); err != nil {
-				return err
+		features []int
+	}
+	var segments []segment
+	for row := range rows {
+		for col := range cols {
+			key := cellKey{row: row, col: col}
+			if feats, ok := segmentsMap[key]; ok {
+				segments = append(segments, segment{
+					row:      row,
+					col:      col,
+					features: feats,
+				})
 			}
 		}
 	}
 
+	// Segments are encoded up front so the index ahead of them can record
+	// each one's length.
+	segData := make([]bytes.Buffer, len(segments))
+	var featureCount, coordCount int
+	totalFeatures := 0
 	for _, seg := range segments {
+		totalFeatures += len(seg.features)
+	}
+	// Per-feature fields and coordinates are built in scratch and written in
+	// one go, avoiding a reflective binary.Write per value.
+	var scratch []byte
+	var absCoords [][2]int32
+	for i, seg := range segments {
+		w := &segData[i]
 		segMinLon, segMinLat := math.MaxFloat64, math.MaxFloat64
 		segMaxLon, segMaxLat := -math.MaxFloat64, -math.MaxFloat64
-		for _, feature := range seg.features {
-			for _, coord := range feature.coords {
+		for _, fi := range seg.features {
+			for _, coord := range features[fi].coords {
 				if coord[0] < segMinLon {
 					segMinLon = coord[0]
 				}
@@ -1332,112 +3440,338 @@ func encodeFeatures(features []lineFeature, writer io.Writer) error {
 				}
 			}
 		}
+		if segMinLon > segMaxLon {
+			// Every feature in the segment is geometry-less.
+			segMinLon, segMinLat, segMaxLon, segMaxLat = globalMinLon, globalMinLat, globalMinLon, globalMinLat
+		}
 
-		deltaMinLon := int32(math.Round((segMinLon - globalMinLon) * 1000000))
-		deltaMinLat := int32(math.Round((segMinLat - globalMinLat) * 1000000))
-		deltaMaxLon := int32(math.Round((segMaxLon - globalMinLon) * 1000000))
-		deltaMaxLat := int32(math.Round((segMaxLat - globalMinLat) * 1000000))
-		if err := writeVarintZigZag(writer, int64(deltaMinLon)); err != nil {
-			return err
+		deltaMinLon := int32(math.Round((segMinLon - globalMinLon) * scale))
+		deltaMinLat := int32(math.Round((segMinLat - globalMinLat) * scale))
+		deltaMaxLon := int32(math.Round((segMaxLon - globalMinLon) * scale))
+		deltaMaxLat := int32(math.Round((segMaxLat - globalMinLat) * scale))
+		if err := writeVarintZigZag(w, int64(deltaMinLon)); err != nil {
+			return encodeStats{}, err
 		}
-		if err := writeVarintZigZag(writer, int64(deltaMinLat)); err != nil {
-			return err
+		if err := writeVarintZigZag(w, int64(deltaMinLat)); err != nil {
+			return encodeStats{}, err
 		}
-		if err := writeVarintZigZag(writer, int64(deltaMaxLon)); err != nil {
-			return err
+		if err := writeVarintZigZag(w, int64(deltaMaxLon)); err != nil {
+			return encodeStats{}, err
 		}
-		if err := writeVarintZigZag(writer, int64(deltaMaxLat)); err != nil {
-			return err
+		if err := writeVarintZigZag(w, int64(deltaMaxLat)); err != nil {
+			return encodeStats{}, err
 		}
 
-		if err := writeUvarint(writer, uint64(len(seg.features))); err != nil {
-			return err
+		if err := writeUvarint(w, uint64(len(seg.features))); err != nil {
+			return encodeStats{}, err
 		}
 
-		for _, f := range seg.features {
+		for _, fi := range seg.features {
+			f := &features[fi]
+			featureCount++
 			stableIDs := []uint16(nil)
 			if f.stableID != "" {
 				ids, ok := stablePieceIDs[f.stableID]
 				if !ok {
-					return fmt.Errorf("missing stable id pieces for stable id %q", f.stableID)
+					return encodeStats{}, fmt.Errorf("missing stable id pieces for stable id %q", f.stableID)
 				}
 				stableIDs = ids
 			}
 			if len(stableIDs) > math.MaxUint8 {
-				return fmt.Errorf("too many stable id pieces in stable id %q: %d exceeds uint8 capacity", f.stableID, len(stableIDs))
+				return encodeStats{}, fmt.Errorf("too many stable id pieces in stable id %q: %d exceeds uint8 capacity", f.stableID, len(stableIDs))
 			}
-			if err := writeUvarint(writer, uint64(len(stableIDs))); err != nil {
-				return err
+			if err := writeUvarint(w, uint64(len(stableIDs))); err != nil {
+				return encodeStats{}, err
 			}
 			for _, pieceID := range stableIDs {
-				if err := writeUvarint(writer, uint64(pieceID)); err != nil {
-					return err
+				if err := writeUvarint(w, uint64(pieceID)); err != nil {
+					return encodeStats{}, err
 				}
 			}
 			pieceIDs := []uint16(nil)
 			if f.title != "" {
 				ids, ok := titlePieceIDs[f.title]
 				if !ok {
-					return fmt.Errorf("missing title pieces for title %q", f.title)
+					return encodeStats{}, fmt.Errorf("missing title pieces for title %q", f.title)
 				}
 				pieceIDs = ids
 			}
 			if len(pieceIDs) > math.MaxUint8 {
-				return fmt.Errorf("too many title pieces in feature title %q: %d exceeds uint8 capacity", f.title, len(pieceIDs))
+				return encodeStats{}, fmt.Errorf("too many title pieces in feature title %q: %d exceeds uint8 capacity", f.title, len(pieceIDs))
 			}
-			if err := writeUvarint(writer, uint64(len(pieceIDs))); err != nil {
-				return err
+			if err := writeUvarint(w, uint64(len(pieceIDs))); err != nil {
+				return encodeStats{}, err
 			}
 			for _, pieceID := range pieceIDs {
-				if err := writeUvarint(writer, uint64(pieceID)); err != nil {
-					return err
+				if err := writeUvarint(w, uint64(pieceID)); err != nil {
+					return encodeStats{}, err
 				}
 			}
-			if err := writeUvarint(writer, uint64(f.priority)); err != nil {
-				return err
+			if err := writeUvarint(w, uint64(f.priority)); err != nil {
+				return encodeStats{}, err
 			}
-			if err := writeUvarint(writer, uint64(f.sourceDataset)); err != nil {
-				return err
+			if err := writeUvarint(w, uint64(f.sourceDataset)); err != nil {
+				return encodeStats{}, err
 			}
-			if err := writeUvarint(writer, uint64(f.routeID)); err != nil {
-				return err
+			if err := writeUvarint(w, uint64(routeIDs[fi])); err != nil {
+				return encodeStats{}, err
+			}
+			scratch = scratch[:0]
+			if opts.BikeTypes {
+				scratch = append(scratch, f.bikeType)
+			}
+			if serviced {
+				scratch = append(scratch, make([]byte, 8)...)
+				order.PutUint64(scratch[len(scratch)-8:], uint64(f.serviced))
+			}
+			if featureFlags {
+				scratch = append(scratch, f.direction&featureFlagDirectionMask)
+			}
+			if opts.HoursRemaining {
+				scratch = append(scratch, 0, 0)
+				order.PutUint16(scratch[len(scratch)-2:], uint16(f.hoursRemaining))
+			}
+			if _, err := w.Write(scratch); err != nil {
+				return encodeStats{}, err
 			}
 
-			if len(f.coords) > math.MaxUint16 {
-				return fmt.Errorf("too many coordinates in feature: %d exceeds uint16 capacity", len(f.coords))
+			if err := writeUvarint(w, uint64(len(f.coords))); err != nil {
+				return encodeStats{}, err
 			}
-			if err := writeUvarint(writer, uint64(len(f.coords))); err != nil {
-				return err
+			// Coordinates are relative to the segment base (its min lon/lat),
+			// which keeps first-coordinate varints short.
+			coordCount += len(f.coords)
+			absCoords = absCoords[:0]
+			for _, coord := range f.coords {
+				absCoords = append(absCoords, [2]int32{
+					int32(math.Round((coord[0]-globalMinLon)*scale)) - deltaMinLon,
+					int32(math.Round((coord[1]-globalMinLat)*scale)) - deltaMinLat,
+				})
 			}
-			prevLon := int32(0)
-			prevLat := int32(0)
-			for i, coord := range f.coords {
-				absLon := int32(math.Round((coord[0] - globalMinLon) * 1000000))
-				absLat := int32(math.Round((coord[1] - globalMinLat) * 1000000))
-				dLon := absLon
-				dLat := absLat
-				if i > 0 {
-					dLon = absLon - prevLon
-					dLat = absLat - prevLat
-				}
-				if err := writeVarintZigZag(writer, int64(dLon)); err != nil {
-					return err
-				}
-				if err := writeVarintZigZag(writer, int64(dLat)); err != nil {
-					return err
+			scratch = appendCoords(scratch[:0], order, absCoords, opts.CompactCoords)
+			if _, err := w.Write(scratch); err != nil {
+				return encodeStats{}, err
+			}
+			if opts.Assigned != nil {
+				orig := fi
+				if origins != nil {
+					orig = origins[fi]
 				}
-				prevLon = absLon
-				prevLat = absLat
+				opts.Assigned(orig, seg.row, seg.col)
+			}
+			if opts.Progress != nil {
+				opts.Progress(featureCount, totalFeatures)
 			}
 		}
 	}
-	return nil
+	if featureCount < opts.MinFeatures {
+		return encodeStats{}, fmt.Errorf("%d features is below the minimum of %d", featureCount, opts.MinFeatures)
+	}
+
+	if _, err := writer.Write([]byte(featuresBinMagic)); err != nil {
+		return encodeStats{}, err
+	}
+	if err := binary.Write(writer, order, featuresBinVersion); err != nil {
+		return encodeStats{}, err
+	}
+	var flags uint8
+	if opts.CompactCoords {
+		flags |= flagCompactCoords
+	}
+	if order == binary.BigEndian {
+		flags |= flagBigEndian
+	}
+	if opts.Mercator {
+		flags |= flagMercator
+	}
+	if !opts.GeneratedAt.IsZero() {
+		flags |= flagGeneratedAt
+	}
+	if len(opts.Styles) > 0 {
+		flags |= flagStyles
+	}
+	if !opts.EndTime.IsZero() {
+		flags |= flagTimelines
+	}
+	if opts.BikeTypes {
+		flags |= flagBikeTypes
+	}
+	if len(opts.Labels) > 0 {
+		flags |= flagLabels
+	}
+	if err := binary.Write(writer, order, flags); err != nil {
+		return encodeStats{}, err
+	}
+	var extFlags uint8
+	if serviced {
+		extFlags |= extFlagServiced
+	}
+	if featureFlags {
+		extFlags |= extFlagFeatureFlags
+	}
+	if opts.Precision > 0 {
+		extFlags |= extFlagPrecision
+	}
+	if opts.HoursRemaining {
+		extFlags |= extFlagHoursRemaining
+	}
+	if err := binary.Write(writer, order, extFlags); err != nil {
+		return encodeStats{}, err
+	}
+	if opts.Precision > 0 {
+		if err := binary.Write(writer, order, uint8(precision)); err != nil {
+			return encodeStats{}, err
+		}
+	}
+	if err := writeUvarint(writer, uint64(len(segments))); err != nil {
+		return encodeStats{}, err
+	}
+	if err := binary.Write(writer, order, globalMinLon); err != nil {
+		return encodeStats{}, err
+	}
+	if err := binary.Write(writer, order, globalMinLat); err != nil {
+		return encodeStats{}, err
+	}
+	if !opts.GeneratedAt.IsZero() {
+		if err := binary.Write(writer, order, opts.GeneratedAt.Unix()); err != nil {
+			return encodeStats{}, err
+		}
+	}
+	if len(opts.Styles) > 0 {
+		if err := writeStyles(writer, opts.Styles); err != nil {
+			return encodeStats{}, err
+		}
+	}
+	if !opts.EndTime.IsZero() {
+		if err := binary.Write(writer, order, opts.EndTime.Unix()); err != nil {
+			return encodeStats{}, err
+		}
+		if err := writeTimelines(writer, opts.Timelines); err != nil {
+			return encodeStats{}, err
+		}
+	}
+	if len(opts.Labels) > 0 {
+		if err := writeLabels(writer, opts.Labels); err != nil {
+			return encodeStats{}, err
+		}
+	}
+	if err := writeUvarint(writer, uint64(cols)); err != nil {
+		return encodeStats{}, err
+	}
+	if err := writeUvarint(writer, uint64(rows)); err != nil {
+		return encodeStats{}, err
+	}
+	if err := writeUvarint(writer, uint64(len(routeEntries))); err != nil {
+		return encodeStats{}, err
+	}
+	if err := writeUvarint(writer, uint64(len(pieceEntries))); err != nil {
+		return encodeStats{}, err
+	}
+	for _, piece := range pieceEntries {
+		pieceBytes := []byte(piece)
+		if len(pieceBytes) > maxPieceBytes {
+			return encodeStats{}, fmt.Errorf("%w: %q exceeds %d bytes", errTitleTooLong, piece, maxPieceBytes)
+		}
+		if err := writeUvarint(writer, uint64(len(pieceBytes))); err != nil {
+			return encodeStats{}, err
+		}
+		if _, err := writer.Write(pieceBytes); err != nil {
+			return encodeStats{}, err
+		}
+	}
+	for _, entry := range routeEntries {
+		maintIDs := routeMaintPieceIDs[entry.maint]
+		routeIDs := routeNamePieceIDs[entry.route]
+		if err := writeUvarint(writer, uint64(len(maintIDs))); err != nil {
+			return encodeStats{}, err
+		}
+		for _, id := range maintIDs {
+			if err := writeUvarint(writer, uint64(id)); err != nil {
+				return encodeStats{}, err
+			}
+		}
+		if err := writeUvarint(writer, uint64(len(routeIDs))); err != nil {
+			return encodeStats{}, err
+		}
+		for _, id := range routeIDs {
+			if err := writeUvarint(writer, uint64(id)); err != nil {
+				return encodeStats{}, err
+			}
+		}
+	}
+
+	for i, seg := range segments {
+		if err := writeUvarint(writer, uint64(seg.row)); err != nil {
+			return encodeStats{}, err
+		}
+		if err := writeUvarint(writer, uint64(seg.col)); err != nil {
+			return encodeStats{}, err
+		}
+		if err := writeUvarint(writer, uint64(segData[i].Len())); err != nil {
+			return encodeStats{}, err
+		}
+	}
+	for i := range segData {
+		if _, err := segData[i].WriteTo(writer); err != nil {
+			return encodeStats{}, err
+		}
+	}
+	return encodeStats{
+		Features:   featureCount,
+		Segments:   len(segments),
+		Coords:     coordCount,
+		Routes:     len(routeEntries),
+		NamePieces: len(pieceEntries),
+		Bytes:      cw.n,
+	}, nil
+}
+
+// featureSource is a dataset read from path or, if path is empty, downloaded
+// by item ID and optionally saved as saveName.
+type featureSource struct {
+	path     string
+	saveName string
+	itemID   string
+}
+
+// loadFeatureCollections loads sources concurrently, returning their
+// collections in order. The first failure cancels the remaining loads.
+func loadFeatureCollections(ctx context.Context, client *http.Client, logger *log.Logger, saveDir string, sources []featureSource) ([]*geojson.FeatureCollection, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fcs := make([]*geojson.FeatureCollection, len(sources))
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for i, src := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fc, err := loadFeatureCollection(ctx, client, logger, src.path, saveDir, src.saveName, src.itemID)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			fcs[i] = fc
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return fcs, nil
 }
 
-func loadFeatureCollection(ctx context.Context, path, saveDir, saveName, itemID string) (*geojson.FeatureCollection, error) {
+func loadFeatureCollection(ctx context.Context, client *http.Client, logger *log.Logger, path, saveDir, saveName, itemID string) (*geojson.FeatureCollection, error) {
 	var data []byte
 	if path == "" {
-		rc, err := download(ctx, itemID)
+		rc, err := download(ctx, client, logger, itemID)
 		if err != nil {
 			return nil, err
 		}
@@ -1464,14 +3798,154 @@ func loadFeatureCollection(ctx context.Context, path, saveDir, saveName, itemID
 		data = b
 	}
 
+	// orb.Point holds only x and y, so any Z ordinate ArcGIS exports is
+	// dropped here.
 	fc := geojson.NewFeatureCollection()
 	if err := json.Unmarshal(data, &fc); err != nil {
 		return nil, err
 	}
+	source := path
+	if source == "" {
+		source = saveName
+	}
+	if err := checkFiniteCoords(fc); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
 	return fc, nil
 }
 
-func download(ctx context.Context, itemID string) (io.ReadCloser, error) {
+// countDuplicateStableIDs returns how many features in fc share the stable
+// ID that stableID derives for them with an earlier feature. Features without
+// one are ignored.
+func countDuplicateStableIDs(fc *geojson.FeatureCollection, stableID func(geojson.Properties, int) string) int {
+	seen := make(map[string]bool, len(fc.Features))
+	var dups int
+	for _, f := range fc.Features {
+		id := stableID(f.Properties, f.Properties.MustInt("OBJECTID", 0))
+		if id == "" {
+			continue
+		}
+		if seen[id] {
+			dups++
+		}
+		seen[id] = true
+	}
+	return dups
+}
+
+// suffixDuplicateStableIDs appends -2, -3 and so on to the stable IDs of
+// features that repeat an earlier feature's, so each stays unique. It returns
+// how many were changed.
+func suffixDuplicateStableIDs(features []lineFeature) int {
+	counts := make(map[string]int, len(features))
+	var changed int
+	for i := range features {
+		id := features[i].stableID
+		if id == "" {
+			continue
+		}
+		counts[id]++
+		if n := counts[id]; n > 1 {
+			features[i].stableID = fmt.Sprintf("%s-%d", id, n)
+			changed++
+		}
+	}
+	return changed
+}
+
+// checkFiniteCoords rejects NaN and infinite coordinates, which would
+// otherwise poison the bounds and rounding during encoding.
+func checkFiniteCoords(fc *geojson.FeatureCollection) error {
+	for i, f := range fc.Features {
+		if pt, ok := firstNonFinite(f.Geometry); ok {
+			return fmt.Errorf("feature %d (OBJECTID %d) has non-finite coordinate %v", i, f.Properties.MustInt("OBJECTID", 0), pt)
+		}
+	}
+	return nil
+}
+
+func firstNonFinite(geom orb.Geometry) (orb.Point, bool) {
+	finite := func(v float64) bool { return !math.IsNaN(v) && !math.IsInf(v, 0) }
+	check := func(pts []orb.Point) (orb.Point, bool) {
+		for _, pt := range pts {
+			if !finite(pt[0]) || !finite(pt[1]) {
+				return pt, true
+			}
+		}
+		return orb.Point{}, false
+	}
+	switch g := geom.(type) {
+	case orb.Point:
+		return check([]orb.Point{g})
+	case orb.MultiPoint:
+		return check(g)
+	case orb.LineString:
+		return check(g)
+	case orb.Ring:
+		return check(g)
+	case orb.MultiLineString:
+		for _, ls := range g {
+			if pt, ok := check(ls); ok {
+				return pt, true
+			}
+		}
+	case orb.Polygon:
+		for _, r := range g {
+			if pt, ok := check(r); ok {
+				return pt, true
+			}
+		}
+	case orb.MultiPolygon:
+		for _, p := range g {
+			if pt, ok := firstNonFinite(p); ok {
+				return pt, true
+			}
+		}
+	case orb.Collection:
+		for _, sub := range g {
+			if pt, ok := firstNonFinite(sub); ok {
+				return pt, true
+			}
+		}
+	}
+	return orb.Point{}, false
+}
+
+// downloadLogger returns the logger for download progress, which -quiet
+// silences for scheduled runs.
+func downloadLogger(quiet bool) *log.Logger {
+	if quiet {
+		return log.New(io.Discard, "", 0)
+	}
+	return log.Default()
+}
+
+const resultFetchAttempts = 4
+
+// errNonJSON is returned when a source responds with something other than
+// JSON, such as an HTML error page served with a 200 status.
+var errNonJSON = errors.New("unexpected non-JSON response from source")
+
+// nonJSONPreviewBytes is how much of a non-JSON response errNonJSON quotes.
+const nonJSONPreviewBytes = 64
+
+// checkJSON returns errNonJSON, quoting the start of body, if contentType is
+// HTML or body starts with '<'.
+func checkJSON(contentType string, body []byte) error {
+	body = bytes.TrimLeft(body, " \t\r\n")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "text/html" && !bytes.HasPrefix(body, []byte("<")) {
+		return nil
+	}
+	if len(body) > nonJSONPreviewBytes {
+		body = body[:nonJSONPreviewBytes]
+	}
+	return fmt.Errorf("%w: content type %q, body begins %q", errNonJSON, contentType, body)
+}
+
+var resultRetryDelay = 2 * time.Second
+
+func download(ctx context.Context, client *http.Client, logger *log.Logger, itemID string) (io.ReadCloser, error) {
 	downloadURL := fmt.Sprintf("https://hub.arcgis.com/api/download/v1/items/%s/geojson?redirect=false&layers=0&spatialRefId=4326", itemID)
 
 	deadline := time.Now().Add(5 * time.Minute)
@@ -1483,7 +3957,7 @@ func download(ctx context.Context, itemID string) (io.ReadCloser, error) {
 			if err != nil {
 				return "", fmt.Errorf("creating request: %w", err)
 			}
-			resp, err := http.DefaultClient.Do(req)
+			resp, err := client.Do(req)
 			if err != nil {
 				return "", fmt.Errorf("executing request: %w", err)
 			}
@@ -1497,6 +3971,9 @@ func download(ctx context.Context, itemID string) (io.ReadCloser, error) {
 			if err != nil {
 				return "", fmt.Errorf("reading body: %w", err)
 			}
+			if err := checkJSON(resp.Header.Get("Content-Type"), b); err != nil {
+				return "", err
+			}
 
 			var body struct {
 				ResultURL string `json:"resultUrl"`
@@ -1511,7 +3988,7 @@ func download(ctx context.Context, itemID string) (io.ReadCloser, error) {
 			return nil, fmt.Errorf("downloading data: %w", err)
 		}
 		if u == "" {
-			log.Printf("waiting for %s export", itemID)
+			logger.Printf("waiting for %s export", itemID)
 			select {
 			case <-time.After(5 * time.Second):
 			case <-ctx.Done():
@@ -1527,17 +4004,48 @@ func download(ctx context.Context, itemID string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("timed out waiting for %s export", itemID)
 	}
 
-	log.Println("downloading from", resultURL)
+	logger.Println("downloading from", resultURL)
 
-	req, err := http.NewRequestWithContext(ctx, "GET", resultURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("executing request: %w", err)
+	// The export can briefly 404 after resultUrl is handed out, so retry
+	// error statuses a few times before giving up.
+	var lastErr error
+	delay := resultRetryDelay
+	for attempt := 1; attempt <= resultFetchAttempts; attempt++ {
+		if attempt > 1 {
+			logger.Printf("retrying %s in %s: %v", resultURL, delay, lastErr)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			delay *= 2
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", resultURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("creating request: %w", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("executing request: %w", err)
+		}
+		if resp.StatusCode/100 == 2 {
+			br := bufio.NewReader(resp.Body)
+			// Peek returns what it could read along with any error; a short
+			// body is still worth checking.
+			head, _ := br.Peek(nonJSONPreviewBytes)
+			if err := checkJSON(resp.Header.Get("Content-Type"), head); err != nil {
+				resp.Body.Close()
+				return nil, fmt.Errorf("downloading %s: %w", resultURL, err)
+			}
+			return struct {
+				io.Reader
+				io.Closer
+			}{br, resp.Body}, nil
+		}
+		resp.Body.Close()
+		lastErr = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
-	return resp.Body, nil
+	return nil, fmt.Errorf("downloading %s: %w", resultURL, lastErr)
 }
 
 type pointXY struct {
@@ -1554,6 +4062,8 @@ type indexedLine struct {
 	maxLat   float64
 	priority uint8
 	objectID int
+	// name is the line's street name as a streetNameKey, if known.
+	name string
 }
 
 type spatialIndex struct {
@@ -1566,6 +4076,12 @@ type spatialIndex struct {
 	rows      int
 	cells     map[cellKey][]int
 	projector projector
+	// bufferMeters widens each line to a band of this half-width; match
+	// distances are measured from the band's edges rather than the line.
+	bufferMeters float64
+	// nameBiasMeters makes lines whose name matches the bike route's street
+	// rank as if they were this much closer.
+	nameBiasMeters float64
 }
 
 type segmentAssignment struct {
@@ -1668,28 +4184,8 @@ func newSpatialIndex(lines []indexedLine, cols, rows int) (*spatialIndex, error)
 		projector: proj,
 	}
 
-	cellWidth := (idx.maxLon - idx.minLon) / float64(cols)
-	cellHeight := (idx.maxLat - idx.minLat) / float64(rows)
-
 	for i, line := range idx.lines {
-		colMin := int((line.minLon - idx.minLon) / cellWidth)
-		colMax := int((line.maxLon - idx.minLon) / cellWidth)
-		rowMin := int((line.minLat - idx.minLat) / cellHeight)
-		rowMax := int((line.maxLat - idx.minLat) / cellHeight)
-
-		if colMin < 0 {
-			colMin = 0
-		}
-		if rowMin < 0 {
-			rowMin = 0
-		}
-		if colMax >= cols {
-			colMax = cols - 1
-		}
-		if rowMax >= rows {
-			rowMax = rows - 1
-		}
-
+		colMin, colMax, rowMin, rowMax := idx.cellRange(line.minLon, line.minLat, line.maxLon, line.maxLat)
 		for row := rowMin; row <= rowMax; row++ {
 			for col := colMin; col <= colMax; col++ {
 				key := cellKey{row: row, col: col}
@@ -1701,27 +4197,41 @@ func newSpatialIndex(lines []indexedLine, cols, rows int) (*spatialIndex, error)
 	return idx, nil
 }
 
-func (idx *spatialIndex) candidates(minLon, minLat, maxLon, maxLat float64) []int {
+// cellRange returns the clamped cell range covering the given bounds. An
+// index with zero width or height (e.g. a single horizontal line) maps that
+// axis entirely to cell 0 rather than dividing by zero.
+func (idx *spatialIndex) cellRange(minLon, minLat, maxLon, maxLat float64) (colMin, colMax, rowMin, rowMax int) {
 	cellWidth := (idx.maxLon - idx.minLon) / float64(idx.cols)
 	cellHeight := (idx.maxLat - idx.minLat) / float64(idx.rows)
 
-	colMin := int((minLon - idx.minLon) / cellWidth)
-	colMax := int((maxLon - idx.minLon) / cellWidth)
-	rowMin := int((minLat - idx.minLat) / cellHeight)
-	rowMax := int((maxLat - idx.minLat) / cellHeight)
-
-	if colMin < 0 {
-		colMin = 0
+	if cellWidth > 0 {
+		colMin = int((minLon - idx.minLon) / cellWidth)
+		colMax = int((maxLon - idx.minLon) / cellWidth)
 	}
-	if rowMin < 0 {
-		rowMin = 0
+	if cellHeight > 0 {
+		rowMin = int((minLat - idx.minLat) / cellHeight)
+		rowMax = int((maxLat - idx.minLat) / cellHeight)
 	}
-	if colMax >= idx.cols {
-		colMax = idx.cols - 1
+
+	colMin = clampInt(colMin, 0, idx.cols-1)
+	colMax = clampInt(colMax, 0, idx.cols-1)
+	rowMin = clampInt(rowMin, 0, idx.rows-1)
+	rowMax = clampInt(rowMax, 0, idx.rows-1)
+	return colMin, colMax, rowMin, rowMax
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
 	}
-	if rowMax >= idx.rows {
-		rowMax = idx.rows - 1
+	if v > hi {
+		return hi
 	}
+	return v
+}
+
+func (idx *spatialIndex) candidates(minLon, minLat, maxLon, maxLat float64) []int {
+	colMin, colMax, rowMin, rowMax := idx.cellRange(minLon, minLat, maxLon, maxLat)
 
 	seen := make(map[int]struct{})
 	var out []int
@@ -1765,7 +4275,50 @@ func lineSegments(points []pointXY) []segmentXY {
 	return out
 }
 
-func overlapAttribution(line orb.LineString, idx *spatialIndex, sourceDataset uint8, maxDistanceMeters, maxAngleRad float64) overlapAttributionResult {
+// matchTrace logs matching steps for one feature, for -trace-title. Its
+// methods do nothing on a nil *matchTrace.
+type matchTrace struct {
+	title    string
+	objectID int
+}
+
+func (t *matchTrace) printf(format string, args ...any) {
+	if t == nil {
+		return
+	}
+	log.Printf("trace %q (OBJECTID %d): %s", t.title, t.objectID, fmt.Sprintf(format, args...))
+}
+
+// matchRank orders candidate segment matches. The closest wins; exact ties
+// go to the lower priority number, then the smaller angle delta, then the
+// lower OBJECTID, so results don't depend on candidate order.
+type matchRank struct {
+	dist float64
+	// score is dist less any name match bias; lower ranks better.
+	score    float64
+	priority uint8
+	angle    float64
+	objectID int
+}
+
+func (r matchRank) better(o matchRank) bool {
+	if r.score != o.score {
+		return r.score < o.score
+	}
+	if r.priority != o.priority {
+		return r.priority < o.priority
+	}
+	if r.angle != o.angle {
+		return r.angle < o.angle
+	}
+	return r.objectID < o.objectID
+}
+
+// overlapAttribution assigns each segment of line to the nearest line in idx
+// within maxDistanceMeters and maxAngleRad, or at any angle if maxAngleRad is
+// 0. name is the street name of line as a streetNameKey, favoring idx lines
+// with the same name by idx.nameBiasMeters.
+func overlapAttribution(line orb.LineString, name string, idx *spatialIndex, sourceDataset uint8, maxDistanceMeters, maxAngleRad float64, tr *matchTrace) overlapAttributionResult {
 	result := overlapAttributionResult{
 		byPriority: make(map[uint8]float64),
 		byObjectID: make(map[int]float64),
@@ -1774,13 +4327,15 @@ func overlapAttribution(line orb.LineString, idx *spatialIndex, sourceDataset ui
 		return result
 	}
 
+	reach := maxDistanceMeters + idx.bufferMeters
 	minLon, minLat, maxLon, maxLat := lineBounds(line)
-	minLon -= metersToDegreesLon(maxDistanceMeters, idx.projector.lat0Rad)
-	maxLon += metersToDegreesLon(maxDistanceMeters, idx.projector.lat0Rad)
-	minLat -= metersToDegreesLat(maxDistanceMeters)
-	maxLat += metersToDegreesLat(maxDistanceMeters)
+	minLon -= metersToDegreesLon(reach, idx.projector.lat0Rad)
+	maxLon += metersToDegreesLon(reach, idx.projector.lat0Rad)
+	minLat -= metersToDegreesLat(reach)
+	maxLat += metersToDegreesLat(reach)
 
 	candidateIdxs := idx.candidates(minLon, minLat, maxLon, maxLat)
+	tr.printf("%s: %d candidate lines within %.1fm", datasetName(sourceDataset), len(candidateIdxs), reach)
 	if len(candidateIdxs) == 0 {
 		return result
 	}
@@ -1794,6 +4349,7 @@ func overlapAttribution(line orb.LineString, idx *spatialIndex, sourceDataset ui
 		objectID int
 		priority uint8
 		segments []segmentXY
+		bias     float64
 	}
 
 	candidates := make([]candidateLine, 0, len(candidateIdxs))
@@ -1803,10 +4359,15 @@ func overlapAttribution(line orb.LineString, idx *spatialIndex, sourceDataset ui
 		if len(segs) == 0 {
 			continue
 		}
+		var bias float64
+		if name != "" && candidate.name == name {
+			bias = idx.nameBiasMeters
+		}
 		candidates = append(candidates, candidateLine{
 			objectID: candidate.objectID,
 			priority: candidate.priority,
 			segments: segs,
+			bias:     bias,
 		})
 	}
 
@@ -1820,25 +4381,32 @@ func overlapAttribution(line orb.LineString, idx *spatialIndex, sourceDataset ui
 		if segLength == 0 {
 			continue
 		}
-		bestDist := math.Inf(1)
-		bestPriority := uint8(0)
-		bestObjectID := 0
+		best := matchRank{dist: math.Inf(1), score: math.Inf(1)}
 		for _, cand := range candidates {
 			for _, candSeg := range cand.segments {
-				if maxAngleRad > 0 && angleDelta(seg.angle, candSeg.angle) > maxAngleRad {
+				angle := angleDelta(seg.angle, candSeg.angle)
+				if maxAngleRad > 0 && angle > maxAngleRad {
+					tr.printf("segment %d: OBJECTID %d rejected, angle %.1f° > %.1f°", i, cand.objectID, rad2deg(angle), rad2deg(maxAngleRad))
+					continue
+				}
+				d := math.Max(0, segmentDistance(seg.a, seg.b, candSeg.a, candSeg.b)-idx.bufferMeters)
+				if d > maxDistanceMeters {
+					tr.printf("segment %d: OBJECTID %d rejected, distance %.1fm > %.1fm", i, cand.objectID, d, maxDistanceMeters)
 					continue
 				}
-				d := segmentDistance(seg.a, seg.b, candSeg.a, candSeg.b)
-				if d <= maxDistanceMeters && d < bestDist {
-					bestDist = d
-					bestPriority = cand.priority
-					bestObjectID = cand.objectID
+				tr.printf("segment %d: OBJECTID %d priority %d distance %.1fm angle %.1f°", i, cand.objectID, cand.priority, d, rad2deg(angle))
+				rank := matchRank{dist: d, score: d - cand.bias, priority: cand.priority, angle: angle, objectID: cand.objectID}
+				if rank.better(best) {
+					best = rank
 				}
 			}
 		}
-		if bestPriority == 0 {
+		if best.priority == 0 {
+			tr.printf("segment %d: no match", i)
 			continue
 		}
+		tr.printf("segment %d: chose %s OBJECTID %d priority %d", i, datasetName(sourceDataset), best.objectID, best.priority)
+		bestDist, bestPriority, bestObjectID := best.dist, best.priority, best.objectID
 		result.assignments = append(result.assignments, segmentAssignment{
 			priority:       bestPriority,
 			start:          line[i],
@@ -1859,7 +4427,7 @@ func overlapAttribution(line orb.LineString, idx *spatialIndex, sourceDataset ui
 	return result
 }
 
-func overlapAttributionPrefer(line orb.LineString, primaryIdx *spatialIndex, primaryDataset uint8, fallbackIdx *spatialIndex, fallbackDataset uint8, maxDistanceMeters, maxAngleRad float64) overlapAttributionResult {
+func overlapAttributionPrefer(line orb.LineString, name string, primaryIdx *spatialIndex, primaryDataset uint8, fallbackIdx *spatialIndex, fallbackDataset uint8, maxDistanceMeters, maxAngleRad float64, tr *matchTrace) overlapAttributionResult {
 	result := overlapAttributionResult{
 		byPriority: make(map[uint8]float64),
 		byObjectID: make(map[int]float64),
@@ -1868,19 +4436,19 @@ func overlapAttributionPrefer(line orb.LineString, primaryIdx *spatialIndex, pri
 		return result
 	}
 
-	primary := overlapAttribution(line, primaryIdx, primaryDataset, maxDistanceMeters, maxAngleRad)
+	primary := overlapAttribution(line, name, primaryIdx, primaryDataset, maxDistanceMeters, maxAngleRad, tr)
 	if primaryIdx == nil || fallbackIdx == nil || primary.totalLength == 0 {
 		if fallbackIdx == nil {
 			return primary
 		}
-		fallback := overlapAttribution(line, fallbackIdx, fallbackDataset, maxDistanceMeters, maxAngleRad)
+		fallback := overlapAttribution(line, name, fallbackIdx, fallbackDataset, maxDistanceMeters, maxAngleRad, tr)
 		if primary.totalLength == 0 {
 			return fallback
 		}
 		return primary
 	}
 
-	fallback := overlapAttribution(line, fallbackIdx, fallbackDataset, maxDistanceMeters, maxAngleRad)
+	fallback := overlapAttribution(line, name, fallbackIdx, fallbackDataset, maxDistanceMeters, maxAngleRad, tr)
 
 	// Merge by segment index (same line input)
 	assignments := make([]segmentAssignment, 0, len(primary.assignments)+len(fallback.assignments))
@@ -1986,6 +4554,63 @@ func runsFromAssignments(assignments []segmentAssignment, minRunMeters float64)
 	return runs
 }
 
+// fillUnmatchedRuns adds bike-sourced runs at priority for the stretches of
+// line not covered by runs, skipping any shorter than minRunMeters.
+func fillUnmatchedRuns(line orb.LineString, runs []lineRun, priority uint8, minRunMeters float64) []lineRun {
+	proj := projectorForLine(line)
+	covered := make([]bool, len(line)-1)
+	for _, run := range runs {
+		for i := run.startSegment; i <= run.endSegment; i++ {
+			covered[i] = true
+		}
+	}
+	out := append([]lineRun(nil), runs...)
+	for start := 0; start < len(covered); start++ {
+		if covered[start] {
+			continue
+		}
+		end := start
+		for end+1 < len(covered) && !covered[end+1] {
+			end++
+		}
+		coords := append(orb.LineString(nil), line[start:end+2]...)
+		length := lineLengthMeters(coords, proj)
+		if length > 0 && length >= minRunMeters {
+			out = append(out, lineRun{
+				priority:      priority,
+				sourceDataset: datasetBike,
+				coords:        coords,
+				length:        length,
+				byObjectID:    make(map[int]float64),
+				startSegment:  start,
+				endSegment:    end,
+			})
+		}
+		start = end
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].startSegment < out[j].startSegment })
+	return out
+}
+
+// densifyLine inserts points so no segment is longer than maxStepMeters.
+func densifyLine(line orb.LineString, maxStepMeters float64) orb.LineString {
+	if len(line) < 2 || maxStepMeters <= 0 {
+		return line
+	}
+	proj := projectorForLine(line)
+	out := orb.LineString{line[0]}
+	for i := 1; i < len(line); i++ {
+		a, b := line[i-1], line[i]
+		n := int(math.Ceil(distancePoint(proj.toXY(a), proj.toXY(b)) / maxStepMeters))
+		for j := 1; j < n; j++ {
+			t := float64(j) / float64(n)
+			out = append(out, orb.Point{a[0] + (b[0]-a[0])*t, a[1] + (b[1]-a[1])*t})
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
 func mergeShortRuns(runs []lineRun, minLen float64) []lineRun {
 	if len(runs) <= 1 {
 		return runs
@@ -2082,7 +4707,7 @@ func dominantObjectID(byObjectID map[int]float64) int {
 	var bestID int
 	bestLen := 0.0
 	for id, length := range byObjectID {
-		if length > bestLen {
+		if length > bestLen || (length == bestLen && length > 0 && id < bestID) {
 			bestLen = length
 			bestID = id
 		}
@@ -2094,7 +4719,7 @@ func dominantPriority(byPriority map[uint8]float64) uint8 {
 	var bestPriority uint8
 	bestLen := 0.0
 	for p, length := range byPriority {
-		if length > bestLen {
+		if length > bestLen || (length == bestLen && length > 0 && p < bestPriority) {
 			bestLen = length
 			bestPriority = p
 		}
@@ -2161,6 +4786,67 @@ func simplifyLineString(line orb.LineString, toleranceMeters float64) orb.LineSt
 	return out
 }
 
+// snapEndpointsMeters is how far -snap-endpoints will move a line's ends.
+const snapEndpointsMeters = 5
+
+// snapLineEndpoints moves line's first point, if snapFirst, and last point,
+// if snapLast, onto the nearest point of targets within maxMeters, returning
+// the new line and how many ends moved.
+func snapLineEndpoints(line orb.LineString, targets []orb.LineString, maxMeters float64, snapFirst, snapLast bool) (orb.LineString, int) {
+	if len(line) < 2 || len(targets) == 0 {
+		return line, 0
+	}
+	var ends []int
+	if snapFirst {
+		ends = append(ends, 0)
+	}
+	if snapLast {
+		ends = append(ends, len(line)-1)
+	}
+	if len(ends) == 0 {
+		return line, 0
+	}
+	proj := projectorForLine(line)
+	out := line.Clone()
+	moved := 0
+	for _, i := range ends {
+		if p, ok := nearestPointOnLines(out[i], targets, proj, maxMeters); ok && p != out[i] {
+			out[i] = p
+			moved++
+		}
+	}
+	return out, moved
+}
+
+// nearestPointOnLines returns the point on lines closest to p, if any is
+// within maxMeters.
+func nearestPointOnLines(p orb.Point, lines []orb.LineString, proj projector, maxMeters float64) (orb.Point, bool) {
+	pxy := proj.toXY(p)
+	var best orb.Point
+	bestDist := maxMeters
+	found := false
+	for _, line := range lines {
+		for i := 1; i < len(line); i++ {
+			a, b := proj.toXY(line[i-1]), proj.toXY(line[i])
+			vx, vy := b.x-a.x, b.y-a.y
+			var t float64
+			if c2 := vx*vx + vy*vy; c2 > 0 {
+				t = max(0, min(1, ((pxy.x-a.x)*vx+(pxy.y-a.y)*vy)/c2))
+			}
+			// The projection is linear, so t applies to lon/lat too.
+			if d := distancePoint(pxy, pointXY{x: a.x + t*vx, y: a.y + t*vy}); d <= bestDist {
+				best = orb.Point{
+					line[i-1][0] + t*(line[i][0]-line[i-1][0]),
+					line[i-1][1] + t*(line[i][1]-line[i-1][1]),
+				}
+				bestDist = d
+				found = true
+			}
+		}
+	}
+	return best, found
+}
+
 func projectorForLine(line orb.LineString) projector {
 	if len(line) == 0 {
 		return projector{}
@@ -3,13 +3,29 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/danp/snowhfx/internal/featuresbin"
 	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
 )
 
 type geojsonFeatureCollection struct {
@@ -131,7 +147,7 @@ func TestEncodeFeaturesNameTableDeduplicatesTitles(t *testing.T) {
 	}
 
 	var out bytes.Buffer
-	if err := encodeFeatures(features, &out); err != nil {
+	if _, err := encodeFeatures(features, &out, encodeOptions{}); err != nil {
 		t.Fatalf("encode features: %v", err)
 	}
 
@@ -156,521 +172,4514 @@ func TestEncodeFeaturesNameTableDeduplicatesTitles(t *testing.T) {
 	}
 }
 
-func runWithGeoJSON(t *testing.T, travelways, bike, ice geojsonFeatureCollection) (string, string) {
-	t.Helper()
-	dir := t.TempDir()
-	travelwaysPath := filepath.Join(dir, "travelways.geojson")
-	bikePath := filepath.Join(dir, "bike.geojson")
-	icePath := filepath.Join(dir, "ice.geojson")
-	travelwaysOut := filepath.Join(dir, "features.bin")
-	bikeOut := filepath.Join(dir, "features_cycling.bin")
+func TestEncodeFeaturesProgress(t *testing.T) {
+	features := []lineFeature{
+		{title: "One", priority: 1, coords: orb.LineString{{0, 0}, {0.001, 0}}},
+		{title: "Two", priority: 2, coords: orb.LineString{{1, 1}, {1.001, 1}}},
+		{title: "Empty", priority: 2},
+		{title: "Three", priority: 3, coords: orb.LineString{{2, 2}, {2.001, 2}}},
+	}
 
-	writeGeoJSON(t, travelwaysPath, travelways)
-	writeGeoJSON(t, bikePath, bike)
-	writeGeoJSON(t, icePath, ice)
+	for _, allowEmpty := range []bool{false, true} {
+		wantTotal := 3
+		if allowEmpty {
+			wantTotal = 4
+		}
+		var calls []int
+		opts := encodeOptions{
+			AllowEmptyGeometry: allowEmpty,
+			Progress: func(done, total int) {
+				if total != wantTotal {
+					t.Fatalf("allow empty %v: progress total: got %d want %d", allowEmpty, total, wantTotal)
+				}
+				calls = append(calls, done)
+			},
+		}
+		var out bytes.Buffer
+		if _, err := encodeFeatures(features, &out, opts); err != nil {
+			t.Fatalf("allow empty %v: encode features: %v", allowEmpty, err)
+		}
+		if len(calls) != wantTotal {
+			t.Fatalf("allow empty %v: progress calls: got %d want %d", allowEmpty, len(calls), wantTotal)
+		}
+		for i, done := range calls {
+			if done != i+1 {
+				t.Fatalf("allow empty %v: progress call %d: got done=%d want %d", allowEmpty, i, done, i+1)
+			}
+		}
+	}
+}
 
-	cfg := runConfig{
-		TravelwaysFile: travelwaysPath,
-		BikeFile:       bikePath,
-		IceFile:        icePath,
-		TravelwaysOut:  travelwaysOut,
-		BikeOut:        bikeOut,
-		MaxMatchMeters: 30,
-		MaxAngleDeg:    30,
+func TestEncodeFeaturesSegmentRelativeCoords(t *testing.T) {
+	features := []lineFeature{
+		{
+			stableID:      "near",
+			title:         "Near Base",
+			priority:      1,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.6, 44.6}, {-63.599, 44.6005}, {-63.598, 44.601}},
+		},
+		{
+			stableID:      "far",
+			title:         "Far From Base",
+			priority:      2,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.0012, 44.9013}, {-63.0005, 44.9008}, {-63.0, 44.9}},
+		},
 	}
-	if err := run(context.Background(), cfg); err != nil {
-		t.Fatalf("run: %v", err)
+
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	decoded, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decode features: %v", err)
+	}
+	if len(decoded) != len(features) {
+		t.Fatalf("decoded feature count: got %d want %d", len(decoded), len(features))
+	}
+
+	varintLen := func(v int64) int {
+		var buf [binary.MaxVarintLen64]byte
+		return binary.PutUvarint(buf[:], encodeZigZag(v))
+	}
+	var globalBytes, segmentBytes int
+	for i, feat := range decoded {
+		want := features[i].coords
+		if len(feat.Coords) != len(want) {
+			t.Fatalf("feature %q coord count: got %d want %d", feat.Title, len(feat.Coords), len(want))
+		}
+		for j, coord := range feat.Coords {
+			if math.Abs(coord[0]-want[j][0]) > 1e-6 || math.Abs(coord[1]-want[j][1]) > 1e-6 {
+				t.Fatalf("feature %q coord %d: got %v want %v", feat.Title, j, coord, want[j])
+			}
+		}
+		// Each feature sits alone in its grid cell, so its segment base is its
+		// own bounding box minimum.
+		minLon, minLat, _, _ := lineBounds(want)
+		first := want[0]
+		globalBytes += varintLen(int64(math.Round((first[0]-header.GlobalMinLon)*1000000))) +
+			varintLen(int64(math.Round((first[1]-header.GlobalMinLat)*1000000)))
+		segmentBytes += varintLen(int64(math.Round((first[0]-minLon)*1000000))) +
+			varintLen(int64(math.Round((first[1]-minLat)*1000000)))
+	}
+	if segmentBytes >= globalBytes {
+		t.Fatalf("expected segment-relative first coords to be smaller: segment=%d global=%d", segmentBytes, globalBytes)
 	}
-	return travelwaysOut, bikeOut
 }
 
-func TestTravelwaysFeaturesBin(t *testing.T) {
-	travelways := geojsonFeatureCollection{
-		Type: "FeatureCollection",
-		Features: []geojsonFeature{
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"OBJECTID":  1,
-					"WINT_PLOW": "Y",
-					"WINT_LOS":  "PRI2",
-					"OWNER":     "HRM",
-					"LOCATION":  "CORNWALLIS ST",
-				},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
-				},
-			},
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"OBJECTID":  2,
-					"WINT_PLOW": "N",
-					"WINT_LOS":  "PRI1",
-					"OWNER":     "HRM",
-					"LOCATION":  "Not Plowed",
-				},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{1, 1}, {1.001, 1}},
-				},
-			},
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"OBJECTID":  3,
-					"WINT_PLOW": "Y",
-					"WINT_LOS":  "PRI1",
-					"OWNER":     "PRIV",
-					"LOCATION":  "Private Way",
-				},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{2, 2}, {2.001, 2}},
-				},
-			},
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"OBJECTID":  4,
-					"WINT_PLOW": "Y",
-					"WINT_LOS":  "PRI5",
-					"OWNER":     "HRM",
-					"LOCATION":  "Bad Priority",
-				},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{3, 3}, {3.001, 3}},
-				},
-			},
+func TestReaderSegmentDecodesMultiFeatureCell(t *testing.T) {
+	features := []lineFeature{
+		{
+			stableID:      "sw",
+			title:         "South West",
+			priority:      1,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.6, 44.6}, {-63.599, 44.601}},
+		},
+		{
+			stableID:      "ne1",
+			title:         "North East One",
+			priority:      2,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.001, 44.899}, {-63.0, 44.9}},
+		},
+		{
+			stableID:      "ne2",
+			title:         "North East Two",
+			priority:      3,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.002, 44.898}, {-63.001, 44.898}},
 		},
 	}
-	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
-	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
-	bike, ice = addBaselineBikeAndIce(bike, ice)
 
-	travelwaysOut, _ := runWithGeoJSON(t, travelways, bike, ice)
-	features := readFeaturesBin(t, travelwaysOut)
-	if len(features) != 1 {
-		t.Fatalf("expected 1 travelway feature, got %d", len(features))
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
 	}
-	feature := features[0]
-	if feature.title != "Nora Bernard St" {
-		t.Fatalf("unexpected title: %q", feature.title)
+	reader, err := featuresbin.Open(out.Bytes())
+	if err != nil {
+		t.Fatalf("open features: %v", err)
 	}
-	if feature.priority != 2 {
-		t.Fatalf("unexpected priority: %d", feature.priority)
+
+	got, err := reader.Segment(3, 7)
+	if err != nil {
+		t.Fatalf("segment: %v", err)
 	}
-	if feature.sourceDataset != datasetTravelways {
-		t.Fatalf("unexpected source dataset: %d", feature.sourceDataset)
+	var titles []string
+	for _, feat := range got {
+		titles = append(titles, feat.Title)
 	}
-	if len(feature.coords) == 0 {
-		t.Fatal("missing travelway coords")
+	if len(titles) != 2 || titles[0] != "North East One" || titles[1] != "North East Two" {
+		t.Fatalf("segment (3, 7) titles: got %q, want both North East features", titles)
+	}
+
+	decoded, _, _, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("read features: %v", err)
+	}
+	if len(decoded) != len(features) {
+		t.Fatalf("read features: got %d, want %d", len(decoded), len(features))
 	}
 }
 
-func TestTravelwaysRequiresLocation(t *testing.T) {
-	travelways := geojsonFeatureCollection{
-		Type: "FeatureCollection",
-		Features: []geojsonFeature{
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"OBJECTID":  10,
-					"WINT_PLOW": "Y",
-					"WINT_LOS":  "PRI1",
-					"OWNER":     "HRM",
-					"LOCATION":  "",
-				},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
-				},
-			},
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"OBJECTID":  11,
-					"WINT_PLOW": "Y",
-					"WINT_LOS":  "PRI1",
-					"OWNER":     "HRM",
-					"LOCATION":  "Valid Name Line",
-				},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{5, 5}, {5.001, 5}},
-				},
-			},
+func TestReaderSegmentDecodesSingleCell(t *testing.T) {
+	features := []lineFeature{
+		{
+			stableID:      "sw",
+			title:         "South West",
+			priority:      1,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.6, 44.6}, {-63.599, 44.601}},
+		},
+		{
+			stableID:      "ne",
+			title:         "North East",
+			priority:      2,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.001, 44.899}, {-63.0, 44.9}},
 		},
 	}
-	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
-	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
-	bike, ice = addBaselineBikeAndIce(bike, ice)
 
-	travelwaysOut, _ := runWithGeoJSON(t, travelways, bike, ice)
-	features := readFeaturesBin(t, travelwaysOut)
-	if len(features) != 1 {
-		t.Fatalf("expected 1 travelway feature, got %d", len(features))
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
 	}
-	if features[0].title != "Valid Name Line" {
-		t.Fatalf("unexpected title: %q", features[0].title)
+	reader, err := featuresbin.Open(out.Bytes())
+	if err != nil {
+		t.Fatalf("open features: %v", err)
+	}
+
+	got, err := reader.Segment(3, 7)
+	if err != nil {
+		t.Fatalf("segment: %v", err)
+	}
+	if len(got) != 1 || got[0].Title != "North East" {
+		t.Fatalf("segment (3, 7): got %+v, want only North East", got)
+	}
+	if math.Abs(got[0].Coords[1][0]-(-63.0)) > 1e-6 || math.Abs(got[0].Coords[1][1]-44.9) > 1e-6 {
+		t.Fatalf("segment (3, 7) coords: got %v", got[0].Coords)
+	}
+
+	for _, cell := range [][2]int{{1, 1}, {9, 9}, {-1, 0}} {
+		got, err := reader.Segment(cell[0], cell[1])
+		if err != nil {
+			t.Fatalf("segment %v: %v", cell, err)
+		}
+		if got == nil || len(got) != 0 {
+			t.Fatalf("segment %v: got %+v, want empty slice", cell, got)
+		}
 	}
 }
 
-func TestBikeFeaturesBin(t *testing.T) {
-	type expectedBikeFeature struct {
-		title         string
-		priority      uint8
-		sourceDataset uint8
-		present       bool
+// recordingReaderAt records the byte ranges read through it.
+type recordingReaderAt struct {
+	r     io.ReaderAt
+	reads [][2]int64
+}
+
+func (r *recordingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	r.reads = append(r.reads, [2]int64{off, off + int64(n)})
+	return n, err
+}
+
+func TestDecoderAtReadsOnlyRequestedSegment(t *testing.T) {
+	features := []lineFeature{
+		{stableID: "sw", title: "South West", priority: 1, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.6, 44.6}, {-63.599, 44.601}}},
+		{stableID: "mid", title: "Middle", priority: 3, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.3, 44.75}, {-63.299, 44.751}}},
+		{stableID: "ne", title: "North East", priority: 2, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.001, 44.899}, {-63.0, 44.9}}},
+	}
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	ra := &recordingReaderAt{r: bytes.NewReader(out.Bytes())}
+	reader, err := featuresbin.DecoderAt(ra, int64(out.Len()))
+	if err != nil {
+		t.Fatalf("decoder at: %v", err)
 	}
 
-	tests := []struct {
-		name          string
-		travelways    geojsonFeatureCollection
-		bike          geojsonFeatureCollection
-		ice           geojsonFeatureCollection
-		ensureOutput  bool
-		minCount      int
-		expectedTests []expectedBikeFeature
-	}{
-		{
-			name: "protected prefers closer plowed",
-			travelways: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"OBJECTID":  1,
-							"WINT_PLOW": "Y",
-							"WINT_LOS":  "PRI1",
-							"OWNER":     "HRM",
-							"LOCATION":  "Plowed Way",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
+	var ranges [][2]int64
+	for _, cell := range []struct {
+		row, col int
+		title    string
+	}{{3, 7, "North East"}, {0, 0, "South West"}} {
+		ra.reads = nil
+		got, err := reader.Segment(cell.row, cell.col)
+		if err != nil {
+			t.Fatalf("segment (%d, %d): %v", cell.row, cell.col, err)
+		}
+		if len(got) != 1 || got[0].Title != cell.title {
+			t.Fatalf("segment (%d, %d): got %+v, want only %s", cell.row, cell.col, got, cell.title)
+		}
+		if len(ra.reads) != 1 {
+			t.Fatalf("segment (%d, %d): got %d reads %v, want 1", cell.row, cell.col, len(ra.reads), ra.reads)
+		}
+		ranges = append(ranges, ra.reads[0])
+	}
+	a, b := ranges[0], ranges[1]
+	if a[0] < b[1] && b[0] < a[1] {
+		t.Fatalf("segment reads overlap: %v and %v", a, b)
+	}
+	if n := (a[1] - a[0]) + (b[1] - b[0]); n >= int64(out.Len()) {
+		t.Fatalf("segment reads covered %d of %d bytes", n, out.Len())
+	}
+
+	all, _, _, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("read features: %v", err)
+	}
+	var titles []string
+	for {
+		feat, ok, err := reader.NextFeature()
+		if err != nil {
+			t.Fatalf("next feature: %v", err)
+		}
+		if !ok {
+			break
+		}
+		titles = append(titles, feat.Title)
+	}
+	if len(titles) != len(all) {
+		t.Fatalf("sequential decode: got %v, want %d features", titles, len(all))
+	}
+}
+
+func TestReaderSegmentConcurrent(t *testing.T) {
+	features := []lineFeature{
+		{stableID: "sw", title: "South West", priority: 1, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.6, 44.6}, {-63.599, 44.601}}},
+		{stableID: "mid", title: "Middle", priority: 3, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.3, 44.75}, {-63.299, 44.751}}},
+		{stableID: "ne", title: "North East", priority: 2, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.001, 44.899}, {-63.0, 44.9}}},
+	}
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "features.bin")
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	opened, err := featuresbin.Open(out.Bytes())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	decoderAt, err := featuresbin.DecoderAt(f, int64(out.Len()))
+	if err != nil {
+		t.Fatalf("decoder at: %v", err)
+	}
+
+	cells := []struct {
+		row, col int
+		title    string
+	}{{0, 0, "South West"}, {2, 4, "Middle"}, {3, 7, "North East"}, {1, 1, ""}}
+	for name, reader := range map[string]*featuresbin.Reader{"Open": opened, "DecoderAt": decoderAt} {
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for g := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 200 {
+					cell := cells[(g+i)%len(cells)]
+					got, err := reader.Segment(cell.row, cell.col)
+					if err != nil {
+						errs <- fmt.Errorf("segment (%d, %d): %w", cell.row, cell.col, err)
+						return
+					}
+					if cell.title == "" && len(got) == 0 {
+						continue
+					}
+					if len(got) != 1 || got[0].Title != cell.title {
+						errs <- fmt.Errorf("segment (%d, %d): got %+v, want only %s", cell.row, cell.col, got, cell.title)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestReaderBoundsAndGrid(t *testing.T) {
+	features := []lineFeature{
+		{stableID: "a", title: "A", priority: 1, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.7, 44.6}, {-63.65, 44.62}}},
+		{stableID: "b", title: "B", priority: 2, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.52, 44.7}, {-63.5, 44.75}}},
+		{stableID: "c", title: "C", priority: 3, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.6, 44.55}, {-63.59, 44.56}}},
+	}
+	want := orb.Bound{Min: orb.Point{-63.7, 44.55}, Max: orb.Point{-63.5, 44.75}}
+
+	for _, opts := range []encodeOptions{{}, {Mercator: true}} {
+		var out bytes.Buffer
+		if _, err := encodeFeatures(features, &out, opts); err != nil {
+			t.Fatalf("encode features %+v: %v", opts, err)
+		}
+		reader, err := featuresbin.Open(out.Bytes())
+		if err != nil {
+			t.Fatalf("open features %+v: %v", opts, err)
+		}
+
+		got := reader.Bounds()
+		for i, pair := range [][2]float64{{got.Min[0], want.Min[0]}, {got.Min[1], want.Min[1]}, {got.Max[0], want.Max[0]}, {got.Max[1], want.Max[1]}} {
+			if math.Abs(pair[0]-pair[1]) > 1e-6 {
+				t.Fatalf("bounds %+v: value %d got %v want %v (%v)", opts, i, pair[0], pair[1], got)
+			}
+		}
+		if cols, rows := reader.Grid(); cols != 8 || rows != 4 {
+			t.Fatalf("grid %+v: got %dx%d want 8x4", opts, cols, rows)
+		}
+		// Each feature starts in a different cell.
+		if n := reader.SegmentCount(); n != 3 {
+			t.Fatalf("segment count %+v: got %d want 3", opts, n)
+		}
+	}
+}
+
+func BenchmarkEncodeFeatures(b *testing.B) {
+	// A city-sized fixture: 50000 short lines spread over about 20km.
+	features := make([]lineFeature, 50000)
+	for i := range features {
+		lon := -63.7 + float64(i%250)*0.001
+		lat := 44.55 + float64(i/250)*0.001
+		coords := make(orb.LineString, 20)
+		for j := range coords {
+			coords[j] = orb.Point{lon + float64(j)*0.00001, lat + float64(j%3)*0.00001}
+		}
+		features[i] = lineFeature{
+			stableID:      fmt.Sprintf("objectid:%d", i),
+			title:         fmt.Sprintf("Street %d", i%500),
+			priority:      uint8(i%3 + 1),
+			sourceDataset: datasetTravelways,
+			wintMaint:     "HRM",
+			wintRoute:     fmt.Sprintf("R%d", i%40),
+			coords:        coords,
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := encodeFeatures(features, io.Discard, encodeOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// writeCoordsReference writes coordinates as appendCoords does, but with a
+// binary.Write per value as encodeFeatures used to.
+func writeCoordsReference(w io.Writer, order binary.ByteOrder, absCoords [][2]int32, compactCoords bool) error {
+	if compactCoords {
+		compact, ok := compactDeltas(absCoords)
+		width := coordWidthWide
+		if ok {
+			width = coordWidthCompact
+		}
+		if err := binary.Write(w, order, width); err != nil {
+			return err
+		}
+		if ok {
+			return binary.Write(w, order, compact)
+		}
+	}
+	var prevLon, prevLat int32
+	for _, abs := range absCoords {
+		if err := writeVarintZigZag(w, int64(abs[0]-prevLon)); err != nil {
+			return err
+		}
+		if err := writeVarintZigZag(w, int64(abs[1]-prevLat)); err != nil {
+			return err
+		}
+		prevLon, prevLat = abs[0], abs[1]
+	}
+	return nil
+}
+
+func benchmarkCoords() [][2]int32 {
+	coords := make([][2]int32, 200)
+	for i := range coords {
+		coords[i] = [2]int32{int32(i*731 - 40000), int32(i*-377 + 9000)}
+	}
+	return coords
+}
+
+func TestAppendCoordsMatchesBinaryWrite(t *testing.T) {
+	far := [][2]int32{{0, 0}, {4000000, -4000000}, {-4000000, 4000000}}
+	for _, coords := range [][][2]int32{nil, {{5, 7}}, benchmarkCoords(), far} {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			for _, compact := range []bool{false, true} {
+				var want bytes.Buffer
+				if err := writeCoordsReference(&want, order, coords, compact); err != nil {
+					t.Fatal(err)
+				}
+				if got := appendCoords(nil, order, coords, compact); !bytes.Equal(got, want.Bytes()) {
+					t.Fatalf("%d coords %v compact=%t: got % x want % x", len(coords), order, compact, got, want.Bytes())
+				}
+			}
+		}
+	}
+
+	// The per-feature fields written alongside survive a round trip in both
+	// byte orders.
+	features := []lineFeature{
+		{stableID: "a", title: "A", priority: 1, sourceDataset: datasetBike, bikeType: bikeTypeProtected, serviced: 1700000000, direction: directionWithTraffic,
+			coords: orb.LineString{{-63.6, 44.6}, {-63.5999, 44.6001}, {-63.59, 44.61}}},
+		{stableID: "b", title: "B", priority: 2, sourceDataset: datasetBike, bikeType: bikeTypeUnprotected,
+			coords: orb.LineString{{-63.58, 44.6}, {-63.3, 44.9}}},
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var out bytes.Buffer
+		if _, err := encodeFeatures(features, &out, encodeOptions{BikeTypes: true, CompactCoords: true, ByteOrder: order}); err != nil {
+			t.Fatal(err)
+		}
+		decoded, _, _, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, f := range decoded {
+			want := features[i]
+			var serviced int64
+			if !f.Serviced.IsZero() {
+				serviced = f.Serviced.Unix()
+			}
+			if f.BikeType != want.bikeType || serviced != want.serviced || f.Direction != want.direction {
+				t.Fatalf("%v feature %s: got bike type %d serviced %v direction %d", order, f.Title, f.BikeType, f.Serviced, f.Direction)
+			}
+			for j, c := range f.Coords {
+				if d := geo.Distance(orb.Point{c[0], c[1]}, want.coords[j]); d > 10 {
+					t.Fatalf("%v feature %s coord %d: %v is %.1fm from %v", order, f.Title, j, c, d, want.coords[j])
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkWriteCoords(b *testing.B) {
+	coords := benchmarkCoords()
+	for _, compact := range []bool{false, true} {
+		b.Run(fmt.Sprintf("binary.Write/compact=%t", compact), func(b *testing.B) {
+			var buf bytes.Buffer
+			b.ReportAllocs()
+			for range b.N {
+				buf.Reset()
+				if err := writeCoordsReference(&buf, binary.LittleEndian, coords, compact); err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(buf.Len()))
+			}
+		})
+		b.Run(fmt.Sprintf("appendCoords/compact=%t", compact), func(b *testing.B) {
+			var buf bytes.Buffer
+			var scratch []byte
+			b.ReportAllocs()
+			for range b.N {
+				buf.Reset()
+				scratch = appendCoords(scratch[:0], binary.LittleEndian, coords, compact)
+				buf.Write(scratch)
+				b.SetBytes(int64(buf.Len()))
+			}
+		})
+	}
+}
+
+func TestEncodeFeaturesLabels(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "labels.json")
+	if err := os.WriteFile(path, []byte(`{"1": {"en": "Main routes", "fr": "Voies prioritaires"}, "3": {"en": "Local streets"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	labels, err := loadLabels(path)
+	if err != nil {
+		t.Fatalf("load labels: %v", err)
+	}
+
+	features := []lineFeature{
+		{stableID: "a", title: "A", priority: 1, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.6, 44.6}, {-63.59, 44.61}}},
+	}
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{Labels: labels}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	decoded, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("read features: %v", err)
+	}
+	if got, want := header.Labels[1], (featuresbin.Label{En: "Main routes", Fr: "Voies prioritaires"}); got != want {
+		t.Fatalf("priority 1 label: got %+v want %+v", got, want)
+	}
+	if got, want := header.Labels[3], (featuresbin.Label{En: "Local streets"}); got != want {
+		t.Fatalf("priority 3 label: got %+v want %+v", got, want)
+	}
+	if len(decoded) != 1 || decoded[0].Title != "A" {
+		t.Fatalf("features after labels: got %+v", decoded)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"4": {"en": "Nope"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadLabels(path); err == nil {
+		t.Fatalf("expected priority 4 to be rejected")
+	}
+}
+
+func TestEncodeFeaturesDeterministic(t *testing.T) {
+	var features []lineFeature
+	for i := range 200 {
+		lon, lat := -63.7+float64(i%20)*0.01, 44.6+float64(i/20)*0.01
+		features = append(features, lineFeature{
+			stableID:      fmt.Sprintf("s%d", i),
+			title:         fmt.Sprintf("Street %d", i%13),
+			priority:      uint8(i%3 + 1),
+			sourceDataset: datasetTravelways,
+			objectID:      i + 1,
+			wintMaint:     "HRM",
+			wintRoute:     fmt.Sprintf("R%d", i%5),
+			coords:        orb.LineString{{lon, lat}, {lon + 0.004, lat + 0.001}, {lon + 0.008, lat}},
+		})
+	}
+	features = append(features, lineFeature{stableID: "empty", title: "Nowhere", priority: 2, sourceDataset: datasetTravelways})
+
+	var first, second bytes.Buffer
+	if _, err := encodeFeatures(features, &first, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	if _, err := encodeFeatures(features, &second, encodeOptions{}); err != nil {
+		t.Fatalf("encode features again: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatalf("encoding the same features twice produced different output")
+	}
+}
+
+func TestDominantBreaksTiesDeterministically(t *testing.T) {
+	for range 100 {
+		if got := dominantObjectID(map[int]float64{30: 5, 10: 5, 20: 5, 40: 1}); got != 10 {
+			t.Fatalf("dominant object id: got %d want 10", got)
+		}
+		if got := dominantPriority(map[uint8]float64{3: 5, 2: 5, 1: 2}); got != 2 {
+			t.Fatalf("dominant priority: got %d want 2", got)
+		}
+	}
+}
+
+func TestEncodeFeaturesServiced(t *testing.T) {
+	plowed := time.Date(2025, 2, 6, 14, 30, 0, 0, time.UTC)
+	features := []lineFeature{
+		{stableID: "a", title: "A", priority: 1, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.6, 44.6}, {-63.59, 44.61}},
+			serviced: servicedAt(geojson.Properties{"serviced": float64(plowed.UnixMilli())})},
+		{stableID: "b", title: "B", priority: 2, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.58, 44.6}, {-63.57, 44.61}},
+			serviced: servicedAt(geojson.Properties{"serviced": "2025-02-06T15:00:00-04:00"})},
+		{stableID: "c", title: "C", priority: 3, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.56, 44.6}, {-63.55, 44.61}}},
+	}
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	decoded, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("read features: %v", err)
+	}
+	if !header.Serviced {
+		t.Fatalf("expected serviced flag in header")
+	}
+	want := map[string]time.Time{
+		"A": plowed,
+		"B": time.Date(2025, 2, 6, 19, 0, 0, 0, time.UTC),
+		"C": {},
+	}
+	for _, f := range decoded {
+		if !f.Serviced.Equal(want[f.Title]) {
+			t.Fatalf("feature %s serviced: got %v want %v", f.Title, f.Serviced, want[f.Title])
+		}
+	}
+	if len(decoded) != len(want) {
+		t.Fatalf("decoded %d features, want %d", len(decoded), len(want))
+	}
+
+	out.Reset()
+	if _, err := encodeFeatures(features[2:], &out, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	if _, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes())); err != nil || header.Serviced {
+		t.Fatalf("expected no serviced flag without serviced features, got %t (err %v)", header.Serviced, err)
+	}
+}
+
+func TestEncodeFeaturesDirection(t *testing.T) {
+	features := []lineFeature{
+		{stableID: "a", title: "A", priority: 1, sourceDataset: datasetBike, bikeType: bikeTypeProtected, coords: orb.LineString{{-63.6, 44.6}, {-63.59, 44.61}},
+			direction: directionFrom("One Way")},
+		{stableID: "b", title: "B", priority: 1, sourceDataset: datasetBike, bikeType: bikeTypeProtected, coords: orb.LineString{{-63.58, 44.6}, {-63.57, 44.61}},
+			direction: directionFrom("contraflow")},
+		{stableID: "c", title: "C", priority: 2, sourceDataset: datasetBike, bikeType: bikeTypeUnprotected, coords: orb.LineString{{-63.56, 44.6}, {-63.55, 44.61}},
+			direction: directionFrom("")},
+	}
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{BikeTypes: true}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	decoded, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("read features: %v", err)
+	}
+	if !header.FeatureFlags {
+		t.Fatalf("expected feature flags in header")
+	}
+	want := map[string]uint8{
+		"A": featuresbin.DirectionWithTraffic,
+		"B": featuresbin.DirectionAgainstTraffic,
+		"C": featuresbin.DirectionTwoWay,
+	}
+	for _, f := range decoded {
+		if f.Direction != want[f.Title] {
+			t.Fatalf("feature %s direction: got %d want %d", f.Title, f.Direction, want[f.Title])
+		}
+		if f.BikeType == bikeTypeUnknown {
+			t.Fatalf("feature %s lost its bike type", f.Title)
+		}
+	}
+	if len(decoded) != len(want) {
+		t.Fatalf("decoded %d features, want %d", len(decoded), len(want))
+	}
+
+	out.Reset()
+	if _, err := encodeFeatures(features[2:], &out, encodeOptions{BikeTypes: true}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	if _, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes())); err != nil || header.FeatureFlags {
+		t.Fatalf("expected no feature flags with only two-way features, got %t (err %v)", header.FeatureFlags, err)
+	}
+}
+
+func TestEncodeFeaturesStyles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "styles.json")
+	if err := os.WriteFile(path, []byte(`{"1": {"color": "#017A74", "weight": 6}, "3": {"color": "#6b3fa0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	styles, err := loadStyles(path)
+	if err != nil {
+		t.Fatalf("load styles: %v", err)
+	}
+
+	features := []lineFeature{
+		{stableID: "a", title: "A", priority: 1, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.6, 44.6}, {-63.59, 44.61}}},
+	}
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{Styles: styles}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	decoded, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("read features: %v", err)
+	}
+	want := map[uint8]featuresbin.Style{
+		1: {Color: "#017A74", Weight: 6},
+		3: {Color: "#6B3FA0", Weight: 0},
+	}
+	if len(header.Styles) != len(want) {
+		t.Fatalf("styles: got %v want %v", header.Styles, want)
+	}
+	for p, style := range want {
+		if header.Styles[p] != style {
+			t.Fatalf("priority %d style: got %+v want %+v", p, header.Styles[p], style)
+		}
+	}
+	if len(decoded) != 1 || decoded[0].Title != "A" {
+		t.Fatalf("features after styles: got %+v", decoded)
+	}
+
+	out.Reset()
+	if _, err := encodeFeatures(features, &out, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	if _, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes())); err != nil || header.Styles != nil {
+		t.Fatalf("expected no styles without config, got %v (err %v)", header.Styles, err)
+	}
+
+	for _, bad := range []string{`{"4": {"color": "#000000"}}`, `{"1": {"color": "teal"}}`, `{"1": {"color": "#000000", "weight": 300}}`} {
+		if err := os.WriteFile(path, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadStyles(path); err == nil {
+			t.Fatalf("expected error loading %s", bad)
+		}
+	}
+}
+
+func TestVerifyEncoded(t *testing.T) {
+	features := []lineFeature{
+		{
+			stableID:      "a",
+			title:         "Spring Garden Road",
+			priority:      1,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.6, 44.6}, {-63.599, 44.601}},
+		},
+	}
+	for _, opts := range []encodeOptions{{}, {CompactCoords: true}, {Mercator: true}, {Mercator: true, CompactCoords: true}} {
+		var out bytes.Buffer
+		if _, err := encodeFeatures(features, &out, opts); err != nil {
+			t.Fatalf("encode features %+v: %v", opts, err)
+		}
+		if err := verifyEncoded(out.Bytes(), 1, true); err != nil {
+			t.Fatalf("verify %+v: %v", opts, err)
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	// The only segment starts at the global base with max deltas of 1000
+	// (zigzag varint d0 0f). Shrink them to 500 so the feature's far end
+	// falls outside the written bounds.
+	header := []byte{0x00, 0x00, 0xd0, 0x0f, 0xd0, 0x0f, 0x01}
+	data := out.Bytes()
+	i := bytes.Index(data, header)
+	if i < 0 || bytes.Index(data[i+1:], header) >= 0 {
+		t.Fatalf("expected exactly one segment header %x in %x", header, data)
+	}
+	copy(data[i:], []byte{0x00, 0x00, 0xe8, 0x07, 0xe8, 0x07, 0x01})
+
+	err := verifyEncoded(data, 1, true)
+	if err == nil || !strings.Contains(err.Error(), "outside segment bounds") {
+		t.Fatalf("expected segment bounds error, got %v", err)
+	}
+	if err := verifyEncoded(data, 1, false); err != nil {
+		t.Fatalf("expected count-only verification to ignore bounds, got %v", err)
+	}
+	err = verifyEncoded(data, 2, false)
+	if err == nil || !strings.Contains(err.Error(), "decoded 1 features, encoded 2") {
+		t.Fatalf("expected feature count mismatch, got %v", err)
+	}
+}
+
+func TestCheckFiniteCoords(t *testing.T) {
+	fc := geojson.NewFeatureCollection()
+	ok := geojson.NewFeature(orb.LineString{{0, 0}, {0.001, 0}})
+	ok.Properties["OBJECTID"] = 6
+	bad := geojson.NewFeature(orb.LineString{{0, 0}, {math.NaN(), 0}})
+	bad.Properties["OBJECTID"] = 7
+	fc.Append(ok)
+	fc.Append(bad)
+
+	err := checkFiniteCoords(fc)
+	if err == nil {
+		t.Fatal("expected error for NaN coordinate")
+	}
+	if !strings.Contains(err.Error(), "OBJECTID 7") || !strings.Contains(err.Error(), "non-finite coordinate") {
+		t.Fatalf("error should name the feature and problem, got %q", err)
+	}
+
+	inf := geojson.NewFeature(orb.MultiLineString{{{0, 0}, {1, 1}}, {{0, math.Inf(1)}, {1, 1}}})
+	if err := checkFiniteCoords(&geojson.FeatureCollection{Features: []*geojson.Feature{ok, inf}}); err == nil {
+		t.Fatal("expected error for infinite coordinate")
+	}
+	if err := checkFiniteCoords(&geojson.FeatureCollection{Features: []*geojson.Feature{ok}}); err != nil {
+		t.Fatalf("unexpected error for finite coordinates: %v", err)
+	}
+}
+
+func TestSampleFeaturesIsReproducible(t *testing.T) {
+	var features []lineFeature
+	for i := 0; i < 1000; i++ {
+		features = append(features, lineFeature{
+			stableID:      fmt.Sprintf("s%d", i),
+			title:         "Sample Street",
+			priority:      1,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{float64(i) * 0.001, 0}, {float64(i)*0.001 + 0.0005, 0}},
+		})
+	}
+	ids := func(fs []lineFeature) []string {
+		var out []string
+		for _, f := range fs {
+			out = append(out, f.stableID)
+		}
+		return out
+	}
+
+	first := ids(sampleFeatures(features, 0.1, 42))
+	second := ids(sampleFeatures(features, 0.1, 42))
+	if strings.Join(first, ",") != strings.Join(second, ",") {
+		t.Fatal("same seed produced different samples")
+	}
+	if len(first) < 50 || len(first) > 150 {
+		t.Fatalf("sampled %d of 1000 at rate 0.1", len(first))
+	}
+	if other := ids(sampleFeatures(features, 0.1, 43)); strings.Join(first, ",") == strings.Join(other, ",") {
+		t.Fatal("different seeds produced the same sample")
+	}
+
+	// The encoded bounds come from the sample, not the full set.
+	sample := sampleFeatures(features, 0.1, 42)
+	var out bytes.Buffer
+	if _, err := encodeFeatures(sample, &out, encodeOptions{}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	_, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if header.GlobalMinLon != sample[0].coords[0][0] {
+		t.Fatalf("header base lon %v, want first sampled lon %v", header.GlobalMinLon, sample[0].coords[0][0])
+	}
+}
+
+func TestClipFeaturesDropsOutliers(t *testing.T) {
+	clipPath := filepath.Join(t.TempDir(), "clip.geojson")
+	clipJSON := `{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[-64,44.4],[-63,44.4],[-63,45],[-64,45],[-64,44.4]]]}}`
+	if err := os.WriteFile(clipPath, []byte(clipJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clip, err := loadClipPolygon(clipPath)
+	if err != nil {
+		t.Fatalf("load clip polygon: %v", err)
+	}
+
+	features := []lineFeature{
+		{stableID: "a", title: "Inside A", priority: 1, coords: orb.LineString{{-63.6, 44.6}, {-63.59, 44.61}}},
+		{stableID: "b", title: "Inside B", priority: 1, coords: orb.LineString{{-63.5, 44.7}, {-63.49, 44.71}}},
+		{stableID: "x", title: "Outlier", priority: 1, coords: orb.LineString{{-79.4, 43.6}, {-79.39, 43.61}}},
+	}
+
+	var before bytes.Buffer
+	if _, err := encodeFeatures(features, &before, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	_, _, beforeHeader, err := featuresbin.Read(bytes.NewReader(before.Bytes()))
+	if err != nil {
+		t.Fatalf("decode features: %v", err)
+	}
+
+	kept, clipped := clipFeatures(features, clip)
+	if clipped != 1 {
+		t.Fatalf("clipped: got %d want 1", clipped)
+	}
+	for _, f := range kept {
+		if f.title == "Outlier" {
+			t.Fatalf("outlier was not clipped")
+		}
+	}
+
+	var after bytes.Buffer
+	if _, err := encodeFeatures(kept, &after, encodeOptions{}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	_, _, afterHeader, err := featuresbin.Read(bytes.NewReader(after.Bytes()))
+	if err != nil {
+		t.Fatalf("decode features: %v", err)
+	}
+	if math.Abs(afterHeader.GlobalMinLon-(-63.6)) > 1e-9 || math.Abs(afterHeader.GlobalMinLat-44.6) > 1e-9 {
+		t.Fatalf("clipped bbox min: got (%f, %f) want (-63.6, 44.6)", afterHeader.GlobalMinLon, afterHeader.GlobalMinLat)
+	}
+	if afterHeader.GlobalMinLon <= beforeHeader.GlobalMinLon {
+		t.Fatalf("bbox did not tighten: before %f after %f", beforeHeader.GlobalMinLon, afterHeader.GlobalMinLon)
+	}
+
+	// A geometry-less feature has no centroid; it used to be tested at (0, 0)
+	// and dropped.
+	kept, clipped = clipFeatures([]lineFeature{{stableID: "e", title: "No Geometry", priority: 1}}, clip)
+	if clipped != 0 || len(kept) != 1 {
+		t.Fatalf("geometry-less feature: got %d kept, %d clipped, want 1 kept", len(kept), clipped)
+	}
+}
+
+func TestEncodeFeaturesCompactCoords(t *testing.T) {
+	features := []lineFeature{
+		{
+			stableID:      "short",
+			title:         "Short Street",
+			priority:      1,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.7, 44.5}, {-63.612345, 44.543219}, {-63.6, 44.55}},
+		},
+		{
+			stableID:      "wide",
+			title:         "Wide Span",
+			priority:      2,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.0, 44.6}, {-59.123457, 44.612345}, {-57.0, 44.6}},
+		},
+	}
+
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{CompactCoords: true}); err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	decoded, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("decode features: %v", err)
+	}
+	if !header.CompactCoords {
+		t.Fatalf("header does not record compact coords")
+	}
+
+	if len(decoded) != 2 || decoded[0].Title != "Short Street" || decoded[1].Title != "Wide Span" {
+		t.Fatalf("unexpected decoded features: %+v", decoded)
+	}
+	short, wide := decoded[0], decoded[1]
+	for i, coord := range short.Coords {
+		want := features[0].coords[i]
+		if math.Abs(coord[0]-want[0]) > 1e-4 || math.Abs(coord[1]-want[1]) > 1e-4 {
+			t.Fatalf("compact coord %d: got %v want %v within 1e-4", i, coord, want)
+		}
+	}
+	if math.Abs(short.Coords[1][0]-features[0].coords[1][0]) < 1e-6 {
+		t.Fatalf("short feature was not stored compactly: %v", short.Coords)
+	}
+	// The wide feature's deltas overflow int16, so it keeps full precision.
+	for i, coord := range wide.Coords {
+		want := features[1].coords[i]
+		if math.Abs(coord[0]-want[0]) > 1e-6 || math.Abs(coord[1]-want[1]) > 1e-6 {
+			t.Fatalf("wide coord %d: got %v want %v within 1e-6", i, coord, want)
+		}
+	}
+}
+
+func TestEncodeFeaturesTypedErrors(t *testing.T) {
+	longTitle := "Rue " + strings.Repeat("x", 300)
+	features := []lineFeature{
+		{
+			stableID:      "long1",
+			title:         longTitle,
+			priority:      1,
+			sourceDataset: datasetTravelways,
+			objectID:      42,
+			coords:        orb.LineString{{0, 0}, {0.001, 0}},
+		},
+	}
+	var out bytes.Buffer
+	_, err := encodeFeatures(features, &out, encodeOptions{})
+	if !errors.Is(err, errTitleTooLong) {
+		t.Fatalf("expected errTitleTooLong, got %v", err)
+	}
+	var fe *featureError
+	if !errors.As(err, &fe) {
+		t.Fatalf("expected a featureError, got %T", err)
+	}
+	if fe.title != longTitle || fe.objectID != 42 {
+		t.Fatalf("feature identity: got title %q objectID %d", fe.title, fe.objectID)
+	}
+
+	if _, _, err := flattenLineString(orb.Point{0, 0}); !errors.Is(err, errUnknownGeometry) {
+		t.Fatalf("expected errUnknownGeometry, got %v", err)
+	}
+}
+
+func TestEncodeFeaturesSplitsLongLines(t *testing.T) {
+	coords := make(orb.LineString, 70000)
+	for i := range coords {
+		coords[i] = orb.Point{float64(i%1000) * 1e-5, float64(i/1000) * 1e-5}
+	}
+	features := []lineFeature{{stableID: "many1", title: "Long Way", priority: 2, sourceDataset: datasetTravelways, coords: coords}}
+
+	var out bytes.Buffer
+	stats, err := encodeFeatures(features, &out, encodeOptions{})
+	if err != nil {
+		t.Fatalf("encode features: %v", err)
+	}
+	if stats.Features != 2 {
+		t.Fatalf("expected 2 features, got %d", stats.Features)
+	}
+
+	decoded, _, _, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(decoded) != 2 {
+		t.Fatalf("expected 2 decoded features, got %d", len(decoded))
+	}
+	// Segments may reorder the pieces; put them back in line order.
+	if decoded[0].Coords[0][1] > decoded[1].Coords[0][1] {
+		decoded[0], decoded[1] = decoded[1], decoded[0]
+	}
+	var joined [][]float64
+	for i, f := range decoded {
+		if f.Title != "Long Way" || f.Priority != 2 || f.StableID != "many1" {
+			t.Fatalf("piece %d: got title %q priority %d stable id %q", i, f.Title, f.Priority, f.StableID)
+		}
+		if len(f.Coords) > math.MaxUint16 {
+			t.Fatalf("piece %d has %d coordinates", i, len(f.Coords))
+		}
+		if i > 0 {
+			// Pieces share their end points.
+			if !slices.Equal(joined[len(joined)-1], f.Coords[0]) {
+				t.Fatalf("piece %d starts at %v, previous ended at %v", i, f.Coords[0], joined[len(joined)-1])
+			}
+			f.Coords = f.Coords[1:]
+		}
+		joined = append(joined, f.Coords...)
+	}
+	if len(joined) != len(coords) {
+		t.Fatalf("expected %d coordinates across pieces, got %d", len(coords), len(joined))
+	}
+	for i, c := range joined {
+		if math.Abs(c[0]-coords[i][0]) > 1e-6 || math.Abs(c[1]-coords[i][1]) > 1e-6 {
+			t.Fatalf("coordinate %d: got %v, want %v", i, c, coords[i])
+		}
+	}
+}
+
+func TestEncodeFeaturesExplicitBounds(t *testing.T) {
+	features := []lineFeature{
+		{
+			stableID:      "bounded",
+			title:         "Bounded Way",
+			priority:      1,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{0.5, 0.5}, {0.501, 0.5}},
+		},
+	}
+	bound := orb.Bound{Min: orb.Point{-1, -2}, Max: orb.Point{3, 4}}
+
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{Bounds: &bound}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	decoded, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if header.GlobalMinLon != -1 || header.GlobalMinLat != -2 {
+		t.Fatalf("header base: got %v,%v want -1,-2", header.GlobalMinLon, header.GlobalMinLat)
+	}
+	if len(decoded) != 1 {
+		t.Fatalf("expected 1 feature, got %d", len(decoded))
+	}
+	for i, coord := range decoded[0].Coords {
+		want := features[0].coords[i]
+		if math.Abs(coord[0]-want[0]) > 1e-6 || math.Abs(coord[1]-want[1]) > 1e-6 {
+			t.Fatalf("coord %d: got %v want %v", i, coord, want)
+		}
+	}
+
+	tight := orb.Bound{Min: orb.Point{0, 0}, Max: orb.Point{0.5005, 1}}
+	if _, err := encodeFeatures(features, &out, encodeOptions{Bounds: &tight}); err == nil {
+		t.Fatal("expected error for coordinates outside bounds")
+	}
+}
+
+func TestEncodeFeaturesMercatorRoundTrip(t *testing.T) {
+	// Halifax City Hall and a point about 300m east.
+	features := []lineFeature{
+		{
+			stableID:      "mercator",
+			title:         "Argyle Street",
+			priority:      1,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.575217, 44.648766}, {-63.571432, 44.648903}},
+		},
+	}
+	for _, compact := range []bool{false, true} {
+		var out bytes.Buffer
+		if _, err := encodeFeatures(features, &out, encodeOptions{Mercator: true, CompactCoords: compact}); err != nil {
+			t.Fatalf("encode (compact=%t): %v", compact, err)
+		}
+		decoded, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("read (compact=%t): %v", compact, err)
+		}
+		if !header.Mercator {
+			t.Fatalf("compact=%t: expected mercator header flag", compact)
+		}
+		// The base is stored in Mercator metres.
+		if header.GlobalMinLon > -7e6 || header.GlobalMinLat < 5e6 {
+			t.Fatalf("compact=%t: base %v,%v does not look like Mercator metres", compact, header.GlobalMinLon, header.GlobalMinLat)
+		}
+		// Full precision keeps centimetres; compact keeps metres.
+		tolerance := 1e-6
+		if compact {
+			tolerance = 1e-5
+		}
+		if len(decoded) != 1 {
+			t.Fatalf("compact=%t: expected 1 feature, got %d", compact, len(decoded))
+		}
+		for i, coord := range decoded[0].Coords {
+			want := features[0].coords[i]
+			if math.Abs(coord[0]-want[0]) > tolerance || math.Abs(coord[1]-want[1]) > tolerance {
+				t.Fatalf("compact=%t coord %d: got %v want %v", compact, i, coord, want)
+			}
+		}
+	}
+	if features[0].coords[0] != (orb.Point{-63.575217, 44.648766}) {
+		t.Fatalf("encoding modified the input coordinates: %v", features[0].coords[0])
+	}
+}
+
+func TestEncodeFeaturesGeneratedAt(t *testing.T) {
+	features := []lineFeature{
+		{
+			stableID:      "stamped",
+			title:         "Stamped Street",
+			priority:      2,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.57, 44.64}, {-63.56, 44.65}},
+		},
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		now := time.Now()
+		var out bytes.Buffer
+		if _, err := encodeFeatures(features, &out, encodeOptions{GeneratedAt: now, ByteOrder: order}); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		decoded, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if d := header.GeneratedAt.Sub(now); d > time.Second || d < -time.Second {
+			t.Fatalf("%v: generated at %v, encoded at %v", order, header.GeneratedAt, now)
+		}
+		if len(decoded) != 1 || decoded[0].Title != "Stamped Street" {
+			t.Fatalf("%v: unexpected features after timestamp: %+v", order, decoded)
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	_, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !header.GeneratedAt.IsZero() {
+		t.Fatalf("expected no generation time without the option, got %v", header.GeneratedAt)
+	}
+}
+
+func TestEncodeFeaturesEmptyGeometry(t *testing.T) {
+	legend := lineFeature{
+		stableID:      "legend1",
+		title:         "Priority 1 Sidewalks",
+		priority:      1,
+		sourceDataset: datasetTravelways,
+	}
+	street := lineFeature{
+		stableID:      "street1",
+		title:         "Barrington Street",
+		priority:      2,
+		sourceDataset: datasetTravelways,
+		coords:        orb.LineString{{-63.57, 44.64}, {-63.56, 44.65}},
+	}
+
+	decode := func(features []lineFeature, opts encodeOptions) []featuresbin.Feature {
+		t.Helper()
+		var out bytes.Buffer
+		if _, err := encodeFeatures(features, &out, opts); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		decoded, _, _, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return decoded
+	}
+
+	if got := decode([]lineFeature{legend, street}, encodeOptions{}); len(got) != 1 || got[0].Title != "Barrington Street" {
+		t.Fatalf("without the option the legend should be skipped, got %+v", got)
+	}
+
+	for _, opts := range []encodeOptions{
+		{AllowEmptyGeometry: true},
+		{AllowEmptyGeometry: true, CompactCoords: true},
+	} {
+		got := decode([]lineFeature{legend, street}, opts)
+		if len(got) != 2 {
+			t.Fatalf("%+v: expected 2 features, got %+v", opts, got)
+		}
+		var found bool
+		for _, f := range got {
+			if f.Title != legend.title {
+				if len(f.Coords) != 2 {
+					t.Fatalf("%+v: street lost its coordinates: %+v", opts, f)
+				}
+				continue
+			}
+			found = true
+			if f.Coords != nil || f.Priority != 1 || f.StableID != "legend1" {
+				t.Fatalf("%+v: legend decoded as %+v", opts, f)
+			}
+		}
+		if !found {
+			t.Fatalf("%+v: legend missing from %+v", opts, got)
+		}
+	}
+
+	if got := decode([]lineFeature{legend}, encodeOptions{AllowEmptyGeometry: true}); len(got) != 1 || got[0].Coords != nil {
+		t.Fatalf("legend-only file: got %+v", got)
+	}
+}
+
+func TestEncodeFeaturesBigEndianRoundTrip(t *testing.T) {
+	features := []lineFeature{
+		{
+			stableID:      "a",
+			title:         "Barrington St",
+			priority:      1,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.575, 44.645}, {-63.574, 44.646}},
+		},
+		{
+			stableID:      "b",
+			title:         "Long Trail",
+			priority:      3,
+			sourceDataset: datasetTravelways,
+			coords:        orb.LineString{{-63.9, 44.5}, {-59.2, 44.7}},
+		},
+	}
+
+	decode := func(order binary.ByteOrder) ([]featuresbin.Feature, featuresbin.Header, []byte) {
+		t.Helper()
+		var out bytes.Buffer
+		if _, err := encodeFeatures(features, &out, encodeOptions{CompactCoords: true, ByteOrder: order}); err != nil {
+			t.Fatalf("encode features: %v", err)
+		}
+		decoded, _, header, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("decode features: %v", err)
+		}
+		return decoded, header, out.Bytes()
+	}
+
+	little, littleHeader, littleBytes := decode(nil)
+	big, bigHeader, bigBytes := decode(binary.BigEndian)
+	if littleHeader.BigEndian || !bigHeader.BigEndian {
+		t.Fatalf("byte order flags: little %v big %v", littleHeader.BigEndian, bigHeader.BigEndian)
+	}
+	if bytes.Equal(littleBytes, bigBytes) {
+		t.Fatal("big-endian encoding should differ from little-endian")
+	}
+	if bigHeader.GlobalMinLon != littleHeader.GlobalMinLon || bigHeader.GlobalMinLat != littleHeader.GlobalMinLat {
+		t.Fatalf("global base: big (%f, %f) little (%f, %f)", bigHeader.GlobalMinLon, bigHeader.GlobalMinLat, littleHeader.GlobalMinLon, littleHeader.GlobalMinLat)
+	}
+	if len(big) != len(little) {
+		t.Fatalf("feature count: big %d little %d", len(big), len(little))
+	}
+	for i := range big {
+		if big[i].Title != little[i].Title || len(big[i].Coords) != len(little[i].Coords) {
+			t.Fatalf("feature %d: big %+v little %+v", i, big[i], little[i])
+		}
+		for j := range big[i].Coords {
+			if big[i].Coords[j][0] != little[i].Coords[j][0] || big[i].Coords[j][1] != little[i].Coords[j][1] {
+				t.Fatalf("feature %q coord %d: big %v little %v", big[i].Title, j, big[i].Coords[j], little[i].Coords[j])
+			}
+		}
+	}
+}
+
+func TestEncodeFeaturesClosedLoop(t *testing.T) {
+	loop := orb.LineString{
+		{-63.58, 44.64},
+		{-63.57, 44.64},
+		{-63.57, 44.65},
+		{-63.57, 44.65}, // repeated point, zero delta
+		{-63.58, 44.65},
+		{-63.58, 44.64},
+	}
+	features := []lineFeature{
+		{
+			stableID:      "loop",
+			title:         "Loop Path",
+			priority:      2,
+			sourceDataset: datasetTravelways,
+			coords:        loop,
+		},
+	}
+
+	for _, opts := range []encodeOptions{{}, {CompactCoords: true}} {
+		var out bytes.Buffer
+		if _, err := encodeFeatures(features, &out, opts); err != nil {
+			t.Fatalf("encode features: %v", err)
+		}
+		decoded, _, _, err := featuresbin.Read(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("decode features: %v", err)
+		}
+		if len(decoded) != 1 || len(decoded[0].Coords) != len(loop) {
+			t.Fatalf("compact=%v: unexpected decoded features: %+v", opts.CompactCoords, decoded)
+		}
+		coords := decoded[0].Coords
+		for i, coord := range coords {
+			if math.Abs(coord[0]-loop[i][0]) > 1e-6 || math.Abs(coord[1]-loop[i][1]) > 1e-6 {
+				t.Fatalf("compact=%v: coord %d: got %v want %v", opts.CompactCoords, i, coord, loop[i])
+			}
+		}
+		last := coords[len(coords)-1]
+		if last[0] != coords[0][0] || last[1] != coords[0][1] {
+			t.Fatalf("compact=%v: loop not closed: first %v last %v", opts.CompactCoords, coords[0], last)
+		}
+	}
+
+	simplified := simplifyLineString(loop, 2)
+	if len(simplified) < 4 || simplified[0] != simplified[len(simplified)-1] {
+		t.Fatalf("simplified loop should stay closed: %v", simplified)
+	}
+}
+
+// newRunConfig writes travelways, bike and ice to a temporary directory and
+// returns a runConfig that reads them and writes its outputs alongside, with
+// the matching tolerances most tests use.
+func newRunConfig(t *testing.T, travelways, bike, ice geojsonFeatureCollection) runConfig {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := runConfig{
+		TravelwaysFile: filepath.Join(dir, "travelways.geojson"),
+		BikeFile:       filepath.Join(dir, "bike.geojson"),
+		IceFile:        filepath.Join(dir, "ice.geojson"),
+		TravelwaysOut:  filepath.Join(dir, "features.bin"),
+		BikeOut:        filepath.Join(dir, "features_cycling.bin"),
+		MaxMatchMeters: 30,
+		MaxAngleDeg:    30,
+	}
+	writeGeoJSON(t, cfg.TravelwaysFile, travelways)
+	writeGeoJSON(t, cfg.BikeFile, bike)
+	writeGeoJSON(t, cfg.IceFile, ice)
+	return cfg
+}
+
+// runWithGeoJSON runs the config from newRunConfig, changed by opts, and
+// returns the travelways and cycling output paths.
+func runWithGeoJSON(t *testing.T, travelways, bike, ice geojsonFeatureCollection, opts ...func(*runConfig)) (string, string) {
+	t.Helper()
+	cfg := newRunConfig(t, travelways, bike, ice)
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	return cfg.TravelwaysOut, cfg.BikeOut
+}
+
+func TestTravelwaysFeaturesBin(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI2",
+					"OWNER":     "HRM",
+					"LOCATION":  "CORNWALLIS ST",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  2,
+					"WINT_PLOW": "N",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Not Plowed",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{1, 1}, {1.001, 1}},
+				},
+			},
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  3,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "PRIV",
+					"LOCATION":  "Private Way",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{2, 2}, {2.001, 2}},
+				},
+			},
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  4,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI5",
+					"OWNER":     "HRM",
+					"LOCATION":  "Bad Priority",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{3, 3}, {3.001, 3}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	travelwaysOut, _ := runWithGeoJSON(t, travelways, bike, ice)
+	features := readFeaturesBin(t, travelwaysOut)
+	if len(features) != 1 {
+		t.Fatalf("expected 1 travelway feature, got %d", len(features))
+	}
+	feature := features[0]
+	if feature.title != "Nora Bernard St" {
+		t.Fatalf("unexpected title: %q", feature.title)
+	}
+	if feature.priority != 2 {
+		t.Fatalf("unexpected priority: %d", feature.priority)
+	}
+	if feature.sourceDataset != datasetTravelways {
+		t.Fatalf("unexpected source dataset: %d", feature.sourceDataset)
+	}
+	if len(feature.coords) == 0 {
+		t.Fatal("missing travelway coords")
+	}
+}
+
+func TestTravelwaysRequiresLocation(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  10,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  11,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Valid Name Line",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{5, 5}, {5.001, 5}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	travelwaysOut, _ := runWithGeoJSON(t, travelways, bike, ice)
+	features := readFeaturesBin(t, travelwaysOut)
+	if len(features) != 1 {
+		t.Fatalf("expected 1 travelway feature, got %d", len(features))
+	}
+	if features[0].title != "Valid Name Line" {
+		t.Fatalf("unexpected title: %q", features[0].title)
+	}
+}
+
+func TestSpatialIndexZeroHeight(t *testing.T) {
+	lines := []indexedLine{
+		{coords: orb.LineString{{-63.6, 44.65}, {-63.59, 44.65}}},
+		{coords: orb.LineString{{-63.58, 44.65}, {-63.57, 44.65}}},
+	}
+	idx, err := newSpatialIndex(lines, 8, 4)
+	if err != nil {
+		t.Fatalf("newSpatialIndex: %v", err)
+	}
+
+	// All lines share a latitude, so the index has no height.
+	got := idx.candidates(-63.595, 44.649, -63.594, 44.651)
+	found := make(map[int]bool)
+	for _, i := range got {
+		found[i] = true
+	}
+	if !found[0] || found[1] {
+		t.Fatalf("expected only line 0 among candidates, got %v", got)
+	}
+}
+
+func TestSpatialIndexLineOnTopEdge(t *testing.T) {
+	lines := []indexedLine{
+		{coords: orb.LineString{{-63.6, 44.6}, {-63.5, 44.7}}},
+		{coords: orb.LineString{{-63.6, 44.7}, {-63.59, 44.7}}},
+	}
+	idx, err := newSpatialIndex(lines, 8, 4)
+	if err != nil {
+		t.Fatalf("newSpatialIndex: %v", err)
+	}
+
+	// Line 1 lies along the index's maximum latitude, which falls just past
+	// the last row.
+	got := idx.candidates(-63.6, 44.7, -63.59, 44.7)
+	found := make(map[int]bool)
+	for _, i := range got {
+		found[i] = true
+	}
+	if !found[1] {
+		t.Fatalf("expected line 1 among candidates, got %v", got)
+	}
+}
+
+func TestBikeFeaturesBin(t *testing.T) {
+	type expectedBikeFeature struct {
+		title         string
+		priority      uint8
+		sourceDataset uint8
+		present       bool
+	}
+
+	tests := []struct {
+		name          string
+		travelways    geojsonFeatureCollection
+		bike          geojsonFeatureCollection
+		ice           geojsonFeatureCollection
+		ensureOutput  bool
+		minCount      int
+		expectedTests []expectedBikeFeature
+	}{
+		{
+			name: "protected prefers closer plowed",
+			travelways: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"OBJECTID":  1,
+							"WINT_PLOW": "Y",
+							"WINT_LOS":  "PRI1",
+							"OWNER":     "HRM",
+							"LOCATION":  "Plowed Way",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{0, 0.0001}, {0.001, 0.0001}},
+						},
+					},
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"OBJECTID":  2,
+							"WINT_PLOW": "N",
+							"OWNER":     "HRM",
+							"LOCATION":  "No Plow Way",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{0, 0.0002}, {0.001, 0.0002}},
+						},
+					},
+				},
+			},
+			bike: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"OBJECTID":   10,
+							"WINT_PLOW":  "Y",
+							"WINT_LOS":   "PRI1",
+							"BIKETYPE":   "PROTBL",
+							"PROT_TYPE":  "CURB",
+							"BIKE_NAME":  "Test Protected",
+							"STREETNAME": "Test St",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+						},
+					},
+				},
+			},
+			ice: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"PRIORITY": "1",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{5, 5}, {5.001, 5}},
+						},
+					},
+				},
+			},
+			minCount: 1,
+			expectedTests: []expectedBikeFeature{
+				{
+					title:         "Test Protected",
+					priority:      1,
+					sourceDataset: datasetTravelways,
+					present:       true,
+				},
+			},
+		},
+		{
+			name: "protected skipped when no-plow closer",
+			travelways: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"OBJECTID":  1,
+							"WINT_PLOW": "Y",
+							"WINT_LOS":  "PRI1",
+							"OWNER":     "HRM",
+							"LOCATION":  "Plowed Way",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{0, 0.0002}, {0.001, 0.0002}},
+						},
+					},
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"OBJECTID":  2,
+							"WINT_PLOW": "N",
+							"OWNER":     "HRM",
+							"LOCATION":  "No Plow Way",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{0, 0.00005}, {0.001, 0.00005}},
+						},
+					},
+				},
+			},
+			bike: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"OBJECTID":   11,
+							"WINT_PLOW":  "Y",
+							"WINT_LOS":   "PRI1",
+							"BIKETYPE":   "PROTBL",
+							"PROT_TYPE":  "CURB",
+							"BIKE_NAME":  "Test Protected",
+							"STREETNAME": "Test St",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+						},
+					},
+				},
+			},
+			ice: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"PRIORITY": "1",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{5, 5}, {5.001, 5}},
+						},
+					},
+				},
+			},
+			ensureOutput: true,
+			minCount:     1,
+			expectedTests: []expectedBikeFeature{
+				{
+					title:         "Test Protected",
+					present:       true,
+					priority:      1,
+					sourceDataset: datasetTravelways,
+				},
+				{
+					title:   "Baseline Bike",
+					present: true,
+				},
+			},
+		},
+		{
+			name: "unprotected matches ice",
+			travelways: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"OBJECTID":  1,
+							"WINT_PLOW": "Y",
+							"WINT_LOS":  "PRI1",
+							"OWNER":     "HRM",
+							"LOCATION":  "Plowed Way",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{1, 1}, {1.001, 1}},
+						},
+					},
+				},
+			},
+			bike: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"OBJECTID":   12,
+							"WINT_PLOW":  "Y",
+							"WINT_LOS":   "PRI1",
+							"BIKETYPE":   "ONSTREET",
+							"PROT_TYPE":  "NONE",
+							"BIKE_NAME":  "Test Unprotected",
+							"STREETNAME": "Test St",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+						},
+					},
+				},
+			},
+			ice: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"PRIORITY": "2",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
 							Coordinates: [][]float64{{0, 0.0001}, {0.001, 0.0001}},
 						},
 					},
+				},
+			},
+			minCount: 1,
+			expectedTests: []expectedBikeFeature{
+				{
+					title:         "Test Unprotected",
+					priority:      2,
+					sourceDataset: datasetIce,
+					present:       true,
+				},
+			},
+		},
+		{
+			name: "fallback to bike priority",
+			travelways: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"OBJECTID":  1,
+							"WINT_PLOW": "Y",
+							"WINT_LOS":  "PRI1",
+							"OWNER":     "HRM",
+							"LOCATION":  "Plowed Way",
+						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{1, 1}, {1.001, 1}},
+						},
+					},
+				},
+			},
+			bike: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
 					{
 						Type: "Feature",
 						Properties: map[string]interface{}{
-							"OBJECTID":  2,
-							"WINT_PLOW": "N",
-							"OWNER":     "HRM",
-							"LOCATION":  "No Plow Way",
+							"OBJECTID":   13,
+							"WINT_PLOW":  "Y",
+							"WINT_LOS":   "PRI2",
+							"BIKETYPE":   "ONSTREET",
+							"PROT_TYPE":  "NONE",
+							"BIKE_NAME":  "Test Fallback",
+							"STREETNAME": "Test St",
 						},
 						Geometry: geojsonGeometry{
 							Type:        "LineString",
-							Coordinates: [][]float64{{0, 0.0002}, {0.001, 0.0002}},
+							Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+						},
+					},
+				},
+			},
+			ice: geojsonFeatureCollection{
+				Type: "FeatureCollection",
+				Features: []geojsonFeature{
+					{
+						Type: "Feature",
+						Properties: map[string]interface{}{
+							"PRIORITY": "1",
 						},
+						Geometry: geojsonGeometry{
+							Type:        "LineString",
+							Coordinates: [][]float64{{5, 5}, {5.001, 5}},
+						},
+					},
+				},
+			},
+			minCount: 1,
+			expectedTests: []expectedBikeFeature{
+				{
+					title:         "Test Fallback",
+					priority:      2,
+					sourceDataset: datasetBike,
+					present:       true,
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bike := tt.bike
+			ice := tt.ice
+			if tt.ensureOutput {
+				bike, ice = addBaselineBikeAndIce(bike, ice)
+			}
+			_, bikeOut := runWithGeoJSON(t, tt.travelways, bike, ice)
+			features := readFeaturesBin(t, bikeOut)
+			if tt.minCount > 0 && len(features) < tt.minCount {
+				t.Fatalf("expected at least %d bike features, got %d", tt.minCount, len(features))
+			}
+			for _, expected := range tt.expectedTests {
+				actual := findFeatureByTitle(features, expected.title)
+				if expected.present && actual == nil {
+					t.Fatalf("expected feature %q to be present", expected.title)
+				}
+				if !expected.present && actual != nil {
+					t.Fatalf("expected feature %q to be absent", expected.title)
+				}
+				if !expected.present || actual == nil {
+					continue
+				}
+				if expected.priority != 0 && actual.priority != expected.priority {
+					t.Fatalf("feature %q priority: got %d want %d", expected.title, actual.priority, expected.priority)
+				}
+				if expected.sourceDataset != 0 && actual.sourceDataset != expected.sourceDataset {
+					t.Fatalf("feature %q source dataset: got %d want %d", expected.title, actual.sourceDataset, expected.sourceDataset)
+				}
+			}
+		})
+	}
+}
+
+func TestPriorityFromWintLOSNormalizes(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   uint8
+		wantOK bool
+	}{
+		{value: "PRI1", want: 1, wantOK: true},
+		{value: "pri 2", want: 2, wantOK: true},
+		{value: " PRI3 ", want: 3, wantOK: true},
+		{value: "Pri  1", want: 1, wantOK: true},
+		{value: "PRI4"},
+		{value: "PRI0"},
+		{value: "PRI"},
+		{value: " "},
+	}
+	for _, tt := range tests {
+		got, ok := priorityFromWintLOS(tt.value)
+		if got != tt.want || ok != tt.wantOK {
+			t.Fatalf("priorityFromWintLOS(%q): got %d %t, want %d %t", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestBikePrefersExplicitWinterPriority(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Devonshire Ave",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  2,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI3",
+					"OWNER":     "HRM",
+					"LOCATION":  "Devonshire Ave",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0.001, 0}, {0.002, 0}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   709,
+					"BIKEFACID":  "BIKEFAC6122",
+					"WINT_PLOW":  "Y",
+					"WINT_LOS":   "PRI1",
+					"WINT_MAINT": "W2",
+					"WINT_ROUTE": "BLR",
+					"BIKETYPE":   "PROTBL",
+					"PROT_TYPE":  "BOLLARD",
+					"BIKE_NAME":  "Devonshire Protected Bike Lanes",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}, {0.002, 0}},
+				},
+			},
+		},
+	}
+	ice := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"PRIORITY": "1",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{10, 10}, {10.001, 10}},
+				},
+			},
+		},
+	}
+
+	_, bikeOut := runWithGeoJSON(t, travelways, bike, ice)
+	features := readFeaturesBin(t, bikeOut)
+	var target []decodedFeature
+	for _, feat := range features {
+		if feat.title == "Devonshire Protected Bike Lanes" {
+			target = append(target, feat)
+		}
+	}
+	if len(target) != 1 {
+		t.Fatalf("expected exactly 1 feature for explicit-priority bike route, got %d", len(target))
+	}
+	if target[0].priority != 1 {
+		t.Fatalf("expected explicit bike priority 1, got %d", target[0].priority)
+	}
+	if target[0].sourceDataset != datasetBike {
+		t.Fatalf("expected source dataset bike (%d), got %d", datasetBike, target[0].sourceDataset)
+	}
+}
+
+func TestBikeMultiLinePreserved(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Split Trail",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  200,
+					"WINT_PLOW": "Y",
+					"BIKETYPE":  "MUPATH",
+					"PROT_TYPE": "OFFSTREET",
+					"BIKE_NAME": "Split Trail",
+				},
+				Geometry: geojsonGeometry{
+					Type: "MultiLineString",
+					Coordinates: [][][]float64{
+						{{0, 0}, {0.001, 0}},
+						{{0, 1}, {0.001, 1}},
+					},
+				},
+			},
+		},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice.Features = append(ice.Features, geojsonFeature{
+		Type: "Feature",
+		Properties: map[string]interface{}{
+			"PRIORITY": "1",
+		},
+		Geometry: geojsonGeometry{
+			Type:        "LineString",
+			Coordinates: [][]float64{{0, 1}, {0.001, 1}},
+		},
+	})
+
+	dir := t.TempDir()
+	travelwaysPath := filepath.Join(dir, "travelways.geojson")
+	bikePath := filepath.Join(dir, "bike.geojson")
+	icePath := filepath.Join(dir, "ice.geojson")
+	travelwaysOut := filepath.Join(dir, "features.bin")
+	bikeOut := filepath.Join(dir, "features_cycling.bin")
+
+	writeGeoJSON(t, travelwaysPath, travelways)
+	writeGeoJSON(t, bikePath, bike)
+	writeGeoJSON(t, icePath, ice)
+
+	cfg := runConfig{
+		TravelwaysFile: travelwaysPath,
+		BikeFile:       bikePath,
+		IceFile:        icePath,
+		TravelwaysOut:  travelwaysOut,
+		BikeOut:        bikeOut,
+		MaxMatchMeters: 30,
+		MaxAngleDeg:    30,
+		MinRunMeters:   0,
+	}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	features := readFeaturesBin(t, bikeOut)
+	var count, travelCount, iceCount int
+	for _, feat := range features {
+		if feat.title != "Split Trail" {
+			continue
+		}
+		count++
+		if feat.sourceDataset == datasetTravelways {
+			travelCount++
+		}
+		if feat.sourceDataset == datasetIce {
+			iceCount++
+		}
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 split trail features, got %d", count)
+	}
+	if travelCount == 0 || iceCount == 0 {
+		t.Fatalf("expected travelways+ice split, got travelways=%d ice=%d", travelCount, iceCount)
+	}
+}
+
+func TestBikeOverlapRuns(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Far Trail",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{10, 10}, {10.001, 10}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  300,
+					"WINT_PLOW": "Y",
+					"BIKETYPE":  "BRMAINRD",
+					"PROT_TYPE": "NONE",
+					"BIKE_NAME": "Overlap Run",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.0009, 0}, {0.0018, 0}},
+				},
+			},
+		},
+	}
+	ice := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   11,
+					"PRIORITY":   "1",
+					"OPERATOR":   "W1",
+					"ROUTE_NAME": "R1",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.0005, 0}},
+				},
+			},
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   22,
+					"PRIORITY":   "2",
+					"OPERATOR":   "W2",
+					"ROUTE_NAME": "R2",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0.0013, 0}, {0.0018, 0}},
+				},
+			},
+		},
+	}
+
+	dir := t.TempDir()
+	travelwaysPath := filepath.Join(dir, "travelways.geojson")
+	bikePath := filepath.Join(dir, "bike.geojson")
+	icePath := filepath.Join(dir, "ice.geojson")
+	travelwaysOut := filepath.Join(dir, "features.bin")
+	bikeOut := filepath.Join(dir, "features_cycling.bin")
+
+	writeGeoJSON(t, travelwaysPath, travelways)
+	writeGeoJSON(t, bikePath, bike)
+	writeGeoJSON(t, icePath, ice)
+
+	cfg := runConfig{
+		TravelwaysFile: travelwaysPath,
+		BikeFile:       bikePath,
+		IceFile:        icePath,
+		TravelwaysOut:  travelwaysOut,
+		BikeOut:        bikeOut,
+		MaxMatchMeters: 30,
+		MaxAngleDeg:    30,
+		MinRunMeters:   0,
+	}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	features := readFeaturesBin(t, bikeOut)
+	routesByID := map[uint16]featuresbin.RouteEntry{}
+	_, routes, _, err := featuresbin.ReadFile(bikeOut)
+	if err != nil {
+		t.Fatalf("read features (routes): %v", err)
+	}
+	for i, route := range routes {
+		routesByID[uint16(i+1)] = route
+	}
+	var p1, p2 int
+	var p1Route, p2Route string
+	for _, feat := range features {
+		if feat.title != "Overlap Run" {
+			continue
+		}
+		switch feat.priority {
+		case 1:
+			p1++
+			if route, ok := routesByID[feat.routeID]; ok {
+				p1Route = route.Route
+			}
+		case 2:
+			p2++
+			if route, ok := routesByID[feat.routeID]; ok {
+				p2Route = route.Route
+			}
+		}
+	}
+	if p1 == 0 || p2 == 0 {
+		t.Fatalf("expected overlap runs with priorities 1 and 2, got p1=%d p2=%d", p1, p2)
+	}
+	if p1Route == "" || p2Route == "" || p1Route == p2Route {
+		t.Fatalf("expected distinct routes per run, got p1=%q p2=%q", p1Route, p2Route)
+	}
+}
+
+func TestBikeOffstreetFallbackToIce(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Far Trail",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{10, 10}, {10.001, 10}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  400,
+					"WINT_PLOW": "Y",
+					"BIKETYPE":  "MUPATH",
+					"PROT_TYPE": "OFFSTREET",
+					"BIKE_NAME": "Offstreet Fallback",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	ice := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type:       "Feature",
+				Properties: map[string]interface{}{"PRIORITY": "1"},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+
+	_, bikeOut := runWithGeoJSON(t, travelways, bike, ice)
+	features := readFeaturesBin(t, bikeOut)
+	found := false
+	for _, feat := range features {
+		if feat.title == "Offstreet Fallback" && feat.sourceDataset == datasetIce {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected offstreet fallback to ice")
+	}
+}
+
+func TestBikeNameFallbackFromTravelways(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Fallback Name Trail",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  500,
+					"WINT_PLOW": "Y",
+					"BIKETYPE":  "MUPATH",
+					"PROT_TYPE": "OFFSTREET",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	ice := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type:       "Feature",
+				Properties: map[string]interface{}{"PRIORITY": "1"},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{5, 5}, {5.001, 5}},
+				},
+			},
+		},
+	}
+
+	_, bikeOut := runWithGeoJSON(t, travelways, bike, ice)
+	features := readFeaturesBin(t, bikeOut)
+	found := false
+	for _, feat := range features {
+		if feat.title == "Fallback Name Trail" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected name fallback from travelways")
+	}
+}
+
+type cannedTransport struct {
+	responses map[string][]byte
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (c *cannedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.requests = append(c.requests, req.URL.String())
+	c.mu.Unlock()
+	for prefix, body := range c.responses {
+		if strings.HasPrefix(req.URL.String(), prefix) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       io.NopCloser(bytes.NewReader(body)),
+				Request:    req,
+			}, nil
+		}
+	}
+	return &http.Response{
+		StatusCode: http.StatusNotFound,
+		Body:       io.NopCloser(strings.NewReader("not found")),
+		Request:    req,
+	}, nil
+}
+
+func (c *cannedTransport) addDataset(t *testing.T, itemID string, fc geojsonFeatureCollection) {
+	t.Helper()
+	resultURL := "https://results.example/" + itemID + ".geojson"
+	exportBody, err := json.Marshal(map[string]string{"resultUrl": resultURL})
+	if err != nil {
+		t.Fatalf("marshal export: %v", err)
+	}
+	fcBody, err := json.Marshal(fc)
+	if err != nil {
+		t.Fatalf("marshal geojson: %v", err)
+	}
+	c.responses["https://hub.arcgis.com/api/download/v1/items/"+itemID+"/"] = exportBody
+	c.responses[resultURL] = fcBody
+}
+
+func TestRunDownloadsWithCustomTransport(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Downloaded Way",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	transport := &cannedTransport{responses: map[string][]byte{}}
+	transport.addDataset(t, activeTravelwaysItemID, travelways)
+	transport.addDataset(t, bikeInfraItemID, bike)
+	transport.addDataset(t, iceRoutesItemID, ice)
+
+	dir := t.TempDir()
+	cfg := runConfig{
+		TravelwaysOut:  filepath.Join(dir, "features.bin"),
+		BikeOut:        filepath.Join(dir, "features_cycling.bin"),
+		MaxMatchMeters: 30,
+		MaxAngleDeg:    30,
+		HTTPClient:     &http.Client{Transport: transport},
+	}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if len(transport.requests) != 6 {
+		t.Fatalf("expected 6 requests through transport, got %d: %v", len(transport.requests), transport.requests)
+	}
+	features := readFeaturesBin(t, cfg.TravelwaysOut)
+	if findFeatureByTitle(features, "Downloaded Way") == nil {
+		t.Fatal("expected downloaded travelway feature")
+	}
+}
+
+// hostRewriteTransport sends every request to target, keeping the path and
+// query, so the hard-coded ArcGIS hub URL can be served by a test server.
+type hostRewriteTransport struct {
+	target *url.URL
+}
+
+func (h hostRewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = h.target.Scheme
+	req.URL.Host = h.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// itemRouteTransport sends ArcGIS hub requests to the test server for the
+// item in the URL path. Other requests, like the result URLs the servers hand
+// out, go straight to their own host.
+type itemRouteTransport map[string]*url.URL
+
+func (t itemRouteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "hub.arcgis.com" {
+		for itemID, target := range t {
+			if strings.Contains(req.URL.Path, "/items/"+itemID+"/") {
+				req = req.Clone(req.Context())
+				req.URL.Scheme = target.Scheme
+				req.URL.Host = target.Host
+				break
+			}
+		}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// datasetServer serves an export response pointing at its own result URL.
+// beforeExport runs first and can delay or fail the export request.
+func datasetServer(t *testing.T, fc geojsonFeatureCollection, beforeExport func(w http.ResponseWriter, r *http.Request) bool) *url.URL {
+	t.Helper()
+	body, err := json.Marshal(fc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/result.geojson" {
+			w.Write(body)
+			return
+		}
+		if !beforeExport(w, r) {
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"resultUrl": srv.URL + "/result.geojson"})
+	}))
+	t.Cleanup(srv.Close)
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+func TestRunDownloadsConcurrently(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Downloaded Way",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+	datasets := map[string]geojsonFeatureCollection{
+		activeTravelwaysItemID: travelways,
+		bikeInfraItemID:        bike,
+		iceRoutesItemID:        ice,
+	}
+
+	// Each export waits until all three have been requested, so the run
+	// only succeeds if the downloads overlap.
+	var arrived sync.WaitGroup
+	arrived.Add(len(datasets))
+	allArrived := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(allArrived)
+	}()
+	transport := itemRouteTransport{}
+	for itemID, fc := range datasets {
+		transport[itemID] = datasetServer(t, fc, func(w http.ResponseWriter, r *http.Request) bool {
+			arrived.Done()
+			select {
+			case <-allArrived:
+				return true
+			case <-time.After(5 * time.Second):
+				http.Error(w, "downloads did not overlap", http.StatusInternalServerError)
+				return false
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	cfg := runConfig{
+		TravelwaysOut:  filepath.Join(dir, "features.bin"),
+		BikeOut:        filepath.Join(dir, "features_cycling.bin"),
+		MaxMatchMeters: 30,
+		MaxAngleDeg:    30,
+		Quiet:          true,
+		HTTPClient:     &http.Client{Transport: transport},
+	}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	features := readFeaturesBin(t, cfg.TravelwaysOut)
+	if findFeatureByTitle(features, "Downloaded Way") == nil {
+		t.Fatal("expected downloaded travelway feature")
+	}
+}
+
+func TestRunDownloadFailureCancelsOthers(t *testing.T) {
+	empty := geojsonFeatureCollection{Type: "FeatureCollection"}
+
+	// Travelways and bike block until their requests are cancelled. Ice
+	// fails once both are in flight.
+	var waiting, cancelled sync.WaitGroup
+	waiting.Add(2)
+	cancelled.Add(2)
+	blocking := func(w http.ResponseWriter, r *http.Request) bool {
+		waiting.Done()
+		select {
+		case <-r.Context().Done():
+			cancelled.Done()
+		case <-time.After(5 * time.Second):
+		}
+		return false
+	}
+	transport := itemRouteTransport{
+		activeTravelwaysItemID: datasetServer(t, empty, blocking),
+		bikeInfraItemID:        datasetServer(t, empty, blocking),
+		iceRoutesItemID: datasetServer(t, empty, func(w http.ResponseWriter, r *http.Request) bool {
+			waiting.Wait()
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return false
+		}),
+	}
+
+	dir := t.TempDir()
+	cfg := runConfig{
+		TravelwaysOut:  filepath.Join(dir, "features.bin"),
+		BikeOut:        filepath.Join(dir, "features_cycling.bin"),
+		MaxMatchMeters: 30,
+		MaxAngleDeg:    30,
+		Quiet:          true,
+		HTTPClient:     &http.Client{Transport: transport},
+	}
+	start := time.Now()
+	err := run(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "unexpected status code: 500") {
+		t.Fatalf("expected ice download error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Fatalf("run took %v, expected the failure to cancel the other downloads", elapsed)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cancelled.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected travelways and bike requests to be cancelled")
+	}
+}
+
+func TestDownloadRetriesResultNotFound(t *testing.T) {
+	defer func(d time.Duration) { resultRetryDelay = d }(resultRetryDelay)
+	resultRetryDelay = time.Millisecond
+
+	var resultHits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/download/v1/items/item/geojson":
+			json.NewEncoder(w).Encode(map[string]string{"resultUrl": "https://results.example/item.geojson"})
+		case "/item.geojson":
+			resultHits++
+			if resultHits == 1 {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(`{"type":"FeatureCollection","features":[]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: hostRewriteTransport{target: target}}
+
+	rc, err := download(context.Background(), client, downloadLogger(true), "item")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "FeatureCollection") {
+		t.Fatalf("unexpected body: %s", b)
+	}
+	if resultHits != 2 {
+		t.Fatalf("result fetches: got %d want 2", resultHits)
+	}
+}
+
+func TestDownloadHTMLErrorPage(t *testing.T) {
+	const page = `<!DOCTYPE html><html><head><title>Service Unavailable</title></head><body>ArcGIS is down</body></html>`
+	for name, path := range map[string]string{
+		"export": "/api/download/v1/items/item/geojson",
+		"result": "/item.geojson",
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == path {
+					w.Header().Set("Content-Type", "text/html; charset=utf-8")
+					w.Write([]byte(page))
+					return
+				}
+				switch r.URL.Path {
+				case "/api/download/v1/items/item/geojson":
+					json.NewEncoder(w).Encode(map[string]string{"resultUrl": "https://results.example/item.geojson"})
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+			target, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: hostRewriteTransport{target: target}}
+
+			_, err = loadFeatureCollection(context.Background(), client, downloadLogger(true), "", "", "item.geojson", "item")
+			if !errors.Is(err, errNonJSON) {
+				t.Fatalf("expected non-JSON error, got %v", err)
+			}
+			if !strings.Contains(err.Error(), "<!DOCTYPE html><html><head><title>Service") {
+				t.Fatalf("expected error to quote the body, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadFeatureCollectionQuiet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/download/v1/items/item/geojson":
+			json.NewEncoder(w).Encode(map[string]string{"resultUrl": "https://results.example/item.geojson"})
+		case "/item.geojson":
+			w.Write([]byte(`{"type":"FeatureCollection","features":[]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: hostRewriteTransport{target: target}}
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	if _, err := loadFeatureCollection(context.Background(), client, downloadLogger(false), "", "", "item.geojson", "item"); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !strings.Contains(logs.String(), "downloading from") {
+		t.Fatalf("expected download logs without -quiet, got %q", logs.String())
+	}
+
+	logs.Reset()
+	if _, err := loadFeatureCollection(context.Background(), client, downloadLogger(true), "", "", "item.geojson", "item"); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("expected no output with -quiet, got %q", logs.String())
+	}
+}
+
+func TestRunDownloadsIceLayer(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Far Trail",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{10, 10}, {10.001, 10}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  400,
+					"WINT_PLOW": "Y",
+					"BIKETYPE":  "MUPATH",
+					"PROT_TYPE": "OFFSTREET",
+					"BIKE_NAME": "Downloaded Ice Match",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	ice := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type:       "Feature",
+				Properties: map[string]interface{}{"PRIORITY": "1"},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	iceBody, err := json.Marshal(ice)
+	if err != nil {
+		t.Fatalf("marshal geojson: %v", err)
+	}
+
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/api/download/v1/items/" + iceRoutesItemID + "/geojson":
+			json.NewEncoder(w).Encode(map[string]string{"resultUrl": "https://results.example/ice.geojson"})
+		case "/ice.geojson":
+			w.Write(iceBody)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	travelwaysPath := filepath.Join(dir, "travelways.geojson")
+	bikePath := filepath.Join(dir, "bike.geojson")
+	writeGeoJSON(t, travelwaysPath, travelways)
+	writeGeoJSON(t, bikePath, bike)
+	cfg := runConfig{
+		TravelwaysFile: travelwaysPath,
+		BikeFile:       bikePath,
+		TravelwaysOut:  filepath.Join(dir, "features.bin"),
+		BikeOut:        filepath.Join(dir, "features_cycling.bin"),
+		MaxMatchMeters: 30,
+		MaxAngleDeg:    30,
+		HTTPClient:     &http.Client{Transport: hostRewriteTransport{target: target}},
+	}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("expected only the ice layer to be downloaded, got requests %v", paths)
+	}
+
+	feat := findFeatureByTitle(readFeaturesBin(t, cfg.BikeOut), "Downloaded Ice Match")
+	if feat == nil {
+		t.Fatal("expected bike feature in cycling output")
+	}
+	if feat.sourceDataset != datasetIce || feat.priority != 1 {
+		t.Fatalf("expected bike feature matched to downloaded ice route, got dataset %d priority %d", feat.sourceDataset, feat.priority)
+	}
+}
+
+func TestRunNoFlattenRejectsMultiLineString(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  7,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Split Path",
+				},
+				Geometry: geojsonGeometry{
+					Type: "MultiLineString",
+					Coordinates: [][][]float64{
+						{{0, 0}, {0.001, 0}},
+						{{0.002, 0}, {0.003, 0}},
 					},
 				},
-			},
-			bike: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"OBJECTID":   10,
-							"WINT_PLOW":  "Y",
-							"WINT_LOS":   "PRI1",
-							"BIKETYPE":   "PROTBL",
-							"PROT_TYPE":  "CURB",
-							"BIKE_NAME":  "Test Protected",
-							"STREETNAME": "Test St",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{0, 0}, {0.001, 0}},
-						},
-					},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.NoFlatten = true
+
+	err := run(context.Background(), cfg)
+	if err == nil {
+		t.Fatal("expected error for MultiLineString travelway with NoFlatten")
+	}
+	if !strings.Contains(err.Error(), "Split Path") || !strings.Contains(err.Error(), "MultiLineString") {
+		t.Fatalf("error should name the feature and geometry type: %v", err)
+	}
+
+	cfg.NoFlatten = false
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run without NoFlatten: %v", err)
+	}
+	feat := findFeatureByTitle(readFeaturesBin(t, cfg.TravelwaysOut), "Split Path")
+	if feat == nil || len(feat.coords) != 4 {
+		t.Fatalf("expected flattened feature with 4 coords, got %+v", feat)
+	}
+}
+
+func TestOverlapAttributionBreaksTiesDeterministically(t *testing.T) {
+	line := orb.LineString{{0, 0}, {0.001, 0}}
+	tests := []struct {
+		name         string
+		lines        []indexedLine
+		wantPriority uint8
+		wantObjectID int
+	}{
+		{
+			name: "lower priority wins",
+			lines: []indexedLine{
+				{coords: orb.LineString{{0, -0.0001}, {0.001, -0.0001}}, priority: 2, objectID: 1},
+				{coords: orb.LineString{{0, 0.0001}, {0.001, 0.0001}}, priority: 1, objectID: 2},
+			},
+			wantPriority: 1,
+			wantObjectID: 2,
+		},
+		{
+			name: "lower objectid wins",
+			lines: []indexedLine{
+				{coords: orb.LineString{{0, -0.0001}, {0.001, -0.0001}}, priority: 1, objectID: 20},
+				{coords: orb.LineString{{0, 0.0001}, {0.001, 0.0001}}, priority: 1, objectID: 10},
+			},
+			wantPriority: 1,
+			wantObjectID: 10,
+		},
+		{
+			// Both lines come closest at (0, 0.0001), so only the angle
+			// differs; the lower OBJECTID would pick the tilted one.
+			name: "smaller angle wins",
+			lines: []indexedLine{
+				{coords: orb.LineString{{0, 0.0001}, {0.001, 0.0003}}, priority: 1, objectID: 10},
+				{coords: orb.LineString{{0, 0.0001}, {0.001, 0.0001}}, priority: 1, objectID: 20},
+			},
+			wantPriority: 1,
+			wantObjectID: 20,
+		},
+	}
+	for _, tt := range tests {
+		idx, err := newSpatialIndex(tt.lines, 48, 24)
+		if err != nil {
+			t.Fatalf("%s: new spatial index: %v", tt.name, err)
+		}
+		result := overlapAttribution(line, "", idx, datasetTravelways, 30, deg2rad(30), nil)
+		if len(result.assignments) != 1 {
+			t.Fatalf("%s: expected 1 assignment, got %d", tt.name, len(result.assignments))
+		}
+		got := result.assignments[0]
+		if got.priority != tt.wantPriority || got.objectID != tt.wantObjectID {
+			t.Fatalf("%s: got priority %d objectid %d, want priority %d objectid %d", tt.name, got.priority, got.objectID, tt.wantPriority, tt.wantObjectID)
+		}
+	}
+}
+
+func TestOverlapAttributionGridMatchesBruteForce(t *testing.T) {
+	// A street grid with mixed priorities, some streets offset so bike
+	// lines land at varying distances.
+	var lines []indexedLine
+	id := 1
+	for i := 0; i < 20; i++ {
+		off := float64(i) * 0.0005
+		lines = append(lines,
+			indexedLine{coords: orb.LineString{{0, off}, {0.005, off + 0.00002}}, priority: uint8(i%3 + 1), objectID: id},
+			indexedLine{coords: orb.LineString{{off, 0}, {off + 0.00003, 0.01}}, priority: uint8((i+1)%3 + 1), objectID: id + 1},
+		)
+		id += 2
+	}
+	copyLines := func() []indexedLine {
+		out := make([]indexedLine, len(lines))
+		copy(out, lines)
+		return out
+	}
+	grid, err := newSpatialIndex(copyLines(), 48, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A single cell holds every line, so candidates are all lines.
+	brute, err := newSpatialIndex(copyLines(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bikes := []orb.LineString{
+		{{0.0001, 0.00011}, {0.002, 0.00012}, {0.0045, 0.00014}},
+		{{0.00252, 0.0001}, {0.00253, 0.004}, {0.00255, 0.0095}},
+		{{0, 0}, {0.004, 0.004}},
+		{{0.001, 0.0049}, {0.0049, 0.0049}, {0.0049, 0.0091}},
+	}
+	for i, bike := range bikes {
+		for _, maxMeters := range []float64{5, 15, 30} {
+			got := overlapAttribution(bike, "", grid, datasetTravelways, maxMeters, deg2rad(30), nil)
+			want := overlapAttribution(bike, "", brute, datasetTravelways, maxMeters, deg2rad(30), nil)
+			if fmt.Sprint(got.assignments) != fmt.Sprint(want.assignments) {
+				t.Fatalf("bike %d at %vm: grid assignments %v, brute force %v", i, maxMeters, got.assignments, want.assignments)
+			}
+			// Bike 2 runs diagonally, outside the angle limit of every street.
+			if maxMeters == 30 && i != 2 && len(want.assignments) == 0 {
+				t.Fatalf("bike %d at %vm: expected matches", i, maxMeters)
+			}
+		}
+	}
+}
+
+func TestRunOnlyBike(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Only Way",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.Only = onlyBike
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if _, err := os.Stat(cfg.TravelwaysOut); !os.IsNotExist(err) {
+		t.Fatalf("expected travelways output to be left alone, stat err: %v", err)
+	}
+	if findFeatureByTitle(readFeaturesBin(t, cfg.BikeOut), "Baseline Bike") == nil {
+		t.Fatal("expected cycling output to be written")
+	}
+
+	cfg.Only = "ice"
+	if err := run(context.Background(), cfg); err == nil {
+		t.Fatal("expected error for invalid -only value")
+	}
+}
+
+func TestRunOnlyTravelwaysMatchesAll(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "ROBIE ST",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	// The bike dataset is where the street's title casing comes from.
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   7,
+					"WINT_PLOW":  "Y",
+					"BIKETYPE":   "PROTBL",
+					"PROT_TYPE":  "CURB",
+					"BIKE_NAME":  "Robie Lane",
+					"STREETNAME": "Robie St",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0.00002}, {0.001, 0.00002}},
+				},
+			},
+		},
+	}
+	bike, ice := addBaselineBikeAndIce(bike, geojsonFeatureCollection{Type: "FeatureCollection"})
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want, err := os.ReadFile(cfg.TravelwaysOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findFeatureByTitle(readFeaturesBin(t, cfg.TravelwaysOut), "Robie St") == nil {
+		t.Fatal("expected the travelway titled with the bike dataset's casing")
+	}
+	if err := os.Remove(cfg.BikeOut); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bike dataset is downloaded for its casing; ice isn't served, so
+	// fetching it would fail the run.
+	transport := &cannedTransport{responses: map[string][]byte{}}
+	transport.addDataset(t, bikeInfraItemID, bike)
+	cfg.Only = onlyTravelways
+	cfg.BikeFile = ""
+	cfg.IceFile = ""
+	cfg.HTTPClient = &http.Client{Transport: transport}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run -only travelways: %v", err)
+	}
+	for _, req := range transport.requests {
+		if !strings.Contains(req, bikeInfraItemID) {
+			t.Fatalf("expected only the bike dataset to be downloaded, got %v", transport.requests)
+		}
+	}
+	got, err := os.ReadFile(cfg.TravelwaysOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("-only travelways wrote %d bytes that differ from -only all's %d", len(got), len(want))
+	}
+	if _, err := os.Stat(cfg.BikeOut); !os.IsNotExist(err) {
+		t.Fatalf("expected cycling output to be left alone, stat err: %v", err)
+	}
+
+	cfg.Offline = true
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "no file given for bike") {
+		t.Fatalf("-offline -only travelways without -bike: got %v, want a missing bike file error", err)
+	}
+}
+
+func TestRunGeoJSONOutSource(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Plowed Way",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  500,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI2",
+					"BIKETYPE":  "ONSTREET",
+					"PROT_TYPE": "NONE",
+					"BIKE_NAME": "Lonely Lane",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{5, 5}, {5.001, 5}},
+				},
+			},
+		},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	dir := filepath.Dir(cfg.TravelwaysOut)
+	cfg.GeoJSONOut = filepath.Join(dir, "out.geojson")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	b, err := os.ReadFile(cfg.GeoJSONOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fc struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(b, &fc); err != nil {
+		t.Fatalf("unmarshal geojson out: %v", err)
+	}
+	sources := map[string]interface{}{}
+	for _, f := range fc.Features {
+		sources[f.Properties["output"].(string)+"/"+f.Properties["title"].(string)] = f.Properties["source"]
+	}
+	if got := sources["cycling/Lonely Lane"]; got != "bike" {
+		t.Fatalf("fallback feature source: got %v want bike (all: %v)", got, sources)
+	}
+	if got := sources["travelways/Plowed Way"]; got != "travelways" {
+		t.Fatalf("travelway source: got %v want travelways (all: %v)", got, sources)
+	}
+}
+
+func TestRunGeoJSONOutSegment(t *testing.T) {
+	street := func(objectID int, name string, coords [][]float64) geojsonFeature {
+		return geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  objectID,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  "PRI1",
+				"OWNER":     "HRM",
+				"LOCATION":  name,
+			},
+			Geometry: geojsonGeometry{Type: "LineString", Coordinates: coords},
+		}
+	}
+	// Streets starting in opposite corners of the default 8x4 grid.
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			street(1, "Corner Street", [][]float64{{0, 0}, {0.001, 0}}),
+			street(2, "Far Street", [][]float64{{0.999, 1}, {1, 1}}),
+		},
+	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	dir := filepath.Dir(cfg.TravelwaysOut)
+	cfg.GeoJSONOut = filepath.Join(dir, "out.geojson")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	b, err := os.ReadFile(cfg.GeoJSONOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fc struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(b, &fc); err != nil {
+		t.Fatalf("unmarshal geojson out: %v", err)
+	}
+	segments := map[string]interface{}{}
+	for _, f := range fc.Features {
+		segments[f.Properties["output"].(string)+"/"+f.Properties["title"].(string)] = f.Properties["segment"]
+	}
+	want := map[string]interface{}{
+		"travelways/Corner Street": "0,0",
+		"travelways/Far Street":    "3,7",
+		"cycling/Baseline Bike":    "0,0",
+	}
+	for k, v := range want {
+		if segments[k] != v {
+			t.Fatalf("%s segment: got %v want %v (all: %v)", k, segments[k], v, segments)
+		}
+	}
+}
+
+func TestRunUnmatchedOut(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Plowed Way",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	bikeFeature := func(objectID int, name, plow, los string, coords [][]float64) geojsonFeature {
+		return geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  objectID,
+				"WINT_PLOW": plow,
+				"WINT_LOS":  los,
+				"BIKETYPE":  "ONSTREET",
+				"PROT_TYPE": "NONE",
+				"BIKE_NAME": name,
+			},
+			Geometry: geojsonGeometry{Type: "LineString", Coordinates: coords},
+		}
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			bikeFeature(500, "Lonely Lane", "Y", "PRI2", [][]float64{{5, 5}, {5.001, 5}}),
+			bikeFeature(501, "Mystery Lane", "Y", "", [][]float64{{6, 6}, {6.001, 6}}),
+			bikeFeature(502, "Unplowed Lane", "N", "PRI2", [][]float64{{7, 7}, {7.001, 7}}),
+		},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	dir := filepath.Dir(cfg.TravelwaysOut)
+	cfg.UnmatchedOut = filepath.Join(dir, "unmatched.geojson")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	b, err := os.ReadFile(cfg.UnmatchedOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Type        string      `json:"type"`
+				Coordinates [][]float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(b, &fc); err != nil {
+		t.Fatalf("unmarshal unmatched: %v", err)
+	}
+	reasons := map[string]interface{}{}
+	for _, f := range fc.Features {
+		reasons[f.Properties["title"].(string)] = f.Properties["reason"]
+		if f.Geometry.Type != "LineString" || len(f.Geometry.Coordinates) != 2 {
+			t.Fatalf("%v: expected its line, got %+v", f.Properties["title"], f.Geometry)
+		}
+	}
+	want := map[string]interface{}{
+		"Lonely Lane":  "fallback WINT_LOS",
+		"Mystery Lane": "no match",
+	}
+	if len(reasons) != len(want) {
+		t.Fatalf("unmatched reasons: got %v want %v", reasons, want)
+	}
+	for title, reason := range want {
+		if reasons[title] != reason {
+			t.Fatalf("%s reason: got %v want %v (all: %v)", title, reasons[title], reason, reasons)
+		}
+	}
+}
+
+func TestRunSkipsDegenerateBikeLines(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Main Street",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   7,
+					"WINT_PLOW":  "Y",
+					"BIKETYPE":   "ONSTREET",
+					"PROT_TYPE":  "NONE",
+					"BIKE_NAME":  "Single Point",
+					"STREETNAME": "Main Street",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0.0005, 0}},
+				},
+			},
+		},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	dir := filepath.Dir(cfg.TravelwaysOut)
+	cfg.StatsOut = filepath.Join(dir, "stats.json")
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for _, f := range readFeaturesBin(t, cfg.BikeOut) {
+		if f.title == "Single Point" {
+			t.Fatalf("degenerate bike line was encoded: %+v", f)
+		}
+	}
+
+	b, err := os.ReadFile(cfg.StatsOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats runStats
+	if err := json.Unmarshal(b, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.BikeMatches == nil || stats.BikeMatches.SkippedDegenerate != 1 {
+		t.Fatalf("bike match stats: got %+v", stats.BikeMatches)
+	}
+
+	cfg.Strict = true
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "fewer than two coordinates") {
+		t.Fatalf("expected strict warning for degenerate bike line, got %v", err)
+	}
+}
+
+func TestRunPrettyLogSummary(t *testing.T) {
+	travelways := geojsonFeatureCollection{Type: "FeatureCollection"}
+	for i, los := range []string{"PRI1", "PRI2", "PRI3"} {
+		travelways.Features = append(travelways.Features, geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  i + 1,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  los,
+				"OWNER":     "HRM",
+				"LOCATION":  fmt.Sprintf("Street %d", i+1),
+			},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{0, float64(i) * 0.01}, {0.001, float64(i) * 0.01}},
+			},
+		})
+	}
+	// Not plowed, so it's read but not written.
+	travelways.Features = append(travelways.Features, geojsonFeature{
+		Type: "Feature",
+		Properties: map[string]interface{}{
+			"OBJECTID":  4,
+			"WINT_PLOW": "N",
+			"WINT_LOS":  "PRI1",
+			"OWNER":     "HRM",
+			"LOCATION":  "Street 4",
+		},
+		Geometry: geojsonGeometry{
+			Type:        "LineString",
+			Coordinates: [][]float64{{0, 0.05}, {0.001, 0.05}},
+		},
+	})
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	sink := &memSink{}
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.TravelwaysOut = "features.bin"
+	cfg.BikeOut = "features_cycling.bin"
+	cfg.Output = sink
+	cfg.PrettyLog = true
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	_, summary, ok := strings.Cut(logs.String(), "summary:\n")
+	if !ok {
+		t.Fatalf("no summary in logs:\n%s", logs.String())
+	}
+	for _, want := range []string{
+		"  travelways        4 in      3 out\n",
+		"  bike              1 in      1 out\n",
+		"  ice               1 in\n",
+		fmt.Sprintf("  wrote features.bin (%d bytes)\n", len(sink.files["features.bin"])),
+		fmt.Sprintf("  wrote features_cycling.bin (%d bytes)\n", len(sink.files["features_cycling.bin"])),
+		"  bike matches travelways=0 ice=1 bike=0 fallback=0 skipped=0\n",
+		"  warnings 0\n",
+		"  elapsed ",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary missing %q:\n%s", want, summary)
+		}
+	}
+
+	logs.Reset()
+	cfg.Quiet = true
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("quiet run: %v", err)
+	}
+	if strings.Contains(logs.String(), "summary:") {
+		t.Fatalf("-quiet should suppress the summary:\n%s", logs.String())
+	}
+}
+
+func TestRunSnapEndpoints(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Main Street",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.002, 0}},
+				},
+			},
+		},
+	}
+	// About 2m north of the street.
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   7,
+					"WINT_PLOW":  "Y",
+					"BIKETYPE":   "PROTBL",
+					"PROT_TYPE":  "CURB",
+					"BIKE_NAME":  "Offset Lane",
+					"STREETNAME": "Main Street",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0.0005, 0.00002}, {0.001, 0.00002}, {0.0015, 0.00002}},
+				},
+			},
+		},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+
+	offsetLane := func() decodedFeature {
+		t.Helper()
+		if err := run(context.Background(), cfg); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		for _, f := range readFeaturesBin(t, cfg.BikeOut) {
+			if f.title == "Offset Lane" {
+				if f.sourceDataset != datasetTravelways {
+					t.Fatalf("Offset Lane source: got %d, want travelways", f.sourceDataset)
+				}
+				return f
+			}
+		}
+		t.Fatal("Offset Lane not encoded")
+		return decodedFeature{}
+	}
+
+	f := offsetLane()
+	first, last := f.coords[0], f.coords[len(f.coords)-1]
+	if math.Abs(first[1]-0.00002) > 1e-6 || math.Abs(last[1]-0.00002) > 1e-6 {
+		t.Fatalf("without -snap-endpoints, ends should keep their offset: got %v", f.coords)
+	}
+
+	cfg.SnapEndpoints = true
+	f = offsetLane()
+	first, last = f.coords[0], f.coords[len(f.coords)-1]
+	if math.Abs(first[1]) > 1e-6 || math.Abs(last[1]) > 1e-6 {
+		t.Fatalf("ends not snapped onto the street: got %v", f.coords)
+	}
+	if math.Abs(first[0]-0.0005) > 1e-6 || math.Abs(last[0]-0.0015) > 1e-6 {
+		t.Fatalf("snapping should move ends straight onto the street: got %v", f.coords)
+	}
+}
+
+func TestRunSnapEndpointsSplitPartial(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Main Street",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+				},
+			},
+		},
+	}
+	// About 2m north of the street, then turning north at its east end.
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   7,
+					"WINT_PLOW":  "Y",
+					"WINT_LOS":   "PRI3",
+					"BIKETYPE":   "PROTBL",
+					"PROT_TYPE":  "CURB",
+					"BIKE_NAME":  "Offset Lane",
+					"STREETNAME": "Main Street",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0.00002}, {0.001, 0.00002}, {0.001, 0.001}},
+				},
+			},
+		},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.MinRunMeters = 20
+	cfg.SplitPartial = true
+	cfg.SnapEndpoints = true
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var parts []decodedFeature
+	for _, f := range readFeaturesBin(t, cfg.BikeOut) {
+		if f.title == "Offset Lane" {
+			parts = append(parts, f)
+		}
+	}
+	if len(parts) != 2 {
+		t.Fatalf("expected Offset Lane split in 2, got %+v", parts)
+	}
+	near, far := parts[0], parts[1]
+	if near.coords[0][1] > far.coords[0][1] {
+		near, far = far, near
+	}
+	if near.sourceDataset != datasetTravelways || far.sourceDataset != datasetBike {
+		t.Fatalf("sources: got near %d far %d", near.sourceDataset, far.sourceDataset)
+	}
+	if math.Abs(near.coords[0][1]) > 1e-6 {
+		t.Fatalf("the line's first point should snap onto the street: got %v", near.coords)
+	}
+	// The end the matched run shares with the unmatched one isn't an end of
+	// the line, so it stays where the split put it.
+	if shared := near.coords[len(near.coords)-1]; !slices.Equal(shared, far.coords[0]) {
+		t.Fatalf("gap between runs: near ends at %v, far starts at %v", shared, far.coords[0])
+	}
+}
+
+func TestRunMaxAngleZeroMatchesOnDistance(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Main Street",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.002, 0}},
+				},
+			},
+		},
+	}
+	// Runs north from about 5m to 17m off the street, perpendicular to it.
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   7,
+					"WINT_PLOW":  "Y",
+					"BIKETYPE":   "PROTBL",
+					"PROT_TYPE":  "CURB",
+					"BIKE_NAME":  "Cross Lane",
+					"STREETNAME": "Main Street",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0.001, 0.00005}, {0.001, 0.00015}},
+				},
+			},
+		},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+
+	crossLane := func() (decodedFeature, bool) {
+		t.Helper()
+		if err := run(context.Background(), cfg); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		for _, f := range readFeaturesBin(t, cfg.BikeOut) {
+			if f.title == "Cross Lane" {
+				return f, true
+			}
+		}
+		return decodedFeature{}, false
+	}
+
+	if f, ok := crossLane(); ok {
+		t.Fatalf("perpendicular lane matched with -max-angle-deg 30: %+v", f)
+	}
+
+	cfg.MaxAngleDeg = 0
+	f, ok := crossLane()
+	if !ok {
+		t.Fatal("perpendicular lane not matched with -max-angle-deg 0")
+	}
+	if f.priority != 1 || f.sourceDataset != datasetTravelways {
+		t.Fatalf("Cross Lane: got priority %d source %d, want 1 from travelways", f.priority, f.sourceDataset)
+	}
+
+	cfg.MaxAngleDeg = -1
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "invalid -max-angle-deg") {
+		t.Fatalf("expected negative -max-angle-deg error, got %v", err)
+	}
+}
+
+func TestRunStatsJSON(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Only Way",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
 				},
 			},
-			ice: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"PRIORITY": "1",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{5, 5}, {5.001, 5}},
-						},
-					},
+		},
+	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	dir := filepath.Dir(cfg.TravelwaysOut)
+	cfg.StatsOut = filepath.Join(dir, "stats.json")
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	b, err := os.ReadFile(cfg.StatsOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"outputs", "bike_matches", "timing"} {
+		if _, ok := raw[key]; !ok {
+			t.Fatalf("stats json missing %q: %s", key, b)
+		}
+	}
+
+	var stats runStats
+	if err := json.Unmarshal(b, &stats); err != nil {
+		t.Fatal(err)
+	}
+	tw, ok := stats.Outputs["travelways"]
+	if !ok {
+		t.Fatalf("missing travelways output stats: %s", b)
+	}
+	if tw.Features != 1 || tw.Coords != 2 || tw.Segments != 1 {
+		t.Fatalf("travelways stats: got %+v", tw)
+	}
+	if info, err := os.Stat(cfg.TravelwaysOut); err != nil || int64(tw.Bytes) != info.Size() {
+		t.Fatalf("travelways bytes %d does not match file size (stat err %v)", tw.Bytes, err)
+	}
+	cycling, ok := stats.Outputs["cycling"]
+	if !ok || cycling.Features != 1 {
+		t.Fatalf("cycling stats: got %+v (present %v)", cycling, ok)
+	}
+	if stats.BikeMatches == nil || stats.BikeMatches.Ice != 1 || stats.BikeMatches.Skipped != 0 {
+		t.Fatalf("bike match stats: got %+v", stats.BikeMatches)
+	}
+}
+
+func TestRunSplitPartialMatch(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Only Way",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
 				},
 			},
-			minCount: 1,
-			expectedTests: []expectedBikeFeature{
-				{
-					title:         "Test Protected",
-					priority:      1,
-					sourceDataset: datasetTravelways,
-					present:       true,
+		},
+	}
+	// The bike lane runs about 210m but the ice route beside it only
+	// covers the western half.
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   50,
+					"WINT_PLOW":  "Y",
+					"WINT_LOS":   "PRI3",
+					"BIKETYPE":   "ONSTREET",
+					"PROT_TYPE":  "NONE",
+					"BIKE_NAME":  "Half Plowed",
+					"STREETNAME": "Half St",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{20, 20}, {20.002, 20}},
 				},
 			},
 		},
-		{
-			name: "protected skipped when no-plow closer",
-			travelways: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"OBJECTID":  1,
-							"WINT_PLOW": "Y",
-							"WINT_LOS":  "PRI1",
-							"OWNER":     "HRM",
-							"LOCATION":  "Plowed Way",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{0, 0.0002}, {0.001, 0.0002}},
-						},
-					},
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"OBJECTID":  2,
-							"WINT_PLOW": "N",
-							"OWNER":     "HRM",
-							"LOCATION":  "No Plow Way",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{0, 0.00005}, {0.001, 0.00005}},
-						},
-					},
+	}
+	ice := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type:       "Feature",
+				Properties: map[string]interface{}{"PRIORITY": "1"},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{20, 20.0001}, {20.001, 20.0001}},
 				},
 			},
-			bike: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"OBJECTID":   11,
-							"WINT_PLOW":  "Y",
-							"WINT_LOS":   "PRI1",
-							"BIKETYPE":   "PROTBL",
-							"PROT_TYPE":  "CURB",
-							"BIKE_NAME":  "Test Protected",
-							"STREETNAME": "Test St",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{0, 0}, {0.001, 0}},
-						},
-					},
+		},
+	}
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.MinRunMeters = 20
+	cfg.SimplifyMeters = 2
+
+	halfPlowed := func() []decodedFeature {
+		var out []decodedFeature
+		for _, f := range readFeaturesBin(t, cfg.BikeOut) {
+			if f.title == "Half Plowed" {
+				out = append(out, f)
+			}
+		}
+		return out
+	}
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := halfPlowed(); len(got) != 1 || got[0].priority != 1 {
+		t.Fatalf("without split: expected one priority 1 feature, got %+v", got)
+	}
+
+	cfg.SplitPartial = true
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	got := halfPlowed()
+	if len(got) != 2 {
+		t.Fatalf("with split: expected 2 features, got %+v", got)
+	}
+	near, far := got[0], got[1]
+	if near.coords[0][0] > far.coords[0][0] {
+		near, far = far, near
+	}
+	if near.priority != 1 || near.sourceDataset != datasetIce {
+		t.Fatalf("near part: got priority %d source %d", near.priority, near.sourceDataset)
+	}
+	if far.priority != 3 || far.sourceDataset != datasetBike {
+		t.Fatalf("far part: got priority %d source %d", far.priority, far.sourceDataset)
+	}
+	// The split lands within a densify step (max-match-meters/4, about
+	// 0.00007 degrees here) plus match distance of the ice route's end.
+	split := near.coords[len(near.coords)-1][0]
+	if split < 20.001 || split > 20.0015 {
+		t.Fatalf("split at lon %f, want just past 20.001", split)
+	}
+	if far.coords[0][0] != split || far.coords[len(far.coords)-1][0] < 20.00199 {
+		t.Fatalf("far part should run from the split to the end, got %v", far.coords)
+	}
+}
+
+func TestRunSplitPartialKeepsUnsplitLines(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Only Way",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
 				},
 			},
-			ice: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"PRIORITY": "1",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{5, 5}, {5.001, 5}},
-						},
-					},
+		},
+	}
+	bikeLane := func(id int, name string, lat float64) geojsonFeature {
+		return geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":   id,
+				"WINT_PLOW":  "Y",
+				"WINT_LOS":   "PRI3",
+				"BIKETYPE":   "ONSTREET",
+				"PROT_TYPE":  "NONE",
+				"BIKE_NAME":  name,
+				"STREETNAME": name,
+			},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{20, lat}, {20.002, lat}},
+			},
+		}
+	}
+	iceRoute := func(lat, toLon float64) geojsonFeature {
+		return geojsonFeature{
+			Type:       "Feature",
+			Properties: map[string]interface{}{"PRIORITY": "1"},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{20, lat + 0.0001}, {toLon, lat + 0.0001}},
+			},
+		}
+	}
+	// The first lane is covered by an ice route for half its length and
+	// the second for all of it.
+	bike := geojsonFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []geojsonFeature{bikeLane(50, "Half Plowed", 20), bikeLane(51, "Fully Plowed", 20.01)},
+	}
+	ice := geojsonFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []geojsonFeature{iceRoute(20, 20.001), iceRoute(20.01, 20.002)},
+	}
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.MinRunMeters = 20
+	cfg.SplitPartial = true
+	cfg.StatsOut = filepath.Join(filepath.Dir(cfg.BikeOut), "stats.json")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	var half, full []decodedFeature
+	for _, f := range readFeaturesBin(t, cfg.BikeOut) {
+		switch f.title {
+		case "Half Plowed":
+			half = append(half, f)
+		case "Fully Plowed":
+			full = append(full, f)
+		}
+	}
+	if len(half) != 2 {
+		t.Fatalf("expected the half plowed lane to split in 2, got %+v", half)
+	}
+	if len(full) != 1 || len(full[0].coords) != 2 {
+		t.Fatalf("expected the fully plowed lane unchanged with its 2 points, got %+v", full)
+	}
+
+	b, err := os.ReadFile(cfg.StatsOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats runStats
+	if err := json.Unmarshal(b, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.BikeMatches == nil || stats.BikeMatches.Split != 1 {
+		t.Fatalf("bike match stats: got %+v", stats.BikeMatches)
+	}
+}
+
+func TestRunTravelwayBuffer(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Divided Boulevard",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.002, 0}},
 				},
 			},
-			ensureOutput: true,
-			minCount:     1,
-			expectedTests: []expectedBikeFeature{
-				{
-					title:         "Test Protected",
-					present:       true,
-					priority:      1,
-					sourceDataset: datasetTravelways,
+		},
+	}
+	// The protected lane runs along the north edge, about 44m from the
+	// centerline: out of reach of -max-match-meters on its own.
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   60,
+					"WINT_PLOW":  "Y",
+					"WINT_LOS":   "PRI3",
+					"BIKETYPE":   "PROTBL",
+					"PROT_TYPE":  "CURB",
+					"BIKE_NAME":  "Edge Lane",
+					"STREETNAME": "Divided Blvd",
 				},
-				{
-					title:   "Baseline Bike",
-					present: true,
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0.0004}, {0.002, 0.0004}},
 				},
 			},
 		},
-		{
-			name: "unprotected matches ice",
-			travelways: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"OBJECTID":  1,
-							"WINT_PLOW": "Y",
-							"WINT_LOS":  "PRI1",
-							"OWNER":     "HRM",
-							"LOCATION":  "Plowed Way",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{1, 1}, {1.001, 1}},
-						},
-					},
-				},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.MinRunMeters = 20
+	cfg.SimplifyMeters = 2
+
+	edgeLane := func() decodedFeature {
+		for _, f := range readFeaturesBin(t, cfg.BikeOut) {
+			if f.title == "Edge Lane" {
+				return f
+			}
+		}
+		t.Fatalf("Edge Lane not found")
+		return decodedFeature{}
+	}
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := edgeLane(); got.priority != 3 || got.sourceDataset != datasetBike {
+		t.Fatalf("centerline: expected WINT_LOS fallback priority 3, got priority %d source %d", got.priority, got.sourceDataset)
+	}
+
+	cfg.TravelwayBufferMeters = 20
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := edgeLane(); got.priority != 1 || got.sourceDataset != datasetTravelways {
+		t.Fatalf("buffered: expected travelway priority 1, got priority %d source %d", got.priority, got.sourceDataset)
+	}
+}
+
+func TestRunNameMatchBias(t *testing.T) {
+	street := func(objectID int, name, los string, lat float64) geojsonFeature {
+		return geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  objectID,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  los,
+				"OWNER":     "HRM",
+				"LOCATION":  name,
 			},
-			bike: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"OBJECTID":   12,
-							"WINT_PLOW":  "Y",
-							"WINT_LOS":   "PRI1",
-							"BIKETYPE":   "ONSTREET",
-							"PROT_TYPE":  "NONE",
-							"BIKE_NAME":  "Test Unprotected",
-							"STREETNAME": "Test St",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{0, 0}, {0.001, 0}},
-						},
-					},
-				},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{0, lat}, {0.002, lat}},
 			},
-			ice: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"PRIORITY": "2",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{0, 0.0001}, {0.001, 0.0001}},
-						},
-					},
+		}
+	}
+	// The lane runs midway between two streets; only the lower priority one
+	// shares its street name.
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			street(1, "Side Street", "PRI1", -0.0001),
+			street(2, "Main Street", "PRI2", 0.0001),
+		},
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   60,
+					"WINT_PLOW":  "Y",
+					"WINT_LOS":   "PRI3",
+					"BIKETYPE":   "PROTBL",
+					"PROT_TYPE":  "CURB",
+					"BIKE_NAME":  "Main Lane",
+					"STREETNAME": "MAIN  STREET",
 				},
-			},
-			minCount: 1,
-			expectedTests: []expectedBikeFeature{
-				{
-					title:         "Test Unprotected",
-					priority:      2,
-					sourceDataset: datasetIce,
-					present:       true,
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.002, 0}},
 				},
 			},
 		},
-		{
-			name: "fallback to bike priority",
-			travelways: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"OBJECTID":  1,
-							"WINT_PLOW": "Y",
-							"WINT_LOS":  "PRI1",
-							"OWNER":     "HRM",
-							"LOCATION":  "Plowed Way",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{1, 1}, {1.001, 1}},
-						},
-					},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.MinRunMeters = 20
+
+	mainLane := func() decodedFeature {
+		for _, f := range readFeaturesBin(t, cfg.BikeOut) {
+			if f.title == "Main Lane" {
+				return f
+			}
+		}
+		t.Fatalf("Main Lane not found")
+		return decodedFeature{}
+	}
+
+	// Equidistant candidates tie, and the higher priority one wins.
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := mainLane(); got.priority != 1 {
+		t.Fatalf("without bias: expected Side Street priority 1, got %d", got.priority)
+	}
+
+	cfg.NameMatchBiasMeters = 5
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := mainLane(); got.priority != 2 || got.sourceDataset != datasetTravelways {
+		t.Fatalf("with bias: expected Main Street priority 2, got priority %d source %d", got.priority, got.sourceDataset)
+	}
+}
+
+func TestWriteFeaturesBinVerifyOutput(t *testing.T) {
+	features := []lineFeature{
+		{stableID: "a", title: "First Street", priority: 1, sourceDataset: datasetTravelways, coords: orb.LineString{{0, 0}, {0.001, 0}}},
+		{stableID: "b", title: "Second Street", priority: 2, sourceDataset: datasetTravelways, coords: orb.LineString{{0, 0.001}, {0.001, 0.001}}},
+	}
+	// A broken encoder that drops the last feature but reports writing all
+	// of them.
+	broken := func(features []lineFeature, w io.Writer, opts encodeOptions) (encodeStats, error) {
+		stats, err := encodeFeatures(features[:len(features)-1], w, opts)
+		stats.Features = len(features)
+		return stats, err
+	}
+
+	sink := &memSink{}
+	for _, opts := range []encodeOptions{{VerifyOutput: true}, {Verify: true}} {
+		_, _, err := writeFeaturesBin(sink, broken, "features.bin", features, 0, opts)
+		if err == nil || !strings.Contains(err.Error(), "decoded 1 features, encoded 2") {
+			t.Fatalf("%+v: expected feature count mismatch, got %v", opts, err)
+		}
+		if _, ok := sink.files["features.bin"]; ok {
+			t.Fatalf("%+v: expected features.bin not to be written", opts)
+		}
+	}
+
+	if _, _, err := writeFeaturesBin(sink, broken, "features.bin", features, 0, encodeOptions{}); err != nil {
+		t.Fatalf("write without verification: %v", err)
+	}
+	if _, ok := sink.files["features.bin"]; !ok {
+		t.Fatal("expected features.bin to be written without verification")
+	}
+}
+
+func TestRunEndTimeDeadlines(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":  1,
+					"WINT_PLOW": "Y",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Main Street",
 				},
-			},
-			bike: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"OBJECTID":   13,
-							"WINT_PLOW":  "Y",
-							"WINT_LOS":   "PRI2",
-							"BIKETYPE":   "ONSTREET",
-							"PROT_TYPE":  "NONE",
-							"BIKE_NAME":  "Test Fallback",
-							"STREETNAME": "Test St",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{0, 0}, {0.001, 0}},
-						},
-					},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
 				},
 			},
-			ice: geojsonFeatureCollection{
-				Type: "FeatureCollection",
-				Features: []geojsonFeature{
-					{
-						Type: "Feature",
-						Properties: map[string]interface{}{
-							"PRIORITY": "1",
-						},
-						Geometry: geojsonGeometry{
-							Type:        "LineString",
-							Coordinates: [][]float64{{5, 5}, {5.001, 5}},
-						},
-					},
+		},
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			{
+				Type: "Feature",
+				Properties: map[string]interface{}{
+					"OBJECTID":   70,
+					"WINT_PLOW":  "Y",
+					"WINT_LOS":   "PRI2",
+					"BIKETYPE":   "ONSTREET",
+					"PROT_TYPE":  "NONE",
+					"BIKE_NAME":  "Deadline Lane",
+					"STREETNAME": "Deadline St",
+				},
+				Geometry: geojsonGeometry{
+					Type:        "LineString",
+					Coordinates: [][]float64{{30, 30}, {30.001, 30}},
 				},
 			},
-			minCount: 1,
-			expectedTests: []expectedBikeFeature{
-				{
-					title:         "Test Fallback",
-					priority:      2,
-					sourceDataset: datasetBike,
-					present:       true,
-				},
+		},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.EndTime = "2025-02-07T10:00:00Z"
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	features, _, header, err := featuresbin.ReadFile(cfg.BikeOut)
+	if err != nil {
+		t.Fatalf("read %s: %v", cfg.BikeOut, err)
+	}
+	var lane *featuresbin.Feature
+	for i := range features {
+		if features[i].Title == "Deadline Lane" {
+			lane = &features[i]
+		}
+	}
+	if lane == nil || lane.Priority != 2 {
+		t.Fatalf("expected a priority 2 Deadline Lane, got %+v", lane)
+	}
+	endTime := time.Date(2025, 2, 7, 10, 0, 0, 0, time.UTC)
+	deadline, ok := header.Deadline(lane.Priority)
+	if !ok || header.Timelines[2] != 18*time.Hour || !deadline.Equal(endTime.Add(18*time.Hour)) {
+		t.Fatalf("priority 2 deadline: got %v %t, timelines %v", deadline, ok, header.Timelines)
+	}
+	_, _, header, err = featuresbin.ReadFile(cfg.TravelwaysOut)
+	if err != nil {
+		t.Fatalf("read %s: %v", cfg.TravelwaysOut, err)
+	}
+	if deadline, ok := header.Deadline(1); !ok || !deadline.Equal(endTime.Add(12*time.Hour)) {
+		t.Fatalf("travelways priority 1 deadline: got %v %t", deadline, ok)
+	}
+
+	cfg.Timelines = "1=6h,2=90m"
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run with timelines: %v", err)
+	}
+	_, _, header, err = featuresbin.ReadFile(cfg.BikeOut)
+	if err != nil {
+		t.Fatalf("read %s: %v", cfg.BikeOut, err)
+	}
+	if deadline, ok := header.Deadline(2); !ok || !deadline.Equal(endTime.Add(90*time.Minute)) {
+		t.Fatalf("configured priority 2 deadline: got %v %t", deadline, ok)
+	}
+	// Priorities -timelines doesn't name keep their default.
+	if deadline, ok := header.Deadline(3); !ok || !deadline.Equal(endTime.Add(36*time.Hour)) {
+		t.Fatalf("default priority 3 deadline: got %v %t", deadline, ok)
+	}
+
+	cfg.EndTime = ""
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "-timelines requires -end-time") {
+		t.Fatalf("expected -timelines without -end-time to fail, got %v", err)
+	}
+}
+
+func TestRunPastDueOnly(t *testing.T) {
+	travelways := geojsonFeatureCollection{Type: "FeatureCollection"}
+	for i := 1; i <= 3; i++ {
+		travelways.Features = append(travelways.Features, geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  i,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  fmt.Sprintf("PRI%d", i),
+				"OWNER":     "HRM",
+				"LOCATION":  fmt.Sprintf("Street %d", i),
+			},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{0, float64(i) * 0.01}, {0.001, float64(i) * 0.01}},
 			},
-		},
+		})
 	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			bike := tt.bike
-			ice := tt.ice
-			if tt.ensureOutput {
-				bike, ice = addBaselineBikeAndIce(bike, ice)
-			}
-			_, bikeOut := runWithGeoJSON(t, tt.travelways, bike, ice)
-			features := readFeaturesBin(t, bikeOut)
-			if tt.minCount > 0 && len(features) < tt.minCount {
-				t.Fatalf("expected at least %d bike features, got %d", tt.minCount, len(features))
-			}
-			for _, expected := range tt.expectedTests {
-				actual := findFeatureByTitle(features, expected.title)
-				if expected.present && actual == nil {
-					t.Fatalf("expected feature %q to be present", expected.title)
-				}
-				if !expected.present && actual != nil {
-					t.Fatalf("expected feature %q to be absent", expected.title)
-				}
-				if !expected.present || actual == nil {
-					continue
-				}
-				if expected.priority != 0 && actual.priority != expected.priority {
-					t.Fatalf("feature %q priority: got %d want %d", expected.title, actual.priority, expected.priority)
-				}
-				if expected.sourceDataset != 0 && actual.sourceDataset != expected.sourceDataset {
-					t.Fatalf("feature %q source dataset: got %d want %d", expected.title, actual.sourceDataset, expected.sourceDataset)
-				}
-			}
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.Only = onlyTravelways
+	cfg.EndTime = "2025-02-07T00:00:00Z"
+	cfg.PastDueOnly = true
+	// Priority 1 and 2 deadlines (12h and 18h) have passed; priority 3's
+	// (36h) hasn't.
+	cfg.Now = "2025-02-07T20:00:00Z"
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var titles []string
+	for _, f := range readFeaturesBin(t, cfg.TravelwaysOut) {
+		titles = append(titles, f.title)
+	}
+	slices.Sort(titles)
+	if want := []string{"Street 1", "Street 2"}; !slices.Equal(titles, want) {
+		t.Fatalf("past due titles: got %v, want %v", titles, want)
+	}
+
+	// Before any deadline, the layer is valid but empty.
+	cfg.Now = "2025-02-07T06:00:00Z"
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run before deadlines: %v", err)
+	}
+	if got := readFeaturesBin(t, cfg.TravelwaysOut); len(got) != 0 {
+		t.Fatalf("expected no past due features, got %d", len(got))
+	}
+
+	cfg.EndTime = ""
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "-past-due-only requires -end-time") {
+		t.Fatalf("expected -end-time error, got %v", err)
+	}
+}
+
+func TestRunDeadlineFields(t *testing.T) {
+	travelways := geojsonFeatureCollection{Type: "FeatureCollection"}
+	for i := 1; i <= 3; i++ {
+		travelways.Features = append(travelways.Features, geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  i,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  fmt.Sprintf("PRI%d", i),
+				"OWNER":     "HRM",
+				"LOCATION":  fmt.Sprintf("Street %d", i),
+			},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{0, float64(i) * 0.01}, {0.001, float64(i) * 0.01}},
+			},
 		})
 	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.Only = onlyTravelways
+	cfg.EndTime = "2025-02-07T00:00:00Z"
+	cfg.DeadlineFields = true
+	cfg.GeoJSONOut = filepath.Join(t.TempDir(), "features.geojson")
+	// Priority 1 and 2 deadlines (12h and 18h) passed 8.5 and 2.5 hours
+	// ago; priority 3's (36h) is 15.5 hours away.
+	cfg.Now = "2025-02-07T20:30:00Z"
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	features, _, header, err := featuresbin.ReadFile(cfg.TravelwaysOut)
+	if err != nil {
+		t.Fatalf("read features: %v", err)
+	}
+	if !header.HoursRemaining {
+		t.Fatal("expected the hours remaining flag in the header")
+	}
+	type deadline struct {
+		hours  int16
+		passed bool
+	}
+	want := map[string]deadline{
+		"Street 1": {-9, true},
+		"Street 2": {-3, true},
+		"Street 3": {15, false},
+	}
+	if len(features) != len(want) {
+		t.Fatalf("got %d features, want %d", len(features), len(want))
+	}
+	for _, f := range features {
+		if got := (deadline{f.HoursRemaining, f.DeadlinePassed}); got != want[f.Title] {
+			t.Fatalf("%s: got %+v want %+v", f.Title, got, want[f.Title])
+		}
+	}
+
+	data, err := os.ReadFile(cfg.GeoJSONOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fc.Features {
+		w := want[f.Properties.MustString("title", "")]
+		if f.Properties.MustInt("hoursRemaining", 0) != int(w.hours) || f.Properties.MustBool("deadlinePassed", !w.passed) != w.passed {
+			t.Fatalf("geojson %v: want %+v", f.Properties, w)
+		}
+	}
+
+	cfg.DeadlineFields = false
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "-now requires") {
+		t.Fatalf("expected -now to need -past-due-only or -deadline-fields, got %v", err)
+	}
+	cfg.Now = ""
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run without deadline fields: %v", err)
+	}
+	if _, _, header, err := featuresbin.ReadFile(cfg.TravelwaysOut); err != nil || header.HoursRemaining {
+		t.Fatalf("expected no hours remaining flag without -deadline-fields, got %t (err %v)", header.HoursRemaining, err)
+	}
+
+	cfg.DeadlineFields = true
+	cfg.EndTime = ""
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "-deadline-fields requires -end-time") {
+		t.Fatalf("expected -end-time error, got %v", err)
+	}
 }
 
-func TestBikePrefersExplicitWinterPriority(t *testing.T) {
+func TestRunBikeTypes(t *testing.T) {
 	travelways := geojsonFeatureCollection{
 		Type: "FeatureCollection",
 		Features: []geojsonFeature{
@@ -681,28 +4690,449 @@ func TestBikePrefersExplicitWinterPriority(t *testing.T) {
 					"WINT_PLOW": "Y",
 					"WINT_LOS":  "PRI1",
 					"OWNER":     "HRM",
-					"LOCATION":  "Devonshire Ave",
+					"LOCATION":  "Main Street",
 				},
 				Geometry: geojsonGeometry{
 					Type:        "LineString",
 					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
 				},
 			},
+		},
+	}
+	lane := func(id int, name, bikeType, protType string, lat float64) geojsonFeature {
+		return geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":   id,
+				"WINT_PLOW":  "Y",
+				"WINT_LOS":   "PRI2",
+				"BIKETYPE":   bikeType,
+				"PROT_TYPE":  protType,
+				"BIKE_NAME":  name,
+				"STREETNAME": name,
+			},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{30, lat}, {30.001, lat}},
+			},
+		}
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			lane(80, "Protected Lane", "PROTBL", "CURB", 30),
+			lane(81, "Painted Lane", "ONSTREET", "NONE", 30.01),
+		},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	features, _, header, err := featuresbin.ReadFile(cfg.BikeOut)
+	if err != nil {
+		t.Fatalf("read %s: %v", cfg.BikeOut, err)
+	}
+	if !header.BikeTypes {
+		t.Fatalf("expected cycling header to record bike types: %s", header)
+	}
+	got := make(map[string]uint8)
+	for _, f := range features {
+		got[f.Title] = f.BikeType
+	}
+	if got["Protected Lane"] != bikeTypeProtected {
+		t.Fatalf("Protected Lane bike type: got %d want %d", got["Protected Lane"], bikeTypeProtected)
+	}
+	if got["Painted Lane"] != bikeTypeUnprotected {
+		t.Fatalf("Painted Lane bike type: got %d want %d", got["Painted Lane"], bikeTypeUnprotected)
+	}
+
+	_, _, header, err = featuresbin.ReadFile(cfg.TravelwaysOut)
+	if err != nil {
+		t.Fatalf("read %s: %v", cfg.TravelwaysOut, err)
+	}
+	if header.BikeTypes {
+		t.Fatalf("expected travelways header not to record bike types")
+	}
+}
+
+func TestRunTraceTitle(t *testing.T) {
+	street := func(id int, los, name string, lat float64) geojsonFeature {
+		return geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  id,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  los,
+				"OWNER":     "HRM",
+				"LOCATION":  name,
+			},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{0, lat}, {0.001, lat}},
+			},
+		}
+	}
+	// Two parallel streets: 5 is about 11m from the lane, 6 about 22m.
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
+			street(5, "PRI2", "Near Street", 0.0001),
+			street(6, "PRI1", "Far Street", 0.0002),
+		},
+	}
+	bike := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{
 			{
 				Type: "Feature",
 				Properties: map[string]interface{}{
-					"OBJECTID":  2,
-					"WINT_PLOW": "Y",
-					"WINT_LOS":  "PRI3",
-					"OWNER":     "HRM",
-					"LOCATION":  "Devonshire Ave",
+					"OBJECTID":   91,
+					"WINT_PLOW":  "Y",
+					"WINT_LOS":   "PRI3",
+					"BIKETYPE":   "PROTBL",
+					"PROT_TYPE":  "CURB",
+					"BIKE_NAME":  "Test St",
+					"STREETNAME": "Test St",
 				},
 				Geometry: geojsonGeometry{
 					Type:        "LineString",
-					Coordinates: [][]float64{{0.001, 0}, {0.002, 0}},
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
 				},
 			},
-		},
+		},
+	}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.MinRunMeters = 20
+	cfg.TraceTitle = "test st"
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var trace []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "trace ") {
+			trace = append(trace, line)
+		}
+	}
+	joined := strings.Join(trace, "\n")
+	for _, want := range []string{
+		`trace "Test St" (OBJECTID 91)`,
+		"OBJECTID 6 priority 1 distance",
+		"chose travelways OBJECTID 5 priority 2",
+		`decision: found=true source=travelways reason="overlap-first travelways"`,
+	} {
+		if !strings.Contains(joined, want) {
+			t.Fatalf("trace missing %q:\n%s", want, joined)
+		}
+	}
+	for _, line := range trace {
+		if !strings.Contains(line, `trace "Test St"`) {
+			t.Fatalf("unexpected trace for another feature: %s", line)
+		}
+	}
+}
+
+func TestLengthByPriority(t *testing.T) {
+	// A degree of latitude is about 111.2km.
+	const degree = 111195.0
+	line := func(lon, fromLat, toLat float64) orb.LineString {
+		return orb.LineString{{lon, fromLat}, {lon, (fromLat + toLat) / 2}, {lon, toLat}}
+	}
+	lengths := lengthByPriority([]lineFeature{
+		{title: "A", priority: 1, coords: line(-63.6, 44, 44.5)},
+		{title: "B", priority: 1, coords: line(-63.5, 44.5, 45)},
+		{title: "C", priority: 2, coords: line(-63.4, 44, 44.25)},
+	})
+	for priority, want := range map[uint8]float64{1: degree, 2: degree / 4} {
+		if got := lengths[priority]; math.Abs(got-want)/want > 0.01 {
+			t.Fatalf("priority %d length: got %.0fm want %.0fm within 1%%", priority, got, want)
+		}
+	}
+	if len(lengths) != 2 {
+		t.Fatalf("got lengths for %d priorities, want 2: %v", len(lengths), lengths)
+	}
+}
+
+func TestRunDropsZCoordinates(t *testing.T) {
+	travelways := geojsonFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []geojsonFeature{{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  1,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  "PRI2",
+				"LOCATION":  "Hilly St",
+			},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{-63.6, 44.6, 12.5}, {-63.599, 44.6005, 14}, {-63.598, 44.601, 15.25}},
+			},
+		}},
+	}
+	bike, ice := addBaselineBikeAndIce(geojsonFeatureCollection{Type: "FeatureCollection"}, geojsonFeatureCollection{Type: "FeatureCollection"})
+	cfg := newRunConfig(t, travelways, bike, ice)
+	dir := filepath.Dir(cfg.TravelwaysOut)
+	cfg.GeoJSONOut = filepath.Join(dir, "out.geojson")
+	cfg.Only = onlyTravelways
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	features, _, _, err := featuresbin.ReadFile(cfg.TravelwaysOut)
+	if err != nil {
+		t.Fatalf("read features: %v", err)
+	}
+	if len(features) != 1 {
+		t.Fatalf("got %d features, want 1", len(features))
+	}
+	want := travelways.Features[0].Geometry.Coordinates.([][]float64)
+	got := features[0].Coords
+	if len(got) != len(want) {
+		t.Fatalf("got %d coords, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if len(got[i]) != 2 || math.Abs(got[i][0]-want[i][0]) > 1e-6 || math.Abs(got[i][1]-want[i][1]) > 1e-6 {
+			t.Fatalf("coord %d: got %v, want lon/lat of %v", i, got[i], want[i])
+		}
+	}
+
+	data, err := os.ReadFile(cfg.GeoJSONOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Features []struct {
+			Geometry struct {
+				Coordinates [][]float64 `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Features) != 1 {
+		t.Fatalf("geojson output has %d features, want 1", len(out.Features))
+	}
+	for _, f := range out.Features {
+		for _, c := range f.Geometry.Coordinates {
+			if len(c) != 2 {
+				t.Fatalf("geojson output coordinate %v has %d ordinates, want 2", c, len(c))
+			}
+		}
+	}
+}
+
+func TestRunTiers(t *testing.T) {
+	// Gently curving streets with a vertex every few metres, so coarse tiers
+	// have vertices to drop.
+	var travelways geojsonFeatureCollection
+	travelways.Type = "FeatureCollection"
+	for i := range 20 {
+		var coords [][]float64
+		for j := range 60 {
+			x := float64(j) * 0.00003
+			coords = append(coords, []float64{-63.6 + x, 44.6 + float64(i)*0.002 + 0.0005*math.Sin(x*300)})
+		}
+		travelways.Features = append(travelways.Features, geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  i + 1,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  "PRI1",
+				"LOCATION":  fmt.Sprintf("Curve %d", i),
+			},
+			Geometry: geojsonGeometry{Type: "LineString", Coordinates: coords},
+		})
+	}
+	bike, ice := addBaselineBikeAndIce(geojsonFeatureCollection{Type: "FeatureCollection"}, geojsonFeatureCollection{Type: "FeatureCollection"})
+	cfg := newRunConfig(t, travelways, bike, ice)
+	dir := filepath.Dir(cfg.TravelwaysOut)
+	cfg.Tiers = "4,6"
+	cfg.Only = onlyTravelways
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	read := func(name string) ([]byte, map[string][][]float64) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		features, _, _, err := featuresbin.Read(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		coords := make(map[string][][]float64)
+		for _, f := range features {
+			coords[f.Title] = f.Coords
+		}
+		return data, coords
+	}
+	full, fullCoords := read("features.bin")
+	low, lowCoords := read("features.p4.bin")
+	_, highCoords := read("features.p6.bin")
+
+	if len(low) >= len(full) {
+		t.Fatalf("4 decimal tier is %d bytes, want less than the full output's %d", len(low), len(full))
+	}
+	for title, coords := range fullCoords {
+		high := highCoords[title]
+		if len(high) != len(coords) {
+			t.Fatalf("%s: 6 decimal tier has %d coords, want %d", title, len(high), len(coords))
+		}
+		for i := range coords {
+			if math.Abs(high[i][0]-coords[i][0]) > 1e-9 || math.Abs(high[i][1]-coords[i][1]) > 1e-9 {
+				t.Fatalf("%s: 6 decimal tier coord %d is %v, want %v", title, i, high[i], coords[i])
+			}
+		}
+		// Coarse vertices are rounded originals, so each is within half a
+		// 1e-4 step of one.
+		for _, pt := range lowCoords[title] {
+			nearest := math.Inf(1)
+			for _, orig := range coords {
+				nearest = min(nearest, max(math.Abs(pt[0]-orig[0]), math.Abs(pt[1]-orig[1])))
+			}
+			if nearest > 0.5e-4+1e-9 {
+				t.Fatalf("%s: 4 decimal tier coord %v is %v from the nearest original", title, pt, nearest)
+			}
+		}
+		if len(lowCoords[title]) >= len(coords) {
+			t.Fatalf("%s: 4 decimal tier kept %d of %d coords", title, len(lowCoords[title]), len(coords))
+		}
+	}
+
+	cfg.Tiers = "7"
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "invalid tier 7: the travelways output only stores 6 decimal places") {
+		t.Fatalf("expected 7 decimals to be rejected, got %v", err)
+	}
+
+	// Mercator centimetres resolve 7 places of a degree.
+	cfg.Mercator = true
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run with 7 decimals and -mercator: %v", err)
+	}
+	cfg.Mercator = false
+
+	// A coarser output makes its own precision the full-precision tier.
+	cfg.TravelwaysPrecision = 4
+	cfg.Tiers = "4"
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run with a tier at -precision-travelways: %v", err)
+	}
+	_, tierCoords := read("features.p4.bin")
+	_, fullCoords = read("features.bin")
+	// The tier drops the points rounding makes repeat, but isn't simplified.
+	for title, coords := range fullCoords {
+		var distinct [][]float64
+		for i, c := range coords {
+			if i == 0 || c[0] != coords[i-1][0] || c[1] != coords[i-1][1] {
+				distinct = append(distinct, c)
+			}
+		}
+		if len(tierCoords[title]) != len(distinct) {
+			t.Fatalf("%s: tier at the output's precision has %d coords, want %d", title, len(tierCoords[title]), len(distinct))
+		}
+	}
+	cfg.Tiers = "5"
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "only stores 4 decimal places") {
+		t.Fatalf("expected a tier finer than -precision-travelways to be rejected, got %v", err)
+	}
+}
+
+func TestRunStrict(t *testing.T) {
+	street := func(id int, location string) geojsonFeature {
+		return geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  id,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  "PRI2",
+				"LOCATION":  location,
+			},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{-63.6, 44.6 + float64(id)*0.001}, {-63.599, 44.6 + float64(id)*0.001}},
+			},
+		}
+	}
+	bike, ice := addBaselineBikeAndIce(geojsonFeatureCollection{Type: "FeatureCollection"}, geojsonFeatureCollection{Type: "FeatureCollection"})
+	cfg := newRunConfig(t, geojsonFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []geojsonFeature{street(1, "Clean St"), street(2, "Other St")},
+	}, bike, ice)
+	dir := filepath.Dir(cfg.TravelwaysOut)
+	cfg.MinRunMeters = 20
+	cfg.Only = onlyAll
+	cfg.Strict = true
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("strict run on clean input: %v", err)
+	}
+
+	writeGeoJSON(t, cfg.TravelwaysFile, geojsonFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []geojsonFeature{street(1, "Clean St"), street(2, "")},
+	})
+	cfg.Strict = false
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("lenient run with a skipped feature: %v", err)
+	}
+	cfg.Strict = true
+	err := run(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "travelways: skipped 1 features: missing LOCATION") {
+		t.Fatalf("expected strict run to fail on the skipped feature, got %v", err)
+	}
+
+	writeGeoJSON(t, cfg.TravelwaysFile, geojsonFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []geojsonFeature{street(1, "Clean St"), street(2, "Other St")},
+	})
+	cfg.PriorityOverrides = filepath.Join(dir, "overrides.json")
+	if err := os.WriteFile(cfg.PriorityOverrides, []byte(`{"Clean St": 1, "Renamed St": 3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = run(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), `priority override "renamed st": no features have this title`) {
+		t.Fatalf("expected strict run to fail on an unmatched override, got %v", err)
+	}
+}
+
+func TestRunOfflineDeterministic(t *testing.T) {
+	street := func(id int, los, name string, lat float64) geojsonFeature {
+		return geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":   id,
+				"WINT_PLOW":  "Y",
+				"WINT_LOS":   los,
+				"WINT_MAINT": "HRM",
+				"WINT_ROUTE": fmt.Sprintf("R%d", id%3),
+				"OWNER":      "HRM",
+				"LOCATION":   name,
+			},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{-63.6, lat}, {-63.599, lat}, {-63.598, lat + 0.0001}},
+			},
+		}
+	}
+	var travelways geojsonFeatureCollection
+	travelways.Type = "FeatureCollection"
+	for i := range 40 {
+		los := fmt.Sprintf("PRI%d", i%3+1)
+		travelways.Features = append(travelways.Features, street(i+1, los, fmt.Sprintf("Street %d", i%7), 44.6+float64(i)*0.001))
 	}
 	bike := geojsonFeatureCollection{
 		Type: "FeatureCollection",
@@ -710,59 +5140,165 @@ func TestBikePrefersExplicitWinterPriority(t *testing.T) {
 			{
 				Type: "Feature",
 				Properties: map[string]interface{}{
-					"OBJECTID":   709,
-					"BIKEFACID":  "BIKEFAC6122",
+					"OBJECTID":   500,
 					"WINT_PLOW":  "Y",
-					"WINT_LOS":   "PRI1",
-					"WINT_MAINT": "W2",
-					"WINT_ROUTE": "BLR",
+					"WINT_LOS":   "PRI3",
 					"BIKETYPE":   "PROTBL",
-					"PROT_TYPE":  "BOLLARD",
-					"BIKE_NAME":  "Devonshire Protected Bike Lanes",
+					"PROT_TYPE":  "CURB",
+					"BIKE_NAME":  "Snapshot Lane",
+					"STREETNAME": "Street 1",
 				},
 				Geometry: geojsonGeometry{
 					Type:        "LineString",
-					Coordinates: [][]float64{{0, 0}, {0.001, 0}, {0.002, 0}},
+					Coordinates: [][]float64{{-63.6, 44.6011}, {-63.599, 44.6011}},
 				},
 			},
 		},
 	}
-	ice := geojsonFeatureCollection{
-		Type: "FeatureCollection",
-		Features: []geojsonFeature{
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"PRIORITY": "1",
-				},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{10, 10}, {10.001, 10}},
-				},
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	transport := &cannedTransport{}
+	cfg := newRunConfig(t, travelways, bike, ice)
+	dir := filepath.Dir(cfg.TravelwaysOut)
+	cfg.MinRunMeters = 20
+	cfg.SimplifyMeters = 2
+	cfg.EndTime = "2025-02-07T10:00:00Z"
+	cfg.Offline = true
+	cfg.HTTPClient = &http.Client{Transport: transport}
+
+	encode := func(name string) (travelwaysBin, bikeBin []byte) {
+		t.Helper()
+		cfg := cfg
+		cfg.TravelwaysOut = filepath.Join(dir, name+".bin")
+		cfg.BikeOut = filepath.Join(dir, name+"_cycling.bin")
+		if err := run(context.Background(), cfg); err != nil {
+			t.Fatalf("run %s: %v", name, err)
+		}
+		travelwaysBin, err := os.ReadFile(cfg.TravelwaysOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bikeBin, err = os.ReadFile(cfg.BikeOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return travelwaysBin, bikeBin
+	}
+	travelways1, bike1 := encode("first")
+	travelways2, bike2 := encode("second")
+	if !bytes.Equal(travelways1, travelways2) {
+		t.Fatalf("travelways output differs between runs")
+	}
+	if !bytes.Equal(bike1, bike2) {
+		t.Fatalf("cycling output differs between runs")
+	}
+	if len(transport.requests) != 0 {
+		t.Fatalf("expected no requests offline, got %v", transport.requests)
+	}
+
+	cfg.IceFile = ""
+	cfg.TravelwaysOut = filepath.Join(dir, "missing.bin")
+	cfg.BikeOut = filepath.Join(dir, "missing_cycling.bin")
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "-offline: no file given for ice") {
+		t.Fatalf("expected missing ice file to fail offline, got %v", err)
+	}
+	if len(transport.requests) != 0 {
+		t.Fatalf("expected no requests offline, got %v", transport.requests)
+	}
+}
+
+func TestRunMaxFeatures(t *testing.T) {
+	travelways := geojsonFeatureCollection{Type: "FeatureCollection"}
+	for i := 1; i <= 3; i++ {
+		travelways.Features = append(travelways.Features, geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  i,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  "PRI1",
+				"OWNER":     "HRM",
+				"LOCATION":  fmt.Sprintf("Street %d", i),
 			},
-		},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{0, float64(i) * 0.01}, {0.001, float64(i) * 0.01}},
+			},
+		})
 	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
 
-	_, bikeOut := runWithGeoJSON(t, travelways, bike, ice)
-	features := readFeaturesBin(t, bikeOut)
-	var target []decodedFeature
-	for _, feat := range features {
-		if feat.title == "Devonshire Protected Bike Lanes" {
-			target = append(target, feat)
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.MaxFeatures = 2
+
+	err := run(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "3 features exceeds the limit of 2") {
+		t.Fatalf("expected max features error, got %v", err)
+	}
+	if _, err := os.Stat(cfg.TravelwaysOut); !os.IsNotExist(err) {
+		t.Fatalf("expected no travelways output, stat err: %v", err)
+	}
+
+	cfg.MaxFeatures = 3
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run at the limit: %v", err)
+	}
+}
+
+func TestRunMinFeatures(t *testing.T) {
+	travelways := geojsonFeatureCollection{Type: "FeatureCollection"}
+	for i := 1; i <= 3; i++ {
+		plow := "Y"
+		if i == 3 {
+			plow = "N"
 		}
+		travelways.Features = append(travelways.Features, geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  i,
+				"WINT_PLOW": plow,
+				"WINT_LOS":  "PRI1",
+				"OWNER":     "HRM",
+				"LOCATION":  fmt.Sprintf("Street %d", i),
+			},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{0, float64(i) * 0.01}, {0.001, float64(i) * 0.01}},
+			},
+		})
 	}
-	if len(target) != 1 {
-		t.Fatalf("expected exactly 1 feature for explicit-priority bike route, got %d", len(target))
+	// No bike lanes, so the cycling output is empty.
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	_, ice := addBaselineBikeAndIce(bike, geojsonFeatureCollection{Type: "FeatureCollection"})
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.TravelwaysMinFeatures = 3
+
+	// The unplowed street is dropped, leaving 2 features.
+	err := run(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "2 features is below the minimum of 3") {
+		t.Fatalf("expected min features error, got %v", err)
 	}
-	if target[0].priority != 1 {
-		t.Fatalf("expected explicit bike priority 1, got %d", target[0].priority)
+	if _, err := os.Stat(cfg.TravelwaysOut); !os.IsNotExist(err) {
+		t.Fatalf("expected no travelways output, stat err: %v", err)
 	}
-	if target[0].sourceDataset != datasetBike {
-		t.Fatalf("expected source dataset bike (%d), got %d", datasetBike, target[0].sourceDataset)
+
+	// The travelways minimum doesn't apply to the cycling output.
+	cfg.TravelwaysMinFeatures = 2
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run at the minimum: %v", err)
+	}
+
+	cfg.BikeMinFeatures = 1
+	err = run(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "0 features is below the minimum of 1") {
+		t.Fatalf("expected cycling min features error, got %v", err)
 	}
 }
 
-func TestBikeMultiLinePreserved(t *testing.T) {
+func TestRunEmptyCycling(t *testing.T) {
 	travelways := geojsonFeatureCollection{
 		Type: "FeatureCollection",
 		Features: []geojsonFeature{
@@ -773,7 +5309,7 @@ func TestBikeMultiLinePreserved(t *testing.T) {
 					"WINT_PLOW": "Y",
 					"WINT_LOS":  "PRI1",
 					"OWNER":     "HRM",
-					"LOCATION":  "Split Trail",
+					"LOCATION":  "Main Street",
 				},
 				Geometry: geojsonGeometry{
 					Type:        "LineString",
@@ -782,219 +5318,270 @@ func TestBikeMultiLinePreserved(t *testing.T) {
 			},
 		},
 	}
-	bike := geojsonFeatureCollection{
-		Type: "FeatureCollection",
-		Features: []geojsonFeature{
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"OBJECTID":  200,
-					"WINT_PLOW": "Y",
-					"BIKETYPE":  "MUPATH",
-					"PROT_TYPE": "OFFSTREET",
-					"BIKE_NAME": "Split Trail",
-				},
-				Geometry: geojsonGeometry{
-					Type: "MultiLineString",
-					Coordinates: [][][]float64{
-						{{0, 0}, {0.001, 0}},
-						{{0, 1}, {0.001, 1}},
-					},
-				},
+	// Every bike route is marked not plowed, so all are rejected.
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	for i := 1; i <= 2; i++ {
+		bike.Features = append(bike.Features, geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":   i,
+				"WINT_PLOW":  "N",
+				"WINT_LOS":   "PRI1",
+				"BIKETYPE":   "PROTECTED",
+				"PROT_TYPE":  "CURB",
+				"BIKE_NAME":  fmt.Sprintf("Bike %d", i),
+				"STREETNAME": "Main Street",
 			},
-		},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{0, float64(i) * 0.00001}, {0.001, float64(i) * 0.00001}},
+			},
+		})
 	}
-	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
-	ice.Features = append(ice.Features, geojsonFeature{
-		Type: "Feature",
-		Properties: map[string]interface{}{
-			"PRIORITY": "1",
-		},
-		Geometry: geojsonGeometry{
-			Type:        "LineString",
-			Coordinates: [][]float64{{0, 1}, {0.001, 1}},
-		},
-	})
+	_, ice := addBaselineBikeAndIce(geojsonFeatureCollection{}, geojsonFeatureCollection{Type: "FeatureCollection"})
 
-	dir := t.TempDir()
-	travelwaysPath := filepath.Join(dir, "travelways.geojson")
-	bikePath := filepath.Join(dir, "bike.geojson")
-	icePath := filepath.Join(dir, "ice.geojson")
-	travelwaysOut := filepath.Join(dir, "features.bin")
-	bikeOut := filepath.Join(dir, "features_cycling.bin")
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.VerifyOutput = true
 
-	writeGeoJSON(t, travelwaysPath, travelways)
-	writeGeoJSON(t, bikePath, bike)
-	writeGeoJSON(t, icePath, ice)
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
 
-	cfg := runConfig{
-		TravelwaysFile: travelwaysPath,
-		BikeFile:       bikePath,
-		IceFile:        icePath,
-		TravelwaysOut:  travelwaysOut,
-		BikeOut:        bikeOut,
-		MaxMatchMeters: 30,
-		MaxAngleDeg:    30,
-		MinRunMeters:   0,
+	features, _, header, err := featuresbin.ReadFile(cfg.BikeOut)
+	if err != nil {
+		t.Fatalf("read cycling output: %v", err)
+	}
+	if len(features) != 0 {
+		t.Fatalf("expected no cycling features, got %d", len(features))
+	}
+	if header.SegmentCount != 0 {
+		t.Fatalf("expected no segments, got %d", header.SegmentCount)
+	}
+	if _, err := encodeFeatures(nil, io.Discard, encodeOptions{}); err == nil {
+		t.Fatal("expected no features error without AllowEmpty")
+	}
+}
+
+func TestRunGridDebug(t *testing.T) {
+	travelways := geojsonFeatureCollection{Type: "FeatureCollection"}
+	// Three streets clustered in one corner and one in the far corner.
+	starts := [][]float64{{0, 0}, {0.0001, 0.0002}, {0.0002, 0.0004}, {0.05, 0.05}}
+	for i, start := range starts {
+		travelways.Features = append(travelways.Features, geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  i + 1,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  "PRI1",
+				"OWNER":     "HRM",
+				"LOCATION":  fmt.Sprintf("Street %d", i+1),
+			},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{start, {start[0] + 0.0001, start[1]}},
+			},
+		})
 	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	cfg := newRunConfig(t, travelways, bike, ice)
+	dir := filepath.Dir(cfg.TravelwaysOut)
+	cfg.GridDebug = filepath.Join(dir, "grid.geojson")
+	cfg.Only = onlyTravelways
+
 	if err := run(context.Background(), cfg); err != nil {
 		t.Fatalf("run: %v", err)
 	}
-	features := readFeaturesBin(t, bikeOut)
-	var count, travelCount, iceCount int
-	for _, feat := range features {
-		if feat.title != "Split Trail" {
-			continue
+
+	b, err := os.ReadFile(cfg.GridDebug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(b)
+	if err != nil {
+		t.Fatalf("unmarshal grid debug: %v", err)
+	}
+	data, err := os.ReadFile(cfg.TravelwaysOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := featuresbin.Open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(fc.Features), int(reader.Header().SegmentCount); got != want || got < 2 {
+		t.Fatalf("grid debug polygons: got %d, want one per segment (%d) and at least 2", got, want)
+	}
+	var total int
+	for _, f := range fc.Features {
+		if _, ok := f.Geometry.(orb.Polygon); !ok {
+			t.Fatalf("grid debug geometry: got %T want orb.Polygon", f.Geometry)
 		}
-		count++
-		if feat.sourceDataset == datasetTravelways {
-			travelCount++
+		if f.Properties.MustString("output") != "travelways" {
+			t.Fatalf("grid debug output: got %v", f.Properties["output"])
 		}
-		if feat.sourceDataset == datasetIce {
-			iceCount++
+		row, col := f.Properties.MustInt("row"), f.Properties.MustInt("col")
+		count := f.Properties.MustInt("features")
+		segment, err := reader.Segment(row, col)
+		if err != nil {
+			t.Fatal(err)
 		}
+		if count == 0 || count != len(segment) {
+			t.Fatalf("cell (%d, %d) features: got %d want %d", row, col, count, len(segment))
+		}
+		total += count
 	}
-	if count != 2 {
-		t.Fatalf("expected 2 split trail features, got %d", count)
-	}
-	if travelCount == 0 || iceCount == 0 {
-		t.Fatalf("expected travelways+ice split, got travelways=%d ice=%d", travelCount, iceCount)
+	if total != len(starts) {
+		t.Fatalf("total features across cells: got %d want %d", total, len(starts))
 	}
 }
 
-func TestBikeOverlapRuns(t *testing.T) {
-	travelways := geojsonFeatureCollection{
-		Type: "FeatureCollection",
-		Features: []geojsonFeature{
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"OBJECTID":  1,
-					"WINT_PLOW": "Y",
-					"WINT_LOS":  "PRI1",
-					"OWNER":     "HRM",
-					"LOCATION":  "Far Trail",
-				},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{10, 10}, {10.001, 10}},
-				},
-			},
-		},
-	}
-	bike := geojsonFeatureCollection{
-		Type: "FeatureCollection",
-		Features: []geojsonFeature{
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"OBJECTID":  300,
-					"WINT_PLOW": "Y",
-					"BIKETYPE":  "BRMAINRD",
-					"PROT_TYPE": "NONE",
-					"BIKE_NAME": "Overlap Run",
-				},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{0, 0}, {0.0009, 0}, {0.0018, 0}},
-				},
+func TestRunDuplicateStableIDs(t *testing.T) {
+	travelways := geojsonFeatureCollection{Type: "FeatureCollection"}
+	// Hollis Street shares Barrington Street's OBJECTID but has its own
+	// ASSETID, so only Queen Street and Lower Water Street collide.
+	for i, f := range []struct {
+		name     string
+		objectID int
+		assetID  string
+	}{
+		{"Spring Garden Road", 5, ""},
+		{"Queen Street", 5, ""},
+		{"Barrington Street", 6, "A1"},
+		{"Hollis Street", 6, "A2"},
+		{"Lower Water Street", 7, "A1"},
+	} {
+		props := map[string]interface{}{
+			"OBJECTID":  f.objectID,
+			"WINT_PLOW": "Y",
+			"WINT_LOS":  "PRI1",
+			"OWNER":     "HRM",
+			"LOCATION":  f.name,
+		}
+		if f.assetID != "" {
+			props["ASSETID"] = f.assetID
+		}
+		travelways.Features = append(travelways.Features, geojsonFeature{
+			Type:       "Feature",
+			Properties: props,
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{0, float64(i+1) * 0.01}, {0.001, float64(i+1) * 0.01}},
 			},
-		},
+		})
 	}
-	ice := geojsonFeatureCollection{
-		Type: "FeatureCollection",
-		Features: []geojsonFeature{
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"OBJECTID":   11,
-					"PRIORITY":   "1",
-					"OPERATOR":   "W1",
-					"ROUTE_NAME": "R1",
-				},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{0, 0}, {0.0005, 0}},
-				},
-			},
-			{
-				Type: "Feature",
-				Properties: map[string]interface{}{
-					"OBJECTID":   22,
-					"PRIORITY":   "2",
-					"OPERATOR":   "W2",
-					"ROUTE_NAME": "R2",
-				},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{0.0013, 0}, {0.0018, 0}},
-				},
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+	// Ice routes aren't written with stable IDs, so their OBJECTIDs may repeat.
+	for i := range 2 {
+		ice.Features = append(ice.Features, geojsonFeature{
+			Type:       "Feature",
+			Properties: map[string]interface{}{"OBJECTID": 99, "PRIORITY": "1"},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{30, float64(i) * 0.01}, {30.001, float64(i) * 0.01}},
 			},
-		},
+		})
 	}
 
-	dir := t.TempDir()
-	travelwaysPath := filepath.Join(dir, "travelways.geojson")
-	bikePath := filepath.Join(dir, "bike.geojson")
-	icePath := filepath.Join(dir, "ice.geojson")
-	travelwaysOut := filepath.Join(dir, "features.bin")
-	bikeOut := filepath.Join(dir, "features_cycling.bin")
-
-	writeGeoJSON(t, travelwaysPath, travelways)
-	writeGeoJSON(t, bikePath, bike)
-	writeGeoJSON(t, icePath, ice)
+	cfg := newRunConfig(t, travelways, bike, ice)
 
-	cfg := runConfig{
-		TravelwaysFile: travelwaysPath,
-		BikeFile:       bikePath,
-		IceFile:        icePath,
-		TravelwaysOut:  travelwaysOut,
-		BikeOut:        bikeOut,
-		MaxMatchMeters: 30,
-		MaxAngleDeg:    30,
-		MinRunMeters:   0,
+	err := run(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "travelways.geojson: 2 features have duplicate stable IDs") {
+		t.Fatalf("expected duplicate stable ID error, got %v", err)
 	}
+
+	cfg.SuffixDuplicateIDs = true
 	if err := run(context.Background(), cfg); err != nil {
-		t.Fatalf("run: %v", err)
+		t.Fatalf("run with -suffix-duplicate-ids: %v", err)
 	}
-
-	features := readFeaturesBin(t, bikeOut)
-	routesByID := map[uint16]featuresbin.RouteEntry{}
-	_, routes, _, err := featuresbin.ReadFile(bikeOut)
+	features, _, _, err := featuresbin.ReadFile(cfg.TravelwaysOut)
 	if err != nil {
-		t.Fatalf("read features (routes): %v", err)
+		t.Fatalf("read features: %v", err)
 	}
-	for i, route := range routes {
-		routesByID[uint16(i+1)] = route
+	got := make(map[string]string)
+	for _, f := range features {
+		got[f.Title] = f.StableID
 	}
-	var p1, p2 int
-	var p1Route, p2Route string
-	for _, feat := range features {
-		if feat.title != "Overlap Run" {
-			continue
-		}
-		switch feat.priority {
-		case 1:
-			p1++
-			if route, ok := routesByID[feat.routeID]; ok {
-				p1Route = route.Route
-			}
-		case 2:
-			p2++
-			if route, ok := routesByID[feat.routeID]; ok {
-				p2Route = route.Route
-			}
+	want := map[string]string{
+		"Spring Garden Road": "objectid:5",
+		"Queen Street":       "objectid:5-2",
+		"Barrington Street":  "A1",
+		"Hollis Street":      "A2",
+		"Lower Water Street": "A1-2",
+	}
+	for title, id := range want {
+		if got[title] != id {
+			t.Fatalf("stable IDs: got %v, want %v", got, want)
 		}
 	}
-	if p1 == 0 || p2 == 0 {
-		t.Fatalf("expected overlap runs with priorities 1 and 2, got p1=%d p2=%d", p1, p2)
+}
+
+// Example_decode encodes a small collection the way run does and reads it
+// back with featuresbin, as a client of features.bin would.
+func Example_decode() {
+	features := []lineFeature{
+		{stableID: "t-1", title: "Barrington Street", priority: 1, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.5752, 44.6488}, {-63.5741, 44.6501}}},
+		{stableID: "t-2", title: "Spring Garden Road", priority: 2, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.5790, 44.6430}, {-63.5768, 44.6442}}},
 	}
-	if p1Route == "" || p2Route == "" || p1Route == p2Route {
-		t.Fatalf("expected distinct routes per run, got p1=%q p2=%q", p1Route, p2Route)
+	var buf bytes.Buffer
+	if _, err := encodeFeatures(features, &buf, encodeOptions{}); err != nil {
+		fmt.Println("encode:", err)
+		return
+	}
+
+	decoded, _, header, err := featuresbin.Read(&buf)
+	if err != nil {
+		fmt.Println("read:", err)
+		return
 	}
+	fmt.Println("version", header.FormatVersion)
+	for _, f := range decoded {
+		fmt.Printf("%s priority=%d\n", f.Title, f.Priority)
+		for _, c := range f.Coords {
+			fmt.Printf("  %.4f,%.4f\n", c[0], c[1])
+		}
+	}
+	// Output:
+	// version 17
+	// Spring Garden Road priority=2
+	//   -63.5790,44.6430
+	//   -63.5768,44.6442
+	// Barrington Street priority=1
+	//   -63.5752,44.6488
+	//   -63.5741,44.6501
 }
 
-func TestBikeOffstreetFallbackToIce(t *testing.T) {
+// memSink is an OutputSink that keeps closed files in memory.
+type memSink struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+type memFile struct {
+	bytes.Buffer
+	sink *memSink
+	name string
+}
+
+func (s *memSink) Create(name string) (io.WriteCloser, error) {
+	return &memFile{sink: s, name: name}, nil
+}
+
+func (f *memFile) Close() error {
+	f.sink.mu.Lock()
+	defer f.sink.mu.Unlock()
+	if f.sink.files == nil {
+		f.sink.files = make(map[string][]byte)
+	}
+	f.sink.files[f.name] = f.Bytes()
+	return nil
+}
+
+func TestRunOutputSink(t *testing.T) {
 	travelways := geojsonFeatureCollection{
 		Type: "FeatureCollection",
 		Features: []geojsonFeature{
@@ -1005,62 +5592,130 @@ func TestBikeOffstreetFallbackToIce(t *testing.T) {
 					"WINT_PLOW": "Y",
 					"WINT_LOS":  "PRI1",
 					"OWNER":     "HRM",
-					"LOCATION":  "Far Trail",
+					"LOCATION":  "Sink Street",
 				},
 				Geometry: geojsonGeometry{
 					Type:        "LineString",
-					Coordinates: [][]float64{{10, 10}, {10.001, 10}},
+					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
 				},
 			},
 		},
 	}
-	bike := geojsonFeatureCollection{
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	sink := &memSink{}
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.TravelwaysOut = "features.bin"
+	cfg.BikeOut = "features_cycling.bin"
+	cfg.StatsOut = "stats.json"
+	cfg.Output = sink
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	for _, name := range []string{cfg.TravelwaysOut, cfg.BikeOut} {
+		data, ok := sink.files[name]
+		if !ok {
+			t.Fatalf("expected %s in sink, got %d files", name, len(sink.files))
+		}
+		features, _, _, err := featuresbin.Read(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		if len(features) == 0 {
+			t.Fatalf("expected features in %s", name)
+		}
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("expected %s not to be written to disk, stat err: %v", name, err)
+		}
+	}
+	if !json.Valid(sink.files[cfg.StatsOut]) {
+		t.Fatalf("expected stats json in sink, got %q", sink.files[cfg.StatsOut])
+	}
+}
+
+func TestRunPrecisionPerOutput(t *testing.T) {
+	travelways := geojsonFeatureCollection{
 		Type: "FeatureCollection",
 		Features: []geojsonFeature{
 			{
 				Type: "Feature",
 				Properties: map[string]interface{}{
-					"OBJECTID":  400,
+					"OBJECTID":  1,
 					"WINT_PLOW": "Y",
-					"BIKETYPE":  "MUPATH",
-					"PROT_TYPE": "OFFSTREET",
-					"BIKE_NAME": "Offstreet Fallback",
+					"WINT_LOS":  "PRI1",
+					"OWNER":     "HRM",
+					"LOCATION":  "Precise Street",
 				},
 				Geometry: geojsonGeometry{
 					Type:        "LineString",
-					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+					Coordinates: [][]float64{{-63.5712345, 44.6412345}, {-63.5701234, 44.6401234}},
 				},
 			},
 		},
 	}
-	ice := geojsonFeatureCollection{
-		Type: "FeatureCollection",
-		Features: []geojsonFeature{
-			{
-				Type:       "Feature",
-				Properties: map[string]interface{}{"PRIORITY": "1"},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
-				},
-			},
-		},
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	sink := &memSink{}
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.TravelwaysOut = "features.bin"
+	cfg.BikeOut = "features_cycling.bin"
+	cfg.TravelwaysPrecision = 4
+	cfg.BikePrecision = 7
+	cfg.VerifyOutput = true
+	cfg.Verify = true
+	cfg.Output = sink
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
 	}
 
-	_, bikeOut := runWithGeoJSON(t, travelways, bike, ice)
-	features := readFeaturesBin(t, bikeOut)
-	found := false
-	for _, feat := range features {
-		if feat.title == "Offstreet Fallback" && feat.sourceDataset == datasetIce {
-			found = true
+	tests := []struct {
+		name      string
+		precision uint8
+		want      orb.LineString
+	}{
+		{cfg.TravelwaysOut, 4, orb.LineString{{-63.5712345, 44.6412345}, {-63.5701234, 44.6401234}}},
+		{cfg.BikeOut, 7, orb.LineString{{10, 10}, {10.001, 10}}},
+	}
+	for _, tt := range tests {
+		features, _, header, err := featuresbin.Read(bytes.NewReader(sink.files[tt.name]))
+		if err != nil {
+			t.Fatalf("read %s: %v", tt.name, err)
+		}
+		if header.Precision != tt.precision {
+			t.Fatalf("%s: got precision %d, want %d", tt.name, header.Precision, tt.precision)
+		}
+		if len(features) != 1 || len(features[0].Coords) != len(tt.want) {
+			t.Fatalf("%s: got features %+v", tt.name, features)
+		}
+		tolerance := math.Pow(10, -float64(tt.precision))
+		for i, c := range features[0].Coords {
+			if math.Abs(c[0]-tt.want[i][0]) > tolerance || math.Abs(c[1]-tt.want[i][1]) > tolerance {
+				t.Fatalf("%s: coordinate %d: got %v, want %v within %g", tt.name, i, c, tt.want[i], tolerance)
+			}
 		}
 	}
-	if !found {
-		t.Fatal("expected offstreet fallback to ice")
+
+	// At 4 decimal places the travelways offsets from the base lose their
+	// last digits.
+	features, _, _, _ := featuresbin.Read(bytes.NewReader(sink.files[cfg.TravelwaysOut]))
+	if got := features[0].Coords[1][0]; math.Abs(got-(-63.5701234)) < 1e-5 {
+		t.Fatalf("expected travelways longitude at 4 decimal places, got %.7f", got)
+	}
+
+	cfg.BikePrecision = 8
+	if err := run(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "invalid -precision-bike 8") {
+		t.Fatalf("expected invalid precision error, got %v", err)
 	}
 }
 
-func TestBikeNameFallbackFromTravelways(t *testing.T) {
+func TestRunFormatJSON(t *testing.T) {
 	travelways := geojsonFeatureCollection{
 		Type: "FeatureCollection",
 		Features: []geojsonFeature{
@@ -1071,56 +5726,263 @@ func TestBikeNameFallbackFromTravelways(t *testing.T) {
 					"WINT_PLOW": "Y",
 					"WINT_LOS":  "PRI1",
 					"OWNER":     "HRM",
-					"LOCATION":  "Fallback Name Trail",
+					"LOCATION":  "Json Street",
 				},
 				Geometry: geojsonGeometry{
 					Type:        "LineString",
-					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+					Coordinates: [][]float64{{-63.57123456, 44.64123449}, {-63.57012345, 44.64012345}},
 				},
 			},
-		},
-	}
-	bike := geojsonFeatureCollection{
-		Type: "FeatureCollection",
-		Features: []geojsonFeature{
 			{
 				Type: "Feature",
 				Properties: map[string]interface{}{
-					"OBJECTID":  500,
+					"OBJECTID":  2,
 					"WINT_PLOW": "Y",
-					"BIKETYPE":  "MUPATH",
-					"PROT_TYPE": "OFFSTREET",
+					"WINT_LOS":  "PRI2",
+					"OWNER":     "HRM",
+					"LOCATION":  "Other Street",
 				},
 				Geometry: geojsonGeometry{
 					Type:        "LineString",
-					Coordinates: [][]float64{{0, 0}, {0.001, 0}},
+					Coordinates: [][]float64{{-63.5, 44.6}, {-63.501, 44.6}},
 				},
 			},
 		},
 	}
-	ice := geojsonFeatureCollection{
-		Type: "FeatureCollection",
-		Features: []geojsonFeature{
-			{
-				Type:       "Feature",
-				Properties: map[string]interface{}{"PRIORITY": "1"},
-				Geometry: geojsonGeometry{
-					Type:        "LineString",
-					Coordinates: [][]float64{{5, 5}, {5.001, 5}},
-				},
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
+
+	sink := &memSink{}
+	cfg := newRunConfig(t, travelways, bike, ice)
+	cfg.TravelwaysOut = defaultTravelwaysOut
+	cfg.BikeOut = defaultBikeOut
+	cfg.Format = formatJSON
+	cfg.Tiers = "5"
+	cfg.Output = sink
+
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if _, ok := sink.files[defaultTravelwaysOut]; ok {
+		t.Fatalf("expected no %s with -format json", defaultTravelwaysOut)
+	}
+
+	var got []struct {
+		Title    string       `json:"title"`
+		Priority int          `json:"priority"`
+		Source   string       `json:"source"`
+		Coords   [][2]float64 `json:"coords"`
+	}
+	if err := json.Unmarshal(sink.files["features.json"], &got); err != nil {
+		t.Fatalf("unmarshal features.json: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", got)
+	}
+	first := got[0]
+	if first.Title != "Json Street" || first.Priority != 1 || first.Source != "travelways" {
+		t.Fatalf("first entry: got %+v", first)
+	}
+	want := [][2]float64{{-63.571235, 44.641234}, {-63.570123, 44.640123}}
+	if !slices.Equal(first.Coords, want) {
+		t.Fatalf("coords: got %v, want %v", first.Coords, want)
+	}
+
+	var cycling []json.RawMessage
+	if err := json.Unmarshal(sink.files["features_cycling.json"], &cycling); err != nil || len(cycling) != 1 {
+		t.Fatalf("features_cycling.json: got %d entries, err %v", len(cycling), err)
+	}
+	if _, ok := sink.files["features.p5.json"]; !ok {
+		t.Fatalf("expected a features.p5.json tier, got %v", slices.Sorted(maps.Keys(sink.files)))
+	}
+
+	for name, set := range map[string]func(*runConfig){
+		"-compact-coords": func(c *runConfig) { c.CompactCoords = true },
+		"-verify":         func(c *runConfig) { c.Verify = true },
+		"-verify-output":  func(c *runConfig) { c.VerifyOutput = true },
+	} {
+		c := cfg
+		set(&c)
+		if err := run(context.Background(), c); err == nil || !strings.Contains(err.Error(), name) {
+			t.Fatalf("%s with -format json: got %v, want an error naming it", name, err)
+		}
+	}
+
+	// -verify-output is on by default, which -format json turns off.
+	if got, err := parseArgs("features", []string{"-format", "json"}); err != nil || got.VerifyOutput {
+		t.Fatalf("-format json: got VerifyOutput %v, err %v; want it off", got.VerifyOutput, err)
+	}
+	if got, err := parseArgs("features", []string{"-format", "json", "-verify-output"}); err != nil || !got.VerifyOutput {
+		t.Fatalf("-format json -verify-output: got VerifyOutput %v, err %v; want it kept for run to reject", got.VerifyOutput, err)
+	}
+}
+
+func TestRunPriorityOverrides(t *testing.T) {
+	travelways := geojsonFeatureCollection{Type: "FeatureCollection"}
+	for i, name := range []string{"Barrington Street", "Hollis Street"} {
+		travelways.Features = append(travelways.Features, geojsonFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"OBJECTID":  i + 1,
+				"WINT_PLOW": "Y",
+				"WINT_LOS":  "PRI2",
+				"OWNER":     "HRM",
+				"LOCATION":  name,
 			},
-		},
+			Geometry: geojsonGeometry{
+				Type:        "LineString",
+				Coordinates: [][]float64{{0, float64(i+1) * 0.01}, {0.001, float64(i+1) * 0.01}},
+			},
+		})
 	}
+	bike := geojsonFeatureCollection{Type: "FeatureCollection"}
+	ice := geojsonFeatureCollection{Type: "FeatureCollection"}
+	bike, ice = addBaselineBikeAndIce(bike, ice)
 
-	_, bikeOut := runWithGeoJSON(t, travelways, bike, ice)
-	features := readFeaturesBin(t, bikeOut)
-	found := false
-	for _, feat := range features {
-		if feat.title == "Fallback Name Trail" {
-			found = true
+	cfg := newRunConfig(t, travelways, bike, ice)
+	dir := filepath.Dir(cfg.TravelwaysOut)
+	cfg.PriorityOverrides = filepath.Join(dir, "overrides.json")
+
+	if err := os.WriteFile(cfg.PriorityOverrides, []byte(`{"barrington street": 4}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := run(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "invalid priority 4") {
+		t.Fatalf("expected invalid priority error, got %v", err)
+	}
+
+	if err := os.WriteFile(cfg.PriorityOverrides, []byte(`{"barrington street": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	features, _, _, err := featuresbin.ReadFile(cfg.TravelwaysOut)
+	if err != nil {
+		t.Fatalf("read features: %v", err)
+	}
+	got := make(map[string]uint8)
+	for _, f := range features {
+		got[f.Title] = f.Priority
+	}
+	if got["Barrington Street"] != 1 || got["Hollis Street"] != 2 {
+		t.Fatalf("priorities: got %v, want Barrington Street 1 and Hollis Street 2", got)
+	}
+}
+
+func TestAutoGridDims(t *testing.T) {
+	// A strip about 5km wide and 40km tall.
+	tall := orb.Bound{Min: orb.Point{-63.6, 44.5}, Max: orb.Point{-63.537, 44.86}}
+	cols, rows := autoGridDims(tall, 32, false)
+	if rows <= cols {
+		t.Fatalf("tall bounds: got %dx%d, want more rows than columns", cols, rows)
+	}
+	if cols != 2 || rows != 16 {
+		t.Fatalf("tall bounds: got %dx%d want 2x16", cols, rows)
+	}
+	if cols, rows := autoGridDims(orb.Bound{Min: orb.Point{0, 0}, Max: orb.Point{4000, 1000}}, 16, true); cols != 8 || rows != 2 {
+		t.Fatalf("wide mercator bounds: got %dx%d want 8x2", cols, rows)
+	}
+	if cols, rows := autoGridDims(orb.Bound{Min: orb.Point{-63.6, 44.6}, Max: orb.Point{-63.6, 44.6}}, 32, false); cols != 1 || rows != 1 {
+		t.Fatalf("point bounds: got %dx%d want 1x1", cols, rows)
+	}
+
+	features := []lineFeature{
+		{stableID: "a", title: "A", priority: 1, sourceDataset: datasetTravelways, coords: orb.LineString{tall.Min, {-63.59, 44.51}}},
+		{stableID: "b", title: "B", priority: 2, sourceDataset: datasetTravelways, coords: orb.LineString{{-63.55, 44.85}, tall.Max}},
+	}
+	var out bytes.Buffer
+	if _, err := encodeFeatures(features, &out, encodeOptions{GridCells: 32}); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := featuresbin.Open(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols, rows := reader.Grid(); cols != 2 || rows != 16 {
+		t.Fatalf("encoded grid: got %dx%d want 2x16", cols, rows)
+	}
+	if n := reader.SegmentCount(); n != 2 {
+		t.Fatalf("segment count: got %d want 2", n)
+	}
+}
+
+func TestParseArgsConfig(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(jsonPath, []byte(`{"max-match-meters": 25, "grid-auto": 32, "tiers": [4, 5], "strict": true, "seed": 18446744073709551615, "travelways": "t.geojson"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := parseArgs("features", []string{"-max-match-meters", "25", "-grid-auto", "32", "-tiers", "4,5", "-strict", "-seed", "18446744073709551615", "-travelways", "t.geojson", "-max-angle-deg", "20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A flag on the command line overrides the file, wherever it appears.
+	got, err := parseArgs("features", []string{"-max-angle-deg", "20", "-config", jsonPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+	got, err = parseArgs("features", []string{"-config", jsonPath, "-max-match-meters", "40"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MaxMatchMeters != 40 || got.GridAuto != 32 {
+		t.Fatalf("with -max-match-meters 40: got max match %v grid %d", got.MaxMatchMeters, got.GridAuto)
+	}
+
+	for name, content := range map[string]string{
+		"unknown.json": `{"max-match-meter": 25}`,
+		"nested.json":  `{"config": "other.json"}`,
+		"bad.json":     `{"max-match-meters": "far"}`,
+		"config.yaml":  "max-match-meters: 25\n",
+		"config.toml":  `max-match-meters = 25`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseArgs("features", []string{"-config", path}); err == nil {
+			t.Fatalf("%s: expected an error", name)
 		}
 	}
-	if !found {
-		t.Fatal("expected name fallback from travelways")
+}
+
+func TestDropCoincident(t *testing.T) {
+	// About 1m north of a travelway-matched lane, the same lane as drawn in
+	// the bike dataset and prioritized from its own WINT_LOS.
+	north := metersToDegreesLat(1)
+	matched := lineFeature{title: "Hollis Street", priority: 1, sourceDataset: datasetTravelways, objectID: 1, coords: orb.LineString{{-63.575, 44.645}, {-63.572, 44.649}}}
+	along := func(t, offset float64) orb.Point {
+		return orb.Point{-63.575 + t*0.003, 44.645 + t*0.004 + offset}
+	}
+	duplicate := lineFeature{title: "Hollis Street", priority: 2, sourceDataset: datasetBike, objectID: 2, coords: orb.LineString{along(0.1, north), along(0.9, north)}}
+
+	got, dropped := dropCoincident([]lineFeature{duplicate, matched}, 2)
+	if len(got) != 1 || dropped != 1 || got[0].objectID != 1 {
+		t.Fatalf("got %d features (%d dropped), want only the travelway-matched one: %+v", len(got), dropped, got)
+	}
+
+	// Features kept: one 10m away, one only partly along the matched lane,
+	// and a piece of the matched lane's own source feature.
+	away := duplicate
+	away.objectID = 3
+	away.coords = orb.LineString{along(0.1, 10*north), along(0.9, 10*north)}
+	partial := lineFeature{title: "Hollis Street", priority: 2, sourceDataset: datasetIce, objectID: 4, coords: orb.LineString{along(0.5, 0), along(1.5, 0)}}
+	sameSource := duplicate
+	sameSource.objectID = 1
+	got, dropped = dropCoincident([]lineFeature{matched, away, partial, sameSource}, 2)
+	if len(got) != 4 || dropped != 0 {
+		t.Fatalf("got %d features (%d dropped), want all 4 kept", len(got), dropped)
+	}
+
+	// Equal sources aren't deduplicated against each other.
+	twin := matched
+	twin.objectID = 5
+	if _, dropped := dropCoincident([]lineFeature{matched, twin}, 2); dropped != 0 {
+		t.Fatalf("dropped %d features from the same source, want 0", dropped)
 	}
 }
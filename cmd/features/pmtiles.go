@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/clip"
+)
+
+const (
+	pmtilesHeaderLen = 127
+	// pmtilesRootMaxLen is how much of the archive's first 16KiB the root
+	// directory may use after the header.
+	pmtilesRootMaxLen = 16384 - pmtilesHeaderLen
+	mvtExtent         = 4096
+	// mvtBuffer is how far past its edges, in tile pixels, a tile keeps
+	// the lines clipped to it, so line joins and caps render across tile
+	// boundaries.
+	mvtBuffer      = 64
+	maxPMTilesZoom = 22
+)
+
+// pmtilesEntry is a PMTiles directory entry. A run length of 0 points at a
+// leaf directory rather than tile data.
+type pmtilesEntry struct {
+	tileID    uint64
+	offset    uint64
+	length    uint64
+	runLength uint64
+}
+
+// pmtilesTileID is the PMTiles tile ID for z/x/y: the number of tiles at
+// lower zooms plus the tile's position along the zoom's Hilbert curve.
+func pmtilesTileID(z int, x, y uint32) uint64 {
+	var acc uint64
+	for i := range z {
+		acc += uint64(1) << (2 * i)
+	}
+	n := uint32(1) << z
+	var d uint64
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint32
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		if ry == 0 {
+			if rx == 1 {
+				x = n - 1 - x
+				y = n - 1 - y
+			}
+			x, y = y, x
+		}
+	}
+	return acc + d
+}
+
+// serializePMTilesDirectory writes entries, which must be sorted by tile ID,
+// as columns of varints: tile ID deltas, run lengths, lengths and offsets.
+// An offset is written as 0 when it directly follows the previous entry's
+// data, otherwise as offset+1.
+func serializePMTilesDirectory(entries []pmtilesEntry) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(entries)))
+	var lastID uint64
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, e.tileID-lastID)
+		lastID = e.tileID
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, e.runLength)
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, e.length)
+	}
+	for i, e := range entries {
+		if i > 0 && e.offset == entries[i-1].offset+entries[i-1].length {
+			b = binary.AppendUvarint(b, 0)
+		} else {
+			b = binary.AppendUvarint(b, e.offset+1)
+		}
+	}
+	return b
+}
+
+// pmtilesDirectories serializes entries as a root directory, splitting them
+// into leaf directories when they don't fit in the root.
+func pmtilesDirectories(entries []pmtilesEntry) (root, leaves []byte) {
+	if root := serializePMTilesDirectory(entries); len(root) <= pmtilesRootMaxLen {
+		return root, nil
+	}
+	for leafSize := 4096; ; leafSize *= 2 {
+		var rootEntries []pmtilesEntry
+		leaves = leaves[:0]
+		for start := 0; start < len(entries); start += leafSize {
+			leaf := serializePMTilesDirectory(entries[start:min(start+leafSize, len(entries))])
+			rootEntries = append(rootEntries, pmtilesEntry{tileID: entries[start].tileID, offset: uint64(len(leaves)), length: uint64(len(leaf))})
+			leaves = append(leaves, leaf...)
+		}
+		if root := serializePMTilesDirectory(rootEntries); len(root) <= pmtilesRootMaxLen {
+			return root, leaves
+		}
+	}
+}
+
+// mvtLayer builds one layer of a Mapbox Vector Tile.
+type mvtLayer struct {
+	name     string
+	features [][]byte
+	values   [][]byte
+	strings  map[string]uint32
+	uints    map[uint64]uint32
+}
+
+// Tag key indexes in every mvtLayer.
+const (
+	mvtKeyTitle = iota
+	mvtKeyPriority
+)
+
+func newMVTLayer(name string) *mvtLayer {
+	return &mvtLayer{name: name, strings: make(map[string]uint32), uints: make(map[uint64]uint32)}
+}
+
+func (l *mvtLayer) stringValue(v string) uint32 {
+	if i, ok := l.strings[v]; ok {
+		return i
+	}
+	i := uint32(len(l.values))
+	l.values = append(l.values, appendProtoBytes(nil, 1, []byte(v)))
+	l.strings[v] = i
+	return i
+}
+
+func (l *mvtLayer) uintValue(v uint64) uint32 {
+	if i, ok := l.uints[v]; ok {
+		return i
+	}
+	i := uint32(len(l.values))
+	l.values = append(l.values, appendProtoVarint(nil, 5, v))
+	l.uints[v] = i
+	return i
+}
+
+// addLine adds a linestring feature with points in tile pixels, skipping
+// repeated points. Lines with fewer than two distinct points are dropped.
+func (l *mvtLayer) addLine(title string, priority uint8, points [][2]int64) {
+	distinct := make([][2]int64, 0, len(points))
+	for _, pt := range points {
+		if n := len(distinct); n > 0 && distinct[n-1] == pt {
+			continue
+		}
+		distinct = append(distinct, pt)
+	}
+	if len(distinct) < 2 {
+		return
+	}
+	// A MoveTo to the first point, then one LineTo for the rest, each as a
+	// command integer of id and count followed by zigzag deltas.
+	geom := make([]uint64, 0, 2+2*len(distinct))
+	var cx, cy int64
+	for i, pt := range distinct {
+		switch i {
+		case 0:
+			geom = append(geom, 1|1<<3)
+		case 1:
+			geom = append(geom, 2|uint64(len(distinct)-1)<<3)
+		}
+		geom = append(geom, encodeZigZag(pt[0]-cx), encodeZigZag(pt[1]-cy))
+		cx, cy = pt[0], pt[1]
+	}
+	tags := []uint64{mvtKeyTitle, uint64(l.stringValue(title)), mvtKeyPriority, uint64(l.uintValue(uint64(priority)))}
+	var f []byte
+	f = appendProtoPacked(f, 2, tags)
+	f = appendProtoVarint(f, 3, 2) // LINESTRING
+	f = appendProtoPacked(f, 4, geom)
+	l.features = append(l.features, f)
+}
+
+func (l *mvtLayer) encode() []byte {
+	var b []byte
+	b = appendProtoVarint(b, 15, 2) // version
+	b = appendProtoBytes(b, 1, []byte(l.name))
+	for _, f := range l.features {
+		b = appendProtoBytes(b, 2, f)
+	}
+	b = appendProtoBytes(b, 3, []byte("title"))
+	b = appendProtoBytes(b, 3, []byte("priority"))
+	for _, v := range l.values {
+		b = appendProtoBytes(b, 4, v)
+	}
+	return appendProtoVarint(b, 5, mvtExtent)
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendProtoPacked(b []byte, field int, values []uint64) []byte {
+	var packed []byte
+	for _, v := range values {
+		packed = binary.AppendUvarint(packed, v)
+	}
+	return appendProtoBytes(b, field, packed)
+}
+
+// lonLatToTile returns pt's position in tile units at zoom in Web Mercator,
+// so its integer part is the tile's x and y.
+func lonLatToTile(pt orb.Point, zoom int) (x, y float64) {
+	n := math.Exp2(float64(zoom))
+	latRad := deg2rad(pt[1])
+	x = (pt[0] + 180) / 360 * n
+	y = (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n
+	return x, y
+}
+
+// writePMTiles writes outputs as a PMTiles v3 archive of uncompressed
+// Mapbox Vector Tiles at a single zoom, with a layer per output whose
+// features have title and priority attributes. Each line is clipped to
+// every tile it crosses, plus mvtBuffer, so a tile only holds the parts of
+// lines it shows.
+func writePMTiles(sink OutputSink, path string, zoom int, outputs []geojsonOutput) error {
+	if zoom < 0 || zoom > maxPMTilesZoom {
+		return fmt.Errorf("invalid zoom %d: want 0 to %d", zoom, maxPMTilesZoom)
+	}
+	type tileKey struct{ x, y uint32 }
+	tiles := make(map[tileKey][]*mvtLayer)
+	maxTile := float64(uint32(1)<<zoom - 1)
+	clampTile := func(v float64) uint32 {
+		return uint32(min(max(v, 0), maxTile))
+	}
+	const buffer = float64(mvtBuffer) / mvtExtent
+	var bound orb.Bound
+	haveBound := false
+	for li, out := range outputs {
+		for _, f := range out.features {
+			if len(f.coords) < 2 {
+				continue
+			}
+			lb := f.coords.Bound()
+			if haveBound {
+				bound = bound.Union(lb)
+			} else {
+				bound, haveBound = lb, true
+			}
+			xy := make(orb.LineString, len(f.coords))
+			for i, pt := range f.coords {
+				xy[i][0], xy[i][1] = lonLatToTile(pt, zoom)
+			}
+			xyBound := xy.Bound()
+			for ty := clampTile(xyBound.Min[1] - buffer); ty <= clampTile(xyBound.Max[1]+buffer); ty++ {
+				for tx := clampTile(xyBound.Min[0] - buffer); tx <= clampTile(xyBound.Max[0]+buffer); tx++ {
+					tileBound := orb.Bound{
+						Min: orb.Point{float64(tx) - buffer, float64(ty) - buffer},
+						Max: orb.Point{float64(tx) + 1 + buffer, float64(ty) + 1 + buffer},
+					}
+					parts := clip.LineString(tileBound, xy)
+					if len(parts) == 0 {
+						continue
+					}
+					key := tileKey{tx, ty}
+					layers := tiles[key]
+					if layers == nil {
+						layers = make([]*mvtLayer, len(outputs))
+						tiles[key] = layers
+					}
+					if layers[li] == nil {
+						layers[li] = newMVTLayer(out.name)
+					}
+					for _, part := range parts {
+						points := make([][2]int64, len(part))
+						for i, p := range part {
+							points[i] = [2]int64{
+								int64(math.Round((p[0] - float64(tx)) * mvtExtent)),
+								int64(math.Round((p[1] - float64(ty)) * mvtExtent)),
+							}
+						}
+						layers[li].addLine(f.title, f.priority, points)
+					}
+				}
+			}
+		}
+	}
+
+	entries := make([]pmtilesEntry, 0, len(tiles))
+	data := make(map[uint64][]byte, len(tiles))
+	for key, layers := range tiles {
+		var tile []byte
+		for _, l := range layers {
+			if l != nil && len(l.features) > 0 {
+				tile = appendProtoBytes(tile, 3, l.encode())
+			}
+		}
+		if len(tile) == 0 {
+			continue
+		}
+		id := pmtilesTileID(zoom, key.x, key.y)
+		data[id] = tile
+		entries = append(entries, pmtilesEntry{tileID: id, runLength: 1})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tileID < entries[j].tileID })
+	var tileData []byte
+	for i := range entries {
+		entries[i].offset = uint64(len(tileData))
+		entries[i].length = uint64(len(data[entries[i].tileID]))
+		tileData = append(tileData, data[entries[i].tileID]...)
+	}
+
+	type vectorLayer struct {
+		ID      string            `json:"id"`
+		Fields  map[string]string `json:"fields"`
+		MinZoom int               `json:"minzoom"`
+		MaxZoom int               `json:"maxzoom"`
+	}
+	metadata := struct {
+		Name         string        `json:"name"`
+		Format       string        `json:"format"`
+		VectorLayers []vectorLayer `json:"vector_layers"`
+	}{Name: "snowhfx", Format: "pbf"}
+	for _, out := range outputs {
+		metadata.VectorLayers = append(metadata.VectorLayers, vectorLayer{
+			ID:      out.name,
+			Fields:  map[string]string{"title": "String", "priority": "Number"},
+			MinZoom: zoom,
+			MaxZoom: zoom,
+		})
+	}
+	meta, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	root, leaves := pmtilesDirectories(entries)
+	rootOffset := uint64(pmtilesHeaderLen)
+	metaOffset := rootOffset + uint64(len(root))
+	leavesOffset := metaOffset + uint64(len(meta))
+	dataOffset := leavesOffset + uint64(len(leaves))
+
+	header := make([]byte, 0, pmtilesHeaderLen)
+	header = append(header, "PMTiles"...)
+	header = append(header, 3)
+	for _, v := range []uint64{
+		rootOffset, uint64(len(root)),
+		metaOffset, uint64(len(meta)),
+		leavesOffset, uint64(len(leaves)),
+		dataOffset, uint64(len(tileData)),
+		uint64(len(entries)), uint64(len(entries)), uint64(len(entries)),
+	} {
+		header = binary.LittleEndian.AppendUint64(header, v)
+	}
+	// Clustered, no internal or tile compression, MVT tiles, then zooms.
+	header = append(header, 1, 1, 1, 1, uint8(zoom), uint8(zoom))
+	e7 := func(v float64) uint32 { return uint32(int32(math.Round(v * 1e7))) }
+	center := bound.Center()
+	for _, v := range []float64{bound.Min[0], bound.Min[1], bound.Max[0], bound.Max[1]} {
+		header = binary.LittleEndian.AppendUint32(header, e7(v))
+	}
+	header = append(header, uint8(zoom))
+	header = binary.LittleEndian.AppendUint32(header, e7(center[0]))
+	header = binary.LittleEndian.AppendUint32(header, e7(center[1]))
+
+	var archive bytes.Buffer
+	for _, part := range [][]byte{header, root, meta, leaves, tileData} {
+		archive.Write(part)
+	}
+	return writeOutput(sink, path, archive.Bytes())
+}
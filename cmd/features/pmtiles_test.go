@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+)
+
+func TestPMTilesTileID(t *testing.T) {
+	for _, tt := range []struct {
+		z    int
+		x, y uint32
+		want uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1},
+		{1, 0, 1, 2},
+		{1, 1, 1, 3},
+		{1, 1, 0, 4},
+		{2, 0, 0, 5},
+	} {
+		if got := pmtilesTileID(tt.z, tt.x, tt.y); got != tt.want {
+			t.Errorf("%d/%d/%d: got %d, want %d", tt.z, tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+// protoFields splits a protobuf message into its fields, with varints in
+// value and length-delimited fields in data.
+type protoField struct {
+	num   int
+	value uint64
+	data  []byte
+}
+
+func protoFields(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad field key")
+		}
+		b = b[n:]
+		f := protoField{num: int(key >> 3)}
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad field %d", f.num)
+		}
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			f.value = v
+		case 2:
+			f.data, b = b[:v], b[v:]
+		default:
+			t.Fatalf("field %d: unexpected wire type %d", f.num, key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func packedVarints(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	var vs []uint64
+	for len(b) > 0 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad packed varint")
+		}
+		vs, b = append(vs, v), b[n:]
+	}
+	return vs
+}
+
+// readPMTilesDirectory parses an uncompressed PMTiles directory.
+func readPMTilesDirectory(t *testing.T, b []byte) []pmtilesEntry {
+	t.Helper()
+	vs := packedVarints(t, b)
+	n := int(vs[0])
+	if len(vs) != 1+4*n {
+		t.Fatalf("directory has %d varints, want %d", len(vs), 1+4*n)
+	}
+	entries := make([]pmtilesEntry, n)
+	var id uint64
+	for i := range entries {
+		id += vs[1+i]
+		entries[i].tileID = id
+		entries[i].runLength = vs[1+n+i]
+		entries[i].length = vs[1+2*n+i]
+		if off := vs[1+3*n+i]; off == 0 && i > 0 {
+			entries[i].offset = entries[i-1].offset + entries[i-1].length
+		} else {
+			entries[i].offset = off - 1
+		}
+	}
+	return entries
+}
+
+func TestWritePMTiles(t *testing.T) {
+	const zoom = 14
+	travelways := []lineFeature{
+		{title: "Barrington Street", priority: 1, coords: orb.LineString{{-63.5752, 44.6488}, {-63.5745, 44.6495}}},
+		{title: "Hollis Street", priority: 2, coords: orb.LineString{{-63.5740, 44.6480}, {-63.5735, 44.6486}}},
+	}
+	cycling := []lineFeature{
+		{title: "Harbourfront Trail", priority: 1, coords: orb.LineString{{-63.5730, 44.6470}, {-63.5725, 44.6476}}},
+	}
+	sink := &memSink{}
+	err := writePMTiles(sink, "features.pmtiles", zoom, []geojsonOutput{
+		{name: "travelways", features: travelways},
+		{name: "cycling", features: cycling},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := sink.files["features.pmtiles"]
+	if len(archive) < pmtilesHeaderLen || string(archive[:7]) != "PMTiles" || archive[7] != 3 {
+		t.Fatalf("archive does not start with a PMTiles v3 header: %q", archive[:min(len(archive), 8)])
+	}
+	u64 := func(off int) uint64 { return binary.LittleEndian.Uint64(archive[off:]) }
+	rootOff, rootLen := u64(8), u64(16)
+	dataOff := u64(56)
+	if archive[99] != 1 || archive[100] != zoom || archive[101] != zoom {
+		t.Fatalf("tile type %d zooms %d-%d, want mvt at %d", archive[99], archive[100], archive[101], zoom)
+	}
+	entries := readPMTilesDirectory(t, archive[rootOff:rootOff+rootLen])
+
+	fx, fy := lonLatToTile(travelways[0].coords[0], zoom)
+	tx, ty := uint32(fx), uint32(fy)
+	id := pmtilesTileID(zoom, tx, ty)
+	var tile []byte
+	for _, e := range entries {
+		if e.tileID == id {
+			tile = archive[dataOff+e.offset : dataOff+e.offset+e.length]
+		}
+	}
+	if tile == nil {
+		t.Fatalf("no tile %d/%d/%d in %v", zoom, tx, ty, entries)
+	}
+
+	type decoded struct {
+		title    string
+		priority uint64
+		start    orb.Point
+	}
+	got := make(map[string][]decoded)
+	for _, lf := range protoFields(t, tile) {
+		if lf.num != 3 {
+			continue
+		}
+		var name string
+		var keys []string
+		var values []protoField
+		var features [][]protoField
+		for _, f := range protoFields(t, lf.data) {
+			switch f.num {
+			case 1:
+				name = string(f.data)
+			case 2:
+				features = append(features, protoFields(t, f.data))
+			case 3:
+				keys = append(keys, string(f.data))
+			case 4:
+				values = append(values, protoFields(t, f.data)[0])
+			}
+		}
+		for _, feature := range features {
+			var d decoded
+			for _, f := range feature {
+				switch f.num {
+				case 2:
+					tags := packedVarints(t, f.data)
+					for i := 0; i < len(tags); i += 2 {
+						v := values[tags[i+1]]
+						switch keys[tags[i]] {
+						case "title":
+							d.title = string(v.data)
+						case "priority":
+							d.priority = v.value
+						}
+					}
+				case 3:
+					if f.value != 2 {
+						t.Fatalf("%s: geometry type %d, want LINESTRING", name, f.value)
+					}
+				case 4:
+					geom := packedVarints(t, f.data)
+					if geom[0] != 1|1<<3 {
+						t.Fatalf("%s: geometry starts with command %d, want MoveTo", name, geom[0])
+					}
+					px := float64(decodeZigZagTest(geom[1])) / mvtExtent
+					py := float64(decodeZigZagTest(geom[2])) / mvtExtent
+					n := math.Exp2(zoom)
+					lon := (float64(tx)+px)/n*360 - 180
+					lat := rad2deg(math.Atan(math.Sinh(math.Pi * (1 - 2*(float64(ty)+py)/n))))
+					d.start = orb.Point{lon, lat}
+				}
+			}
+			got[name] = append(got[name], d)
+		}
+	}
+
+	for name, want := range map[string][]lineFeature{"travelways": travelways, "cycling": cycling} {
+		if len(got[name]) != len(want) {
+			t.Fatalf("%s: got %d features, want %d: %v", name, len(got[name]), len(want), got[name])
+		}
+		for i, w := range want {
+			g := got[name][i]
+			if g.title != w.title || g.priority != uint64(w.priority) {
+				t.Errorf("%s feature %d: got %q priority %d, want %q priority %d", name, i, g.title, g.priority, w.title, w.priority)
+			}
+			if d := geo.Distance(g.start, w.coords[0]); d > 5 {
+				t.Errorf("%s feature %d: starts %.1fm from %v", name, i, d, w.coords[0])
+			}
+		}
+	}
+}
+
+func decodeZigZagTest(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func TestPMTilesDirectoriesSplitsLeaves(t *testing.T) {
+	entries := make([]pmtilesEntry, 20000)
+	for i := range entries {
+		entries[i] = pmtilesEntry{tileID: uint64(i * 3), offset: uint64(i * 100), length: 50 + uint64(i%7), runLength: 1}
+	}
+	root, leaves := pmtilesDirectories(entries)
+	if len(root) > pmtilesRootMaxLen {
+		t.Fatalf("root directory is %d bytes, want at most %d", len(root), pmtilesRootMaxLen)
+	}
+	if len(leaves) == 0 {
+		t.Fatal("expected leaf directories")
+	}
+	var got []pmtilesEntry
+	for _, leaf := range readPMTilesDirectory(t, root) {
+		if leaf.runLength != 0 {
+			t.Fatalf("root entry %v is not a leaf pointer", leaf)
+		}
+		got = append(got, readPMTilesDirectory(t, leaves[leaf.offset:leaf.offset+leaf.length])...)
+	}
+	if !slices.Equal(got, entries) {
+		t.Fatalf("leaf entries differ from input: got %d entries, want %d", len(got), len(entries))
+	}
+}
+
+func TestWritePMTilesClipsToTiles(t *testing.T) {
+	const zoom = 14
+	fx, fy := lonLatToTile(orb.Point{-63.5752, 44.6488}, zoom)
+	tx, ty := float64(uint32(fx)), float64(uint32(fy))
+	tileToLonLat := func(x, y float64) orb.Point {
+		n := math.Exp2(zoom)
+		return orb.Point{x/n*360 - 180, rad2deg(math.Atan(math.Sinh(math.Pi * (1 - 2*y/n))))}
+	}
+	// An L running east across three tiles, then south down two more, so
+	// four of the nine tiles its bounding box touches don't hold any of it.
+	street := lineFeature{title: "Corner Street", priority: 1, coords: orb.LineString{
+		tileToLonLat(tx+0.5, ty+0.5),
+		tileToLonLat(tx+2.5, ty+0.5),
+		tileToLonLat(tx+2.5, ty+2.5),
+	}}
+	sink := &memSink{}
+	if err := writePMTiles(sink, "features.pmtiles", zoom, []geojsonOutput{{name: "travelways", features: []lineFeature{street}}}); err != nil {
+		t.Fatal(err)
+	}
+	archive := sink.files["features.pmtiles"]
+	u64 := func(off int) uint64 { return binary.LittleEndian.Uint64(archive[off:]) }
+	rootOff, rootLen, dataOff := u64(8), u64(16), u64(56)
+
+	want := make(map[uint64]bool)
+	for _, d := range [][2]uint32{{0, 0}, {1, 0}, {2, 0}, {2, 1}, {2, 2}} {
+		want[pmtilesTileID(zoom, uint32(tx)+d[0], uint32(ty)+d[1])] = true
+	}
+	entries := readPMTilesDirectory(t, archive[rootOff:rootOff+rootLen])
+	if len(entries) != len(want) {
+		t.Fatalf("got %d tiles, want %d", len(entries), len(want))
+	}
+	for _, e := range entries {
+		if !want[e.tileID] {
+			t.Fatalf("unexpected tile %d holding none of the line", e.tileID)
+		}
+		tile := archive[dataOff+e.offset : dataOff+e.offset+e.length]
+		for _, lf := range protoFields(t, tile) {
+			for _, f := range protoFields(t, lf.data) {
+				if f.num != 2 {
+					continue
+				}
+				for _, ff := range protoFields(t, f.data) {
+					if ff.num != 4 {
+						continue
+					}
+					// A MoveTo command and point, then a LineTo command and
+					// the rest of the points as deltas.
+					geom := packedVarints(t, ff.data)
+					deltas := append(geom[1:3:3], geom[4:]...)
+					var x, y int64
+					for i := 0; i < len(deltas); i += 2 {
+						x += decodeZigZagTest(deltas[i])
+						y += decodeZigZagTest(deltas[i+1])
+						if x < -mvtBuffer || x > mvtExtent+mvtBuffer || y < -mvtBuffer || y > mvtExtent+mvtBuffer {
+							t.Fatalf("tile %d: point (%d,%d) outside the tile and its buffer", e.tileID, x, y)
+						}
+					}
+				}
+			}
+		}
+	}
+}
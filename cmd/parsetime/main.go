@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/danp/snowhfx/internal/timeparse"
+)
+
+func main() {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	var (
+		ref      string
+		timezone string
+	)
+	fs.StringVar(&ref, "ref", "", "RFC 3339 reference time used to fill in missing parts; defaults to now")
+	fs.StringVar(&timezone, "timezone", "America/Halifax", "IANA time zone to parse in")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] text\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.Fatal(err)
+	}
+	refTime := time.Now()
+	if ref != "" {
+		if refTime, err = time.Parse(time.RFC3339, ref); err != nil {
+			log.Fatalf("parsing -ref: %v", err)
+		}
+	}
+
+	if err := run(os.Stdout, fs.Arg(0), refTime, loc); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(w io.Writer, txt string, ref time.Time, loc *time.Location) error {
+	t, layout, err := timeparse.ParseLayout(txt, ref, loc)
+	if err != nil {
+		fmt.Fprintln(w, "attempted layouts:")
+		for _, l := range timeparse.Layouts() {
+			fmt.Fprintf(w, "  %s\n", l)
+		}
+		return err
+	}
+	if layout == "" {
+		fmt.Fprintln(w, "blank or N/A")
+		return nil
+	}
+	fmt.Fprintf(w, "layout: %s\n", layout)
+	fmt.Fprintf(w, "time:   %s\n", t.Format(time.RFC3339))
+	return nil
+}
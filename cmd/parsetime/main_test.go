@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunReportsLayout(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := time.Date(2025, 2, 7, 12, 0, 0, 0, loc)
+
+	var out strings.Builder
+	if err := run(&out, "Jan 2 3 PM", ref, loc); err != nil {
+		t.Fatal(err)
+	}
+	want := "layout: Jan 2 3 PM\ntime:   2025-01-02T15:00:00-04:00\n"
+	if out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestRunListsAttemptedLayouts(t *testing.T) {
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := run(&out, "sometime soon", time.Now(), loc); err == nil {
+		t.Fatal("expected error for unrecognized time")
+	}
+	if !strings.Contains(out.String(), "\n  Jan 2 3 PM\n") {
+		t.Fatalf("attempted layouts missing from output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,87 @@
+//go:build integration
+
+// Command smoketest runs cmd/features against the live ArcGIS downloads and
+// fails if any dataset no longer parses or an output has no features, so
+// upstream API changes (such as a renamed resultUrl) are caught. It needs
+// network access and is only built with the integration tag:
+//
+//	go run -tags integration ./cmd/smoketest
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/danp/snowhfx/internal/featuresbin"
+	"github.com/paulmach/orb/geojson"
+)
+
+func main() {
+	var (
+		dir     string
+		timeout time.Duration
+	)
+	flag.StringVar(&dir, "dir", ".", "module root to run cmd/features from")
+	flag.DurationVar(&timeout, "timeout", 15*time.Minute, "give up after this long")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := run(ctx, dir); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(ctx context.Context, dir string) error {
+	tmp, err := os.MkdirTemp("", "smoketest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	outputs := []string{filepath.Join(tmp, "features.bin"), filepath.Join(tmp, "features_cycling.bin")}
+	cmd := exec.CommandContext(ctx, "go", "run", "./cmd/features",
+		"-save-downloads-dir", tmp,
+		"-out-travelways", outputs[0],
+		"-out-bike", outputs[1],
+		"-quiet",
+	)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running cmd/features: %w", err)
+	}
+
+	for _, name := range []string{"travelways.geojson", "bike.geojson", "ice.geojson"} {
+		data, err := os.ReadFile(filepath.Join(tmp, name))
+		if err != nil {
+			return err
+		}
+		fc, err := geojson.UnmarshalFeatureCollection(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if len(fc.Features) == 0 {
+			return fmt.Errorf("%s: no features downloaded", name)
+		}
+		log.Printf("%s: %d features downloaded", name, len(fc.Features))
+	}
+	for _, path := range outputs {
+		features, _, _, err := featuresbin.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		if len(features) == 0 {
+			return fmt.Errorf("%s: no features encoded", filepath.Base(path))
+		}
+		log.Printf("%s: %d features encoded", filepath.Base(path), len(features))
+	}
+	return nil
+}
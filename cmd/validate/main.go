@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/danp/snowhfx/internal/featuresbin"
+	"github.com/paulmach/orb"
+)
+
+// coordBucketBounds are the exclusive upper bounds of the coordinate count
+// histogram buckets; a final bucket holds everything above the last bound.
+var coordBucketBounds = []int{10, 50, 100, 500, 1000, 5000}
+
+type histogramBucket struct {
+	Min   int
+	Max   int // 0 means unbounded
+	Count int
+}
+
+type coordOffender struct {
+	Title  string
+	Coords int
+}
+
+// segmentBound is a segment's grid cell and the bounding box written for it.
+type segmentBound struct {
+	Row, Col int
+	Bound    orb.Bound
+}
+
+type segmentOverlap struct {
+	A, B segmentBound
+}
+
+type report struct {
+	Features       int
+	CoordHistogram []histogramBucket
+	TooManyCoords  []coordOffender
+	Overlaps       []segmentOverlap
+}
+
+func main() {
+	var (
+		path         string
+		maxCoords    int
+		checkOverlap bool
+	)
+	flag.StringVar(&path, "in", "", "path to features bin")
+	flag.IntVar(&maxCoords, "max-coords", 1000, "flag features with more coordinates than this; 0 disables")
+	flag.BoolVar(&checkOverlap, "check-overlap", false, "flag pairs of segments whose bounding boxes overlap, other than neighbouring grid cells")
+	flag.Parse()
+
+	if path == "" {
+		log.Fatal("-in is required")
+	}
+
+	features, segments, err := readFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rep := validate(features, maxCoords)
+	if checkOverlap {
+		rep.Overlaps = overlappingSegments(segments)
+	}
+	writeReport(os.Stdout, rep)
+	if rep.problems() > 0 {
+		os.Exit(1)
+	}
+}
+
+// readFile decodes the features bin at path, returning its features and the
+// bounds of each of its segments.
+func readFile(path string) ([]featuresbin.Feature, []segmentBound, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := featuresbin.Open(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		features []featuresbin.Feature
+		segments []segmentBound
+	)
+	for {
+		feat, ok, err := reader.NextFeature()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			break
+		}
+		features = append(features, feat)
+		row, col := reader.SegmentCell()
+		if n := len(segments); n == 0 || segments[n-1].Row != row || segments[n-1].Col != col {
+			segments = append(segments, segmentBound{Row: row, Col: col, Bound: reader.SegmentBound()})
+		}
+	}
+	return features, segments, nil
+}
+
+func validate(features []featuresbin.Feature, maxCoords int) report {
+	rep := report{Features: len(features)}
+	lo := 0
+	for _, hi := range coordBucketBounds {
+		rep.CoordHistogram = append(rep.CoordHistogram, histogramBucket{Min: lo, Max: hi})
+		lo = hi
+	}
+	rep.CoordHistogram = append(rep.CoordHistogram, histogramBucket{Min: lo})
+
+	for _, feat := range features {
+		n := len(feat.Coords)
+		for i := range rep.CoordHistogram {
+			b := &rep.CoordHistogram[i]
+			if n >= b.Min && (b.Max == 0 || n < b.Max) {
+				b.Count++
+				break
+			}
+		}
+		if maxCoords > 0 && n > maxCoords {
+			rep.TooManyCoords = append(rep.TooManyCoords, coordOffender{Title: feat.Title, Coords: n})
+		}
+	}
+	return rep
+}
+
+// overlappingSegments returns each pair of segments in non-neighbouring grid
+// cells whose bounding boxes share more than an edge, which means a feature
+// reaches more than a cell beyond the one it's filed under. Features are
+// filed by their first coordinate but keep their whole bounds, so segments
+// in neighbouring cells normally overlap and aren't reported.
+func overlappingSegments(segments []segmentBound) []segmentOverlap {
+	var overlaps []segmentOverlap
+	for i, a := range segments {
+		for _, b := range segments[i+1:] {
+			if max(a.Row-b.Row, b.Row-a.Row) <= 1 && max(a.Col-b.Col, b.Col-a.Col) <= 1 {
+				continue
+			}
+			if a.Bound.Min[0] < b.Bound.Max[0] && b.Bound.Min[0] < a.Bound.Max[0] &&
+				a.Bound.Min[1] < b.Bound.Max[1] && b.Bound.Min[1] < a.Bound.Max[1] {
+				overlaps = append(overlaps, segmentOverlap{A: a, B: b})
+			}
+		}
+	}
+	return overlaps
+}
+
+func (r report) problems() int {
+	return len(r.TooManyCoords) + len(r.Overlaps)
+}
+
+func writeReport(w io.Writer, r report) {
+	fmt.Fprintf(w, "features: %d\n", r.Features)
+	fmt.Fprintln(w, "coordinates per feature:")
+	for _, b := range r.CoordHistogram {
+		if b.Max == 0 {
+			fmt.Fprintf(w, "  %d+: %d\n", b.Min, b.Count)
+		} else {
+			fmt.Fprintf(w, "  %d-%d: %d\n", b.Min, b.Max-1, b.Count)
+		}
+	}
+	if len(r.TooManyCoords) > 0 {
+		fmt.Fprintf(w, "features with too many coordinates: %d\n", len(r.TooManyCoords))
+		for _, o := range r.TooManyCoords {
+			fmt.Fprintf(w, "  %q: %d\n", o.Title, o.Coords)
+		}
+	}
+	if len(r.Overlaps) > 0 {
+		fmt.Fprintf(w, "segments with overlapping bounds: %d\n", len(r.Overlaps))
+		for _, o := range r.Overlaps {
+			fmt.Fprintf(w, "  (%d, %d) and (%d, %d)\n", o.A.Row, o.A.Col, o.B.Row, o.B.Col)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/danp/snowhfx/internal/featuresbin"
+	"github.com/paulmach/orb"
+)
+
+func lineWithCoords(n int) [][]float64 {
+	coords := make([][]float64, n)
+	for i := range coords {
+		coords[i] = []float64{-63.6 + float64(i)*0.00001, 44.6}
+	}
+	return coords
+}
+
+func TestValidateFlagsHighVertexFeature(t *testing.T) {
+	features := []featuresbin.Feature{
+		{Title: "Short St", Coords: lineWithCoords(2)},
+		{Title: "Medium St", Coords: lineWithCoords(60)},
+		{Title: "Wiggly Trail", Coords: lineWithCoords(2500)},
+	}
+
+	rep := validate(features, 1000)
+	if rep.Features != 3 {
+		t.Fatalf("features: got %d want 3", rep.Features)
+	}
+	if len(rep.TooManyCoords) != 1 || rep.TooManyCoords[0].Title != "Wiggly Trail" || rep.TooManyCoords[0].Coords != 2500 {
+		t.Fatalf("offenders: got %+v, want only Wiggly Trail with 2500", rep.TooManyCoords)
+	}
+	if rep.problems() != 1 {
+		t.Fatalf("problems: got %d want 1", rep.problems())
+	}
+
+	counts := map[int]int{}
+	total := 0
+	for _, b := range rep.CoordHistogram {
+		counts[b.Min] = b.Count
+		total += b.Count
+	}
+	if total != 3 || counts[0] != 1 || counts[50] != 1 || counts[1000] != 1 {
+		t.Fatalf("unexpected histogram: %+v", rep.CoordHistogram)
+	}
+
+	var out bytes.Buffer
+	writeReport(&out, rep)
+	if !strings.Contains(out.String(), `"Wiggly Trail": 2500`) {
+		t.Fatalf("report does not list offender:\n%s", out.String())
+	}
+}
+
+func TestValidateMaxCoordsDisabled(t *testing.T) {
+	features := []featuresbin.Feature{{Title: "Wiggly Trail", Coords: lineWithCoords(2500)}}
+	if rep := validate(features, 0); rep.problems() != 0 {
+		t.Fatalf("expected no problems with -max-coords 0, got %+v", rep.TooManyCoords)
+	}
+}
+
+func TestOverlappingSegments(t *testing.T) {
+	bound := func(minLon, minLat, maxLon, maxLat float64) orb.Bound {
+		return orb.Bound{Min: orb.Point{minLon, minLat}, Max: orb.Point{maxLon, maxLat}}
+	}
+	segments := []segmentBound{
+		{Row: 0, Col: 0, Bound: bound(0, 0, 1, 1)},
+		// Shares only an edge with (0, 0).
+		{Row: 0, Col: 1, Bound: bound(1, 0, 2, 1)},
+		// Reaches into its neighbour (0, 1), as features that cross a cell
+		// edge do.
+		{Row: 1, Col: 1, Bound: bound(1.5, 0.5, 2.5, 2)},
+		// Reaches back past (0, 2) into (0, 1).
+		{Row: 0, Col: 3, Bound: bound(1.8, 0, 4, 0.4)},
+	}
+
+	rep := validate(nil, 0)
+	rep.Overlaps = overlappingSegments(segments)
+	if len(rep.Overlaps) != 1 {
+		t.Fatalf("overlaps: got %+v, want only (0, 1) and (0, 3)", rep.Overlaps)
+	}
+	if o := rep.Overlaps[0]; o.A.Row != 0 || o.A.Col != 1 || o.B.Row != 0 || o.B.Col != 3 {
+		t.Fatalf("overlap: got %+v, want (0, 1) and (0, 3)", o)
+	}
+	if rep.problems() != 1 {
+		t.Fatalf("problems: got %d want 1", rep.problems())
+	}
+
+	var out bytes.Buffer
+	writeReport(&out, rep)
+	if !strings.Contains(out.String(), "  (0, 1) and (0, 3)\n") {
+		t.Fatalf("report does not name the overlapping cells:\n%s", out.String())
+	}
+}
+
+//go:generate go run ../features -offline -quiet -only travelways -travelways testdata/travelways.geojson -bike testdata/bike.geojson -grid-auto 16 -out-travelways testdata/features.bin
+
+func TestOverlappingSegmentsEncodedFile(t *testing.T) {
+	// testdata/features.bin is the street grid in testdata/travelways.geojson
+	// written by the go:generate line above. Each street runs two blocks from
+	// its first point, so segment bounds overlap their neighbours but reach no
+	// further.
+	features, segments, err := readFile("testdata/features.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 36 || len(segments) < 2 {
+		t.Fatalf("got %d features in %d segments, want 36 in several", len(features), len(segments))
+	}
+	neighbours := 0
+	for i, a := range segments {
+		for _, b := range segments[i+1:] {
+			if a.Bound.Min[0] < b.Bound.Max[0] && b.Bound.Min[0] < a.Bound.Max[0] &&
+				a.Bound.Min[1] < b.Bound.Max[1] && b.Bound.Min[1] < a.Bound.Max[1] {
+				neighbours++
+			}
+		}
+	}
+	if neighbours == 0 {
+		t.Fatal("expected neighbouring segment bounds to overlap in an encoded file")
+	}
+	if overlaps := overlappingSegments(segments); len(overlaps) != 0 {
+		t.Fatalf("overlaps: got %+v, want none", overlaps)
+	}
+}
@@ -5,13 +5,33 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/project"
 )
 
 const (
-	magic     = "SHFX"
-	versionV4 = uint8(4)
+	magic      = "SHFX"
+	versionV17 = uint8(17)
+
+	flagCompactCoords        = uint8(1 << 0)
+	flagBigEndian            = uint8(1 << 1)
+	flagMercator             = uint8(1 << 2)
+	flagGeneratedAt          = uint8(1 << 3)
+	flagStyles               = uint8(1 << 4)
+	flagTimelines            = uint8(1 << 5)
+	flagBikeTypes            = uint8(1 << 6)
+	flagLabels               = uint8(1 << 7)
+	extFlagServiced          = uint8(1 << 0)
+	extFlagFeatureFlags      = uint8(1 << 1)
+	extFlagPrecision         = uint8(1 << 2)
+	extFlagHoursRemaining    = uint8(1 << 3)
+	featureFlagDirectionMask = uint8(0x3)
+	coordWidthCompact        = uint8(1)
 )
 
 type Feature struct {
@@ -20,34 +40,154 @@ type Feature struct {
 	Priority      uint8
 	SourceDataset uint8
 	RouteID       uint16
-	Coords        [][]float64
+	// BikeType is 1 for protected and 2 for unprotected bike features, or
+	// 0 if unknown or the file doesn't record it.
+	BikeType uint8
+	// Serviced is when the feature was last plowed, or zero if unknown.
+	Serviced time.Time
+	// Direction is which way a cycling feature runs: DirectionTwoWay,
+	// DirectionWithTraffic or DirectionAgainstTraffic.
+	Direction uint8
+	// HoursRemaining is the whole hours until the feature's clearing
+	// deadline when the file was written, rounded down, if the header's
+	// HoursRemaining is set. DeadlinePassed is set once it's negative.
+	HoursRemaining int16
+	DeadlinePassed bool
+	Coords         [][]float64
 }
 
+// Feature directions.
+const (
+	DirectionTwoWay uint8 = iota
+	DirectionWithTraffic
+	DirectionAgainstTraffic
+)
+
 type Header struct {
-	FormatVersion  uint8
-	SegmentCount   uint32
-	GlobalMinLon   float64
-	GlobalMinLat   float64
+	FormatVersion uint8
+	SegmentCount  uint32
+	GlobalMinLon  float64
+	GlobalMinLat  float64
+	GridCols      uint16
+	GridRows      uint16
+	CompactCoords bool
+	BigEndian     bool
+	Mercator      bool
+	// Precision is how many decimal places of degrees, or of metres for
+	// Mercator, coordinates are stored at.
+	Precision uint8
+	// BikeTypes is set if features record a bike protection type.
+	BikeTypes bool
+	// Serviced is set if features record a last-serviced time.
+	Serviced bool
+	// FeatureFlags is set if features record a flags byte, such as their
+	// direction.
+	FeatureFlags bool
+	// HoursRemaining is set if features record the hours until their
+	// clearing deadline.
+	HoursRemaining bool
+	// GeneratedAt is when the file was written, or zero if not recorded.
+	GeneratedAt time.Time
+	// Styles maps priorities to how viewers should draw them, or is nil if
+	// the file has none.
+	Styles map[uint8]Style
+	// EndTime is the weather event end time the file was written for, or
+	// zero if not recorded. Timelines maps priorities to how long after it
+	// they must be cleared.
+	EndTime   time.Time
+	Timelines map[uint8]time.Duration
+	// Labels maps priorities to their names for viewers, or is nil if the
+	// file has none.
+	Labels         map[uint8]Label
 	RouteCount     uint16
 	NamePieceCount uint16
 }
 
+// Deadline returns when features of priority must be cleared by, if the
+// file records an end time and a timeline for it.
+func (h Header) Deadline(priority uint8) (time.Time, bool) {
+	timeline, ok := h.Timelines[priority]
+	if h.EndTime.IsZero() || !ok {
+		return time.Time{}, false
+	}
+	return h.EndTime.Add(timeline), true
+}
+
+// Label names a priority for viewers in English and French. Either may be
+// empty.
+type Label struct {
+	En string
+	Fr string
+}
+
+// Style is how viewers should draw features of a priority.
+type Style struct {
+	// Color is "#RRGGBB".
+	Color string
+	// Weight is a line width in pixels, or 0 to leave it to the viewer.
+	Weight uint8
+}
+
 type RouteEntry struct {
 	Maint string
 	Route string
 }
 
+type segmentIndexEntry struct {
+	row, col int
+	offset   int64
+	length   int
+}
+
+// source is what a Reader decodes from: read in order for the header and
+// features, and at offsets for individual segments. *bytes.Reader is one.
+type source interface {
+	io.Reader
+	io.ByteReader
+	io.ReaderAt
+	// Len returns the number of unread bytes.
+	Len() int
+	Size() int64
+}
+
+// sectionSource adapts an io.SectionReader to a source, reading through
+// ReadAt so nothing is loaded until it is decoded.
+type sectionSource struct {
+	*io.SectionReader
+}
+
+func (s sectionSource) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(s, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (s sectionSource) Len() int {
+	pos, _ := s.Seek(0, io.SeekCurrent)
+	return int(s.Size() - pos)
+}
+
 type Reader struct {
-	r          *bytes.Reader
+	r          source
+	order      binary.ByteOrder
 	header     Header
 	routes     []RouteEntry
 	namePieces []string
+	segments   []segmentIndexEntry
 	segCount   uint32
 	segIndex   uint32
 	featIndex  uint32
 	featCount  uint32
 	globalLon  float64
 	globalLat  float64
+	scale      float64
+	segLon     int64
+	segLat     int64
+	segMaxLon  int64
+	segMaxLat  int64
+	bounds     orb.Bound
 }
 
 func decodeZigZag(value uint64) int64 {
@@ -79,11 +219,8 @@ func Read(r io.Reader) ([]Feature, []RouteEntry, Header, error) {
 	if err != nil {
 		return nil, nil, Header{}, err
 	}
-	reader := NewReader(bytes.NewReader(data))
-	if err := reader.readHeader(); err != nil {
-		return nil, nil, Header{}, err
-	}
-	if err := reader.readRoutes(); err != nil {
+	reader, err := Open(data)
+	if err != nil {
 		return nil, nil, Header{}, err
 	}
 	var features []Feature
@@ -104,6 +241,153 @@ func NewReader(r *bytes.Reader) *Reader {
 	return &Reader{r: r}
 }
 
+// Open reads the header, routes and segment index from data and returns a
+// Reader positioned at the first segment.
+func Open(data []byte) (*Reader, error) {
+	return open(bytes.NewReader(data))
+}
+
+// DecoderAt is like Open but reads the size bytes of the file from r as
+// needed, so large files can be memory-mapped rather than loaded. Segment
+// reads only the requested segment's bytes, and is safe for concurrent use.
+func DecoderAt(r io.ReaderAt, size int64) (*Reader, error) {
+	return open(sectionSource{io.NewSectionReader(r, 0, size)})
+}
+
+func open(src source) (*Reader, error) {
+	reader := &Reader{r: src}
+	if err := reader.readHeader(); err != nil {
+		return nil, err
+	}
+	if err := reader.readRoutes(); err != nil {
+		return nil, err
+	}
+	if err := reader.readSegmentIndex(); err != nil {
+		return nil, err
+	}
+	if err := reader.readBounds(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Bounds returns the extent of the file's features, from the header's global
+// minimum and the largest segment maximum.
+func (r *Reader) Bounds() orb.Bound {
+	return r.bounds
+}
+
+// Grid returns the dimensions of the segment grid.
+func (r *Reader) Grid() (cols, rows int) {
+	return int(r.header.GridCols), int(r.header.GridRows)
+}
+
+// SegmentCount returns the number of non-empty segments.
+func (r *Reader) SegmentCount() int {
+	return int(r.segCount)
+}
+
+func (r *Reader) readStyles() (map[uint8]Style, error) {
+	count, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if count > 255 {
+		return nil, fmt.Errorf("style count overflow: %d", count)
+	}
+	styles := make(map[uint8]Style, count)
+	for i := uint64(0); i < count; i++ {
+		priority, err := r.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		var rgb [3]byte
+		if _, err := io.ReadFull(r.r, rgb[:]); err != nil {
+			return nil, err
+		}
+		weight, err := r.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if priority > 255 || weight > 255 {
+			return nil, fmt.Errorf("style overflow: priority=%d weight=%d", priority, weight)
+		}
+		styles[uint8(priority)] = Style{
+			Color:  fmt.Sprintf("#%02X%02X%02X", rgb[0], rgb[1], rgb[2]),
+			Weight: uint8(weight),
+		}
+	}
+	return styles, nil
+}
+
+func (r *Reader) readTimelines() (map[uint8]time.Duration, error) {
+	count, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if count > 255 {
+		return nil, fmt.Errorf("timeline count overflow: %d", count)
+	}
+	timelines := make(map[uint8]time.Duration, count)
+	for i := uint64(0); i < count; i++ {
+		priority, err := r.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		minutes, err := r.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if priority > 255 || minutes > uint64(1<<31) {
+			return nil, fmt.Errorf("timeline overflow: priority=%d minutes=%d", priority, minutes)
+		}
+		timelines[uint8(priority)] = time.Duration(minutes) * time.Minute
+	}
+	return timelines, nil
+}
+
+func (r *Reader) readLabels() (map[uint8]Label, error) {
+	count, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if count > 255 {
+		return nil, fmt.Errorf("label count overflow: %d", count)
+	}
+	labels := make(map[uint8]Label, count)
+	for i := uint64(0); i < count; i++ {
+		priority, err := r.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if priority > 255 {
+			return nil, fmt.Errorf("label priority overflow: %d", priority)
+		}
+		var texts [2]string
+		for j := range texts {
+			n, err := r.readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			if n > uint64(r.r.Len()) {
+				return nil, fmt.Errorf("label length overflow: %d", n)
+			}
+			b := make([]byte, n)
+			if _, err := io.ReadFull(r.r, b); err != nil {
+				return nil, err
+			}
+			texts[j] = string(b)
+		}
+		labels[uint8(priority)] = Label{En: texts[0], Fr: texts[1]}
+	}
+	return labels, nil
+}
+
+// Header returns the file header read by Open.
+func (r *Reader) Header() Header {
+	return r.header
+}
+
 func (r *Reader) readHeader() error {
 	prefix := make([]byte, 4)
 	if _, err := io.ReadFull(r.r, prefix); err != nil {
@@ -116,9 +400,30 @@ func (r *Reader) readHeader() error {
 	if err := binary.Read(r.r, binary.LittleEndian, &formatVersion); err != nil {
 		return err
 	}
-	if formatVersion != versionV4 {
+	if formatVersion != versionV17 {
 		return fmt.Errorf("unsupported format version: %d", formatVersion)
 	}
+	var flags uint8
+	if err := binary.Read(r.r, binary.LittleEndian, &flags); err != nil {
+		return err
+	}
+	r.order = binary.LittleEndian
+	if flags&flagBigEndian != 0 {
+		r.order = binary.BigEndian
+	}
+	var extFlags uint8
+	if err := binary.Read(r.r, r.order, &extFlags); err != nil {
+		return err
+	}
+	precision := uint8(6)
+	if flags&flagMercator != 0 {
+		precision = 2
+	}
+	if extFlags&extFlagPrecision != 0 {
+		if err := binary.Read(r.r, r.order, &precision); err != nil {
+			return err
+		}
+	}
 
 	segCount64, err := r.readUvarint()
 	if err != nil {
@@ -129,12 +434,58 @@ func (r *Reader) readHeader() error {
 	}
 	segCount := uint32(segCount64)
 	var globalMinLon, globalMinLat float64
-	if err := binary.Read(r.r, binary.LittleEndian, &globalMinLon); err != nil {
+	if err := binary.Read(r.r, r.order, &globalMinLon); err != nil {
 		return err
 	}
-	if err := binary.Read(r.r, binary.LittleEndian, &globalMinLat); err != nil {
+	if err := binary.Read(r.r, r.order, &globalMinLat); err != nil {
 		return err
 	}
+	var generatedAt time.Time
+	if flags&flagGeneratedAt != 0 {
+		var unix int64
+		if err := binary.Read(r.r, r.order, &unix); err != nil {
+			return err
+		}
+		generatedAt = time.Unix(unix, 0)
+	}
+	var styles map[uint8]Style
+	if flags&flagStyles != 0 {
+		if styles, err = r.readStyles(); err != nil {
+			return err
+		}
+	}
+	var endTime time.Time
+	var timelines map[uint8]time.Duration
+	if flags&flagTimelines != 0 {
+		var unix int64
+		if err := binary.Read(r.r, r.order, &unix); err != nil {
+			return err
+		}
+		endTime = time.Unix(unix, 0)
+		if timelines, err = r.readTimelines(); err != nil {
+			return err
+		}
+	}
+	var labels map[uint8]Label
+	if flags&flagLabels != 0 {
+		if labels, err = r.readLabels(); err != nil {
+			return err
+		}
+	}
+	gridCols64, err := r.readUvarint()
+	if err != nil {
+		return err
+	}
+	if gridCols64 > uint64(^uint16(0)) {
+		return fmt.Errorf("grid cols overflow: %d", gridCols64)
+	}
+	gridRows64, err := r.readUvarint()
+	if err != nil {
+		return err
+	}
+	if gridRows64 > uint64(^uint16(0)) {
+		return fmt.Errorf("grid rows overflow: %d", gridRows64)
+	}
 	routeCount64, err := r.readUvarint()
 	if err != nil {
 		return err
@@ -156,12 +507,28 @@ func (r *Reader) readHeader() error {
 		SegmentCount:   segCount,
 		GlobalMinLon:   globalMinLon,
 		GlobalMinLat:   globalMinLat,
+		GridCols:       uint16(gridCols64),
+		GridRows:       uint16(gridRows64),
+		CompactCoords:  flags&flagCompactCoords != 0,
+		BigEndian:      flags&flagBigEndian != 0,
+		Mercator:       flags&flagMercator != 0,
+		Precision:      precision,
+		BikeTypes:      flags&flagBikeTypes != 0,
+		Serviced:       extFlags&extFlagServiced != 0,
+		FeatureFlags:   extFlags&extFlagFeatureFlags != 0,
+		HoursRemaining: extFlags&extFlagHoursRemaining != 0,
+		GeneratedAt:    generatedAt,
+		Styles:         styles,
+		EndTime:        endTime,
+		Timelines:      timelines,
+		Labels:         labels,
 		RouteCount:     routeCount,
 		NamePieceCount: namePieceCount,
 	}
 	r.segCount = segCount
 	r.globalLon = globalMinLon
 	r.globalLat = globalMinLat
+	r.scale = math.Pow(10, float64(precision))
 	return nil
 }
 
@@ -237,40 +604,161 @@ func (r *Reader) readRoutes() error {
 	return nil
 }
 
-func (r *Reader) NextFeature() (Feature, bool, error) {
-	for r.segIndex < r.segCount {
-		if r.featIndex == r.featCount {
-			if err := r.readSegmentHeader(); err != nil {
-				return Feature{}, false, err
+func (r *Reader) readSegmentIndex() error {
+	r.segments = make([]segmentIndexEntry, 0, r.segCount)
+	for i := uint32(0); i < r.segCount; i++ {
+		row, err := r.readUvarint()
+		if err != nil {
+			return err
+		}
+		col, err := r.readUvarint()
+		if err != nil {
+			return err
+		}
+		length, err := r.readUvarint()
+		if err != nil {
+			return err
+		}
+		if row >= uint64(r.header.GridRows) || col >= uint64(r.header.GridCols) {
+			return fmt.Errorf("segment cell out of grid: row=%d col=%d", row, col)
+		}
+		r.segments = append(r.segments, segmentIndexEntry{row: int(row), col: int(col), length: int(length)})
+	}
+	offset := r.r.Size() - int64(r.r.Len())
+	for i := range r.segments {
+		r.segments[i].offset = offset
+		offset += int64(r.segments[i].length)
+	}
+	if offset > r.r.Size() {
+		return fmt.Errorf("segment index exceeds data: %d > %d", offset, r.r.Size())
+	}
+	return nil
+}
+
+// Segment decodes only the features in the segment for the given grid cell,
+// using the segment index to skip the others. It returns an empty slice if
+// the cell has no segment.
+//
+// Segment only reads the header and index loaded by Open or DecoderAt and
+// reads the segment's bytes with ReadAt, so it is safe to call from multiple
+// goroutines without locking, alongside at most one goroutine calling
+// NextFeature. With DecoderAt the io.ReaderAt must allow concurrent ReadAt
+// calls, as *os.File does.
+func (r *Reader) Segment(row, col int) ([]Feature, error) {
+	for _, entry := range r.segments {
+		if entry.row != row || entry.col != col {
+			continue
+		}
+		data := make([]byte, entry.length)
+		if _, err := r.r.ReadAt(data, entry.offset); err != nil {
+			return nil, err
+		}
+		seg := &Reader{
+			r:          bytes.NewReader(data),
+			order:      r.order,
+			header:     r.header,
+			namePieces: r.namePieces,
+			segCount:   1,
+			globalLon:  r.globalLon,
+			globalLat:  r.globalLat,
+			scale:      r.scale,
+		}
+		features := []Feature{}
+		for {
+			feat, ok, err := seg.NextFeature()
+			if err != nil {
+				return nil, err
 			}
-			if r.featCount == 0 {
-				r.segIndex++
-				continue
+			if !ok {
+				return features, nil
 			}
+			features = append(features, feat)
 		}
-		feat, err := r.readFeature()
-		if err != nil {
+	}
+	return []Feature{}, nil
+}
+
+func (r *Reader) NextFeature() (Feature, bool, error) {
+	// readSegmentHeader advances segIndex, so finish the current segment's
+	// features before checking whether any segments remain.
+	for r.featIndex == r.featCount {
+		if r.segIndex >= r.segCount {
+			return Feature{}, false, nil
+		}
+		if err := r.readSegmentHeader(); err != nil {
 			return Feature{}, false, err
 		}
-		r.featIndex++
-		return feat, true, nil
 	}
-	return Feature{}, false, nil
+	feat, err := r.readFeature()
+	if err != nil {
+		return Feature{}, false, err
+	}
+	r.featIndex++
+	return feat, true, nil
+}
+
+// readBounds reads just the bounding box at the start of each segment to
+// find the global maximum, without decoding any features.
+func (r *Reader) readBounds() error {
+	var maxLon, maxLat int64
+	buf := make([]byte, 4*binary.MaxVarintLen64)
+	for _, entry := range r.segments {
+		n, err := r.r.ReadAt(buf[:min(len(buf), entry.length)], entry.offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		seg := &Reader{r: bytes.NewReader(buf[:n])}
+		var deltas [4]int64
+		for i := range deltas {
+			if deltas[i], err = seg.readVarintZigZag(); err != nil {
+				return fmt.Errorf("segment (%d, %d) bounds: %w", entry.row, entry.col, err)
+			}
+		}
+		maxLon = max(maxLon, deltas[2])
+		maxLat = max(maxLat, deltas[3])
+	}
+	lo := r.coord(0, 0)
+	hi := r.coord(maxLon, maxLat)
+	r.bounds = orb.Bound{Min: orb.Point{lo[0], lo[1]}, Max: orb.Point{hi[0], hi[1]}}
+	return nil
+}
+
+// SegmentBound returns the bounding box written for the segment of the
+// feature most recently returned by NextFeature.
+func (r *Reader) SegmentBound() orb.Bound {
+	lo := r.coord(r.segLon, r.segLat)
+	hi := r.coord(r.segMaxLon, r.segMaxLat)
+	return orb.Bound{Min: orb.Point{lo[0], lo[1]}, Max: orb.Point{hi[0], hi[1]}}
+}
+
+// SegmentCell returns the grid row and column of the segment of the feature
+// most recently returned by NextFeature.
+func (r *Reader) SegmentCell() (row, col int) {
+	entry := r.segments[r.segIndex-1]
+	return entry.row, entry.col
 }
 
 func (r *Reader) readSegmentHeader() error {
-	if _, err := r.readVarintZigZag(); err != nil {
+	deltaMinLon, err := r.readVarintZigZag()
+	if err != nil {
 		return err
 	}
-	if _, err := r.readVarintZigZag(); err != nil {
+	deltaMinLat, err := r.readVarintZigZag()
+	if err != nil {
 		return err
 	}
-	if _, err := r.readVarintZigZag(); err != nil {
+	deltaMaxLon, err := r.readVarintZigZag()
+	if err != nil {
 		return err
 	}
-	if _, err := r.readVarintZigZag(); err != nil {
+	deltaMaxLat, err := r.readVarintZigZag()
+	if err != nil {
 		return err
 	}
+	r.segLon = deltaMinLon
+	r.segLat = deltaMinLat
+	r.segMaxLon = deltaMaxLon
+	r.segMaxLat = deltaMaxLat
 	featCount64, err := r.readUvarint()
 	if err != nil {
 		return err
@@ -366,6 +854,34 @@ func (r *Reader) readFeature() (Feature, error) {
 		return Feature{}, fmt.Errorf("route id overflow: %d", routeID64)
 	}
 	routeID := uint16(routeID64)
+	var bikeType uint8
+	if r.header.BikeTypes {
+		if err := binary.Read(r.r, r.order, &bikeType); err != nil {
+			return Feature{}, err
+		}
+	}
+	var serviced time.Time
+	if r.header.Serviced {
+		var unix int64
+		if err := binary.Read(r.r, r.order, &unix); err != nil {
+			return Feature{}, err
+		}
+		if unix != 0 {
+			serviced = time.Unix(unix, 0)
+		}
+	}
+	var featureFlags uint8
+	if r.header.FeatureFlags {
+		if err := binary.Read(r.r, r.order, &featureFlags); err != nil {
+			return Feature{}, err
+		}
+	}
+	var hoursRemaining int16
+	if r.header.HoursRemaining {
+		if err := binary.Read(r.r, r.order, &hoursRemaining); err != nil {
+			return Feature{}, err
+		}
+	}
 	coordCount64, err := r.readUvarint()
 	if err != nil {
 		return Feature{}, err
@@ -374,44 +890,109 @@ func (r *Reader) readFeature() (Feature, error) {
 		return Feature{}, fmt.Errorf("coord count overflow: %d", coordCount64)
 	}
 	coordCount := uint16(coordCount64)
-	coords := make([][]float64, 0, coordCount)
-	absLon := int32(0)
-	absLat := int32(0)
-	for i := uint16(0); i < coordCount; i++ {
-		dLon64, err := r.readVarintZigZag()
-		if err != nil {
+	compact := false
+	if r.header.CompactCoords {
+		var width uint8
+		if err := binary.Read(r.r, r.order, &width); err != nil {
 			return Feature{}, err
 		}
-		dLat64, err := r.readVarintZigZag()
-		if err != nil {
+		compact = width == coordWidthCompact
+	}
+	// Geometry-less features keep nil coordinates.
+	var coords [][]float64
+	if coordCount > 0 {
+		coords = make([][]float64, 0, coordCount)
+	}
+	if compact {
+		// Compact coordinates are int16 deltas at 1/100 of the scale.
+		deltas := make([]int16, int(coordCount)*2)
+		if err := binary.Read(r.r, r.order, deltas); err != nil {
 			return Feature{}, err
 		}
-		dLon := int32(dLon64)
-		dLat := int32(dLat64)
-		if int64(dLon) != dLon64 || int64(dLat) != dLat64 {
-			return Feature{}, fmt.Errorf("coordinate delta overflow: lon=%d lat=%d", dLon64, dLat64)
+		var absLon, absLat int64
+		for i := 0; i < int(coordCount); i++ {
+			absLon += int64(deltas[i*2]) * 100
+			absLat += int64(deltas[i*2+1]) * 100
+			coords = append(coords, r.coord(r.segLon+absLon, r.segLat+absLat))
 		}
-		if i == 0 {
-			absLon = dLon
-			absLat = dLat
-		} else {
-			absLon += dLon
-			absLat += dLat
+	} else {
+		absLon := int32(0)
+		absLat := int32(0)
+		for i := uint16(0); i < coordCount; i++ {
+			dLon64, err := r.readVarintZigZag()
+			if err != nil {
+				return Feature{}, err
+			}
+			dLat64, err := r.readVarintZigZag()
+			if err != nil {
+				return Feature{}, err
+			}
+			dLon := int32(dLon64)
+			dLat := int32(dLat64)
+			if int64(dLon) != dLon64 || int64(dLat) != dLat64 {
+				return Feature{}, fmt.Errorf("coordinate delta overflow: lon=%d lat=%d", dLon64, dLat64)
+			}
+			if i == 0 {
+				absLon = dLon
+				absLat = dLat
+			} else {
+				absLon += dLon
+				absLat += dLat
+			}
+			coords = append(coords, r.coord(r.segLon+int64(absLon), r.segLat+int64(absLat)))
 		}
-		lon := r.globalLon + float64(absLon)/1000000
-		lat := r.globalLat + float64(absLat)/1000000
-		coords = append(coords, []float64{lon, lat})
 	}
 	return Feature{
-		StableID:      stableID,
-		Title:         title,
-		Priority:      priority,
-		SourceDataset: sourceDataset,
-		RouteID:       routeID,
-		Coords:        coords,
+		StableID:       stableID,
+		Title:          title,
+		Priority:       priority,
+		SourceDataset:  sourceDataset,
+		RouteID:        routeID,
+		BikeType:       bikeType,
+		Serviced:       serviced,
+		Direction:      featureFlags & featureFlagDirectionMask,
+		HoursRemaining: hoursRemaining,
+		DeadlinePassed: hoursRemaining < 0,
+		Coords:         coords,
 	}, nil
 }
 
+// coord converts scaled offsets from the global base to lon/lat, projecting
+// back from Web Mercator if needed.
+func (r *Reader) coord(x, y int64) []float64 {
+	pt := orb.Point{r.globalLon + float64(x)/r.scale, r.globalLat + float64(y)/r.scale}
+	if r.header.Mercator {
+		pt = project.Mercator.ToWGS84(pt)
+	}
+	return []float64{pt[0], pt[1]}
+}
+
 func (h Header) String() string {
-	return fmt.Sprintf("v%d segments=%d global_min=(%.6f,%.6f) routes=%d name_pieces=%d", h.FormatVersion, h.SegmentCount, h.GlobalMinLon, h.GlobalMinLat, h.RouteCount, h.NamePieceCount)
+	s := fmt.Sprintf("v%d segments=%d global_min=(%.6f,%.6f) grid=%dx%d compact=%t big_endian=%t mercator=%t routes=%d name_pieces=%d", h.FormatVersion, h.SegmentCount, h.GlobalMinLon, h.GlobalMinLat, h.GridCols, h.GridRows, h.CompactCoords, h.BigEndian, h.Mercator, h.RouteCount, h.NamePieceCount)
+	if !h.GeneratedAt.IsZero() {
+		s += " generated=" + h.GeneratedAt.UTC().Format(time.RFC3339)
+	}
+	if len(h.Styles) > 0 {
+		s += fmt.Sprintf(" styles=%d", len(h.Styles))
+	}
+	if h.BikeTypes {
+		s += " bike_types=true"
+	}
+	if h.Serviced {
+		s += " serviced=true"
+	}
+	if h.FeatureFlags {
+		s += " feature_flags=true"
+	}
+	if h.HoursRemaining {
+		s += " hours_remaining=true"
+	}
+	s += fmt.Sprintf(" precision=%d", h.Precision)
+	if len(h.Labels) > 0 {
+		s += fmt.Sprintf(" labels=%d", len(h.Labels))
+	}
+	if !h.EndTime.IsZero() {
+		s += " end=" + h.EndTime.UTC().Format(time.RFC3339) + fmt.Sprintf(" timelines=%d", len(h.Timelines))
+	}
+	return s
 }
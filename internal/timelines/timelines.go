@@ -0,0 +1,51 @@
+// Package timelines holds the clearing timelines the municipality commits to
+// for each street priority, counted from the end of a weather event.
+package timelines
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default returns the clearing timelines for each priority. They match those
+// shown in index.html.
+func Default() map[uint8]time.Duration {
+	return map[uint8]time.Duration{
+		1: 12 * time.Hour,
+		2: 18 * time.Hour,
+		3: 36 * time.Hour,
+	}
+}
+
+// Parse parses comma-separated priority=duration pairs such as "3=48h",
+// taking the Default timeline for any priority s doesn't name. Each priority
+// may only be given once.
+func Parse(s string) (map[uint8]time.Duration, error) {
+	timelines := Default()
+	seen := make(map[uint8]bool)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid timeline %q: want priority=duration", pair)
+		}
+		priority, err := strconv.Atoi(key)
+		if err != nil || priority < 1 || priority > 3 {
+			return nil, fmt.Errorf("invalid priority %q: want 1, 2 or 3", key)
+		}
+		if seen[uint8(priority)] {
+			return nil, fmt.Errorf("priority %d given more than once", priority)
+		}
+		seen[uint8(priority)] = true
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("priority %d: %w", priority, err)
+		}
+		if d <= 0 || d%time.Minute != 0 {
+			return nil, fmt.Errorf("priority %d: timeline %s must be a positive whole number of minutes", priority, d)
+		}
+		timelines[uint8(priority)] = d
+	}
+	return timelines, nil
+}
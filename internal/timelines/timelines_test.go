@@ -0,0 +1,32 @@
+package timelines
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want map[uint8]time.Duration
+	}{
+		{"1=12h,2=18h,3=36h", Default()},
+		{"3=48h", map[uint8]time.Duration{1: 12 * time.Hour, 2: 18 * time.Hour, 3: 48 * time.Hour}},
+		{" 2=1h30m , 1=6h", map[uint8]time.Duration{1: 6 * time.Hour, 2: 90 * time.Minute, 3: 36 * time.Hour}},
+	} {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.in, err)
+		}
+		if !maps.Equal(got, tt.want) {
+			t.Errorf("Parse(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "1", "4=12h", "x=12h", "1=soon", "1=-1h", "1=90s", "1=12h,1=18h"} {
+		if got, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) = %v, want error", in, got)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Package timeparse parses the free-form times posted on the Halifax winter
+// operations service updates page.
+package timeparse
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	squeezeRe = regexp.MustCompile(`\s+`)
+	noonRe    = regexp.MustCompile(`(?i)\bnoon\b`)
+	// strayDigitRe matches a lone digit stuck to the end of an a.m./p.m.
+	// marker, as in "11 p.m.7".
+	strayDigitRe = regexp.MustCompile(`([ap]\.m\.)\d(\D|$)`)
+	// relativeDayRe matches the words that put a time on the reference
+	// day or the one after it, as in "tonight 11 p.m.".
+	relativeDayRe = regexp.MustCompile(`(?i)\b(today|tonight|tomorrow)\b`)
+)
+
+type format struct {
+	s       string
+	hasYear bool
+	hasDate bool
+	hasTime bool
+}
+
+// formats are tried in order against the normalized text, then against
+// shorter and shorter prefixes of it.
+var formats = []format{
+	{"1/2/2006 3:04 PM", true, true, true},
+	{"3 PM Jan 2", false, true, true},
+	{"3 PM January 2", false, true, true},
+	{"3 PM Mon Jan 2", false, true, true},
+	{"3 PM Mon January 2", false, true, true},
+	{"3 PM Monday Jan 2", false, true, true},
+	{"3 PM Monday January 2", false, true, true},
+	{"3 PM", false, false, true},
+	{"3:04 PM Jan 2", false, true, true},
+	{"3:04 PM January 2", false, true, true},
+	{"3:04 PM Mon Jan 2", false, true, true},
+	{"3:04 PM Mon January 2", false, true, true},
+	{"3:04 PM Monday Jan 2", false, true, true},
+	{"3:04 PM Monday January 2", false, true, true},
+	{"3:04 PM", false, false, true},
+	{"Jan 2 3 PM", false, true, true},
+	{"Jan 2 3:04 PM", false, true, true},
+	{"January 2 3 PM", false, true, true},
+	{"January 2 3:04 PM", false, true, true},
+	{"Mon Jan 2 3 PM", false, true, true},
+	{"Mon Jan 2 3:04 PM", false, true, true},
+	{"Mon January 2 3 PM", false, true, true},
+	{"Mon January 2 3:04 PM", false, true, true},
+	{"Monday Jan 2", false, true, false},
+	{"Monday Jan 2 3 PM", false, true, true},
+	{"Monday Jan 2 3:04 PM", false, true, true},
+	{"Monday January 2 3 PM", false, true, true},
+	{"Monday January 2 3:04 PM", false, true, true},
+}
+
+// IsNA reports whether txt is one of the placeholders the service updates
+// page uses for an empty cell, such as "N/A" or `N\A`.
+func IsNA(txt string) bool {
+	switch strings.ToUpper(strings.TrimSpace(txt)) {
+	case "N/A", `N\A`, "NA":
+		return true
+	default:
+		return false
+	}
+}
+
+// Parse parses a loosely formatted time such as "Feb. 6 | 8 a.m." or
+// "Monday January 2" in loc. Missing parts are filled in from ref: the year,
+// date or time of day is taken from ref and then moved back if that would
+// put the result after ref. "today", "tonight" and "tomorrow" put the time
+// on ref's day or the next, as in "tomorrow 6 a.m.". Blank and N/A values
+// parse as the zero time.
+func Parse(txt string, ref time.Time, loc *time.Location) (time.Time, error) {
+	t, _, err := ParseLayout(txt, ref, loc)
+	return t, err
+}
+
+// Layouts returns the layouts Parse tries, in the order it tries them.
+func Layouts() []string {
+	layouts := make([]string, len(formats))
+	for i, f := range formats {
+		layouts[i] = f.s
+	}
+	return layouts
+}
+
+// ParseLayout is like Parse but also returns the layout that matched. The
+// layout is empty for blank and N/A values.
+func ParseLayout(txt string, ref time.Time, loc *time.Location) (time.Time, string, error) {
+	orig := txt
+	t := ref.In(loc)
+	txt = strings.TrimSpace(txt)
+	if txt == "" || IsNA(txt) {
+		return time.Time{}, "", nil
+	}
+
+	txt = strayDigitRe.ReplaceAllString(txt, "$1$2")
+	txt = strings.ReplaceAll(txt, "a.m.", "AM")
+	txt = strings.ReplaceAll(txt, "p.m.", "PM")
+	txt = strings.ReplaceAll(txt, "|", " ")
+	txt = strings.ReplaceAll(txt, "-", " ")
+	txt = strings.ReplaceAll(txt, ".", " ")
+	txt = strings.ReplaceAll(txt, ",", " ")
+	txt = strings.ReplaceAll(txt, " at ", " ")
+	txt = squeezeRe.ReplaceAllString(txt, " ")
+	txt = noonRe.ReplaceAllString(txt, "12 PM")
+	txt = strings.TrimSpace(txt)
+
+	if day := relativeDayRe.FindString(txt); day != "" {
+		days := 0
+		if strings.EqualFold(day, "tomorrow") {
+			days = 1
+		}
+		hour, min, sec := t.Clock()
+		layout := strings.ToLower(day)
+		if rest := strings.TrimSpace(squeezeRe.ReplaceAllString(relativeDayRe.ReplaceAllString(txt, ""), " ")); rest != "" {
+			clock, clockLayout, ok := parseClock(rest, loc)
+			if !ok {
+				return time.Time{}, "", fmt.Errorf("unrecognized time: %q", orig)
+			}
+			hour, min, sec = clock.Clock()
+			layout += " " + clockLayout
+		}
+		// Unlike other missing dates, these aren't moved back: "tonight"
+		// can be later than ref.
+		return time.Date(t.Year(), t.Month(), t.Day()+days, hour, min, sec, 0, loc), layout, nil
+	}
+
+	for {
+		for _, format := range formats {
+			if parsed, err := time.ParseInLocation(format.s, txt, loc); err == nil {
+				if !format.hasYear {
+					parsed = parsed.AddDate(t.Year(), 0, 0)
+					if parsed.After(t) {
+						parsed = parsed.AddDate(-1, 0, 0)
+					}
+				}
+				if !format.hasDate {
+					parsed = parsed.AddDate(0, int(t.Month())-1, t.Day()-1)
+					if parsed.After(t) {
+						parsed = parsed.AddDate(0, 0, -1)
+					}
+				}
+				if !format.hasTime {
+					hms := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+					parsed = parsed.Add(hms)
+					if parsed.After(t) {
+						parsed = parsed.AddDate(0, 0, -1)
+					}
+				}
+				return parsed, format.s, nil
+			}
+		}
+		lastSpace := strings.LastIndex(txt, " ")
+		if lastSpace == -1 {
+			break
+		}
+		txt = txt[:lastSpace]
+	}
+
+	return time.Time{}, "", fmt.Errorf("unrecognized time: %q", orig)
+}
+
+// parseClock parses txt with the layouts that have only a time of day.
+func parseClock(txt string, loc *time.Location) (time.Time, string, bool) {
+	for _, format := range formats {
+		if format.hasDate || !format.hasTime {
+			continue
+		}
+		if parsed, err := time.ParseInLocation(format.s, txt, loc); err == nil {
+			return parsed, format.s, true
+		}
+	}
+	return time.Time{}, "", false
+}
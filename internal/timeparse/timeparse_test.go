@@ -0,0 +1,84 @@
+package timeparse
+
+import (
+	"testing"
+	"time"
+)
+
+func halifax(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("America/Halifax")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestParse(t *testing.T) {
+	loc := halifax(t)
+	tests := []struct {
+		name string
+		txt  string
+		ref  time.Time
+		want time.Time
+	}{
+		{"full date", "2/6/2025 8:15 AM", time.Date(2025, 3, 1, 0, 0, 0, 0, loc), time.Date(2025, 2, 6, 8, 15, 0, 0, loc)},
+		{"yearless", "Feb. 6 | 8 a.m.", time.Date(2025, 2, 7, 12, 0, 0, 0, loc), time.Date(2025, 2, 6, 8, 0, 0, 0, loc)},
+		{"yearless previous year", "Dec. 31 | 8 p.m.", time.Date(2025, 1, 1, 10, 0, 0, 0, loc), time.Date(2024, 12, 31, 20, 0, 0, 0, loc)},
+		{"dateless", "8 a.m.", time.Date(2025, 2, 7, 12, 0, 0, 0, loc), time.Date(2025, 2, 7, 8, 0, 0, 0, loc)},
+		{"dateless previous day", "11 p.m.", time.Date(2025, 2, 7, 12, 0, 0, 0, loc), time.Date(2025, 2, 6, 23, 0, 0, 0, loc)},
+		{"timeless", "Monday, Feb. 3", time.Date(2025, 2, 7, 12, 30, 0, 0, loc), time.Date(2025, 2, 3, 12, 30, 0, 0, loc)},
+		{"noon", "noon Feb. 6", time.Date(2025, 2, 7, 12, 0, 0, 0, loc), time.Date(2025, 2, 6, 12, 0, 0, 0, loc)},
+		{"trailing text", "Feb. 6 at 8 a.m. (updated)", time.Date(2025, 2, 7, 12, 0, 0, 0, loc), time.Date(2025, 2, 6, 8, 0, 0, 0, loc)},
+		{"ref in other location", "8 a.m.", time.Date(2025, 2, 7, 16, 0, 0, 0, time.UTC), time.Date(2025, 2, 7, 8, 0, 0, 0, loc)},
+		{"stray digit", "11 p.m.7", time.Date(2025, 2, 7, 23, 30, 0, 0, loc), time.Date(2025, 2, 7, 23, 0, 0, 0, loc)},
+		{"stray digit with minutes", "11:30 p.m.9", time.Date(2025, 2, 7, 23, 45, 0, 0, loc), time.Date(2025, 2, 7, 23, 30, 0, 0, loc)},
+		{"stray digit with date", "Feb. 6 | 11 p.m.7", time.Date(2025, 2, 7, 12, 0, 0, 0, loc), time.Date(2025, 2, 6, 23, 0, 0, 0, loc)},
+		{"tonight", "tonight 11 PM", time.Date(2025, 2, 7, 18, 0, 0, 0, loc), time.Date(2025, 2, 7, 23, 0, 0, 0, loc)},
+		{"tomorrow", "tomorrow 6 AM", time.Date(2025, 2, 7, 18, 0, 0, 0, loc), time.Date(2025, 2, 8, 6, 0, 0, 0, loc)},
+		{"tomorrow at month end", "Tomorrow at 6:30 a.m.", time.Date(2025, 2, 28, 18, 0, 0, 0, loc), time.Date(2025, 3, 1, 6, 30, 0, 0, loc)},
+		{"time before today", "8 a.m. today", time.Date(2025, 2, 7, 18, 0, 0, 0, loc), time.Date(2025, 2, 7, 8, 0, 0, 0, loc)},
+		{"today without time", "today", time.Date(2025, 2, 7, 18, 15, 0, 0, loc), time.Date(2025, 2, 7, 18, 15, 0, 0, loc)},
+		{"blank", "  ", time.Date(2025, 2, 7, 12, 0, 0, 0, loc), time.Time{}},
+		{"placeholder", `N\A`, time.Date(2025, 2, 7, 12, 0, 0, 0, loc), time.Time{}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.txt, tt.ref, loc)
+		if err != nil {
+			t.Errorf("%s: Parse(%q): %v", tt.name, tt.txt, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: Parse(%q) = %v, want %v", tt.name, tt.txt, got, tt.want)
+		}
+	}
+}
+
+func TestParseUnrecognized(t *testing.T) {
+	if _, err := Parse("sometime soon", time.Now(), halifax(t)); err == nil {
+		t.Fatal("expected error for unrecognized time")
+	}
+}
+
+func TestIsNA(t *testing.T) {
+	tests := []struct {
+		txt  string
+		want bool
+	}{
+		{"N/A", true},
+		{`N\A`, true},
+		{"n/a", true},
+		{`n\a`, true},
+		{"na", true},
+		{"NA", true},
+		{"  N/A \n", true},
+		{"", false},
+		{"Nov. 3 | 5 p.m.", false},
+		{"Crews are out", false},
+	}
+	for _, tt := range tests {
+		if got := IsNA(tt.txt); got != tt.want {
+			t.Errorf("IsNA(%q) = %v, want %v", tt.txt, got, tt.want)
+		}
+	}
+}